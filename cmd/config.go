@@ -18,12 +18,15 @@ package cmd
 
 import (
 	"bufio"
+	"encoding/base64"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/version"
 	"github.com/urfave/cli/v2"
 )
@@ -48,6 +51,16 @@ $ juicefs config redis://localhost --inode 10000000 --capacity 1048576
 # Change maximum days before files in trash are deleted
 $ juicefs config redis://localhost --trash-days 7
 
+# Move files untouched for 90 days to tier storage, except the ones under /hot
+$ juicefs config redis://localhost --tier-policy /:90 --tier-policy /hot:0
+
+# Add a new private key to encrypt data, then make it the active one (mounted clients reload the keys in a minute)
+$ juicefs config redis://localhost --add-encrypt-key new-key.pem
+$ juicefs config redis://localhost --encrypt-key-id 1
+
+# Encrypt the secrets with the master key from environment variable
+$ JFS_MASTER_KEY=xxx juicefs config redis://localhost --master-key
+
 # Limit client version that is allowed to connect
 $ juicefs config redis://localhost --min-client-version 1.0.0 --max-client-version 1.1.0`,
 		Flags: []cli.Flag{
@@ -75,14 +88,38 @@ $ juicefs config redis://localhost --min-client-version 1.0.0 --max-client-versi
 				Name:  "session-token",
 				Usage: "session token for object storage",
 			},
+			&cli.StringFlag{
+				Name:  "storage-class",
+				Usage: "the storage class of new objects, the existing ones are not changed",
+			},
 			&cli.BoolFlag{
 				Name:  "encrypt-secret",
 				Usage: "encrypt the secret key if it was previously stored in plain format",
 			},
+			&cli.BoolFlag{
+				Name:  "master-key",
+				Usage: "encrypt the secrets with the master key in environment variable JFS_MASTER_KEY, which is required by all clients",
+			},
 			&cli.IntFlag{
 				Name:  "trash-days",
 				Usage: "number of days after which removed files will be permanently deleted",
 			},
+			&cli.StringSliceFlag{
+				Name:  "tier-policy",
+				Usage: "move files untouched for DAYS under a directory to the tier storage, in format of PATH:DAYS (0 means never)",
+			},
+			&cli.StringFlag{
+				Name:  "add-encrypt-key",
+				Usage: "path to a new RSA private key (PEM) or URI of a key provider to encrypt data with, it's used after activated by --encrypt-key-id",
+			},
+			&cli.IntFlag{
+				Name:  "encrypt-key-id",
+				Usage: "id of the private key to encrypt new data with",
+			},
+			&cli.IntFlag{
+				Name:  "remove-encrypt-key",
+				Usage: "id of the private key to remove (including 0), data encrypted with it can't be read any more, so run `juicefs rekey` first",
+			},
 			&cli.StringFlag{
 				Name:  "min-client-version",
 				Usage: "minimum client version allowed to connect",
@@ -132,7 +169,8 @@ func config(ctx *cli.Context) error {
 		return nil
 	}
 
-	var quota, storage, trash, clientVer bool
+	trustSecretFlags(ctx, "access-key", "secret-key", "session-token")
+	var quota, storage, trash, clientVer, removeKey, masterKey bool
 	var msg strings.Builder
 	encrypted := format.KeyEncrypted
 	for _, flag := range ctx.LocalFlagNames() {
@@ -182,6 +220,12 @@ func config(ctx *cli.Context) error {
 			}
 			format.SessionToken = ctx.String(flag)
 			storage = true
+		case "storage-class":
+			if new := ctx.String(flag); new != format.StorageClass {
+				msg.WriteString(fmt.Sprintf("%10s: %s -> %s\n", flag, format.StorageClass, new))
+				format.StorageClass = new
+				storage = true
+			}
 		case "trash-days":
 			if new := ctx.Int(flag); new != format.TrashDays {
 				if new < 0 {
@@ -191,6 +235,104 @@ func config(ctx *cli.Context) error {
 				format.TrashDays = new
 				trash = true
 			}
+		case "tier-policy":
+			if format.TierBucket == "" {
+				return fmt.Errorf("tier storage is not configured for this volume")
+			}
+			new, err := parseTierPolicies(ctx.StringSlice(flag))
+			if err != nil {
+				return err
+			}
+			msg.WriteString(fmt.Sprintf("%s: %v -> %v\n", flag, format.TierPolicies, new))
+			format.TierPolicies = new
+		case "master-key":
+			if new := ctx.Bool(flag); new != format.MasterKey {
+				if err := format.Decrypt(); err != nil {
+					return fmt.Errorf("decrypt secrets: %s", err)
+				}
+				msg.WriteString(fmt.Sprintf("%s: %t -> %t\n", flag, format.MasterKey, new))
+				format.MasterKey = new
+				encrypted = true
+				masterKey = new
+			}
+		case "add-encrypt-key":
+			if !isEncrypted(format) {
+				return fmt.Errorf("encryption is not enabled for this volume")
+			}
+			key := ctx.String(flag)
+			if object.IsKeyProvider(key) {
+				trustRef(key)
+			} else {
+				pem, err := os.ReadFile(key)
+				if err != nil {
+					return fmt.Errorf("load RSA key from %s: %s", key, err)
+				}
+				key = string(pem)
+			}
+			if _, err = keyEncryptor(key); err != nil {
+				return err
+			}
+			if err = format.Decrypt(); err != nil {
+				return fmt.Errorf("decrypt secrets: %s", err)
+			}
+			id := 1
+			keys := map[int]string{}
+			for i, k := range format.EncryptKeys {
+				keys[i] = k
+				if i >= id {
+					id = i + 1
+				}
+			}
+			if id > math.MaxUint16 {
+				return fmt.Errorf("too many encrypt keys")
+			}
+			keys[id] = key
+			format.EncryptKeys = keys
+			msg.WriteString(fmt.Sprintf("%s: key %d added\n", flag, id))
+		case "encrypt-key-id":
+			if new := ctx.Int(flag); new != format.EncryptKeyID {
+				if _, ok := format.EncryptKeys[new]; !ok && (new != 0 || format.EncryptKey == "") {
+					return fmt.Errorf("encrypt key %d is not found", new)
+				}
+				msg.WriteString(fmt.Sprintf("%s: %d -> %d\n", flag, format.EncryptKeyID, new))
+				format.EncryptKeyID = new
+			}
+		case "remove-encrypt-key":
+			id := ctx.Int(flag)
+			if _, ok := format.EncryptKeys[id]; !ok && (id != 0 || format.EncryptKey == "") {
+				return fmt.Errorf("encrypt key %d is not found", id)
+			}
+			if id == format.EncryptKeyID {
+				return fmt.Errorf("encrypt key %d is active, please activate another one first", id)
+			}
+			if err := format.Decrypt(); err != nil {
+				return fmt.Errorf("decrypt secrets: %s", err)
+			}
+			// the key of local cache should be sealed with another key by rekey
+			if format.EncryptCacheKey == "" && id == 0 && isRSAKey(format.EncryptKey) {
+				return fmt.Errorf("the key of local cache is derived from encrypt key 0, please run `juicefs rekey` first")
+			} else if format.EncryptCacheKey != "" {
+				sealed, err := base64.StdEncoding.DecodeString(format.EncryptCacheKey)
+				if err != nil {
+					return fmt.Errorf("invalid key of local cache: %s", err)
+				}
+				if kid, err := object.KeyIDOf(sealed); err != nil || int(kid) == id {
+					return fmt.Errorf("the key of local cache is sealed with encrypt key %d, please run `juicefs rekey` first", id)
+				}
+			}
+			if id == 0 {
+				format.EncryptKey = ""
+			} else {
+				keys := map[int]string{}
+				for i, k := range format.EncryptKeys {
+					if i != id {
+						keys[i] = k
+					}
+				}
+				format.EncryptKeys = keys
+			}
+			msg.WriteString(fmt.Sprintf("%s: key %d removed\n", flag, id))
+			removeKey = true
 		case "min-client-version":
 			if new := ctx.String(flag); new != format.MinClientVersion {
 				if version.Parse(new) == nil {
@@ -245,6 +387,18 @@ func config(ctx *cli.Context) error {
 				return fmt.Errorf("Aborted.")
 			}
 		}
+		if masterKey {
+			warn("All clients need the master key in JFS_MASTER_KEY to access the volume, and running ones should be remounted with it.")
+			if !userConfirmed() {
+				return fmt.Errorf("Aborted.")
+			}
+		}
+		if removeKey {
+			warn("Objects encrypted with the removed key can't be read any more, please make sure `juicefs rekey` is finished.")
+			if !userConfirmed() {
+				return fmt.Errorf("Aborted.")
+			}
+		}
 		if clientVer && format.CheckVersion() != nil {
 			warn("Clients with the same version of this will be rejected after modification.")
 			if !userConfirmed() {
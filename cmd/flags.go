@@ -17,10 +17,12 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/urfave/cli/v2"
@@ -57,7 +59,7 @@ func globalFlags() []cli.Flag {
 	}
 }
 
-func clientFlags() []cli.Flag {
+func getDefaultCacheDir() string {
 	var defaultCacheDir = "/var/jfsCache"
 	switch runtime.GOOS {
 	case "linux":
@@ -71,10 +73,15 @@ func clientFlags() []cli.Flag {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
 			logger.Fatalf("%v", err)
-			return nil
+			return ""
 		}
 		defaultCacheDir = path.Join(homeDir, ".juicefs", "cache")
 	}
+	return defaultCacheDir
+}
+
+func clientFlags() []cli.Flag {
+	defaultCacheDir := getDefaultCacheDir()
 	return []cli.Flag{
 		&cli.StringFlag{
 			Name:  "storage",
@@ -89,11 +96,26 @@ func clientFlags() []cli.Flag {
 			Value: 60,
 			Usage: "the max number of seconds to download an object",
 		},
+		&cli.Float64Flag{
+			Name:  "hedge-percentile",
+			Value: 0.95,
+			Usage: "send another GET request if the first one has no response after this percentile of latency of recent requests",
+		},
+		&cli.Float64Flag{
+			Name:  "hedge-budget",
+			Value: 0,
+			Usage: "max ratio of extra GET requests sent for hedging (0 means disabled)",
+		},
 		&cli.IntFlag{
 			Name:  "put-timeout",
 			Value: 60,
 			Usage: "the max number of seconds to upload an object",
 		},
+		&cli.IntFlag{
+			Name:  "multipart-threshold",
+			Value: 16,
+			Usage: "upload blocks not smaller than this size (in MiB) in parts, so only the failed parts are retried (0 means disabled)",
+		},
 		&cli.IntFlag{
 			Name:  "io-retries",
 			Value: 10,
@@ -139,6 +161,15 @@ func clientFlags() []cli.Flag {
 			Value: "0",
 			Usage: "delayed duration (in seconds) for uploading objects",
 		},
+		&cli.StringFlag{
+			Name:  "pack-delay",
+			Value: "0",
+			Usage: "max duration to wait for other small files to be packed together, which delays closing every small file (only if pack size is set in format)",
+		},
+		&cli.BoolFlag{
+			Name:  "no-verify",
+			Usage: "skip verifying downloaded blocks against their checksums in metadata, which saves a lookup of metadata for every chunk",
+		},
 		&cli.StringFlag{
 			Name:  "cache-dir",
 			Value: defaultCacheDir,
@@ -149,6 +180,11 @@ func clientFlags() []cli.Flag {
 			Value: 100 << 10,
 			Usage: "size of cached objects in MiB",
 		},
+		&cli.IntFlag{
+			Name:  "pinned-cache-size",
+			Value: 0,
+			Usage: "size of pinned objects in MiB, they are never evicted (0 means pinning is disabled)",
+		},
 		&cli.Float64Flag{
 			Name:  "free-space-ratio",
 			Value: 0.1,
@@ -158,6 +194,10 @@ func clientFlags() []cli.Flag {
 			Name:  "cache-partial-only",
 			Usage: "cache only random/small read",
 		},
+		&cli.BoolFlag{
+			Name:  "encrypt-cache",
+			Usage: "encrypt cached and staging blocks on local disk",
+		},
 		&cli.StringFlag{
 			Name:  "backup-meta",
 			Value: "3600",
@@ -176,6 +216,15 @@ func clientFlags() []cli.Flag {
 			Name:  "no-bgjob",
 			Usage: "disable background jobs (clean-up, backup, etc.)",
 		},
+		&cli.IntFlag{
+			Name:  "compact-budget",
+			Value: 0,
+			Usage: "MiB of data to read and write per hour for compacting fragmented chunks in background (0 means disabled)",
+		},
+		&cli.StringFlag{
+			Name:  "compact-window",
+			Usage: "time of day to compact fragmented chunks in background, e.g. 01:00-05:00 (default: anytime)",
+		},
 		&cli.Float64Flag{
 			Name:  "open-cache",
 			Value: 0.0,
@@ -244,3 +293,23 @@ func duration(s string) time.Duration {
 	}
 	return 0
 }
+
+// timeWindow parses a range of time of day like "01:00-05:00"
+func timeWindow(s string) ([2]time.Duration, error) {
+	var w [2]time.Duration
+	if s == "" {
+		return w, nil
+	}
+	ps := strings.Split(s, "-")
+	if len(ps) != 2 {
+		return w, fmt.Errorf("invalid time window: %s", s)
+	}
+	for i, p := range ps {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return w, fmt.Errorf("invalid time window %s: %s", s, err)
+		}
+		w[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return w, nil
+}
@@ -18,6 +18,7 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -38,10 +39,12 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/compress"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
 	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/version"
 	"github.com/urfave/cli/v2"
 )
@@ -114,13 +117,74 @@ Details: https://juicefs.com/docs/community/quick_start_guide`,
 			&cli.StringFlag{
 				Name:  "compress",
 				Value: "none",
-				Usage: "compression algorithm (lz4, zstd, none)",
+				Usage: "compression algorithm (lz4, zstd, zstd:LEVEL, snappy, none)",
+			},
+			&cli.Float64Flag{
+				Name:  "compress-threshold",
+				Value: 0,
+				Usage: "store blocks uncompressed if compression saves less than this ratio (0 to 1, 0 means always compress)",
+			},
+			&cli.IntFlag{
+				Name:  "pack-size",
+				Value: 0,
+				Usage: "pack slices smaller than this size (in KiB) written in a short time into shared objects (0 means disabled)",
+			},
+			&cli.IntFlag{
+				Name:  "inline-size",
+				Value: 0,
+				Usage: "store the data of files not larger than this size (in KiB) in metadata engine (0 means disabled, at most 64)",
 			},
 			&cli.IntFlag{
 				Name:  "shards",
 				Value: 0,
 				Usage: "store the blocks into N buckets by hash of key",
 			},
+			&cli.IntFlag{
+				Name:  "parity-shards",
+				Value: 0,
+				Usage: "number of parity shards in the N buckets to store blocks with erasure coding (0 means disabled)",
+			},
+			&cli.StringFlag{
+				Name:  "replica-storage",
+				Usage: "object storage type of the replica (default: the same as --storage)",
+			},
+			&cli.StringFlag{
+				Name:  "replica-bucket",
+				Usage: "the bucket URL of another object storage to keep a replica of data",
+			},
+			&cli.StringFlag{
+				Name:  "replica-access-key",
+				Usage: "access key for the replica",
+			},
+			&cli.StringFlag{
+				Name:  "replica-secret-key",
+				Usage: "secret key for the replica",
+			},
+			&cli.StringFlag{
+				Name:  "replica-mode",
+				Value: "sync",
+				Usage: "write the replica synchronously (sync) or in background (async)",
+			},
+			&cli.StringFlag{
+				Name:  "tier-storage",
+				Usage: "object storage type of the tier storage for cold data (default: the same as --storage)",
+			},
+			&cli.StringFlag{
+				Name:  "tier-bucket",
+				Usage: "the bucket URL of another object storage (or storage class) to keep cold data",
+			},
+			&cli.StringFlag{
+				Name:  "tier-access-key",
+				Usage: "access key for the tier storage",
+			},
+			&cli.StringFlag{
+				Name:  "tier-secret-key",
+				Usage: "secret key for the tier storage",
+			},
+			&cli.StringSliceFlag{
+				Name:  "tier-policy",
+				Usage: "move files untouched for DAYS under a directory to the tier storage, in format of PATH:DAYS (0 means never)",
+			},
 			&cli.StringFlag{
 				Name:  "storage",
 				Value: "file",
@@ -143,10 +207,27 @@ Details: https://juicefs.com/docs/community/quick_start_guide`,
 				Name:  "session-token",
 				Usage: "session token for object storage",
 			},
+			&cli.StringFlag{
+				Name:  "storage-class",
+				Usage: "the storage class of objects (e.g. STANDARD_IA for S3, IA for OSS, NEARLINE for GCS, Cool for Azure, default: the one of bucket)",
+			},
+			&cli.BoolFlag{
+				Name:  "master-key",
+				Usage: "encrypt the secrets stored in metadata engine with the master key in environment variable JFS_MASTER_KEY, which is required by all clients",
+			},
 			&cli.StringFlag{
 				Name:  "encrypt-rsa-key",
 				Usage: "a path to RSA private key (PEM)",
 			},
+			&cli.StringFlag{
+				Name:  "encrypt-key-provider",
+				Usage: "URI of the key provider to wrap data keys with a master key kept out of metadata engine (file:///PATH, vault://HOST:PORT/MOUNT/KEY or exec:COMMAND), other clients use file:// and exec: only if they are listed in JFS_TRUSTED_REFS",
+			},
+			&cli.IntFlag{
+				Name:  "encrypt-segment-size",
+				Value: 64,
+				Usage: "size of segments (in KiB) sealed separately in encrypted objects, so part of an object can be read and decrypted alone; 0 means sealing the whole object, which can be read by old clients",
+			},
 			&cli.IntFlag{
 				Name:  "trash-days",
 				Value: 1,
@@ -156,6 +237,10 @@ Details: https://juicefs.com/docs/community/quick_start_guide`,
 				Name:  "hash-prefix",
 				Usage: "give each object a hashed prefix",
 			},
+			&cli.BoolFlag{
+				Name:  "dedup",
+				Usage: "store blocks (split at fixed offsets by block size) with identical content only once (only for new volumes)",
+			},
 			&cli.BoolFlag{
 				Name:  "force",
 				Usage: "overwrite existing format",
@@ -190,6 +275,9 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 	if err := format.Decrypt(); err != nil {
 		return nil, fmt.Errorf("format decrypt: %s", err)
 	}
+	if err := resolveSecrets(&format); err != nil {
+		return nil, err
+	}
 	object.UserAgent = "JuiceFS-" + version.Version()
 	var blob object.ObjectStorage
 	var err error
@@ -208,7 +296,9 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 		}
 	}
 
-	if format.Shards > 1 {
+	if format.ParityShards > 0 {
+		blob, err = object.NewErasureCoded(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey, format.SessionToken, format.Shards, format.ParityShards)
+	} else if format.Shards > 1 {
 		blob, err = object.NewSharded(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey, format.SessionToken, format.Shards)
 	} else {
 		blob, err = object.CreateStorage(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey, format.SessionToken)
@@ -216,31 +306,176 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = setStorageClass(blob, format.StorageClass); err != nil {
+		return nil, err
+	}
+	blob = object.NewInstrumented(blob, strings.ToLower(format.Storage), object.DefaultRetryPolicy)
+	if format.ReplicaBucket != "" {
+		rs := format.ReplicaStorage
+		if rs == "" {
+			rs = format.Storage
+		}
+		replica, err := object.CreateStorage(strings.ToLower(rs), format.ReplicaBucket, format.ReplicaAccessKey, format.ReplicaSecretKey, "")
+		if err != nil {
+			return nil, fmt.Errorf("replica: %s", err)
+		}
+		replica = object.NewInstrumented(replica, strings.ToLower(rs), object.DefaultRetryPolicy)
+		blob = object.NewReplicated(blob, replica, format.ReplicaMode == "async")
+	}
 	blob = object.WithPrefix(blob, format.Name+"/")
 
+	return newEncrypted(blob, format)
+}
+
+// setStorageClass puts new objects into the storage class sc, the default one of bucket is used if it's empty.
+func setStorageClass(blob object.ObjectStorage, sc string) error {
+	if sc == "" {
+		return nil
+	}
+	if c, ok := blob.(object.SupportStorageClass); ok {
+		if err := c.SetStorageClass(sc); err != utils.ENOTSUP {
+			return err
+		}
+	}
+	return fmt.Errorf("storage class is not supported by %s", blob)
+}
+
+// isEncrypted tells whether encryption is enabled for the volume, the first key (EncryptKey) could be
+// removed after rotation.
+func isEncrypted(format *meta.Format) bool {
+	return format.EncryptKey != "" || len(format.EncryptKeys) > 0
+}
+
+// keyRing returns the Encryptor to seal data keys with the encrypt keys of volume, or nil if encryption
+// is not enabled. The format should be decrypted.
+func keyRing(format *meta.Format) (object.Encryptor, error) {
+	if !isEncrypted(format) {
+		return nil, nil
+	}
+	keys := make(map[uint16]object.Encryptor)
 	if format.EncryptKey != "" {
-		passphrase := os.Getenv("JFS_RSA_PASSPHRASE")
-		block, _ := pem.Decode([]byte(format.EncryptKey))
-		if block == nil {
-			return nil, errors.New("failed to parse PEM block containing the key")
-		}
-		// nolint:staticcheck
-		if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") && x509.IsEncryptedPEMBlock(block) {
-			if passphrase == "" {
-				return nil, fmt.Errorf("passphrase is required to private key, please try again after setting the 'JFS_RSA_PASSPHRASE' environment variable")
+		kc, err := keyEncryptor(format.EncryptKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(format.EncryptKeys) == 0 && format.EncryptKeyID == 0 {
+			if format.EncryptSegment > 0 {
+				return object.NewSegmentedAESEncryptor(kc, format.EncryptSegment<<10), nil
 			}
-		} else if passphrase != "" {
-			logger.Warningf("passphrase is not used, because private key is not encrypted")
+			return object.NewAESEncryptor(kc), nil
+		}
+		keys[0] = kc
+	}
+	for id, key := range format.EncryptKeys {
+		kc, err := keyEncryptor(key)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt key %d: %s", id, err)
 		}
+		keys[uint16(id)] = kc
+	}
+	if keys[uint16(format.EncryptKeyID)] == nil {
+		return nil, fmt.Errorf("encrypt key %d is not found", format.EncryptKeyID)
+	}
+	return object.NewKeyRingEncryptor(keys, uint16(format.EncryptKeyID), format.EncryptSegment<<10), nil
+}
+
+// newEncrypted encrypts the objects with the RSA keys or key providers of volume, if they are set.
+func newEncrypted(blob object.ObjectStorage, format meta.Format) (object.ObjectStorage, error) {
+	enc, err := keyRing(&format)
+	if err != nil || enc == nil {
+		return blob, err
+	}
+	return object.NewEncrypted(blob, enc), nil
+}
+
+// isRSAKey tells whether an encrypt key of volume is a RSA private key (PEM).
+func isRSAKey(key string) bool {
+	return strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN")
+}
 
-		privKey, err := object.ParseRsaPrivateKeyFromPem(block, passphrase)
+// keyEncryptor returns the Encryptor to wrap data keys with an encrypt key of volume. The key providers
+// reading local files or running commands are only used when they are trusted (see isTrustedRef).
+func keyEncryptor(key string) (object.Encryptor, error) {
+	if isRSAKey(key) {
+		privKey, err := parseEncryptKey(key)
 		if err != nil {
-			return nil, fmt.Errorf("incorrect passphrase: %s", err)
+			return nil, err
+		}
+		return object.NewRSAEncryptor(privKey), nil
+	}
+	if !object.IsKeyProvider(key) {
+		return nil, fmt.Errorf("invalid encrypt key: expect a RSA private key (PEM) or URI of a key provider")
+	}
+	if object.IsLocalKeyProvider(key) && !isTrustedRef(key) {
+		return nil, fmt.Errorf("key provider %s runs on this host, add it into JFS_TRUSTED_REFS to use it", key)
+	}
+	return object.NewKeyProvider(key)
+}
+
+// NewTierStorage returns the object storage to keep cold data, or nil if it's not configured.
+// Blocks are moved there as they are, so they are encrypted in the same way.
+func NewTierStorage(format meta.Format) (object.ObjectStorage, error) {
+	if format.TierBucket == "" {
+		return nil, nil
+	}
+	if err := format.Decrypt(); err != nil {
+		return nil, fmt.Errorf("format decrypt: %s", err)
+	}
+	if err := resolveSecrets(&format); err != nil {
+		return nil, err
+	}
+	ts := format.TierStorage
+	if ts == "" {
+		ts = format.Storage
+	}
+	blob, err := object.CreateStorage(strings.ToLower(ts), format.TierBucket, format.TierAccessKey, format.TierSecretKey, "")
+	if err != nil {
+		return nil, err
+	}
+	blob = object.NewInstrumented(blob, strings.ToLower(ts), object.DefaultRetryPolicy)
+	return newEncrypted(object.WithPrefix(blob, format.Name+"/"), format)
+}
+
+// parseTierPolicies parses policies in format of PATH:DAYS, the days of "/" is the default one.
+func parseTierPolicies(policies []string) (map[string]int, error) {
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	ps := make(map[string]int)
+	for _, p := range policies {
+		i := strings.LastIndexByte(p, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid tier policy %s, it should be PATH:DAYS", p)
+		}
+		days, err := strconv.Atoi(p[i+1:])
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid days in tier policy %s", p)
+		}
+		ps[path.Clean("/"+p[:i])] = days
+	}
+	return ps, nil
+}
+
+func parseEncryptKey(encryptKey string) (*rsa.PrivateKey, error) {
+	passphrase := os.Getenv("JFS_RSA_PASSPHRASE")
+	block, _ := pem.Decode([]byte(encryptKey))
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block containing the key")
+	}
+	// nolint:staticcheck
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") && x509.IsEncryptedPEMBlock(block) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("passphrase is required to private key, please try again after setting the 'JFS_RSA_PASSPHRASE' environment variable")
 		}
-		encryptor := object.NewAESEncryptor(object.NewRSAEncryptor(privKey))
-		blob = object.NewEncrypted(blob, encryptor)
+	} else if passphrase != "" {
+		logger.Warningf("passphrase is not used, because private key is not encrypted")
+	}
+
+	privKey, err := object.ParseRsaPrivateKeyFromPem(block, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect passphrase: %s", err)
 	}
-	return blob, nil
+	return privKey, nil
 }
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -320,12 +555,34 @@ func format(c *cli.Context) error {
 	if v := c.String("compress"); compress.NewCompressor(v) == nil {
 		logger.Fatalf("Unsupported compress algorithm: %s", v)
 	}
+	if v := c.Float64("compress-threshold"); v < 0 || v >= 1 {
+		logger.Fatalf("Invalid compress threshold: %f", v)
+	}
+	if v := c.Int("pack-size"); v < 0 || v >= c.Int("block-size") {
+		logger.Fatalf("Invalid pack size: %d, it should be less than block size %d", v, c.Int("block-size"))
+	}
+	if v := c.Int("inline-size"); v < 0 || v > chunk.MaxInlineSize>>10 || v >= c.Int("block-size") {
+		logger.Fatalf("Invalid inline size: %d, it should be at most %d and less than block size %d", v, chunk.MaxInlineSize>>10, c.Int("block-size"))
+	}
+	if v := c.Int("encrypt-segment-size"); v < 0 || v > c.Int("block-size") {
+		logger.Fatalf("Invalid encrypt segment size: %d, it should be at most block size %d", v, c.Int("block-size"))
+	}
 	if v := c.Int("trash-days"); v < 0 {
 		logger.Fatalf("Invalid trash days: %d", v)
 	}
 	if v := c.Int("shards"); v > 256 {
 		logger.Fatalf("too many shards: %d", v)
 	}
+	if v := c.Int("parity-shards"); v < 0 || v > 0 && v >= c.Int("shards") {
+		logger.Fatalf("Invalid parity shards: %d, it should be less than shards %d", v, c.Int("shards"))
+	}
+	if v := c.String("replica-mode"); v != "sync" && v != "async" {
+		logger.Fatalf("Invalid replica mode: %s", v)
+	}
+	tierPolicies, err := parseTierPolicies(c.StringSlice("tier-policy"))
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
 	loadEncrypt := func(keyPath string) string {
 		if keyPath == "" {
 			return ""
@@ -336,6 +593,10 @@ func format(c *cli.Context) error {
 		}
 		return string(pem)
 	}
+	trustSecretFlags(c, "access-key", "secret-key", "session-token", "replica-access-key", "replica-secret-key", "tier-access-key", "tier-secret-key")
+	for _, env := range []string{"ACCESS_KEY", "SECRET_KEY", "SESSION_TOKEN"} {
+		trustRef(os.Getenv(env))
+	}
 	var create, encrypted bool
 	format, err := m.Load(false)
 	if err == nil {
@@ -354,30 +615,81 @@ func format(c *cli.Context) error {
 			case "access-key":
 				format.AccessKey = c.String(flag)
 			case "secret-key":
-				encrypted = format.KeyEncrypted
+				encrypted = encrypted || format.KeyEncrypted
 				if err := format.Decrypt(); err != nil && strings.Contains(err.Error(), "secret was removed") {
 					logger.Warnf("decrypt secrets: %s", err)
 				}
 				format.SecretKey = c.String(flag)
 			case "session-key":
-				encrypted = format.KeyEncrypted
+				encrypted = encrypted || format.KeyEncrypted
 				if err := format.Decrypt(); err != nil && strings.Contains(err.Error(), "secret was removed") {
 					logger.Warnf("decrypt secrets: %s", err)
 				}
 				format.SessionToken = c.String(flag)
+			case "storage-class":
+				format.StorageClass = c.String(flag)
 			case "trash-days":
 				format.TrashDays = c.Int(flag)
 			case "block-size":
 				format.BlockSize = fixObjectSize(c.Int(flag))
 			case "compress":
 				format.Compression = c.String(flag)
+			case "compress-threshold":
+				if c.Float64(flag) > 0 && !format.BlockHeader {
+					logger.Fatalf("Compress threshold can only be used by new volumes, which store blocks with a header")
+				}
+				format.CompressThreshold = c.Float64(flag)
+			case "pack-size":
+				format.PackSize = c.Int(flag)
+			case "inline-size":
+				format.InlineSize = c.Int(flag)
 			case "shards":
 				format.Shards = c.Int(flag)
+			case "parity-shards":
+				format.ParityShards = c.Int(flag)
+			case "replica-storage":
+				format.ReplicaStorage = c.String(flag)
+			case "replica-bucket":
+				format.ReplicaBucket = c.String(flag)
+			case "replica-access-key":
+				format.ReplicaAccessKey = c.String(flag)
+			case "replica-secret-key":
+				encrypted = encrypted || format.KeyEncrypted
+				if err := format.Decrypt(); err != nil && strings.Contains(err.Error(), "secret was removed") {
+					logger.Warnf("decrypt secrets: %s", err)
+				}
+				format.ReplicaSecretKey = c.String(flag)
+			case "replica-mode":
+				format.ReplicaMode = c.String(flag)
+			case "tier-storage":
+				format.TierStorage = c.String(flag)
+			case "tier-bucket":
+				format.TierBucket = c.String(flag)
+			case "tier-access-key":
+				format.TierAccessKey = c.String(flag)
+			case "tier-secret-key":
+				encrypted = encrypted || format.KeyEncrypted
+				if err := format.Decrypt(); err != nil && strings.Contains(err.Error(), "secret was removed") {
+					logger.Warnf("decrypt secrets: %s", err)
+				}
+				format.TierSecretKey = c.String(flag)
+			case "tier-policy":
+				format.TierPolicies = tierPolicies
 			case "hash-prefix":
 				format.HashPrefix = c.Bool(flag)
+			case "dedup":
+				format.Dedup = c.Bool(flag)
 			case "storage":
 				format.Storage = c.String(flag)
-			case "encrypt-rsa-key":
+			case "encrypt-segment-size":
+				format.EncryptSegment = c.Int(flag)
+			case "master-key":
+				if err := format.Decrypt(); err != nil {
+					logger.Fatalf("decrypt secrets: %s", err)
+				}
+				format.MasterKey = c.Bool(flag)
+				encrypted = true
+			case "encrypt-rsa-key", "encrypt-key-provider":
 				logger.Warnf("Flag %s is ignored since it cannot be updated", flag)
 			}
 		}
@@ -391,15 +703,47 @@ func format(c *cli.Context) error {
 			AccessKey:    c.String("access-key"),
 			SecretKey:    c.String("secret-key"),
 			SessionToken: c.String("session-token"),
+			StorageClass: c.String("storage-class"),
 			EncryptKey:   loadEncrypt(c.String("encrypt-rsa-key")),
 			Shards:       c.Int("shards"),
+			ParityShards: c.Int("parity-shards"),
 			HashPrefix:   c.Bool("hash-prefix"),
+			Dedup:        c.Bool("dedup"),
+			MasterKey:    c.Bool("master-key"),
 			Capacity:     c.Uint64("capacity") << 30,
 			Inodes:       c.Uint64("inodes"),
 			BlockSize:    fixObjectSize(c.Int("block-size")),
 			Compression:  c.String("compress"),
 			TrashDays:    c.Int("trash-days"),
 			MetaVersion:  1,
+
+			CompressThreshold: c.Float64("compress-threshold"),
+			BlockHeader:       true,
+			PackSize:          c.Int("pack-size"),
+			InlineSize:        c.Int("inline-size"),
+			ReplicaStorage:    c.String("replica-storage"),
+			ReplicaBucket:     c.String("replica-bucket"),
+			ReplicaAccessKey:  c.String("replica-access-key"),
+			ReplicaSecretKey:  c.String("replica-secret-key"),
+			ReplicaMode:       c.String("replica-mode"),
+			TierStorage:       c.String("tier-storage"),
+			TierBucket:        c.String("tier-bucket"),
+			TierAccessKey:     c.String("tier-access-key"),
+			TierSecretKey:     c.String("tier-secret-key"),
+			TierPolicies:      tierPolicies,
+		}
+		if uri := c.String("encrypt-key-provider"); uri != "" {
+			trustRef(uri)
+			if format.EncryptKey != "" {
+				logger.Fatalf("--encrypt-rsa-key and --encrypt-key-provider can't be used together")
+			}
+			format.EncryptKey = uri
+		}
+		if format.EncryptKey != "" {
+			format.EncryptSegment = c.Int("encrypt-segment-size")
+			if format.EncryptCacheKey, err = sealCacheKey(format); err != nil {
+				logger.Fatalf("seal key of local cache: %s", err)
+			}
 		}
 		if format.AccessKey == "" && os.Getenv("ACCESS_KEY") != "" {
 			format.AccessKey = os.Getenv("ACCESS_KEY")
@@ -427,12 +771,24 @@ func format(c *cli.Context) error {
 			format.Bucket += "/"
 		}
 	}
+	if ts := format.TierStorage; format.TierBucket != "" && (ts == "file" || ts == "archive" || ts == "" && format.Storage == "file") {
+		p, err := filepath.Abs(format.TierBucket)
+		if err != nil {
+			logger.Fatalf("Failed to get absolute path of %s: %s", format.TierBucket, err)
+		}
+		format.TierBucket = p + "/"
+	}
 
 	blob, err := createStorage(*format)
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	if tier, err := NewTierStorage(*format); err != nil {
+		logger.Fatalf("tier storage: %s", err)
+	} else if tier != nil {
+		logger.Infof("Cold data use %s", tier)
+	}
 	if os.Getenv("JFS_NO_CHECK_OBJECT_STORAGE") == "" {
 		if err := test(blob); err != nil {
 			logger.Fatalf("Storage %s is not configured correctly: %s", blob, err)
@@ -17,9 +17,13 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"path"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
@@ -43,7 +47,34 @@ It scans all objects in data storage and slices in metadata, comparing them to s
 lost object or broken file.
 
 Examples:
-$ juicefs fsck redis://localhost`,
+$ juicefs fsck redis://localhost
+
+# Download all blocks and verify them with the checksums in metadata
+$ juicefs fsck redis://localhost --verify-data
+
+# Rebuild the lost or corrupt shards of blocks stored with erasure coding
+$ juicefs fsck redis://localhost --repair`,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "verify-data",
+				Usage: "download all blocks to verify their checksums",
+			},
+			&cli.BoolFlag{
+				Name:  "repair",
+				Usage: "repair lost or corrupt shards of blocks (only for volumes with parity shards)",
+			},
+			&cli.IntFlag{
+				Name:    "threads",
+				Aliases: []string{"p"},
+				Value:   10,
+				Usage:   "number of threads to repair blocks",
+			},
+			&cli.IntFlag{
+				Name:  "list-threads",
+				Value: 1,
+				Usage: "number of threads to list objects",
+			},
+		},
 	}
 }
 
@@ -64,15 +95,33 @@ func fsck(ctx *cli.Context) error {
 		MaxUpload:  20,
 		BufferSize: 300 << 20,
 		CacheDir:   "memory",
+		HashPrefix: format.HashPrefix,
 	}
+	chunkConf.BlockHeader = format.BlockHeader
 
 	blob, err := createStorage(*format)
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	storage := blob
 	blob = object.WithPrefix(blob, "chunks/")
-	objs, err := osync.ListAll(blob, "", "")
+	tier, err := NewTierStorage(*format)
+	if err != nil {
+		logger.Fatalf("tier storage: %s", err)
+	}
+	tiers := make(map[uint64]uint8)
+	if tier != nil {
+		if r := m.ListTiers(meta.Background, tiers); r != 0 {
+			logger.Fatalf("list all tiers: %s", r)
+		}
+		tier = object.WithPrefix(tier, "chunks/")
+	}
+	repair := ctx.Bool("repair")
+	if repair && format.ParityShards == 0 {
+		logger.Fatalf("repair is only supported for volumes with parity shards")
+	}
+	objs, err := osync.ParallelListAll(blob, "", "", ctx.Int("list-threads"))
 	if err != nil {
 		logger.Fatalf("list all blocks: %s", err)
 	}
@@ -80,6 +129,30 @@ func fsck(ctx *cli.Context) error {
 	// Find all blocks in object storage
 	progress := utils.NewProgress(false, false)
 	blockDSpin := progress.AddDoubleSpinner("Found blocks")
+	var repairedSpin *utils.Bar
+	var repairs chan string
+	var wg sync.WaitGroup
+	if repair {
+		threads := ctx.Int("threads")
+		if threads <= 0 {
+			logger.Fatalf("threads should be greater than 0")
+		}
+		repairedSpin = progress.AddCountSpinner("Repaired blocks")
+		repairs = make(chan string, threads*10)
+		for i := 0; i < threads; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for key := range repairs {
+					if repaired, err := blob.(object.SupportRepair).Repair(key); err != nil {
+						logger.Errorf("repair block %s: %s", key, err)
+					} else if repaired {
+						repairedSpin.Increment()
+					}
+				}
+			}()
+		}
+	}
 	var blocks = make(map[string]int64)
 	for obj := range objs {
 		if obj == nil {
@@ -97,8 +170,19 @@ func fsck(ctx *cli.Context) error {
 		name := parts[2]
 		blocks[name] = obj.Size()
 		blockDSpin.IncrInt64(obj.Size())
+		if repair {
+			repairs <- obj.Key()
+		}
 	}
 	blockDSpin.Done()
+	if repair {
+		close(repairs)
+		wg.Wait()
+		repairedSpin.Done()
+		if progress.Quiet {
+			logger.Infof("Repaired %d blocks", repairedSpin.Current())
+		}
+	}
 	if progress.Quiet {
 		c, b := blockDSpin.Current()
 		logger.Infof("Found %d blocks (%d bytes)", c, b)
@@ -113,37 +197,87 @@ func fsck(ctx *cli.Context) error {
 		logger.Fatalf("list all slices: %s", r)
 	}
 	sliceCSpin.Done()
+	packs := make(map[uint64][]meta.Slice)
+	if r = m.ListPacks(c, packs); r != 0 {
+		logger.Fatalf("list all packs: %s", r)
+	}
+	packed := make(map[uint64]uint64)
+	for id, ss := range packs {
+		for _, s := range ss {
+			packed[s.Chunkid] = id
+		}
+	}
 
 	// Scan all slices to find lost blocks
 	sliceCBar := progress.AddCountBar("Scanned slices", sliceCSpin.Current())
 	sliceBSpin := progress.AddByteSpinner("Scanned slices")
 	lostDSpin := progress.AddDoubleSpinner("Lost blocks")
 	brokens := make(map[meta.Ino]string)
+	broken := func(inode meta.Ino) string {
+		if _, ok := brokens[inode]; !ok {
+			if ps := meta.GetPaths(m, meta.Background, inode); len(ps) > 0 {
+				brokens[inode] = ps[0]
+			} else {
+				brokens[inode] = fmt.Sprintf("inode:%d", inode)
+			}
+		}
+		return brokens[inode]
+	}
 	for inode, ss := range slices {
 		for _, s := range ss {
+			if id, ok := packed[s.Chunkid]; ok {
+				objKey := strings.TrimPrefix(chunk.PackKey(id, format.HashPrefix), "chunks/")
+				if _, ok := blocks[path.Base(objKey)]; !ok {
+					if _, err := blob.Head(objKey); err != nil {
+						logger.Errorf("can't find pack %s for file %s: %s", objKey, broken(inode), err)
+						lostDSpin.IncrInt64(int64(s.Size))
+					}
+				}
+				sliceCBar.Increment()
+				sliceBSpin.IncrInt64(int64(s.Size))
+				continue
+			}
+			var hashes []string
+			if format.Dedup {
+				if hashes, r = m.GetHashes(c, s.Chunkid); r != 0 {
+					logger.Fatalf("get hashes of slice %d: %s", s.Chunkid, r)
+				}
+			}
 			n := (s.Size - 1) / uint32(chunkConf.BlockSize)
 			for i := uint32(0); i <= n; i++ {
 				sz := chunkConf.BlockSize
 				if i == n {
 					sz = int(s.Size) - int(i)*chunkConf.BlockSize
 				}
+				if int(i) < len(hashes) && hashes[i] != "" {
+					if _, ok := blocks[hashes[i]]; !ok {
+						objKey := strings.TrimPrefix(chunk.DedupKey(hashes[i]), "chunks/")
+						if _, err := blob.Head(objKey); err != nil {
+							logger.Errorf("can't find block %s for file %s: %s", objKey, broken(inode), err)
+							lostDSpin.IncrInt64(int64(sz))
+						}
+					}
+					continue
+				}
 				key := fmt.Sprintf("%d_%d_%d", s.Chunkid, i, sz)
 				if _, ok := blocks[key]; !ok {
+					if sz <= chunk.MaxInlineSize {
+						if data, st := m.GetInline(c, s.Chunkid); st == 0 && data != nil {
+							continue // stored in metadata engine
+						}
+					}
 					var objKey string
 					if format.HashPrefix {
 						objKey = fmt.Sprintf("%02X/%v/%s", s.Chunkid%256, s.Chunkid/1000/1000, key)
 					} else {
 						objKey = fmt.Sprintf("%v/%v/%s", s.Chunkid/1000/1000, s.Chunkid/1000, key)
 					}
-					if _, err := blob.Head(objKey); err != nil {
-						if _, ok := brokens[inode]; !ok {
-							if ps := meta.GetPaths(m, meta.Background, inode); len(ps) > 0 {
-								brokens[inode] = ps[0]
-							} else {
-								brokens[inode] = fmt.Sprintf("inode:%d", inode)
-							}
-						}
-						logger.Errorf("can't find block %s for file %s: %s", objKey, brokens[inode], err)
+					store := blob
+					if tiers[s.Chunkid] != meta.TierPrimary {
+						store = tier
+					}
+					if _, err := store.Head(objKey); err != nil {
+						logger.Errorf("can't find block %s for file %s: %s", objKey, broken(inode), err)
 						lostDSpin.IncrInt64(int64(sz))
 					}
 				}
@@ -152,12 +286,54 @@ func fsck(ctx *cli.Context) error {
 			sliceBSpin.IncrInt64(int64(s.Size))
 		}
 	}
+	corruptDSpin := progress.AddDoubleSpinner("Corrupt blocks")
+	if ctx.Bool("verify-data") {
+		chunkConf.Checksums = blockChecksums(m)
+		if format.HasPacks() {
+			chunkConf.Packs = slicePacks(m)
+		}
+		if format.HasInlines() {
+			chunkConf.Inlines = sliceInlines(m)
+		}
+		if format.Dedup {
+			chunkConf.Hashes = blockHashes(m)
+		}
+		store := chunk.NewCachedStore(storage, chunkConf, nil)
+		verifyDSpin := progress.AddDoubleSpinner("Verified blocks")
+		verified := make(map[uint64]bool)
+		for inode, ss := range slices {
+			for _, s := range ss {
+				if s.Chunkid == 0 || verified[s.Chunkid] || tiers[s.Chunkid] != meta.TierPrimary {
+					continue // archived blocks can't be read before restored
+				}
+				verified[s.Chunkid] = true
+				r := store.NewReader(s.Chunkid, int(s.Size))
+				for off := 0; off < int(s.Size); off += chunkConf.BlockSize {
+					size := utils.Min(chunkConf.BlockSize, int(s.Size)-off)
+					page := chunk.NewOffPage(size)
+					_, err := r.ReadAt(context.Background(), page, off)
+					page.Release()
+					if errors.Is(err, chunk.ErrChecksumMismatch) {
+						logger.Errorf("corrupt block of file %s: %s", broken(inode), err)
+						corruptDSpin.IncrInt64(int64(size))
+					} else if err != nil {
+						logger.Warnf("read chunk %d at %d: %s", s.Chunkid, off, err)
+					}
+					verifyDSpin.IncrInt64(int64(size))
+				}
+			}
+		}
+		verifyDSpin.Done()
+	}
 	progress.Done()
 	if progress.Quiet {
 		logger.Infof("Used by %d slices (%d bytes)", sliceCBar.Current(), sliceBSpin.Current())
 	}
-	if lc, lb := lostDSpin.Current(); lc > 0 {
-		msg := fmt.Sprintf("%d objects are lost (%d bytes), %d broken files:\n", lc, lb, len(brokens))
+	lc, lb := lostDSpin.Current()
+	cc, cb := corruptDSpin.Current()
+	if lc > 0 || cc > 0 {
+		msg := fmt.Sprintf("%d objects are lost (%d bytes), %d objects are corrupt (%d bytes), %d broken files:\n",
+			lc, lb, cc, cb, len(brokens))
 		msg += fmt.Sprintf("%13s: PATH\n", "INODE")
 		var fileList []string
 		for i, p := range brokens {
@@ -194,6 +194,13 @@ func initForSvc(c *cli.Context, mp string, metaUrl string) (*vfs.Config, *fs.Fil
 	logger.Infof("Data use %s", blob)
 
 	chunkConf := getChunkConf(c, format)
+	setMetaHooks(c, chunkConf, format, metaCli)
+	if chunkConf.TierStorage, err = NewTierStorage(*format); err != nil {
+		logger.Fatalf("tier storage: %s", err)
+	} else if chunkConf.TierStorage != nil {
+		logger.Infof("Cold data use %s", chunkConf.TierStorage)
+		chunkConf.Tiers = sliceTiers(metaCli)
+	}
 	store := chunk.NewCachedStore(blob, *chunkConf, registerer)
 	registerMetaMsg(metaCli, store, chunkConf)
 
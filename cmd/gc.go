@@ -21,6 +21,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
@@ -42,22 +43,22 @@ func cmdGC() *cli.Command {
 		ArgsUsage: "META-URL",
 		Description: `
 It scans all objects in data storage and slices in metadata, comparing them to see if there is any
-leaked object. It can also actively trigger compaction of slices.
+leaked object, and aborts the multipart uploads left unfinished. It can also actively trigger compaction of slices.
 Use this command if you find that data storage takes more than expected.
 
 Examples:
 # Check only, no writable change
 $ juicefs gc redis://localhost
 
-# Trigger compaction of all slices
+# Trigger compaction of all slices and shared objects of small files
 $ juicefs gc redis://localhost --compact
 
-# Delete leaked objects
+# Delete leaked objects and abort stale multipart uploads
 $ juicefs gc redis://localhost --delete`,
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:  "compact",
-				Usage: "compact small slices into bigger ones",
+				Usage: "compact small slices into bigger ones, and rewrite shared objects which are mostly unused",
 			},
 			&cli.BoolFlag{
 				Name:  "delete",
@@ -69,6 +70,11 @@ $ juicefs gc redis://localhost --delete`,
 				Value:   10,
 				Usage:   "number threads to delete leaked objects",
 			},
+			&cli.IntFlag{
+				Name:  "list-threads",
+				Value: 1,
+				Usage: "number of threads to list objects",
+			},
 		},
 	}
 }
@@ -91,14 +97,27 @@ func gc(ctx *cli.Context) error {
 	}
 
 	chunkConf := chunk.Config{
-		BlockSize:  format.BlockSize * 1024,
-		Compress:   format.Compression,
-		GetTimeout: time.Second * 60,
-		PutTimeout: time.Second * 60,
-		MaxUpload:  20,
-		MaxDeletes: ctx.Int("threads"),
-		BufferSize: 300 << 20,
-		CacheDir:   "memory",
+		BlockSize:         format.BlockSize * 1024,
+		Compress:          format.Compression,
+		CompressThreshold: format.CompressThreshold,
+		BlockHeader:       format.BlockHeader,
+		GetTimeout:        time.Second * 60,
+		PutTimeout:        time.Second * 60,
+		MaxUpload:         20,
+		MaxDeletes:        ctx.Int("threads"),
+		BufferSize:        300 << 20,
+		CacheDir:          "memory",
+		Checksums:         blockChecksums(m),
+		InlineSize:        format.InlineSize * 1024,
+	}
+	if format.HasPacks() {
+		chunkConf.Packs = slicePacks(m)
+	}
+	if format.HasInlines() {
+		chunkConf.Inlines = sliceInlines(m)
+	}
+	if format.Dedup {
+		chunkConf.Hashes = blockHashes(m)
 	}
 
 	blob, err := createStorage(*format)
@@ -106,7 +125,19 @@ func gc(ctx *cli.Context) error {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	tier, err := NewTierStorage(*format)
+	if err != nil {
+		logger.Fatalf("tier storage: %s", err)
+	}
+	if tier != nil {
+		logger.Infof("Cold data use %s", tier)
+		chunkConf.TierStorage = tier
+		chunkConf.Tiers = sliceTiers(m)
+	}
 	store := chunk.NewCachedStore(blob, chunkConf, nil)
+	m.OnMsg(meta.DeleteBlock, func(args ...interface{}) error {
+		return store.RemoveBlock(args[0].(string))
+	})
 
 	// Scan all chunks first and do compaction if necessary
 	progress := utils.NewProgress(false, false)
@@ -118,7 +149,7 @@ func gc(ctx *cli.Context) error {
 		})
 		m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
 			slices := args[0].([]meta.Slice)
-			err := vfs.Compact(chunkConf, store, slices, args[1].(uint64))
+			err := vfs.Compact(chunkConf, store, slices, args[1].(uint64), args[2].(*[]uint32))
 			for _, s := range slices {
 				spin.IncrInt64(int64(s.Len))
 			}
@@ -190,9 +221,38 @@ func gc(ctx *cli.Context) error {
 	}
 	sliceCSpin.Done()
 
+	// List all slices stored in shared objects
+	packs := make(map[uint64][]meta.Slice)
+	if r = m.ListPacks(c, packs); r != 0 {
+		logger.Fatalf("list all packs: %s", r)
+	}
+	packed := make(map[uint64]bool)
+	for _, ss := range packs {
+		for _, s := range ss {
+			packed[s.Chunkid] = true
+		}
+	}
+
+	// List all deduplicated objects
+	dedups := make(map[string]int64)
+	if format.Dedup {
+		if r = m.ListBlocks(c, dedups); r != 0 {
+			logger.Fatalf("list all deduplicated blocks: %s", r)
+		}
+	}
+
+	// List all slices moved to tier storage
+	tiers := make(map[uint64]uint8)
+	if tier != nil {
+		if r = m.ListTiers(c, tiers); r != 0 {
+			logger.Fatalf("list all tiers: %s", r)
+		}
+	}
+
 	// Scan all objects to find leaked ones
+	storage := blob
 	blob = object.WithPrefix(blob, "chunks/")
-	objs, err := osync.ListAll(blob, "", "")
+	objs, err := osync.ParallelListAll(blob, "", "", ctx.Int("list-threads"))
 	if err != nil {
 		logger.Fatalf("list all blocks: %s", err)
 	}
@@ -202,10 +262,13 @@ func gc(ctx *cli.Context) error {
 	for _, ss := range slices {
 		for _, s := range ss {
 			keys[s.Chunkid] = s.Size
-			total += int64(int(s.Size-1)/chunkConf.BlockSize) + 1 // s.Size should be > 0
+			if !packed[s.Chunkid] {
+				total += int64(int(s.Size-1)/chunkConf.BlockSize) + 1 // s.Size should be > 0
+			}
 			totalBytes += uint64(s.Size)
 		}
 	}
+	total += int64(len(packs)) + int64(len(dedups))
 	if progress.Quiet {
 		logger.Infof("using %d slices (%d bytes)", len(keys), totalBytes)
 	}
@@ -214,6 +277,7 @@ func gc(ctx *cli.Context) error {
 	valid := progress.AddDoubleSpinner("Valid objects")
 	leaked := progress.AddDoubleSpinner("Leaked objects")
 	skipped := progress.AddDoubleSpinner("Skipped objects")
+	stale := progress.AddCountSpinner("Stale uploads")
 	maxMtime := time.Now().Add(time.Hour * -1)
 	strDuration := os.Getenv("JFS_GC_SKIPPEDTIME")
 	if strDuration != "" {
@@ -225,6 +289,7 @@ func gc(ctx *cli.Context) error {
 		}
 	}
 
+	var sparsePacks []uint64 // shared objects mostly unused
 	var leakedObj = make(chan string, 10240)
 	for i := 0; i < threads; i++ {
 		wg.Add(1)
@@ -246,37 +311,25 @@ func gc(ctx *cli.Context) error {
 		}
 	}
 
-	for obj := range objs {
-		if obj == nil {
-			break // failed listing
-		}
-		if obj.IsDir() {
-			continue
-		}
-		if obj.Mtime().After(maxMtime) || obj.Mtime().Unix() == 0 {
-			logger.Debugf("ignore new block: %s %s", obj.Key(), obj.Mtime())
-			bar.Increment()
-			skipped.IncrInt64(obj.Size())
-			continue
-		}
-
+	// checkBlock checks a block stored in the tier `t`
+	checkBlock := func(obj object.Object, t uint8, foundLeaked func(obj object.Object)) {
 		logger.Debugf("found block %s", obj.Key())
 		parts := strings.Split(obj.Key(), "/")
 		if len(parts) != 3 {
-			continue
+			return
 		}
 		name := parts[2]
 		parts = strings.Split(name, "_")
 		if len(parts) != 3 {
-			continue
+			return
 		}
 		bar.Increment()
 		cid, _ := strconv.Atoi(parts[0])
 		size := keys[uint64(cid)]
-		if size == 0 {
+		if size == 0 || tiers[uint64(cid)] != t {
 			logger.Debugf("find leaked object: %s, size: %d", obj.Key(), obj.Size())
 			foundLeaked(obj)
-			continue
+			return
 		}
 		indx, _ := strconv.Atoi(parts[1])
 		csize, _ := strconv.Atoi(parts[2])
@@ -296,17 +349,140 @@ func gc(ctx *cli.Context) error {
 			}
 		}
 	}
+
+	for obj := range objs {
+		if obj == nil {
+			break // failed listing
+		}
+		if obj.IsDir() {
+			continue
+		}
+		if obj.Mtime().After(maxMtime) || obj.Mtime().Unix() == 0 {
+			logger.Debugf("ignore new block: %s %s", obj.Key(), obj.Mtime())
+			bar.Increment()
+			skipped.IncrInt64(obj.Size())
+			continue
+		}
+
+		if id, ok := chunk.ParsePackKey(obj.Key()); ok {
+			bar.Increment()
+			var used int64
+			for _, s := range packs[id] {
+				used += int64(s.Pack.Len)
+			}
+			if used == 0 {
+				logger.Debugf("find leaked pack: %s, size: %d", obj.Key(), obj.Size())
+				foundLeaked(obj)
+			} else {
+				valid.IncrInt64(obj.Size())
+				if used*2 < obj.Size() {
+					sparsePacks = append(sparsePacks, id)
+				}
+			}
+			continue
+		}
+
+		if hash, ok := chunk.ParseDedupKey(obj.Key()); ok {
+			bar.Increment()
+			refs, ok := dedups[hash]
+			if refs > 0 {
+				valid.IncrInt64(obj.Size())
+			} else if !ok {
+				logger.Debugf("find leaked deduplicated block: %s, size: %d", obj.Key(), obj.Size())
+				foundLeaked(obj)
+			} else if refs == 0 {
+				logger.Debugf("find unreferenced deduplicated block: %s, size: %d", obj.Key(), obj.Size())
+				bar.IncrTotal(1)
+				leaked.IncrInt64(obj.Size())
+				if delete {
+					if st := m.RemoveBlock(c, hash); st != 0 && st != syscall.EBUSY {
+						logger.Warnf("remove block %s: %s", hash, st)
+					}
+				}
+			} else {
+				skipped.IncrInt64(obj.Size()) // being deleted
+			}
+			continue
+		}
+
+		checkBlock(obj, meta.TierPrimary, foundLeaked)
+	}
 	close(leakedObj)
 	wg.Wait()
+
+	// abort the multipart uploads left by failed clients, their parts are charged but never used
+	var marker string
+	for {
+		uploads, next, err := blob.ListUploads(marker)
+		if err != nil {
+			if err != utils.ENOTSUP {
+				logger.Warnf("list multipart uploads: %s", err)
+			}
+			break
+		}
+		for _, u := range uploads {
+			if u.Created.After(maxMtime) {
+				continue
+			}
+			stale.Increment()
+			if delete {
+				logger.Debugf("abort stale upload %s of %s (created at %s)", u.UploadID, u.Key, u.Created)
+				blob.AbortUpload(u.Key, u.UploadID)
+			}
+		}
+		if next == "" || next == marker {
+			break
+		}
+		marker = next
+	}
+
+	if tier != nil {
+		tobjs, err := osync.ParallelListAll(object.WithPrefix(tier, "chunks/"), "", "", ctx.Int("list-threads"))
+		if err != nil {
+			logger.Fatalf("list all blocks in tier storage: %s", err)
+		}
+		for obj := range tobjs {
+			if obj == nil {
+				break // failed listing
+			}
+			if obj.IsDir() {
+				continue
+			}
+			if obj.Mtime().After(maxMtime) || obj.Mtime().Unix() == 0 {
+				logger.Debugf("ignore new block in tier storage: %s %s", obj.Key(), obj.Mtime())
+				skipped.IncrInt64(obj.Size())
+				continue
+			}
+			checkBlock(obj, meta.TierArchive, func(obj object.Object) {
+				bar.IncrTotal(1)
+				leaked.IncrInt64(obj.Size())
+				if delete {
+					if err := tier.Delete("chunks/" + obj.Key()); err != nil {
+						logger.Warnf("delete %s from tier storage: %s", obj.Key(), err)
+					}
+				}
+			})
+		}
+	}
+	if ctx.Bool("compact") && len(sparsePacks) > 0 {
+		packBar := progress.AddCountBar("Compacted packs", int64(len(sparsePacks)))
+		for _, id := range sparsePacks {
+			if err := vfs.CompactPack(m, storage, format.HashPrefix, id, packs[id]); err != nil {
+				logger.Warnf("compact pack %d: %s", id, err)
+			}
+			packBar.Increment()
+		}
+		packBar.Done()
+	}
 	progress.Done()
 
 	vc, _ := valid.Current()
 	lc, lb := leaked.Current()
 	sc, sb := skipped.Current()
-	logger.Infof("scanned %d objects, %d valid, %d leaked (%d bytes), %d skipped (%d bytes)",
-		bar.Current(), vc, lc, lb, sc, sb)
-	if lc > 0 && !delete {
-		logger.Infof("Please add `--delete` to clean leaked objects")
+	logger.Infof("scanned %d objects, %d valid, %d leaked (%d bytes), %d skipped (%d bytes), %d stale uploads",
+		bar.Current(), vc, lc, lb, sc, sb, stale.Current())
+	if (lc > 0 || stale.Current() > 0) && !delete {
+		logger.Infof("Please add `--delete` to clean leaked objects and stale uploads")
 	}
 	return nil
 }
@@ -56,6 +56,8 @@ func Main(args []string) error {
 			cmdDestroy(),
 			cmdGC(),
 			cmdFsck(),
+			cmdScrub(),
+			cmdRekey(),
 			cmdDump(),
 			cmdLoad(),
 			cmdVersion(),
@@ -201,6 +201,13 @@ func initForMdtest(c *cli.Context, mp string, metaUrl string) *fs.FileSystem {
 	logger.Infof("Data use %s", blob)
 
 	chunkConf := getChunkConf(c, format)
+	setMetaHooks(c, chunkConf, format, m)
+	if chunkConf.TierStorage, err = NewTierStorage(*format); err != nil {
+		logger.Fatalf("tier storage: %s", err)
+	} else if chunkConf.TierStorage != nil {
+		logger.Infof("Cold data use %s", chunkConf.TierStorage)
+		chunkConf.Tiers = sliceTiers(m)
+	}
 	store := chunk.NewCachedStore(blob, *chunkConf, registerer)
 	registerMetaMsg(m, store, chunkConf)
 
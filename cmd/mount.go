@@ -17,13 +17,20 @@
 package cmd
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"syscall"
@@ -113,6 +120,7 @@ func exposeMetrics(c *cli.Context, m meta.Meta, registerer prometheus.Registerer
 
 	m.InitMetrics(registerer)
 	vfs.InitMetrics(registerer)
+	object.InitMetrics(registerer)
 	go metric.UpdateMetrics(m, registerer)
 	http.Handle("/metrics", promhttp.HandlerFor(
 		registry,
@@ -248,12 +256,142 @@ func getVfsConf(c *cli.Context, metaConf *meta.Config, format *meta.Format, chun
 	return cfg
 }
 
+// blockChecksums returns the checksums of blocks recorded in metadata, to verify blocks read from object storage
+func blockChecksums(m meta.Meta) func(chunkid uint64) ([]uint32, error) {
+	return func(chunkid uint64) ([]uint32, error) {
+		sums, st := m.GetChecksums(meta.Background, chunkid)
+		if st != 0 {
+			return nil, st
+		}
+		return sums, nil
+	}
+}
+
+// slicePacks returns the locations of small slices stored in shared objects
+func slicePacks(m meta.Meta) func(chunkid uint64) (*chunk.Pack, error) {
+	return func(chunkid uint64) (*chunk.Pack, error) {
+		p, st := m.GetPack(meta.Background, chunkid)
+		if st != 0 {
+			return nil, st
+		}
+		return (*chunk.Pack)(p), nil
+	}
+}
+
+// sliceInlines returns the data of small slices stored in metadata engine
+func sliceInlines(m meta.Meta) func(chunkid uint64) ([]byte, error) {
+	return func(chunkid uint64) ([]byte, error) {
+		data, st := m.GetInline(meta.Background, chunkid)
+		if st != 0 {
+			return nil, st
+		}
+		return data, nil
+	}
+}
+
+// blockHashes returns the content hashes of deduplicated blocks, to locate the objects storing them
+func blockHashes(m meta.Meta) func(chunkid uint64) ([]string, error) {
+	return func(chunkid uint64) ([]string, error) {
+		hashes, st := m.GetHashes(meta.Background, chunkid)
+		if st != 0 {
+			return nil, st
+		}
+		return hashes, nil
+	}
+}
+
+// sliceTiers returns the tiers of slices, to locate the ones moved to tier storage
+func sliceTiers(m meta.Meta) func(chunkid uint64) (uint8, error) {
+	return func(chunkid uint64) (uint8, error) {
+		tier, st := m.GetTier(meta.Background, chunkid)
+		if st != 0 {
+			return 0, st
+		}
+		return tier, nil
+	}
+}
+
+// dedupBlocks refers blocks to the objects with the same content
+func dedupBlocks(m meta.Meta) func(chunkid uint64, indx int, hash string, size int) (int64, error) {
+	return func(chunkid uint64, indx int, hash string, size int) (int64, error) {
+		refs, st := m.AcquireBlock(meta.Background, chunkid, uint32(indx), hash, uint32(size))
+		if st != 0 {
+			return 0, st
+		}
+		return refs, nil
+	}
+}
+
+// releaseBlocks drops the references of deduplicated blocks in a slice which is never committed
+func releaseBlocks(m meta.Meta) func(chunkid uint64) error {
+	return func(chunkid uint64) error {
+		if st := m.ReleaseBlocks(meta.Background, chunkid); st != 0 {
+			return st
+		}
+		return nil
+	}
+}
+
+// setMetaHooks wires the lookups of metadata needed by the features used in the volume, so that
+// reads of volumes without them don't pay for the extra queries.
+func setMetaHooks(c *cli.Context, conf *chunk.Config, format *meta.Format, m meta.Meta) {
+	if !c.Bool("no-verify") {
+		conf.Checksums = blockChecksums(m)
+	}
+	if format.HasPacks() {
+		conf.Packs = slicePacks(m)
+	}
+	if format.HasInlines() {
+		conf.Inlines = sliceInlines(m)
+	}
+	if format.Dedup {
+		conf.Dedup = dedupBlocks(m)
+		conf.Hashes = blockHashes(m)
+		conf.Release = releaseBlocks(m)
+		var err error
+		if conf.HashKey, err = DedupHashKey(format); err != nil {
+			logger.Fatalf("key to hash blocks: %s", err)
+		}
+	}
+}
+
+// DedupHashKey returns the key to hash blocks for deduplication on encrypted volumes, so the names of
+// deduplicated objects don't reveal fingerprints of the plaintext. It's derived from the key of local
+// cache, which is never changed (see cacheEncryptKey).
+func DedupHashKey(format *meta.Format) ([]byte, error) {
+	if !isEncrypted(format) {
+		return nil, nil
+	}
+	f := *format
+	if err := f.Decrypt(); err != nil {
+		return nil, err
+	}
+	var key []byte
+	var err error
+	if f.EncryptCacheKey != "" {
+		key, err = openCacheKey(&f)
+	} else if isRSAKey(f.EncryptKey) {
+		key, err = derivedCacheKey(&f)
+	} else {
+		err = fmt.Errorf("the key of local cache is not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte("juicefs dedup:" + f.UUID))
+	return h.Sum(nil), nil
+}
+
 func registerMetaMsg(m meta.Meta, store chunk.ChunkStore, chunkConf *chunk.Config) {
 	m.OnMsg(meta.DeleteChunk, func(args ...interface{}) error {
 		return store.Remove(args[0].(uint64), int(args[1].(uint32)))
 	})
+	m.OnMsg(meta.DeleteBlock, func(args ...interface{}) error {
+		return store.RemoveBlock(args[0].(string))
+	})
 	m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
-		return vfs.Compact(*chunkConf, store, args[0].([]meta.Slice), args[1].(uint64))
+		return vfs.Compact(*chunkConf, store, args[0].([]meta.Slice), args[1].(uint64), args[2].(*[]uint32))
 	})
 }
 
@@ -298,33 +436,49 @@ func getMetaConf(c *cli.Context, mp string, readOnly bool) *meta.Config {
 		logger.Warnf("heartbeat shouldd not be greater than 10 minutes")
 		cfg.Heartbeat = time.Minute * 10
 	}
+	if !readOnly {
+		cfg.CompactBudget = int64(c.Int("compact-budget")) << 20
+	}
+	var err error
+	if cfg.CompactWindow, err = timeWindow(c.String("compact-window")); err != nil {
+		logger.Fatalf("compact-window: %s", err)
+	}
 	return cfg
 }
 
 func getChunkConf(c *cli.Context, format *meta.Format) *chunk.Config {
 	chunkConf := &chunk.Config{
-		BlockSize:  format.BlockSize * 1024,
-		Compress:   format.Compression,
-		HashPrefix: format.HashPrefix,
-
-		GetTimeout:    time.Second * time.Duration(c.Int("get-timeout")),
-		PutTimeout:    time.Second * time.Duration(c.Int("put-timeout")),
-		MaxUpload:     c.Int("max-uploads"),
-		MaxDeletes:    c.Int("max-deletes"),
-		MaxRetries:    c.Int("io-retries"),
-		Writeback:     c.Bool("writeback"),
-		Prefetch:      c.Int("prefetch"),
-		BufferSize:    c.Int("buffer-size") << 20,
-		UploadLimit:   c.Int64("upload-limit") * 1e6 / 8,
-		DownloadLimit: c.Int64("download-limit") * 1e6 / 8,
-		UploadDelay:   duration(c.String("upload-delay")),
-
-		CacheDir:       c.String("cache-dir"),
-		CacheSize:      int64(c.Int("cache-size")),
-		FreeSpace:      float32(c.Float64("free-space-ratio")),
-		CacheMode:      os.FileMode(0600),
-		CacheFullBlock: !c.Bool("cache-partial-only"),
-		AutoCreate:     true,
+		BlockSize:         format.BlockSize * 1024,
+		Compress:          format.Compression,
+		CompressThreshold: format.CompressThreshold,
+		BlockHeader:       format.BlockHeader,
+		HashPrefix:        format.HashPrefix,
+		PackSize:          format.PackSize * 1024,
+		InlineSize:        format.InlineSize * 1024,
+
+		GetTimeout:      time.Second * time.Duration(c.Int("get-timeout")),
+		HedgePercentile: c.Float64("hedge-percentile"),
+		HedgeBudget:     c.Float64("hedge-budget"),
+		PutTimeout:      time.Second * time.Duration(c.Int("put-timeout")),
+		PartThreshold:   c.Int("multipart-threshold") << 20,
+		MaxUpload:       c.Int("max-uploads"),
+		MaxDeletes:      c.Int("max-deletes"),
+		MaxRetries:      c.Int("io-retries"),
+		Writeback:       c.Bool("writeback"),
+		Prefetch:        c.Int("prefetch"),
+		BufferSize:      c.Int("buffer-size") << 20,
+		UploadLimit:     c.Int64("upload-limit") * 1e6 / 8,
+		DownloadLimit:   c.Int64("download-limit") * 1e6 / 8,
+		UploadDelay:     duration(c.String("upload-delay")),
+		PackDelay:       duration(c.String("pack-delay")),
+
+		CacheDir:        c.String("cache-dir"),
+		CacheSize:       int64(c.Int("cache-size")),
+		PinnedCacheSize: int64(c.Int("pinned-cache-size")),
+		FreeSpace:       float32(c.Float64("free-space-ratio")),
+		CacheMode:       os.FileMode(0600),
+		CacheFullBlock:  !c.Bool("cache-partial-only"),
+		AutoCreate:      true,
 	}
 	if chunkConf.MaxUpload <= 0 {
 		logger.Warnf("max-uploads should be greater than 0, set it to 1")
@@ -334,6 +488,14 @@ func getChunkConf(c *cli.Context, format *meta.Format) *chunk.Config {
 		logger.Warnf("buffer-size should be more than 32 MiB")
 		chunkConf.BufferSize = 32 << 20
 	}
+	if chunkConf.HedgeBudget > 0 && (chunkConf.HedgePercentile <= 0 || chunkConf.HedgePercentile >= 1) {
+		logger.Warnf("hedge-percentile should be between 0 and 1, set it to 0.95")
+		chunkConf.HedgePercentile = 0.95
+	}
+
+	if c.Bool("encrypt-cache") {
+		chunkConf.CacheKey = cacheEncryptKey(format, chunkConf.Writeback)
+	}
 
 	if chunkConf.CacheDir != "memory" {
 		ds := utils.SplitDir(chunkConf.CacheDir)
@@ -345,6 +507,87 @@ func getChunkConf(c *cli.Context, format *meta.Format) *chunk.Config {
 	return chunkConf
 }
 
+// cacheEncryptKey returns the key to encrypt blocks in local cache and staging directory.
+// It's generated when formatting and sealed with the encrypt keys of volume, so staging blocks can be
+// uploaded after restart, or it's an ephemeral one that only lives in current mount.
+func cacheEncryptKey(format *meta.Format, writeback bool) []byte {
+	f := *format
+	if err := f.Decrypt(); err != nil {
+		logger.Fatalf("format decrypt: %s", err)
+	}
+	format = &f
+	if format.EncryptCacheKey != "" {
+		key, err := openCacheKey(format)
+		if err != nil {
+			logger.Fatalf("load key to encrypt cache: %s", err)
+		}
+		return key
+	}
+	if isRSAKey(format.EncryptKey) {
+		// volumes formatted before the key is sealed, until it's sealed by rekey
+		key, err := derivedCacheKey(format)
+		if err != nil {
+			logger.Fatalf("load encrypt key: %s", err)
+		}
+		return key
+	}
+	if writeback {
+		logger.Fatalf("encrypt-cache in writeback mode requires an encrypted volume (format with --encrypt-rsa-key or --encrypt-key-provider), or staging blocks can't be read after restart")
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		logger.Fatalf("generate key to encrypt cache: %s", err)
+	}
+	logger.Infof("Encrypt local cache with an ephemeral key, blocks cached by previous mounts can't be used")
+	return key
+}
+
+// derivedCacheKey returns the key of local cache derived from the first RSA key, which was used before
+// the key is generated and sealed.
+func derivedCacheKey(format *meta.Format) ([]byte, error) {
+	privKey, err := parseEncryptKey(format.EncryptKey)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, x509.MarshalPKCS1PrivateKey(privKey))
+	_, _ = h.Write([]byte("juicefs cache:" + format.UUID))
+	return h.Sum(nil), nil
+}
+
+// sealCacheKey generates a random key to encrypt local cache, and seals it with the encrypt keys of volume
+// like a data key, so it's not bound to any of them and can be sealed again with the active one by rekey.
+func sealCacheKey(format *meta.Format) (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return sealKey(format, key)
+}
+
+func sealKey(format *meta.Format, key []byte) (string, error) {
+	ring, err := keyRing(format)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := ring.Encrypt(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openCacheKey(format *meta.Format) ([]byte, error) {
+	ring, err := keyRing(format)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := base64.StdEncoding.DecodeString(format.EncryptCacheKey)
+	if err != nil {
+		return nil, err
+	}
+	return ring.Decrypt(buf)
+}
+
 func initBackgroundTasks(c *cli.Context, vfsConf *vfs.Config, metaConf *meta.Config, m meta.Meta, blob object.ObjectStorage, registerer prometheus.Registerer, registry *prometheus.Registry) {
 	metricsAddr := exposeMetrics(c, m, registerer, registry)
 	if c.IsSet("consul") {
@@ -353,6 +596,12 @@ func initBackgroundTasks(c *cli.Context, vfsConf *vfs.Config, metaConf *meta.Con
 	if !metaConf.ReadOnly && !metaConf.NoBGJob && vfsConf.BackupMeta > 0 {
 		go vfs.Backup(m, blob, vfsConf.BackupMeta)
 	}
+	if !metaConf.ReadOnly && !metaConf.NoBGJob && vfsConf.Format.ReplicaBucket != "" {
+		go vfs.Reconcile(m, blob, time.Hour)
+	}
+	if !metaConf.ReadOnly && !metaConf.NoBGJob && vfsConf.Chunk.TierStorage != nil {
+		go vfs.MoveCold(m, blob, vfsConf.Chunk.TierStorage, time.Hour)
+	}
 	if !c.Bool("no-usage-report") {
 		go usage.ReportUsage(m, version.Version())
 	}
@@ -362,6 +611,53 @@ type storageHolder struct {
 	object.ObjectStorage
 }
 
+func (h *storageHolder) Reconcile(prefix string, before time.Time) (int, error) {
+	if r, ok := h.ObjectStorage.(object.SupportReconcile); ok {
+		return r.Reconcile(prefix, before)
+	}
+	return 0, syscall.ENOTSUP
+}
+
+func (h *storageHolder) Restore(key string) error {
+	if r, ok := h.ObjectStorage.(object.SupportRestore); ok {
+		return r.Restore(key)
+	}
+	return syscall.ENOTSUP
+}
+
+// keysChanged tells whether the encrypt keys of volume are changed, then the storages should be created
+// again to read the objects sealed with the added keys, and seal new ones with the active key.
+func keysChanged(old, new *meta.Format) bool {
+	return new.EncryptKey != old.EncryptKey || new.EncryptKeyID != old.EncryptKeyID || !reflect.DeepEqual(new.EncryptKeys, old.EncryptKeys)
+}
+
+// newReloadableTier creates the tier storage again after its configuration or encrypt keys are changed.
+func newReloadableTier(tier object.ObjectStorage, format *meta.Format, reload func() (*meta.Format, error)) object.ObjectStorage {
+	holder := &storageHolder{tier}
+	go func() {
+		old := *format
+		for {
+			time.Sleep(time.Minute)
+			new, err := reload()
+			if err != nil {
+				logger.Warnf("reload config: %s", err)
+				continue
+			}
+			if new.TierStorage != old.TierStorage || new.TierBucket != old.TierBucket || new.TierAccessKey != old.TierAccessKey ||
+				new.TierSecretKey != old.TierSecretKey || keysChanged(&old, new) {
+				newTier, err := NewTierStorage(*new)
+				if err != nil || newTier == nil {
+					logger.Warnf("tier storage: %v", err)
+					continue
+				}
+				holder.ObjectStorage = newTier
+				old = *new
+			}
+		}
+	}()
+	return holder
+}
+
 func NewReloadableStorage(format *meta.Format, reload func() (*meta.Format, error)) (object.ObjectStorage, error) {
 	blob, err := createStorage(*format)
 	if err != nil {
@@ -377,7 +673,9 @@ func NewReloadableStorage(format *meta.Format, reload func() (*meta.Format, erro
 				logger.Warnf("reload config: %s", err)
 				continue
 			}
-			if new.Storage != old.Storage || new.Bucket != old.Bucket || new.AccessKey != old.AccessKey || new.SecretKey != old.SecretKey || new.SessionToken != old.SessionToken {
+			if new.Storage != old.Storage || new.Bucket != old.Bucket || new.AccessKey != old.AccessKey || new.SecretKey != old.SecretKey || new.SessionToken != old.SessionToken ||
+				new.ReplicaStorage != old.ReplicaStorage || new.ReplicaBucket != old.ReplicaBucket || new.ReplicaAccessKey != old.ReplicaAccessKey ||
+				new.ReplicaSecretKey != old.ReplicaSecretKey || new.ReplicaMode != old.ReplicaMode || keysChanged(&old, new) {
 				logger.Infof("found new configuration: storage=%s bucket=%s ak=%s", new.Storage, new.Bucket, new.AccessKey)
 				newBlob, err := createStorage(*new)
 				if err != nil {
@@ -422,6 +720,16 @@ func mount(c *cli.Context) error {
 	logger.Infof("Data use %s", blob)
 
 	chunkConf := getChunkConf(c, format)
+	setMetaHooks(c, chunkConf, format, metaCli)
+	if chunkConf.TierStorage, err = NewTierStorage(*format); err != nil {
+		return fmt.Errorf("tier storage: %s", err)
+	} else if chunkConf.TierStorage != nil {
+		logger.Infof("Cold data use %s", chunkConf.TierStorage)
+		chunkConf.TierStorage = newReloadableTier(chunkConf.TierStorage, format, func() (*meta.Format, error) {
+			return getFormat(c, metaCli)
+		})
+		chunkConf.Tiers = sliceTiers(metaCli)
+	}
 	store := chunk.NewCachedStore(blob, *chunkConf, registerer)
 	registerMetaMsg(metaCli, store, chunkConf)
 
@@ -913,6 +913,48 @@ func functionalTesting(blob object.ObjectStorage, result *[][]string, tty bool)
 		return utils.ENOTSUP
 	})
 
+	runCase("server-side encryption", func(blob object.ObjectStorage) error {
+		s, ok := blob.(object.SupportSSE)
+		if !ok {
+			return utils.ENOTSUP
+		}
+		br := []byte("hello")
+		if err := blob.Put(key, bytes.NewReader(br)); err != nil {
+			return fmt.Errorf("put object failed: %s", err)
+		}
+		defer blob.Delete(key) //nolint:errcheck
+		if err := s.CheckSSE(key); err != nil {
+			return err
+		}
+		if d, err := get(blob, key, 0, -1); d != string(br) {
+			return fmt.Errorf("expect hello, but got %v, error: %s", d, err)
+		}
+
+		mkey := "multi_sse_test_file"
+		upload, err := blob.CreateMultipartUpload(mkey)
+		if err == utils.ENOTSUP {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("create multipart upload failed: %s", err)
+		}
+		defer blob.Delete(mkey) //nolint:errcheck
+		part, err := blob.UploadPart(mkey, upload.UploadID, 1, br)
+		if err != nil {
+			blob.AbortUpload(mkey, upload.UploadID)
+			return fmt.Errorf("upload part failed: %s", err)
+		}
+		if err = blob.CompleteUpload(mkey, upload.UploadID, []*object.Part{part}); err != nil {
+			return fmt.Errorf("complete multipart upload failed: %s", err)
+		}
+		if err = s.CheckSSE(mkey); err != nil {
+			return err
+		}
+		if d, err := get(blob, mkey, 0, -1); d != string(br) {
+			return fmt.Errorf("expect hello, but got %v, error: %s", d, err)
+		}
+		return nil
+	})
+
 	funFSCase("change owner/group", func() error {
 		if strings.HasPrefix(blob.String(), "file://") && os.Getuid() != 0 {
 			return errors.New("root required")
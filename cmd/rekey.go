@@ -0,0 +1,189 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/juicedata/juicefs/pkg/utils"
+
+	"github.com/urfave/cli/v2"
+)
+
+func cmdRekey() *cli.Command {
+	return &cli.Command{
+		Name:      "rekey",
+		Action:    rekey,
+		Category:  "ADMIN",
+		Usage:     "Re-wrap the data keys of all objects with the active encrypt key",
+		ArgsUsage: "META-URL",
+		Description: `
+It re-wraps the data key of every object with the active private key (see "juicefs config --encrypt-key-id"),
+so the other keys can be removed from the volume afterwards. Only the header is rewritten for objects which
+have the id of key in it, the ones written before rotation is enabled are encrypted again. Objects wrapped
+with the active key are skipped, so it's safe to run it again after interrupted. Objects deleted during
+rekey are not brought back. At last, the key to encrypt local cache is sealed with the active key too.
+
+Examples:
+$ juicefs rekey redis://localhost`,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:    "threads",
+				Aliases: []string{"p"},
+				Value:   10,
+				Usage:   "number of concurrent threads",
+			},
+		},
+	}
+}
+
+func rekey(ctx *cli.Context) error {
+	setup(ctx, 1)
+	removePassword(ctx.Args().Get(0))
+	threads := ctx.Int("threads")
+	if threads <= 0 {
+		logger.Fatalf("threads should be greater than 0")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load(true)
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	if !isEncrypted(format) {
+		logger.Fatalf("encryption is not enabled for volume %s", format.Name)
+	}
+	blob, err := createStorage(*format)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	tier, err := NewTierStorage(*format)
+	if err != nil {
+		logger.Fatalf("tier storage: %s", err)
+	}
+
+	progress := utils.NewProgress(false, true)
+	bar := progress.AddCountSpinner("Scanned objects")
+	rekeyed := progress.AddDoubleSpinner("Rekeyed objects")
+	skipped := progress.AddDoubleSpinner("Archived objects")
+	failed := progress.AddDoubleSpinner("Failed objects")
+	for _, store := range []object.ObjectStorage{blob, tier} {
+		if store == nil {
+			continue
+		}
+		store = object.WithPrefix(store, "chunks/")
+		objs, err := osync.ListAll(store, "", "")
+		if err != nil {
+			logger.Fatalf("list all blocks in %s: %s", store, err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < threads; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for obj := range objs {
+					if obj == nil {
+						logger.Errorf("list all blocks in %s failed", store)
+						failed.IncrInt64(0)
+						continue
+					}
+					if obj.IsDir() {
+						continue
+					}
+					done, err := store.(object.SupportRekey).Rekey(obj.Key())
+					switch {
+					case errors.Is(err, object.ErrNotRestored):
+						skipped.IncrInt64(obj.Size())
+					case err != nil:
+						logger.Errorf("rekey %s: %s", obj.Key(), err)
+						failed.IncrInt64(obj.Size())
+					case done:
+						rekeyed.IncrInt64(obj.Size())
+					}
+					bar.Increment()
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	progress.Done()
+
+	rc, rb := rekeyed.Current()
+	sc, sb := skipped.Current()
+	fc, fb := failed.Current()
+	logger.Infof("scanned %d objects, %d rekeyed (%d bytes), %d archived (%d bytes), %d failed (%d bytes)",
+		bar.Current(), rc, rb, sc, sb, fc, fb)
+	if sc > 0 {
+		logger.Warnf("archived objects are skipped, please run it again after restoring them")
+	}
+	if fc > 0 {
+		return fmt.Errorf("failed to rekey %d objects", fc)
+	}
+	if sealed, err := rekeyCacheKey(format); err != nil {
+		return fmt.Errorf("rekey the key of local cache: %s", err)
+	} else if sealed {
+		if err = m.Init(*format, false); err != nil {
+			return fmt.Errorf("save the key of local cache: %s", err)
+		}
+		logger.Infof("the key of local cache is sealed with encrypt key %d", format.EncryptKeyID)
+	}
+	return nil
+}
+
+// rekeyCacheKey seals the key of local cache with the active key, it returns false if it's sealed
+// with the active key already. The key derived from the first RSA key is sealed as it is, so the
+// blocks in local cache can still be read.
+func rekeyCacheKey(format *meta.Format) (bool, error) {
+	f := *format
+	if err := f.Decrypt(); err != nil {
+		return false, err
+	}
+	if f.EncryptCacheKey == "" {
+		if !isRSAKey(f.EncryptKey) {
+			return false, nil
+		}
+		key, err := derivedCacheKey(&f)
+		if err != nil {
+			return false, err
+		}
+		if format.EncryptCacheKey, err = sealKey(&f, key); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	ring, err := keyRing(&f)
+	if err != nil {
+		return false, err
+	}
+	old, err := base64.StdEncoding.DecodeString(f.EncryptCacheKey)
+	if err != nil {
+		return false, err
+	}
+	sealed, err := object.Rewrap(ring, old)
+	if err != nil || bytes.Equal(sealed, old) {
+		return false, err
+	}
+	format.EncryptCacheKey = base64.StdEncoding.EncodeToString(sealed)
+	return true, nil
+}
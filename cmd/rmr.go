@@ -101,7 +101,7 @@ func rmr(ctx *cli.Context) error {
 		}
 		if errno := readProgress(f, func(count, bytes uint64) {
 			spin.SetCurrent(int64(count))
-		}); errno != 0 {
+		}, nil); errno != 0 {
 			logger.Fatalf("RMR %s: %s", path, errno)
 		}
 		_ = f.Close()
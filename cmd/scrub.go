@@ -0,0 +1,402 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+
+	"github.com/urfave/cli/v2"
+)
+
+func cmdScrub() *cli.Command {
+	return &cli.Command{
+		Name:      "scrub",
+		Action:    scrub,
+		Category:  "ADMIN",
+		Usage:     "Verify the stored data of files by reading it from object storage",
+		ArgsUsage: "META-URL [PATH]",
+		Description: `
+It reads the blocks of all files under PATH (default: /) straight from object storage, bypassing any
+cache, and checks that they can be decrypted and decompressed into the expected size and match the
+checksums in metadata. Files are scanned in the order of inode number, the progress can be saved into a
+checkpoint file to resume the scrubbing later.
+
+Examples:
+$ juicefs scrub redis://localhost
+
+# Check 1% of the blocks under /data at 100 Mbps, and write the broken files into a report
+$ juicefs scrub redis://localhost /data --sample 0.01 --bwlimit 100 --report scrub.txt
+
+# Save the progress every minute and resume from it if it exists
+$ juicefs scrub redis://localhost --checkpoint scrub.ckpt`,
+		Flags: []cli.Flag{
+			&cli.Float64Flag{
+				Name:  "sample",
+				Value: 1,
+				Usage: "ratio of blocks to check (0 to 1)",
+			},
+			&cli.IntFlag{
+				Name:  "bwlimit",
+				Usage: "limit bandwidth in Mbps (0 means unlimited)",
+			},
+			&cli.IntFlag{
+				Name:    "threads",
+				Aliases: []string{"p"},
+				Value:   10,
+				Usage:   "number of concurrent threads",
+			},
+			&cli.StringFlag{
+				Name:  "report",
+				Usage: "file to write the broken files into (default: print them at the end)",
+			},
+			&cli.StringFlag{
+				Name:  "checkpoint",
+				Usage: "file to save the progress into, and to resume from if it exists",
+			},
+		},
+	}
+}
+
+// scrubCheckpoint is the progress of a scrubbing, all files with smaller inode number are checked.
+type scrubCheckpoint struct {
+	Path         string    `json:"path"`
+	Inode        meta.Ino  `json:"inode"`
+	Files        int64     `json:"files"`
+	Blocks       int64     `json:"blocks"`
+	Bytes        int64     `json:"bytes"`
+	BrokenBlocks int64     `json:"brokenBlocks"`
+	BrokenBytes  int64     `json:"brokenBytes"`
+	Archived     int64     `json:"archived"`
+	ArchivedSize int64     `json:"archivedSize"`
+	Started      time.Time `json:"started"`
+}
+
+func loadScrubCheckpoint(fpath, dir string) *scrubCheckpoint {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Fatalf("read checkpoint %s: %s", fpath, err)
+		}
+		return nil
+	}
+	var ckpt scrubCheckpoint
+	if err = json.Unmarshal(data, &ckpt); err != nil {
+		logger.Fatalf("parse checkpoint %s: %s", fpath, err)
+	}
+	if ckpt.Path != dir {
+		logger.Warnf("Checkpoint %s is for path %s, start over", fpath, ckpt.Path)
+		return nil
+	}
+	return &ckpt
+}
+
+func saveScrubCheckpoint(fpath string, ckpt *scrubCheckpoint) error {
+	data, err := json.Marshal(ckpt)
+	if err != nil {
+		return err
+	}
+	tmp := fpath + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
+
+// scrubFiles finds the inodes of all files under a directory, hard links are counted once.
+func scrubFiles(m meta.Meta, inode meta.Ino, files map[meta.Ino]bool) syscall.Errno {
+	var entries []*meta.Entry
+	if st := m.Readdir(meta.Background, inode, 1, &entries); st != 0 {
+		return st
+	}
+	for _, e := range entries {
+		if name := string(e.Name); name == "." || name == ".." {
+			continue
+		}
+		switch e.Attr.Typ {
+		case meta.TypeDirectory:
+			if st := scrubFiles(m, e.Inode, files); st != 0 && st != syscall.ENOENT {
+				return st
+			}
+		case meta.TypeFile:
+			files[e.Inode] = true
+		}
+	}
+	return 0
+}
+
+func scrub(ctx *cli.Context) error {
+	setup(ctx, 1)
+	removePassword(ctx.Args().Get(0))
+	sample := ctx.Float64("sample")
+	if sample <= 0 || sample > 1 {
+		logger.Fatalf("sample should be in (0, 1]: %f", sample)
+	}
+	threads := ctx.Int("threads")
+	if threads <= 0 {
+		logger.Fatalf("threads should be greater than 0")
+	}
+	rand.Seed(time.Now().UnixNano())
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, ReadOnly: true})
+	format, err := m.Load(true)
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+
+	chunkConf := chunk.Config{
+		BlockSize:         format.BlockSize * 1024,
+		Compress:          format.Compression,
+		CompressThreshold: format.CompressThreshold,
+		BlockHeader:       format.BlockHeader,
+		GetTimeout:        time.Second * 60,
+		PutTimeout:        time.Second * 60,
+		MaxUpload:         20,
+		BufferSize:        300 << 20,
+		CacheDir:          "memory",
+		HashPrefix:        format.HashPrefix,
+		DownloadLimit:     int64(ctx.Int("bwlimit")) * 1e6 / 8,
+		Checksums:         blockChecksums(m),
+		InlineSize:        format.InlineSize * 1024,
+	}
+	if format.HasPacks() {
+		chunkConf.Packs = slicePacks(m)
+	}
+	if format.HasInlines() {
+		chunkConf.Inlines = sliceInlines(m)
+	}
+	if format.Dedup {
+		chunkConf.Hashes = blockHashes(m)
+	}
+	blob, err := createStorage(*format)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	tier, err := NewTierStorage(*format)
+	if err != nil {
+		logger.Fatalf("tier storage: %s", err)
+	}
+	if tier != nil {
+		chunkConf.TierStorage = tier
+		chunkConf.Tiers = sliceTiers(m)
+	}
+	store := chunk.NewCachedStore(blob, chunkConf, nil)
+
+	dir := path.Clean("/" + ctx.Args().Get(1))
+	root := meta.RootInode
+	attr := meta.Attr{Typ: meta.TypeDirectory}
+	for _, name := range strings.Split(dir, "/") {
+		if name == "" {
+			continue
+		}
+		if st := m.Lookup(meta.Background, root, name, &root, &attr); st != 0 {
+			logger.Fatalf("lookup %s: %s", dir, st)
+		}
+	}
+
+	fpath := ctx.String("checkpoint")
+	var ckpt *scrubCheckpoint
+	if fpath != "" {
+		ckpt = loadScrubCheckpoint(fpath, dir)
+	}
+	resumed := ckpt != nil
+	if resumed {
+		logger.Infof("Resume scrubbing %s from inode %d, started at %s", dir, ckpt.Inode, ckpt.Started.Format(time.RFC3339))
+	} else {
+		ckpt = &scrubCheckpoint{Path: dir, Started: time.Now()}
+	}
+
+	var report io.Writer
+	if r := ctx.String("report"); r != "" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if !resumed {
+			flags |= os.O_TRUNC
+		}
+		f, err := os.OpenFile(r, flags, 0644)
+		if err != nil {
+			logger.Fatalf("open report %s: %s", r, err)
+		}
+		defer f.Close()
+		report = f
+	}
+
+	found := make(map[meta.Ino]bool)
+	if attr.Typ == meta.TypeFile {
+		found[root] = true
+	} else if st := scrubFiles(m, root, found); st != 0 {
+		logger.Fatalf("list files under %s: %s", dir, st)
+	}
+	var files []meta.Ino
+	for inode := range found {
+		if inode > ckpt.Inode {
+			files = append(files, inode)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i] < files[j] })
+
+	progress := utils.NewProgress(false, true)
+	fileBar := progress.AddCountBar("Scanned files", ckpt.Files+int64(len(files)))
+	fileBar.SetCurrent(ckpt.Files)
+	blockDSpin := progress.AddDoubleSpinner("Scrubbed blocks")
+	blockDSpin.SetCurrent(ckpt.Blocks, ckpt.Bytes)
+	skippedDSpin := progress.AddDoubleSpinner("Archived blocks")
+	skippedDSpin.SetCurrent(ckpt.Archived, ckpt.ArchivedSize)
+	brokenDSpin := progress.AddDoubleSpinner("Broken blocks")
+	brokenDSpin.SetCurrent(ckpt.BrokenBlocks, ckpt.BrokenBytes)
+
+	var mu sync.Mutex
+	seen := make(map[uint64]bool) // slices shared by multiple files are checked only once
+	brokens := make(map[meta.Ino]string)
+	broken := func(inode meta.Ino, key string, size int, err error) {
+		brokenDSpin.IncrInt64(int64(size))
+		mu.Lock()
+		defer mu.Unlock()
+		p, ok := brokens[inode]
+		if !ok {
+			if ps := meta.GetPaths(m, meta.Background, inode); len(ps) > 0 {
+				p = ps[0]
+			} else {
+				p = fmt.Sprintf("inode:%d", inode)
+			}
+			brokens[inode] = p
+		}
+		logger.Errorf("broken block %s of file %s: %s", key, p, err)
+		if report != nil {
+			if _, err := fmt.Fprintf(report, "%d\t%s\t%s\t%s\n", inode, p, key, err); err != nil {
+				logger.Fatalf("write report: %s", err)
+			}
+		}
+	}
+	scrubFile := func(inode meta.Ino) {
+		var attr meta.Attr
+		if st := m.GetAttr(meta.Background, inode, &attr); st != 0 {
+			if st != syscall.ENOENT {
+				logger.Warnf("getattr of inode %d: %s", inode, st)
+			}
+			return
+		}
+		for indx := uint32(0); uint64(indx)*meta.ChunkSize < attr.Length; indx++ {
+			var slices []meta.Slice
+			if st := m.Read(meta.Background, inode, indx, &slices); st != 0 {
+				logger.Warnf("read chunk %d of inode %d: %s", indx, inode, st)
+				return
+			}
+			for _, s := range slices {
+				mu.Lock()
+				checked := s.Chunkid == 0 || seen[s.Chunkid]
+				seen[s.Chunkid] = true
+				mu.Unlock()
+				if checked {
+					continue
+				}
+				for off := 0; off < int(s.Size); off += chunkConf.BlockSize {
+					if sample < 1 && rand.Float64() >= sample {
+						continue
+					}
+					size := utils.Min(chunkConf.BlockSize, int(s.Size)-off)
+					key := chunk.BlockKey(s.Chunkid, off/chunkConf.BlockSize, size, format.HashPrefix)
+					_, err := store.ScrubBlock(key)
+					if errors.Is(err, object.ErrNotRestored) {
+						skippedDSpin.IncrInt64(int64(size))
+						continue
+					}
+					blockDSpin.IncrInt64(int64(size))
+					if err != nil {
+						broken(inode, key, size, err)
+					}
+				}
+			}
+		}
+	}
+
+	const batch = 1000
+	lastSaved := time.Now()
+	for len(files) > 0 {
+		n := utils.Min(batch, len(files))
+		todo := make(chan meta.Ino, n)
+		for _, inode := range files[:n] {
+			todo <- inode
+		}
+		close(todo)
+		var wg sync.WaitGroup
+		for i := 0; i < threads; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for inode := range todo {
+					scrubFile(inode)
+					fileBar.Increment()
+				}
+			}()
+		}
+		wg.Wait()
+		ckpt.Inode = files[n-1]
+		files = files[n:]
+		if fpath != "" && (len(files) == 0 || time.Since(lastSaved) > time.Minute) {
+			ckpt.Files = fileBar.Current()
+			ckpt.Blocks, ckpt.Bytes = blockDSpin.Current()
+			ckpt.Archived, ckpt.ArchivedSize = skippedDSpin.Current()
+			ckpt.BrokenBlocks, ckpt.BrokenBytes = brokenDSpin.Current()
+			if err = saveScrubCheckpoint(fpath, ckpt); err != nil {
+				logger.Errorf("save checkpoint %s: %s", fpath, err)
+			}
+			lastSaved = time.Now()
+		}
+	}
+	progress.Done()
+	bc, bb := blockDSpin.Current()
+	sc, sb := skippedDSpin.Current()
+	logger.Infof("Scrubbed %d files under %s: %d blocks (%d bytes), skipped %d archived blocks (%d bytes), used %s",
+		fileBar.Current(), dir, bc, bb, sc, sb, time.Since(ckpt.Started))
+	if fpath != "" {
+		if err = os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("remove checkpoint %s: %s", fpath, err)
+		}
+	}
+	if c, b := brokenDSpin.Current(); c > 0 {
+		msg := fmt.Sprintf("%d blocks are broken (%d bytes)", c, b)
+		if report != nil {
+			logger.Fatalf("%s, see %s for the broken files", msg, ctx.String("report"))
+		}
+		msg += fmt.Sprintf(", %d broken files:\n", len(brokens))
+		msg += fmt.Sprintf("%13s: PATH\n", "INODE")
+		var fileList []string
+		for i, p := range brokens {
+			fileList = append(fileList, fmt.Sprintf("%13d: %s", i, p))
+		}
+		sort.Strings(fileList)
+		msg += strings.Join(fileList, "\n")
+		logger.Fatal(msg)
+	}
+	return nil
+}
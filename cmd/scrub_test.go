@@ -0,0 +1,50 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	mountTemp(t, nil, true)
+	defer umountTemp(t)
+
+	if err := os.MkdirAll(testMountPoint+"/d", 0755); err != nil {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		filename := fmt.Sprintf("%s/d/f%d.txt", testMountPoint, i)
+		if err := os.WriteFile(filename, []byte("test"), 0644); err != nil {
+			t.Fatalf("write file failed: %s", err)
+		}
+	}
+	report := filepath.Join(t.TempDir(), "report")
+	ckpt := filepath.Join(t.TempDir(), "checkpoint")
+	if err := Main([]string{"", "scrub", testMeta, "/d", "--report", report, "--checkpoint", ckpt}); err != nil {
+		t.Fatalf("scrub failed: %s", err)
+	}
+	if data, err := os.ReadFile(report); err != nil || len(data) > 0 {
+		t.Fatalf("report should be empty: %q %s", data, err)
+	}
+	if _, err := os.Stat(ckpt); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint should be removed after finished: %s", err)
+	}
+}
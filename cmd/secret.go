@@ -0,0 +1,183 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+// localRefs are the references given by flags of current command, the commands and files referred by them
+// are trusted.
+var localRefs = make(map[string]bool)
+
+func trustRef(ref string) {
+	if ref = strings.TrimSpace(ref); ref != "" {
+		localRefs[ref] = true
+	}
+}
+
+// isTrustedRef tells whether a reference is given on this host, by flags of current command or in
+// JFS_TRUSTED_REFS (one per line). The ones only read back from metadata engine are not trusted, since
+// they could be changed by anyone who can write it, to run commands on all the clients.
+func isTrustedRef(ref string) bool {
+	ref = strings.TrimSpace(ref)
+	if localRefs[ref] {
+		return true
+	}
+	for _, r := range strings.Split(os.Getenv("JFS_TRUSTED_REFS"), "\n") {
+		if r = strings.TrimSpace(r); r != "" && r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// trustSecretFlags trusts the references of secrets given by flags of current command.
+func trustSecretFlags(c *cli.Context, flags ...string) {
+	for _, flag := range flags {
+		if c.IsSet(flag) {
+			trustRef(c.String(flag))
+		}
+	}
+}
+
+// resolveSecret returns the secret referred by value, so only the reference is stored in metadata engine:
+//
+//	env://NAME                     the environment variable NAME
+//	file:///PATH                   content of the file, with the trailing spaces trimmed
+//	exec:COMMAND [ARGS...]         output of the command, with the trailing spaces trimmed, only if it's trusted
+//	vault://HOST:PORT/PATH#FIELD   a field of the secret in Vault (vault+https for TLS), authenticated by VAULT_TOKEN
+//
+// Other values are the secrets themselves.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env://"):
+		name := strings.TrimPrefix(value, "env://")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file://"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file://"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), " \r\n"), nil
+	case strings.HasPrefix(value, "exec:"):
+		if !isTrustedRef(value) {
+			return "", fmt.Errorf("%s is not given on this host, add it into JFS_TRUSTED_REFS to run it", value)
+		}
+		args := strings.Fields(strings.TrimPrefix(value, "exec:"))
+		if len(args) == 0 {
+			return "", fmt.Errorf("command is empty")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimRight(string(out), " \r\n"), nil
+	case strings.HasPrefix(value, "vault://") || strings.HasPrefix(value, "vault+http://") || strings.HasPrefix(value, "vault+https://"):
+		return vaultSecret(value)
+	}
+	return value, nil
+}
+
+// vaultSecret reads a field of the secret from KV secrets engine (version 1 or 2) of Vault.
+func vaultSecret(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" || u.Fragment == "" {
+		return "", fmt.Errorf("invalid vault secret %s, expect vault://HOST:PORT/PATH#FIELD", uri)
+	}
+	scheme := "http"
+	if u.Scheme == "vault+https" {
+		scheme = "https"
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/v1/%s", scheme, u.Host, strings.Trim(u.Path, "/")), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := (&http.Client{Timeout: time.Second * 30}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("read %s: status %d", u.Path, resp.StatusCode)
+	}
+	var body struct {
+		Data map[string]interface{}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("read %s: %s", u.Path, err)
+	}
+	data := body.Data
+	if d, ok := data["data"].(map[string]interface{}); ok {
+		data = d // KV version 2
+	}
+	v, ok := data[u.Fragment].(string)
+	if !ok {
+		return "", fmt.Errorf("field %s is not found in %s", u.Fragment, u.Path)
+	}
+	return v, nil
+}
+
+// resolveSecrets replaces the references of credentials in format with the secrets, it should be called
+// after the format is decrypted.
+func resolveSecrets(format *meta.Format) error {
+	for name, v := range map[string]*string{
+		"access key":         &format.AccessKey,
+		"secret key":         &format.SecretKey,
+		"session token":      &format.SessionToken,
+		"replica access key": &format.ReplicaAccessKey,
+		"replica secret key": &format.ReplicaSecretKey,
+		"tier access key":    &format.TierAccessKey,
+		"tier secret key":    &format.TierSecretKey,
+	} {
+		s, err := resolveSecret(*v)
+		if err != nil {
+			return fmt.Errorf("resolve %s: %s", name, err)
+		}
+		*v = s
+	}
+	return nil
+}
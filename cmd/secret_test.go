@@ -0,0 +1,93 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" || r.URL.Path != "/v1/secret/data/jfs" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"data":{"sk":"vault-secret"}}}`))
+	}))
+	defer srv.Close()
+	t.Setenv("VAULT_TOKEN", "token")
+	t.Setenv("JFS_TRUSTED_REFS", "exec:echo exec-access")
+	t.Setenv("JFS_TEST_AK", "env-access")
+	path := filepath.Join(t.TempDir(), "token")
+	_ = os.WriteFile(path, []byte("file-token\n"), 0600)
+
+	format := meta.Format{
+		AccessKey:        "env://JFS_TEST_AK",
+		SecretKey:        "vault://" + strings.TrimPrefix(srv.URL, "http://") + "/secret/data/jfs#sk",
+		SessionToken:     "file://" + path,
+		ReplicaAccessKey: "exec:echo exec-access",
+		ReplicaSecretKey: "plain",
+	}
+	if err := resolveSecrets(&format); err != nil {
+		t.Fatalf("resolve secrets: %s", err)
+	}
+	if format.AccessKey != "env-access" || format.SecretKey != "vault-secret" || format.SessionToken != "file-token" ||
+		format.ReplicaAccessKey != "exec-access" || format.ReplicaSecretKey != "plain" {
+		t.Fatalf("unexpected secrets: %+v", format)
+	}
+
+	for _, ref := range []string{"env://JFS_TEST_NOT_SET", "file:///not/exist", "exec:false", "exec:echo untrusted", "vault://" + strings.TrimPrefix(srv.URL, "http://") + "/secret/data/jfs#ak"} {
+		if _, err := resolveSecret(ref); err == nil {
+			t.Fatalf("resolve %s should fail", ref)
+		}
+	}
+}
+
+func TestTrustedSecret(t *testing.T) {
+	if _, err := resolveSecret("exec:echo local"); err == nil {
+		t.Fatalf("command of secret read from metadata engine should not be run")
+	}
+	trustRef("exec:echo local")
+	defer delete(localRefs, "exec:echo local")
+	if s, err := resolveSecret("exec:echo local"); err != nil || s != "local" {
+		t.Fatalf("resolve trusted secret: %q %v", s, err)
+	}
+}
+
+func TestKeyEncryptor(t *testing.T) {
+	for _, key := range []string{"", "not a key", "http://127.0.0.1/key", "exec:echo"} {
+		if _, err := keyEncryptor(key); err == nil {
+			t.Fatalf("key %q should be rejected", key)
+		}
+	}
+	trustRef("exec:echo")
+	defer delete(localRefs, "exec:echo")
+	if _, err := keyEncryptor("exec:echo"); err != nil {
+		t.Fatalf("trusted key provider: %s", err)
+	}
+	t.Setenv("JFS_TRUSTED_REFS", "exec:kms get\nexec:cat")
+	if _, err := keyEncryptor("exec:cat"); err != nil {
+		t.Fatalf("key provider in JFS_TRUSTED_REFS: %s", err)
+	}
+}
@@ -19,8 +19,14 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/urfave/cli/v2"
 )
 
@@ -37,14 +43,41 @@ S3-gateway and WebDAV) that are connected with the metadata engine.
 
 NOTE: Read-only session is not listed since it cannot register itself in the metadata.
 
+With --pending, it lists the blocks in local staging directories (written in writeback mode) that are
+not uploaded yet, with the files they belong to. The blocks whose slices are not referenced by any file
+(including the files in trash) are marked as deleted, they will never be read again.
+
 Examples:
-$ juicefs status redis://localhost`,
+$ juicefs status redis://localhost
+
+# Show the blocks waiting to be uploaded in local staging directories
+$ juicefs status redis://localhost --pending --cache-dir /var/jfsCache
+
+# Upload the pending blocks and drop the deleted ones (the client using the cache directory should be stopped)
+$ juicefs status redis://localhost --pending --flush`,
 		Flags: []cli.Flag{
 			&cli.Uint64Flag{
 				Name:    "session",
 				Aliases: []string{"s"},
 				Usage:   "show detailed information (sustained inodes, locks) of the specified session (sid)",
 			},
+			&cli.BoolFlag{
+				Name:  "pending",
+				Usage: "show blocks in local staging directories that are not uploaded yet",
+			},
+			&cli.StringFlag{
+				Name:  "cache-dir",
+				Value: getDefaultCacheDir(),
+				Usage: "directory paths of local cache used by the client, use colon to separate multiple paths",
+			},
+			&cli.BoolFlag{
+				Name:  "encrypt-cache",
+				Usage: "the local cache is encrypted (--encrypt-cache used by the client)",
+			},
+			&cli.BoolFlag{
+				Name:  "flush",
+				Usage: "upload the pending blocks and drop the deleted ones (refused if the cache directory is used by a running client)",
+			},
 		},
 	}
 }
@@ -70,6 +103,9 @@ func status(ctx *cli.Context) error {
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
 	}
+	if ctx.Bool("pending") {
+		return pending(ctx, m, format)
+	}
 	format.RemoveSecret()
 
 	if sid := ctx.Uint64("session"); sid != 0 {
@@ -89,3 +125,101 @@ func status(ctx *cli.Context) error {
 	printJson(&sections{format, sessions})
 	return nil
 }
+
+type pendingBlock struct {
+	*chunk.PendingBlock
+	Paths   []string `json:",omitempty"`
+	Deleted bool     `json:",omitempty"`
+}
+
+// blocks staged recently may belong to slices not committed yet
+const pendingGracePeriod = time.Minute * 10
+
+func pending(ctx *cli.Context, m meta.Meta, format *meta.Format) error {
+	ds := utils.SplitDir(ctx.String("cache-dir"))
+	for i := range ds {
+		ds[i] = filepath.Join(ds[i], format.UUID)
+	}
+	blocks, err := chunk.ListPending(strings.Join(ds, string(os.PathListSeparator)))
+	if err != nil {
+		logger.Fatalf("list pending blocks: %s", err)
+	}
+	mctx := meta.Background
+	// A staged block is still used if its slice is referenced by any file, including the ones shared by
+	// clone or copy_file_range and the ones kept in trash, the same check as gc.
+	sliceMap := make(map[meta.Ino][]meta.Slice)
+	var used map[uint64]bool
+	if st := m.ListSlices(mctx, sliceMap, false, nil); st == 0 {
+		used = make(map[uint64]bool)
+		for _, ss := range sliceMap {
+			for _, s := range ss {
+				used[s.Chunkid] = true
+			}
+		}
+	} else {
+		logger.Warnf("list slices: %s, no block is treated as deleted", st)
+	}
+	result := make([]*pendingBlock, 0, len(blocks))
+	for _, b := range blocks {
+		pb := &pendingBlock{PendingBlock: b}
+		if b.Inode != 0 {
+			var attr meta.Attr
+			if st := m.GetAttr(mctx, meta.Ino(b.Inode), &attr); st == 0 {
+				pb.Paths = meta.GetPaths(m, mctx, meta.Ino(b.Inode))
+			}
+		}
+		pb.Deleted = used != nil && b.Chunkid > 0 && !used[b.Chunkid] && time.Since(b.Staged) >= pendingGracePeriod
+		result = append(result, pb)
+	}
+	if !ctx.Bool("flush") {
+		printJson(result)
+		return nil
+	}
+
+	unlock, err := chunk.LockPending(strings.Join(ds, string(os.PathListSeparator)))
+	if err != nil {
+		logger.Fatalf("%s, umount the volume before flushing pending blocks", err)
+	}
+	defer unlock()
+	chunkConf := &chunk.Config{Compress: format.Compression, CompressThreshold: format.CompressThreshold, BlockHeader: format.BlockHeader}
+	if ctx.Bool("encrypt-cache") {
+		chunkConf.CacheKey = cacheEncryptKey(format, true)
+	}
+	blob, err := createStorage(*format)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	// blocks are uploaded as they are, the ones of deduplicated or packed volumes should be uploaded
+	// by the client which stores them in the same layout as others
+	var uploadable = !format.Dedup && format.PackSize == 0
+	if !uploadable {
+		logger.Warnf("Pending blocks can't be uploaded because deduplication or packing is enabled, mount the volume to upload them")
+	}
+	var uploaded, dropped, skipped, failed int
+	for _, b := range result {
+		if b.Deleted {
+			err = chunk.DropPending(b.PendingBlock)
+			if err == nil {
+				dropped++
+			}
+		} else if !uploadable {
+			skipped++
+			continue
+		} else {
+			err = chunk.FlushPending(blob, chunkConf, b.PendingBlock)
+			if err == nil {
+				uploaded++
+			}
+		}
+		if err != nil {
+			logger.Errorf("flush pending block %s: %s", b.Key, err)
+			failed++
+		}
+	}
+	logger.Infof("Uploaded %d blocks, dropped %d deleted blocks, skipped %d, %d failed", uploaded, dropped, skipped, failed)
+	if failed+skipped > 0 {
+		return fmt.Errorf("failed to flush %d blocks", failed+skipped)
+	}
+	return nil
+}
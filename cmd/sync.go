@@ -29,6 +29,8 @@ import (
 
 	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/sync"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
 )
 
@@ -90,10 +92,15 @@ Supported storage systems: https://juicefs.com/docs/community/how_to_setup_objec
 				Value:   10,
 				Usage:   "number of concurrent threads",
 			},
+			&cli.IntFlag{
+				Name:  "list-threads",
+				Value: 1,
+				Usage: "number of threads to list objects of storages without native listing of all objects",
+			},
 			&cli.IntFlag{
 				Name:  "http-port",
 				Value: 6070,
-				Usage: "HTTP `PORT` to listen to",
+				Usage: "HTTP `PORT` to listen to, for profiling and metrics of object storages",
 			},
 			&cli.BoolFlag{
 				Name:    "update",
@@ -161,6 +168,10 @@ Supported storage systems: https://juicefs.com/docs/community/how_to_setup_objec
 				Name:  "no-https",
 				Usage: "donot use HTTPS",
 			},
+			&cli.StringFlag{
+				Name:  "storage-class",
+				Usage: "the storage class of objects copied into destination (default: the one of bucket)",
+			},
 			&cli.BoolFlag{
 				Name:  "check-all",
 				Usage: "verify integrity of all files in source and destination",
@@ -203,7 +214,34 @@ func isFilePath(uri string) bool {
 	return !strings.Contains(uri, ":")
 }
 
+// createSyncStorage creates the storage of uri, with metrics and retries of requests.
 func createSyncStorage(uri string, conf *sync.Config) (object.ObjectStorage, error) {
+	store, err := newSyncStorage(uri, conf)
+	if err != nil {
+		return nil, err
+	}
+	name := "file"
+	if p := strings.Index(uri, "://"); p > 0 {
+		name = strings.ToLower(uri[:p])
+	} else if !isFilePath(uri) {
+		name = "sftp"
+	}
+	return object.NewInstrumented(store, name, object.DefaultRetryPolicy), nil
+}
+
+func newSyncStorage(uri string, conf *sync.Config) (object.ObjectStorage, error) {
+	if strings.HasPrefix(strings.ToLower(uri), "chaos://") {
+		// chaos://URI#OPTIONS: inject faults into the storage of URI
+		inner, opts := uri[len("chaos://"):], ""
+		if p := strings.LastIndex(inner, "#"); p >= 0 {
+			inner, opts = inner[:p], inner[p+1:]
+		}
+		store, err := newSyncStorage(inner, conf)
+		if err != nil {
+			return nil, err
+		}
+		return object.NewChaos(store, opts)
+	}
 	if !strings.Contains(uri, "://") {
 		if isFilePath(uri) {
 			absPath, err := filepath.Abs(uri)
@@ -310,6 +348,9 @@ func doSync(c *cli.Context) error {
 		logger.Warnf("The include option needs to be used with the exclude option, otherwise the result of the current sync may not match your expectations")
 	}
 	config := sync.NewConfigFromCli(c)
+	registry := prometheus.NewRegistry()
+	object.InitMetrics(prometheus.WrapRegistererWithPrefix("juicefs_", registry))
+	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 	go func() { _ = http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", config.HTTPPort), nil) }()
 
 	// Windows support `\` and `/` as its separator, Unix only use `/`
@@ -326,5 +367,8 @@ func doSync(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if err = setStorageClass(dst, config.StorageClass); err != nil {
+		return err
+	}
 	return sync.Sync(src, dst, config)
 }
@@ -30,6 +30,7 @@ import (
 
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
 	"github.com/urfave/cli/v2"
 )
 
@@ -53,7 +54,22 @@ $ cat /tmp/filelist
 /mnt/jfs/datadir/f1
 /mnt/jfs/datadir/f2
 /mnt/jfs/datadir/f3
-$ juicefs warmup -f /tmp/filelist`,
+$ juicefs warmup -f /tmp/filelist
+
+# Warm and pin all files in datadir, so they won't be evicted from cache
+$ juicefs warmup --pin /mnt/jfs/datadir
+
+# Unpin them, they can be evicted as normal cache again
+$ juicefs warmup --unpin /mnt/jfs/datadir
+
+# Check how much data of datadir is cached locally
+$ juicefs warmup --check /mnt/jfs/datadir
+
+# Evict the cached blocks of datadir from local cache, pinned blocks are kept
+$ juicefs warmup --evict /mnt/jfs/datadir
+
+# Evict the cached blocks of datadir including the pinned ones
+$ juicefs warmup --evict --unpin /mnt/jfs/datadir`,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:    "file",
@@ -71,6 +87,22 @@ $ juicefs warmup -f /tmp/filelist`,
 				Aliases: []string{"b"},
 				Usage:   "run in background",
 			},
+			&cli.BoolFlag{
+				Name:  "pin",
+				Usage: "pin the cached blocks so they won't be evicted (requires --pinned-cache-size on mount)",
+			},
+			&cli.BoolFlag{
+				Name:  "unpin",
+				Usage: "unpin the cached blocks so they can be evicted as normal",
+			},
+			&cli.BoolFlag{
+				Name:  "check",
+				Usage: "check how many blocks of the paths are cached locally",
+			},
+			&cli.BoolFlag{
+				Name:  "evict",
+				Usage: "evict the cached blocks of the paths from local cache, pinned blocks are kept unless --unpin is given",
+			},
 		},
 	}
 }
@@ -89,7 +121,7 @@ func readControl(cf *os.File, resp []byte) int {
 	}
 }
 
-func readProgress(cf *os.File, showProgress func(uint64, uint64)) (errno syscall.Errno) {
+func readProgress(cf *os.File, showProgress func(uint64, uint64), showResult func(uint8, uint64)) (errno syscall.Errno) {
 	var resp = make([]byte, 1024)
 END:
 	for {
@@ -101,6 +133,11 @@ END:
 			} else if off+17 <= n && resp[off] == meta.CPROGRESS {
 				showProgress(binary.BigEndian.Uint64(resp[off+1:off+9]), binary.BigEndian.Uint64(resp[off+9:off+17]))
 				off += 17
+			} else if off+9 <= n && (resp[off] == meta.CCACHED || resp[off] == meta.CFAILED) {
+				if showResult != nil {
+					showResult(resp[off], binary.BigEndian.Uint64(resp[off+1:off+9]))
+				}
+				off += 9
 			} else {
 				logger.Errorf("Bad response off %d n %d: %v", off, n, resp)
 				break
@@ -114,30 +151,37 @@ END:
 }
 
 // send fill-cache command to controller file
-func sendCommand(cf *os.File, batch []string, threads uint, background bool, dspin *utils.DoubleSpinner) {
+func sendCommand(cf *os.File, action vfs.CacheAction, batch []string, threads uint, background bool, dspin *utils.DoubleSpinner, cached, failed *uint64) {
 	paths := strings.Join(batch, "\n")
 	var back uint8
 	if background {
 		back = 1
 	}
-	wb := utils.NewBuffer(8 + 4 + 3 + uint32(len(paths)))
+	wb := utils.NewBuffer(8 + 4 + 4 + uint32(len(paths)))
 	wb.Put32(meta.FillCache)
-	wb.Put32(4 + 3 + uint32(len(paths)))
+	wb.Put32(4 + 4 + uint32(len(paths)))
 	wb.Put32(uint32(len(paths)))
 	wb.Put([]byte(paths))
 	wb.Put16(uint16(threads))
 	wb.Put8(back)
+	wb.Put8(uint8(action))
 	if _, err := cf.Write(wb.Bytes()); err != nil {
 		logger.Fatalf("Write message: %s", err)
 	}
 	if background {
-		logger.Infof("Warm-up cache for %d paths in background", len(batch))
+		logger.Infof("%s cache for %d paths in background", action, len(batch))
 		return
 	}
 	if errno := readProgress(cf, func(count, bytes uint64) {
 		dspin.SetCurrent(int64(count), int64(bytes))
+	}, func(typ uint8, n uint64) {
+		if typ == meta.CCACHED {
+			*cached += n
+		} else {
+			*failed += n
+		}
 	}); errno != 0 {
-		logger.Fatalf("Warm up failed: %s", errno)
+		logger.Fatalf("%s failed: %s", action, errno)
 	}
 }
 
@@ -201,10 +245,34 @@ func warmup(ctx *cli.Context) error {
 		threads = 1
 	}
 	background := ctx.Bool("background")
+	action := vfs.WarmupCache
+	var actions int
+	for name, act := range map[string]vfs.CacheAction{
+		"pin":   vfs.PinCache,
+		"unpin": vfs.UnpinCache,
+		"check": vfs.CheckCache,
+		"evict": vfs.EvictCache,
+	} {
+		if ctx.Bool(name) {
+			action = act
+			actions++
+		}
+	}
+	if ctx.Bool("unpin") && ctx.Bool("evict") {
+		action = vfs.UnpinEvictCache
+		actions--
+	}
+	if actions > 1 {
+		logger.Fatalf("--pin, --unpin, --check and --evict can't be used together")
+	}
+	if action == vfs.CheckCache && background {
+		logger.Fatalf("--check can't run in background")
+	}
 	start := len(mp)
 	batch := make([]string, 0, batchMax)
 	progress := utils.NewProgress(background, true)
-	dspin := progress.AddDoubleSpinner("Warming up")
+	dspin := progress.AddDoubleSpinner(fmt.Sprintf("%s cache", action))
+	var cached, failed uint64
 	for _, path := range paths {
 		if mp == "/" {
 			inode, err := utils.GetFileInode(path)
@@ -220,17 +288,37 @@ func warmup(ctx *cli.Context) error {
 			continue
 		}
 		if len(batch) >= batchMax {
-			sendCommand(controller, batch, threads, background, dspin)
+			sendCommand(controller, action, batch, threads, background, dspin, &cached, &failed)
 			batch = batch[0:]
 		}
 	}
 	if len(batch) > 0 {
-		sendCommand(controller, batch, threads, background, dspin)
+		sendCommand(controller, action, batch, threads, background, dspin, &cached, &failed)
 	}
 	progress.Done()
 	if !background {
 		count, bytes := dspin.Current()
-		logger.Infof("Successfully warmed up %d files (%d bytes)", count, bytes)
+		if failed > 0 {
+			logger.Fatalf("Failed to %s %d of %d files, check the log of the mount point for details", action, failed, count)
+		}
+		switch action {
+		case vfs.CheckCache:
+			var ratio float64
+			if bytes > 0 {
+				ratio = float64(cached) / float64(bytes) * 100
+			}
+			logger.Infof("Checked %d files: %d of %d bytes (%.1f%%) are cached locally", count, cached, bytes, ratio)
+		case vfs.EvictCache:
+			logger.Infof("Successfully evicted %d files (%d bytes), pinned blocks are kept", count, bytes)
+		case vfs.UnpinEvictCache:
+			logger.Infof("Successfully unpinned and evicted %d files (%d bytes)", count, bytes)
+		case vfs.PinCache:
+			logger.Infof("Successfully pinned %d files (%d bytes)", count, bytes)
+		case vfs.UnpinCache:
+			logger.Infof("Successfully unpinned %d files (%d bytes)", count, bytes)
+		default:
+			logger.Infof("Successfully warmed up %d files (%d bytes)", count, bytes)
+		}
 	}
 
 	return nil
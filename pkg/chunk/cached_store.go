@@ -21,6 +21,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"strconv"
@@ -40,7 +41,8 @@ const pageSize = 1 << 16  // 64K
 const SlowRequest = time.Second * time.Duration(10)
 
 var (
-	logger = utils.GetLogger("juicefs")
+	logger      = utils.GetLogger("juicefs")
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 type pendingItem struct {
@@ -67,11 +69,16 @@ func (c *rChunk) blockSize(indx int) int {
 	return bsize
 }
 
-func (c *rChunk) key(indx int) string {
-	if c.store.conf.HashPrefix {
-		return fmt.Sprintf("chunks/%02X/%v/%v_%v_%v", c.id%256, c.id/1000/1000, c.id, indx, c.blockSize(indx))
+// BlockKey returns the key of a block in a slice.
+func BlockKey(chunkid uint64, indx, size int, hashPrefix bool) string {
+	if hashPrefix {
+		return fmt.Sprintf("chunks/%02X/%v/%v_%v_%v", chunkid%256, chunkid/1000/1000, chunkid, indx, size)
 	}
-	return fmt.Sprintf("chunks/%v/%v/%v_%v_%v", c.id/1000/1000, c.id/1000, c.id, indx, c.blockSize(indx))
+	return fmt.Sprintf("chunks/%v/%v/%v_%v_%v", chunkid/1000/1000, chunkid/1000, chunkid, indx, size)
+}
+
+func (c *rChunk) key(indx int) string {
+	return BlockKey(c.id, indx, c.blockSize(indx), c.store.conf.HashPrefix)
 }
 
 func (c *rChunk) index(off int) int {
@@ -136,7 +143,7 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 				c.store.cacheReadHist.Observe(time.Since(start).Seconds())
 				return n, nil
 			}
-			if f, ok := r.(*os.File); ok {
+			if f, ok := r.(interface{ Name() string }); ok {
 				logger.Warnf("remove partial cached block %s: %d %s", f.Name(), n, err)
 				_ = os.Remove(f.Name())
 			}
@@ -146,13 +153,20 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 	c.store.cacheMiss.Add(1)
 	c.store.cacheMissBytes.Add(float64(len(p)))
 
-	if c.store.seekable && boff > 0 && len(p) <= blockSize/4 {
+	if boff > 0 && len(p) <= blockSize/4 && !c.store.isInline(key) && c.store.seekableBlock(key) {
 		if c.store.downLimit != nil {
 			c.store.downLimit.Wait(int64(len(p)))
 		}
 		// partial read
 		st := time.Now()
-		in, err := c.store.storage.Get(key, int64(boff), int64(len(p)))
+		obj, base, _, err := c.store.locate(key)
+		if !c.store.seekable {
+			base++ // skip the header of raw block
+		}
+		var in io.ReadCloser
+		if err == nil {
+			in, err = c.store.get(obj, base+int64(boff), int64(len(p)))
+		}
 		if err == nil {
 			n, err = io.ReadFull(in, p)
 			_ = in.Close()
@@ -199,7 +213,10 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 func (c *rChunk) delete(indx int) error {
 	key := c.key(indx)
 	st := time.Now()
-	err := c.store.storage.Delete(key)
+	storage, err := c.store.storageOf(key)
+	if err == nil {
+		err = storage.Delete(key)
+	}
 	used := time.Since(st)
 	logger.Debugf("DELETE %v (%v, %.3fs)", key, err, used.Seconds())
 	if used > SlowRequest {
@@ -226,6 +243,31 @@ func (c *rChunk) Remove() error {
 		c.store.removePending(key)
 		c.store.bcache.remove(key)
 	}
+	if c.store.tiers != nil {
+		c.store.tiers.forget(c.id)
+	}
+	var hashes []string
+	if c.store.hashes != nil {
+		c.store.hashes.forget(c.id)
+		var err error
+		if hashes, err = c.store.conf.Hashes(c.id); err != nil {
+			return err
+		}
+	}
+	if len(hashes) > 0 {
+		// deduplicated objects are deleted after all the references are dropped
+	} else if obj, _, _, err := c.store.locate(c.key(0)); err != nil {
+		return err
+	} else if obj != c.key(0) {
+		return nil // the shared object will be rewritten by gc
+	}
+	if c.store.isInline(c.key(0)) {
+		if data, err := c.store.conf.Inlines(c.id); err != nil {
+			return err
+		} else if data != nil {
+			return nil // no object for it
+		}
+	}
 
 	if c.store.conf.MaxDeletes == 0 {
 		return errors.New("skip deleting objects because MaxDeletes is 0")
@@ -233,6 +275,9 @@ func (c *rChunk) Remove() error {
 	var err error
 	c.store.currentDelete <- struct{}{}
 	for i := 0; i <= lastIndx; i++ {
+		if i < len(hashes) && hashes[i] != "" {
+			continue
+		}
 		if e := c.delete(i); e != nil {
 			err = e
 		}
@@ -275,6 +320,13 @@ type wChunk struct {
 	errors      chan error
 	uploadError error
 	pendings    int
+	inode       uint64 // owner of the chunk, recorded in staging journal
+	findx       uint32
+	sums        []uint32
+	packable    bool
+	packed      *Pack
+	inlinable   bool
+	inlined     []byte
 }
 
 func chunkForWrite(id uint64, store *cachedStore) *wChunk {
@@ -282,6 +334,7 @@ func chunkForWrite(id uint64, store *cachedStore) *wChunk {
 		rChunk: rChunk{id, 0, store},
 		pages:  make([][]*Page, chunkSize/store.conf.BlockSize),
 		errors: make(chan error, chunkSize/store.conf.BlockSize),
+		sums:   make([]uint32, chunkSize/store.conf.BlockSize),
 	}
 }
 
@@ -289,6 +342,19 @@ func (c *wChunk) SetID(id uint64) {
 	c.id = id
 }
 
+func (c *wChunk) SetInode(inode uint64, indx uint32) {
+	c.inode = inode
+	c.findx = indx
+}
+
+func (c *wChunk) AllowPacking() {
+	c.packable = true
+}
+
+func (c *wChunk) AllowInline() {
+	c.inlinable = true
+}
+
 func (c *wChunk) WriteAt(p []byte, off int64) (n int, err error) {
 	if int(off)+len(p) > chunkSize {
 		return 0, fmt.Errorf("write out of chunk boudary: %d > %d", int(off)+len(p), chunkSize)
@@ -373,6 +439,14 @@ func (store *cachedStore) upload(key string, block *Page, c *wChunk) error {
 		// block will be freed after written into disk
 		store.bcache.cache(key, block, false)
 	}
+	if store.conf.Dedup != nil {
+		obj, err := store.dedup(key, block.Data)
+		if err != nil || obj == "" {
+			block.Release()
+			return err
+		}
+		key = obj
+	}
 	n, err := store.compressor.Compress(buf.Data, block.Data)
 	block.Release()
 	if err != nil {
@@ -384,17 +458,26 @@ func (store *cachedStore) upload(key string, block *Page, c *wChunk) error {
 	if sync {
 		max = store.conf.MaxRetries + 1
 	}
+	var mu multipartUpload
 	for ; try < max; try++ {
 		time.Sleep(time.Second * time.Duration(try*try))
 		if c != nil && c.uploadError != nil {
 			err = fmt.Errorf("(cancelled) upload block %s: %s (after %d tries)", key, err, try)
 			break
 		}
-		if err = store.put(key, buf); err == nil {
+		if store.inParts(len(buf.Data)) {
+			err = store.putParts(key, buf, &mu)
+		} else {
+			err = store.put(key, buf)
+		}
+		if err == nil {
 			break
 		}
 		logger.Warnf("Upload %s: %s (try %d)", key, err, try+1)
 	}
+	if err != nil {
+		store.abortParts(key, &mu)
+	}
 	if err != nil && try >= max {
 		err = fmt.Errorf("(max tries) upload block %s: %s (after %d tries)", key, err, try)
 	}
@@ -424,8 +507,9 @@ func (c *wChunk) upload(indx int) {
 		if off != blen {
 			panic(fmt.Sprintf("block length does not match: %v != %v", off, blen))
 		}
+		c.sums[indx] = crc32.Checksum(block.Data, crc32cTable)
 		if c.store.conf.Writeback {
-			stagingPath, err := c.store.bcache.stage(key, block.Data, c.store.shouldCache(blen))
+			stagingPath, err := c.store.bcache.stage(key, block.Data, c.store.shouldCache(blen), c.inode, c.findx)
 			if err != nil {
 				logger.Warnf("write %s to disk: %s, upload it directly", stagingPath, err)
 			} else {
@@ -436,12 +520,7 @@ func (c *wChunk) upload(indx int) {
 						defer func() { <-c.store.currentUpload }()
 						if err = c.store.upload(key, block, nil); err == nil {
 							c.store.bcache.uploaded(key, blen)
-							if os.Remove(stagingPath) == nil {
-								if m, ok := c.store.bcache.(*cacheManager); ok {
-									m.stageBlocks.Sub(1)
-									m.stageBlockBytes.Sub(float64(blen))
-								}
-							}
+							c.store.bcache.removeStage(key)
 						} else { // add to delay list and wait for later scanning
 							c.store.addDelayedStaging(key, stagingPath, time.Now().Add(time.Second*30), false)
 						}
@@ -490,6 +569,17 @@ func (c *wChunk) Finish(length int) error {
 	if c.length != length {
 		return fmt.Errorf("Length mismatch: %v != %v", c.length, length)
 	}
+	if c.inlinable && length > 0 && length <= c.store.conf.InlineSize && c.uploaded == 0 {
+		c.inline()
+		return nil
+	}
+	if c.packable && c.store.packer != nil && length > 0 && length <= c.store.conf.PackSize && c.uploaded == 0 {
+		if err := c.pack(); err != nil {
+			c.uploadError = err
+			return err
+		}
+		return nil
+	}
 
 	n := (length-1)/c.store.conf.BlockSize + 1
 	if err := c.FlushTo(n * c.store.conf.BlockSize); err != nil {
@@ -504,6 +594,21 @@ func (c *wChunk) Finish(length int) error {
 	return nil
 }
 
+func (c *wChunk) Checksums() []uint32 {
+	if c.length == 0 {
+		return nil
+	}
+	return c.sums[:(c.length-1)/c.store.conf.BlockSize+1]
+}
+
+func (c *wChunk) Packed() *Pack {
+	return c.packed
+}
+
+func (c *wChunk) Inlined() []byte {
+	return c.inlined
+}
+
 func (c *wChunk) Abort() {
 	for i := range c.pages {
 		for _, b := range c.pages[i] {
@@ -514,31 +619,56 @@ func (c *wChunk) Abort() {
 	// delete uploaded blocks
 	c.length = c.uploaded
 	_ = c.Remove()
+	// the deduplicated blocks are referred before the slice is committed
+	if c.store.conf.Release != nil && c.id > 0 {
+		if err := c.store.conf.Release(c.id); err != nil {
+			logger.Warnf("release blocks of slice %d: %s", c.id, err)
+		}
+	}
 }
 
 // Config contains options for cachedStore
 type Config struct {
-	CacheDir       string
-	CacheMode      os.FileMode
-	CacheSize      int64
-	FreeSpace      float32
-	AutoCreate     bool
-	Compress       string
-	MaxUpload      int
-	MaxDeletes     int
-	MaxRetries     int
-	UploadLimit    int64 // bytes per second
-	DownloadLimit  int64 // bytes per second
-	Writeback      bool
-	UploadDelay    time.Duration
-	HashPrefix     bool
-	BlockSize      int
-	GetTimeout     time.Duration
-	PutTimeout     time.Duration
-	CacheFullBlock bool
-	BufferSize     int
-	Readahead      int
-	Prefetch       int
+	CacheDir          string
+	CacheMode         os.FileMode
+	CacheSize         int64
+	FreeSpace         float32
+	PinnedCacheSize   int64
+	CacheKey          []byte `json:"-"` // encrypt blocks on local disk if not empty
+	AutoCreate        bool
+	Compress          string
+	CompressThreshold float64 // store blocks uncompressed if compression saves less than this ratio
+	BlockHeader       bool    // compressed blocks start with a header byte of their kind
+	MaxUpload         int
+	MaxDeletes        int
+	MaxRetries        int
+	UploadLimit       int64 // bytes per second
+	DownloadLimit     int64 // bytes per second
+	Writeback         bool
+	UploadDelay       time.Duration
+	HashPrefix        bool
+	BlockSize         int
+	GetTimeout        time.Duration
+	HedgePercentile   float64 // send another GET if the first one is slower than this percentile of recent ones
+	HedgeBudget       float64 // ratio of extra GET requests for hedging (0 means disabled)
+	PutTimeout        time.Duration
+	PartThreshold     int // upload blocks not smaller than this in parts, so only failed parts are retried (0 means disabled)
+	CacheFullBlock    bool
+	BufferSize        int
+	Readahead         int
+	Prefetch          int
+	PackSize          int                                                                  // store slices smaller than this into shared objects (0 means disabled)
+	PackDelay         time.Duration                                                        // max time to wait for other slices to share an object, it delays every packed slice
+	Checksums         func(chunkid uint64) ([]uint32, error)                               `json:"-"` // verify blocks read from object storage if set
+	InlineSize        int                                                                  // keep slices not larger than this in metadata engine (0 means disabled)
+	Packs             func(chunkid uint64) (*Pack, error)                                  `json:"-"` // locate slices stored in shared objects if set
+	Inlines           func(chunkid uint64) ([]byte, error)                                 `json:"-"` // read slices stored in metadata engine if set
+	Dedup             func(chunkid uint64, indx int, hash string, size int) (int64, error) `json:"-"` // refer to the object with the same content if set
+	Hashes            func(chunkid uint64) ([]string, error)                               `json:"-"` // locate deduplicated blocks if set
+	Release           func(chunkid uint64) error                                           `json:"-"` // drop the references of deduplicated blocks in aborted slices if set
+	HashKey           []byte                                                               `json:"-"` // hash blocks with HMAC-SHA256 of this key for deduplication if not empty
+	Tiers             func(chunkid uint64) (uint8, error)                                  `json:"-"` // locate slices moved to TierStorage if set
+	TierStorage       object.ObjectStorage                                                 `json:"-"`
 }
 
 type cachedStore struct {
@@ -553,18 +683,36 @@ type cachedStore struct {
 	pendingKeys   map[string]time.Time
 	pendingMutex  sync.Mutex
 	compressor    compress.Compressor
+	crypter       *cacheCrypter
+	sums          *sumCache
+	packer        *packer
+	packs         *packCache
+	hashes        *hashCache
+	outlines      *outlineCache
+	tiers         *tierCache
+	hedger        *hedger
 	seekable      bool
+	headers       *lruCache // kinds of blocks with header if they're not seekable, true for raw ones
+	noMultipart   int32     // set if the storage doesn't support multipart upload
 	upLimit       *ratelimit.Bucket
 	downLimit     *ratelimit.Bucket
 
-	cacheHits           prometheus.Counter
-	cacheMiss           prometheus.Counter
-	cacheHitBytes       prometheus.Counter
-	cacheMissBytes      prometheus.Counter
-	cacheReadHist       prometheus.Histogram
-	objectReqsHistogram *prometheus.HistogramVec
-	objectReqErrors     prometheus.Counter
-	objectDataBytes     *prometheus.CounterVec
+	cacheHits            prometheus.Counter
+	cacheMiss            prometheus.Counter
+	cacheHitBytes        prometheus.Counter
+	cacheMissBytes       prometheus.Counter
+	cacheReadHist        prometheus.Histogram
+	objectReqsHistogram  *prometheus.HistogramVec
+	objectReqErrors      prometheus.Counter
+	objectDataBytes      *prometheus.CounterVec
+	objectChecksumErrors prometheus.Counter
+	packedSlices         prometheus.Counter
+	inlinedSlices        prometheus.Counter
+	hedgedRequests       prometheus.Counter
+	hedgeWins            prometheus.Counter
+	dedupedBlocks        prometheus.Counter
+	dedupedBytes         prometheus.Counter
+	restoreRequests      prometheus.Counter
 }
 
 func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bool) (err error) {
@@ -574,6 +722,17 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 			err = fmt.Errorf("recovered from %s", e)
 		}
 	}()
+	if store.isInline(key) {
+		var inlined bool
+		if inlined, err = store.loadInline(key, page); err != nil {
+			return err
+		} else if inlined {
+			if err = store.verify(key, page.Data); err == nil && cache {
+				store.bcache.cache(key, page, forceCache)
+			}
+			return err
+		}
+	}
 	needed := store.compressor.CompressBound(len(page.Data))
 	compressed := needed > len(page.Data)
 	// we don't know the actual size for compressed block
@@ -592,7 +751,33 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 			store.objectReqErrors.Add(1)
 			start = time.Now()
 		}
-		in, err = store.storage.Get(key, 0, -1)
+		var obj string
+		var off, limit int64
+		if obj, off, limit, err = store.locate(key); err == nil {
+			in, err = store.get(obj, off, limit)
+		}
+		if err != nil && obj != key && store.packs != nil {
+			// the shared object could be rewritten, locate it again
+			if chunkid, _, ok := parseBlockKey(key); ok {
+				store.packs.forget(chunkid)
+			}
+		}
+		if err != nil && store.hashes != nil {
+			// the staged block could be uploaded as a deduplicated object later
+			if chunkid, _, ok := parseBlockKey(key); ok {
+				store.hashes.forget(chunkid)
+			}
+		}
+		if errors.Is(err, object.ErrNotRestored) {
+			// it will be readable after restored, don't wait for it here
+			store.restore(obj)
+			break
+		} else if err != nil && store.tiers != nil {
+			// the slice could be moved to tier storage
+			if chunkid, _, ok := parseBlockKey(key); ok {
+				store.tiers.forget(chunkid)
+			}
+		}
 		tried++
 	}
 	var n int
@@ -626,23 +811,81 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 		return fmt.Errorf("get %s: %s", key, err)
 	}
 	if compressed {
+		if store.headers != nil && n > 0 {
+			store.headers.put(key, compress.IsRaw(buf[:n]))
+		}
 		n, err = store.compressor.Decompress(page.Data, buf[:n])
 	}
 	if err != nil || n < len(page.Data) {
 		return fmt.Errorf("read %s fully: %s (%d < %d) after %s (tried %d)", key, err, n, len(page.Data),
 			used, tried)
 	}
+	if err = store.verify(key, page.Data); err != nil {
+		return err
+	}
 	if cache {
 		store.bcache.cache(key, page, forceCache)
 	}
 	return nil
 }
 
-// NewCachedStore create a cached store.
-func NewCachedStore(storage object.ObjectStorage, config Config, reg prometheus.Registerer) ChunkStore {
+const maxCachedHeaders = 100000
+
+// seekableBlock returns whether a block can be read in ranges. The blocks with header are seekable
+// only if they are stored uncompressed, it's learned from the header when the block is read fully,
+// or probed by reading the header alone.
+func (store *cachedStore) seekableBlock(key string) bool {
+	if store.seekable {
+		return true
+	}
+	if store.headers == nil {
+		return false
+	}
+	if raw, ok := store.headers.get(key); ok {
+		return raw.(bool)
+	}
+	obj, base, _, err := store.locate(key)
+	var in io.ReadCloser
+	if err == nil {
+		in, err = store.get(obj, base, 1)
+	}
+	if err != nil {
+		logger.Debugf("GET header of %s: %s", key, err)
+		return false
+	}
+	var header [1]byte
+	_, err = io.ReadFull(in, header[:])
+	_ = in.Close()
+	if err != nil {
+		logger.Debugf("read header of %s: %s", key, err)
+		return false
+	}
+	raw := compress.IsRaw(header[:])
+	store.headers.put(key, raw)
+	return raw
+}
+
+// newCompressor returns the compressor for blocks, uncompressed blocks written by adaptive compression
+// are always readable in the volumes with block header, even when it's not enabled.
+func newCompressor(config *Config) (compress.Compressor, error) {
 	compressor := compress.NewCompressor(config.Compress)
 	if compressor == nil {
-		logger.Fatalf("unknown compress algorithm: %s", config.Compress)
+		return nil, fmt.Errorf("unknown compress algorithm: %s", config.Compress)
+	}
+	if !config.BlockHeader {
+		if config.CompressThreshold > 0 && compressor.Name() != "Noop" {
+			return nil, fmt.Errorf("compress threshold is not supported by volumes without block header")
+		}
+		return compressor, nil
+	}
+	return compress.NewAdaptive(compressor, config.CompressThreshold), nil
+}
+
+// NewCachedStore create a cached store.
+func NewCachedStore(storage object.ObjectStorage, config Config, reg prometheus.Registerer) ChunkStore {
+	compressor, err := newCompressor(&config)
+	if err != nil {
+		logger.Fatalf("%s", err)
 	}
 	if config.MaxRetries == 0 {
 		config.MaxRetries = 10
@@ -664,10 +907,45 @@ func NewCachedStore(storage object.ObjectStorage, config Config, reg prometheus.
 		pendingKeys:   make(map[string]time.Time),
 		group:         &Controller{},
 	}
+	if len(config.CacheKey) > 0 {
+		if store.crypter, err = newCacheCrypter(config.CacheKey); err != nil {
+			logger.Fatalf("Invalid key to encrypt cache: %s", err)
+		}
+	}
 	if config.UploadLimit > 0 {
 		// there are overheads coming from HTTP/TCP/IP
 		store.upLimit = ratelimit.NewBucketWithRate(float64(config.UploadLimit)*0.85, config.UploadLimit)
 	}
+	if !store.seekable && config.BlockHeader {
+		store.headers = newLRUCache(maxCachedHeaders)
+	}
+	if config.Checksums != nil {
+		store.sums = newSumCache(config.Checksums)
+	}
+	if config.Packs != nil {
+		store.packs = newPackCache(config.Packs)
+	}
+	if config.Hashes != nil {
+		store.hashes = newHashCache(config.Hashes)
+	}
+	if config.Inlines != nil {
+		store.outlines = newOutlineCache()
+	}
+	if config.Tiers != nil && config.TierStorage != nil {
+		store.tiers = newTierCache(config.Tiers)
+	}
+	if config.HedgeBudget > 0 && config.HedgePercentile > 0 && config.HedgePercentile < 1 {
+		store.hedger = newHedger(config.HedgePercentile, config.HedgeBudget)
+	}
+	if config.InlineSize > MaxInlineSize {
+		store.conf.InlineSize = MaxInlineSize
+	}
+	if config.PackSize > 0 && !config.Writeback { // staged blocks are uploaded alone
+		if config.PackSize >= config.BlockSize {
+			store.conf.PackSize = config.BlockSize - 1
+		}
+		store.packer = &packer{store: store}
+	}
 	if config.DownloadLimit > 0 {
 		store.downLimit = ratelimit.NewBucketWithRate(float64(config.DownloadLimit)*0.85, config.DownloadLimit)
 	}
@@ -746,6 +1024,38 @@ func NewCachedStore(storage object.ObjectStorage, config Config, reg prometheus.
 		Name: "object_request_data_bytes",
 		Help: "Object requests size in bytes.",
 	}, []string{"method"})
+	store.objectChecksumErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_checksum_errors",
+		Help: "blocks from object store not matching their checksums",
+	})
+	store.packedSlices = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_packed_slices",
+		Help: "small slices stored in shared objects",
+	})
+	store.inlinedSlices = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_inlined_slices",
+		Help: "small slices stored in metadata engine",
+	})
+	store.hedgedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_hedged_requests",
+		Help: "extra GET requests sent for slow ones",
+	})
+	store.hedgeWins = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_hedged_wins",
+		Help: "extra GET requests responding earlier than the slow ones",
+	})
+	store.dedupedBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_deduplicated_blocks",
+		Help: "blocks not uploaded because the same content is stored already",
+	})
+	store.dedupedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_deduplicated_bytes",
+		Help: "bytes not uploaded because the same content is stored already",
+	})
+	store.restoreRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_restore_requests",
+		Help: "requests to restore archived objects in tier storage",
+	})
 	store.initMetrics(reg)
 
 	return store
@@ -763,6 +1073,24 @@ func (store *cachedStore) initMetrics(reg prometheus.Registerer) {
 	reg.MustRegister(store.objectReqsHistogram)
 	reg.MustRegister(store.objectReqErrors)
 	reg.MustRegister(store.objectDataBytes)
+	reg.MustRegister(store.objectChecksumErrors)
+	reg.MustRegister(store.packedSlices)
+	reg.MustRegister(store.inlinedSlices)
+	reg.MustRegister(store.hedgedRequests)
+	reg.MustRegister(store.hedgeWins)
+	reg.MustRegister(store.dedupedBlocks)
+	reg.MustRegister(store.dedupedBytes)
+	reg.MustRegister(store.restoreRequests)
+	if store.hedger != nil {
+		reg.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "object_hedge_threshold_seconds",
+				Help: "latency to first byte of GET requests to send another one",
+			},
+			func() float64 {
+				return store.hedger.current().Seconds()
+			}))
+	}
 	reg.MustRegister(prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
 			Name: "blockcache_blocks",
@@ -806,12 +1134,24 @@ func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
 		logger.Debugf("Key %s is not needed, drop it", key)
 		return
 	}
-	f, err := os.Open(stagingPath)
+	var f io.ReadCloser
+	fd, err := os.Open(stagingPath)
+	if err == nil {
+		f = fd
+		if store.crypter != nil {
+			f, err = store.crypter.open(fd, key)
+		}
+	}
 	if err != nil {
 		store.pendingMutex.Lock()
 		_, ok = store.pendingKeys[key]
 		store.pendingMutex.Unlock()
-		if ok {
+		if ok && os.IsNotExist(err) {
+			// flushed or dropped by `juicefs status --pending`
+			logger.Warnf("Staging file %s is gone, drop it", stagingPath)
+			store.removePending(key)
+			store.bcache.removeStage(key)
+		} else if ok {
 			logger.Errorf("Open staging file %s: %s", stagingPath, err)
 		} else {
 			logger.Debugf("Key %s is not needed, drop it", key)
@@ -831,12 +1171,7 @@ func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
 	if err = store.upload(key, block, nil); err == nil {
 		store.bcache.uploaded(key, blen)
 		store.removePending(key)
-		if os.Remove(stagingPath) == nil {
-			if m, ok := store.bcache.(*cacheManager); ok {
-				m.stageBlocks.Sub(1)
-				m.stageBlockBytes.Sub(float64(blen))
-			}
-		}
+		store.bcache.removeStage(key)
 	}
 }
 
@@ -892,31 +1227,95 @@ func (store *cachedStore) Remove(chunkid uint64, length int) error {
 	return r.Remove()
 }
 
+func (store *cachedStore) RemoveBlock(hash string) error {
+	if store.conf.MaxDeletes == 0 {
+		return errors.New("skip deleting objects because MaxDeletes is 0")
+	}
+	key := DedupKey(hash)
+	store.currentDelete <- struct{}{}
+	defer func() { <-store.currentDelete }()
+	st := time.Now()
+	err := store.storage.Delete(key)
+	used := time.Since(st)
+	logger.Debugf("DELETE %v (%v, %.3fs)", key, err, used.Seconds())
+	store.objectReqsHistogram.WithLabelValues("DELETE").Observe(used.Seconds())
+	if err != nil {
+		store.objectReqErrors.Add(1)
+	}
+	return err
+}
+
+func (store *cachedStore) fillCache(key string) error {
+	f, err := store.bcache.load(key)
+	if err == nil { // already cached
+		_ = f.Close()
+		return nil
+	}
+	size := parseObjOrigSize(key)
+	if size == 0 || size > store.conf.BlockSize {
+		logger.Warnf("Invalid size: %s %d", key, size)
+		return nil
+	}
+	p := NewOffPage(size)
+	defer p.Release()
+	if err = store.load(key, p, true, true); err != nil {
+		logger.Warnf("Failed to load key: %s %s", key, err)
+	}
+	return err
+}
+
 func (store *cachedStore) FillCache(chunkid uint64, length uint32) error {
 	r := chunkForRead(chunkid, int(length), store)
-	keys := r.keys()
 	var err error
-	for _, k := range keys {
-		f, e := store.bcache.load(k)
-		if e == nil { // already cached
-			_ = f.Close()
-			continue
+	for _, k := range r.keys() {
+		if e := store.fillCache(k); e != nil {
+			err = e
 		}
-		size := parseObjOrigSize(k)
-		if size == 0 || size > store.conf.BlockSize {
-			logger.Warnf("Invalid size: %s %d", k, size)
-			continue
+	}
+	return err
+}
+
+func (store *cachedStore) PinCache(chunkid uint64, length uint32) error {
+	r := chunkForRead(chunkid, int(length), store)
+	var err error
+	for _, k := range r.keys() {
+		if e := store.bcache.pin(k); e != nil {
+			return fmt.Errorf("pin %s: %s", k, e)
 		}
-		p := NewOffPage(size)
-		defer p.Release()
-		if e := store.load(k, p, true, true); e != nil {
-			logger.Warnf("Failed to load key: %s %s", k, e)
+		if e := store.fillCache(k); e != nil {
 			err = e
 		}
 	}
 	return err
 }
 
+func (store *cachedStore) UnpinCache(chunkid uint64, length uint32) error {
+	r := chunkForRead(chunkid, int(length), store)
+	for _, k := range r.keys() {
+		store.bcache.unpin(k)
+	}
+	return nil
+}
+
+func (store *cachedStore) EvictCache(chunkid uint64, length uint32) error {
+	r := chunkForRead(chunkid, int(length), store)
+	for _, k := range r.keys() {
+		store.bcache.evict(k)
+	}
+	return nil
+}
+
+func (store *cachedStore) CheckCache(chunkid uint64, length uint32) (uint64, error) {
+	r := chunkForRead(chunkid, int(length), store)
+	var cached uint64
+	for i, k := range r.keys() {
+		if store.bcache.exist(k) {
+			cached += uint64(r.blockSize(i))
+		}
+	}
+	return cached, nil
+}
+
 func (store *cachedStore) UsedMemory() int64 {
 	return store.bcache.usedMemory()
 }
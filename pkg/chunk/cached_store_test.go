@@ -20,9 +20,15 @@ package chunk
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -138,6 +144,68 @@ func TestStoreCompressed(t *testing.T) {
 	testStore(t, store)
 }
 
+func TestStoreAdaptiveCompressed(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = "memory"
+	conf.Compress = "zstd:3"
+	conf.CompressThreshold = 0.2
+	conf.BlockHeader = true
+	store := NewCachedStore(mem, conf, nil)
+	testStore(t, store)
+
+	random := make([]byte, 1<<20)
+	rand.Read(random)
+	w := store.NewWriter(20)
+	_, _ = w.WriteAt(random, 0)
+	if err := w.Finish(len(random)); err != nil {
+		t.Fatalf("write random block: %s", err)
+	}
+	if err := forgeChunk(store, 21, 1<<20); err != nil {
+		t.Fatalf("forge chunk 21: %s", err)
+	}
+	if o, err := mem.Head("chunks/0/0/20_0_1048576"); err != nil || o.Size() != 1<<20+1 { // with header
+		t.Fatalf("random block should be stored uncompressed: %v", err)
+	}
+	if o, err := mem.Head("chunks/0/0/21_0_1048576"); err != nil || o.Size() >= 1<<20 {
+		t.Fatalf("block 21 should be compressed: %v", err)
+	}
+
+	// mixed blocks can be read without adaptive compression
+	conf.CompressThreshold = 0
+	store = NewCachedStore(mem, conf, nil)
+	buf := make([]byte, 1<<20)
+	if n, err := store.NewReader(20, len(random)).ReadAt(context.Background(), NewPage(buf), 0); err != nil || n != len(buf) || !bytes.Equal(buf, random) {
+		t.Fatalf("read raw block: %d %v", n, err)
+	}
+	if n, err := store.NewReader(21, 1<<20).ReadAt(context.Background(), NewPage(buf), 0); err != nil || n != len(buf) || !bytes.Equal(buf, bytes.Repeat([]byte{0x41}, 1<<20)) {
+		t.Fatalf("read compressed block: %d %v", n, err)
+	}
+
+	// raw blocks with header are read in ranges after the header
+	ranged := &rangedStorage{ObjectStorage: mem}
+	store = NewCachedStore(ranged, conf, nil)
+	small := make([]byte, 100)
+	if n, err := store.NewReader(20, len(random)).ReadAt(context.Background(), NewPage(small), 1000); err != nil || n != 100 || !bytes.Equal(small, random[1000:1100]) {
+		t.Fatalf("read range of raw block: %d %v", n, err)
+	}
+	if gets := ranged.first(2); len(gets) != 2 || gets[0] != [2]int64{0, 1} || gets[1] != [2]int64{1001, 100} {
+		t.Fatalf("raw block should be read in range: %v", gets)
+	}
+	if n, err := store.NewReader(21, 1<<20).ReadAt(context.Background(), NewPage(small), 1000); err != nil || n != 100 || !bytes.Equal(small, bytes.Repeat([]byte{0x41}, 100)) {
+		t.Fatalf("read range of compressed block: %d %v", n, err)
+	}
+	if raw, ok := store.(*cachedStore).headers.get("chunks/0/0/21_0_1048576"); !ok || raw.(bool) {
+		t.Fatalf("block 21 should be known as compressed")
+	}
+
+	conf.BlockHeader = false
+	conf.CompressThreshold = 0.2
+	if _, err := newCompressor(&conf); err == nil {
+		t.Fatalf("compress threshold should not be used without block header")
+	}
+}
+
 func TestStoreLimited(t *testing.T) {
 	mem, _ := object.CreateStorage("mem", "", "", "", "")
 	conf := defaultConf
@@ -203,6 +271,39 @@ func TestStoreDelayed(t *testing.T) {
 	}
 }
 
+func TestStoreEncryptedCache(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.CacheKey = bytes.Repeat([]byte{0x1}, 32)
+	conf.Writeback = true
+	store := NewCachedStore(mem, conf, nil)
+	time.Sleep(time.Millisecond * 50) // wait for scan to finish
+	testStore(t, store)
+
+	if err := forgeChunk(store, 10, 200<<10); err != nil {
+		t.Fatalf("forge chunk 10: %s", err)
+	}
+	defer store.Remove(10, 200<<10)
+	time.Sleep(time.Millisecond * 100) // waiting for flush
+	path := filepath.Join(conf.CacheDir, cacheDir, "chunks/0/0/10_0_204800")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read cached block: %s", err)
+	}
+	if bytes.Contains(data, bytes.Repeat([]byte{0x41}, 100)) {
+		t.Fatalf("cached block is not encrypted")
+	}
+	r := store.NewReader(10, 200<<10)
+	p := NewPage(make([]byte, 100))
+	if n, err := r.ReadAt(context.Background(), p, 65500); err != nil || n != 100 {
+		t.Fatalf("read across segments: %d %s", n, err)
+	}
+	if !bytes.Equal(p.Data, bytes.Repeat([]byte{0x41}, 100)) {
+		t.Fatalf("read unexpected data: %v", p.Data)
+	}
+}
+
 func TestStoreMultiBuckets(t *testing.T) {
 	mem, _ := object.CreateStorage("mem", "", "", "", "")
 	conf := defaultConf
@@ -245,6 +346,101 @@ func TestFillCache(t *testing.T) {
 	}
 }
 
+func TestPinCache(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.CacheSize = 1
+	store := NewCachedStore(mem, conf, nil)
+	if err := forgeChunk(store, 10, 1024); err != nil {
+		t.Fatalf("forge chunk 10 1024: %s", err)
+	}
+	if err := store.PinCache(10, 1024); err == nil {
+		t.Fatalf("pin cache should fail when pinned cache is disabled")
+	}
+
+	conf.CacheDir = t.TempDir()
+	conf.PinnedCacheSize = 1
+	store = NewCachedStore(mem, conf, nil)
+	bsize := conf.BlockSize
+	if err := forgeChunk(store, 11, bsize); err != nil {
+		t.Fatalf("forge chunk 11 %d: %s", bsize, err)
+	}
+	if err := store.PinCache(10, 1024); err != nil {
+		t.Fatalf("pin cache 10 1024: %s", err)
+	}
+	if err := store.PinCache(11, uint32(bsize)); err == nil {
+		t.Fatalf("pin cache 11 should exceed the pinned capacity")
+	}
+	time.Sleep(time.Millisecond * 100) // waiting for flush
+	m := store.(*cachedStore).bcache.(*cacheManager)
+	s := m.stores[0]
+	key := "chunks/0/0/10_0_1024"
+	s.Lock()
+	s.cleanup()
+	_, cached := s.keys[key]
+	used := s.used
+	s.Unlock()
+	if !cached || used != 0 {
+		t.Fatalf("pinned block should not be evicted: cached %t used %d", cached, used)
+	}
+	if err := s.savePinned(); err != nil {
+		t.Fatalf("save pinned: %s", err)
+	}
+
+	// pinned keys survive restart
+	s2 := newCacheStore(m, s.dir, 1<<20, 1<<20, 1, &conf, nil)
+	if _, ok := s2.pinned[key]; !ok || s2.pinnedUsed != 1024+4096 {
+		t.Fatalf("pinned keys are not loaded: %v %d", s2.pinned, s2.pinnedUsed)
+	}
+
+	if err := store.EvictCache(10, 1024); err != nil || !s.exist(key) {
+		t.Fatalf("pinned block should not be evicted: %v", err)
+	}
+	if err := store.UnpinCache(10, 1024); err != nil {
+		t.Fatalf("unpin cache 10 1024: %s", err)
+	}
+	s.Lock()
+	used = s.used
+	s.Unlock()
+	if used != 1024+4096 {
+		t.Fatalf("unpinned block should be counted as normal cache: used %d", used)
+	}
+}
+
+func TestCheckAndEvictCache(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.CacheSize = 10
+	store := NewCachedStore(mem, conf, nil)
+	bsize := conf.BlockSize
+	if err := forgeChunk(store, 12, bsize+1024); err != nil {
+		t.Fatalf("forge chunk 12 %d: %s", bsize+1024, err)
+	}
+	defer store.Remove(12, bsize+1024)
+	time.Sleep(time.Millisecond * 100) // waiting for flush
+	if cached, err := store.CheckCache(12, uint32(bsize+1024)); err != nil || cached != 1024 {
+		t.Fatalf("check cache 12: %d %s, expect 1024 cached", cached, err)
+	}
+	if err := store.FillCache(12, uint32(bsize+1024)); err != nil {
+		t.Fatalf("fill cache 12: %s", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if cached, err := store.CheckCache(12, uint32(bsize+1024)); err != nil || cached != uint64(bsize+1024) {
+		t.Fatalf("check cache 12: %d %s, expect %d cached", cached, err, bsize+1024)
+	}
+	if err := store.EvictCache(12, uint32(bsize+1024)); err != nil {
+		t.Fatalf("evict cache 12: %s", err)
+	}
+	if cached, err := store.CheckCache(12, uint32(bsize+1024)); err != nil || cached != 0 {
+		t.Fatalf("check cache 12: %d %s, expect nothing cached", cached, err)
+	}
+	if cnt, used := store.(*cachedStore).bcache.stats(); cnt != 0 || used != 0 {
+		t.Fatalf("cache cnt %d used %d, expect both 0", cnt, used)
+	}
+}
+
 func BenchmarkCachedRead(b *testing.B) {
 	blob, _ := object.CreateStorage("mem", "", "", "", "")
 	config := defaultConf
@@ -290,3 +486,616 @@ func BenchmarkUncachedRead(b *testing.B) {
 		}
 	}
 }
+
+func TestStorePacked(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.MaxUpload = 5
+	conf.PackSize = 64 << 10
+	conf.PackDelay = time.Millisecond * 100
+	var mu sync.Mutex
+	packs := make(map[uint64]*Pack)
+	conf.Packs = func(chunkid uint64) (*Pack, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return packs[chunkid], nil
+	}
+	store := NewCachedStore(mem, conf, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 20; i < 25; i++ {
+		wg.Add(1)
+		go func(chunkid uint64) {
+			defer wg.Done()
+			w := store.NewWriter(chunkid)
+			w.AllowPacking()
+			data := bytes.Repeat([]byte{byte(chunkid)}, int(chunkid)*100)
+			if _, err := w.WriteAt(data, 0); err != nil {
+				errs <- err
+				return
+			}
+			if err := w.Finish(len(data)); err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			packs[chunkid] = w.Packed()
+			mu.Unlock()
+		}(uint64(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("write packed chunk: %s", err)
+	}
+	var id uint64
+	for chunkid, p := range packs {
+		if p == nil {
+			t.Fatalf("chunk %d is not packed", chunkid)
+		}
+		if id == 0 {
+			id = p.ID
+		} else if p.ID != id {
+			t.Fatalf("chunks are packed into different objects: %d %d", id, p.ID)
+		}
+	}
+	objs, err := mem.List("", "", 100)
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	var keys []string
+	for _, o := range objs {
+		keys = append(keys, o.Key())
+	}
+	if len(keys) != 1 || keys[0] != PackKey(id, false) {
+		t.Fatalf("expect only pack %d, but got %v", id, keys)
+	}
+
+	// read them back without cache
+	conf.CacheDir = t.TempDir()
+	store = NewCachedStore(mem, conf, nil)
+	for i := 20; i < 25; i++ {
+		size := i * 100
+		p := NewPage(make([]byte, size))
+		if n, err := store.NewReader(uint64(i), size).ReadAt(context.Background(), p, 0); n != size || err != nil {
+			t.Fatalf("read chunk %d: %d %s", i, n, err)
+		} else if !bytes.Equal(p.Data, bytes.Repeat([]byte{byte(i)}, size)) {
+			t.Fatalf("data of chunk %d mismatch", i)
+		}
+	}
+	if err := store.Remove(20, 2000); err != nil {
+		t.Fatalf("remove chunk 20: %s", err)
+	}
+	if _, err := mem.Head(PackKey(id, false)); err != nil {
+		t.Fatalf("pack should be kept after removing a slice in it: %s", err)
+	}
+}
+
+func TestStorePackedWithoutDelay(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	blocked := &blockedStorage{ObjectStorage: mem, release: make(chan struct{})}
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.MaxUpload = 5
+	conf.PackSize = 64 << 10
+	store := NewCachedStore(blocked, conf, nil).(*cachedStore)
+
+	write := func(chunkid uint64) (*Pack, error) {
+		w := store.NewWriter(chunkid)
+		w.AllowPacking()
+		data := bytes.Repeat([]byte{byte(chunkid)}, 100)
+		if _, err := w.WriteAt(data, 0); err != nil {
+			return nil, err
+		}
+		err := w.Finish(len(data))
+		return w.Packed(), err
+	}
+	// the first slice is uploaded at once, the ones written during its upload share the next object
+	var wg sync.WaitGroup
+	packs := make([]*Pack, 5)
+	errs := make([]error, 5)
+	for i := range packs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			packs[i], errs[i] = write(uint64(30 + i))
+		}(i)
+		if i == 0 {
+			for blocked.puts() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	for {
+		store.packer.Lock()
+		n := 0
+		if store.packer.current != nil {
+			n = len(store.packer.current.data)
+		}
+		store.packer.Unlock()
+		if n == 400 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(blocked.release)
+	wg.Wait()
+	ids := make(map[uint64]int)
+	for i, p := range packs {
+		if errs[i] != nil || p == nil {
+			t.Fatalf("write packed chunk %d: %v %s", 30+i, p, errs[i])
+		}
+		ids[p.ID]++
+	}
+	if len(ids) != 2 || ids[30] != 1 {
+		t.Fatalf("expect 2 shared objects, but got %v", ids)
+	}
+}
+
+func TestStoreInline(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.InlineSize = 4 << 10
+	inlines := make(map[uint64][]byte)
+	lookups := make(map[uint64]int)
+	conf.Inlines = func(chunkid uint64) ([]byte, error) {
+		lookups[chunkid]++
+		return inlines[chunkid], nil
+	}
+	store := NewCachedStore(mem, conf, nil)
+
+	data := []byte("hello inline")
+	w := store.NewWriter(30)
+	w.AllowInline()
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	if !bytes.Equal(w.Inlined(), data) {
+		t.Fatalf("inlined data: %q", w.Inlined())
+	}
+	inlines[30] = w.Inlined()
+	// too large to be inlined
+	w = store.NewWriter(31)
+	w.AllowInline()
+	big := bytes.Repeat([]byte{1}, conf.InlineSize+1)
+	if _, err := w.WriteAt(big, 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(len(big)); err != nil || w.Inlined() != nil {
+		t.Fatalf("finish: %s, inlined %d bytes", err, len(w.Inlined()))
+	}
+	if objs, _ := mem.List("", "", 100); len(objs) != 1 || objs[0].Key() != "chunks/0/0/31_0_4097" {
+		t.Fatalf("objects: %+v", objs)
+	}
+
+	// read it back without cache
+	conf.CacheDir = t.TempDir()
+	store = NewCachedStore(mem, conf, nil)
+	p := NewPage(make([]byte, 6))
+	if n, err := store.NewReader(30, len(data)).ReadAt(context.Background(), p, 6); n != 6 || err != nil {
+		t.Fatalf("read inline chunk: %d %s", n, err)
+	} else if string(p.Data) != "inline" {
+		t.Fatalf("not expected: %q", p.Data)
+	}
+	if err := store.Remove(30, len(data)); err != nil {
+		t.Fatalf("remove inline chunk: %s", err)
+	}
+
+	// the slices stored in object storage are looked up only once
+	for i := 0; i < 3; i++ {
+		page := NewPage(make([]byte, len(big)))
+		if err := store.(*cachedStore).load("chunks/0/0/31_0_4097", page, false, false); err != nil || !bytes.Equal(page.Data, big) {
+			t.Fatalf("load block of slice 31: %v", err)
+		}
+		page.Release()
+	}
+	if lookups[31] != 1 {
+		t.Fatalf("inline data of slice 31 is looked up %d times", lookups[31])
+	}
+}
+
+func TestStoreDedup(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	refs := make(map[string]int64)
+	hashes := make(map[uint64][]string)
+	var mu sync.Mutex
+	conf.Dedup = func(chunkid uint64, indx int, hash string, size int) (int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for len(hashes[chunkid]) <= indx {
+			hashes[chunkid] = append(hashes[chunkid], "")
+		}
+		hashes[chunkid][indx] = hash
+		refs[hash]++
+		return refs[hash], nil
+	}
+	conf.Hashes = func(chunkid uint64) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return hashes[chunkid], nil
+	}
+	store := NewCachedStore(mem, conf, nil)
+
+	data := bytes.Repeat([]byte("dedup"), 1000)
+	for _, id := range []uint64{40, 41} {
+		w := store.NewWriter(id)
+		if _, err := w.WriteAt(data, 0); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		if err := w.Finish(len(data)); err != nil {
+			t.Fatalf("finish: %s", err)
+		}
+	}
+	objs, _ := mem.List("", "", 100)
+	if len(objs) != 1 {
+		t.Fatalf("objects: %+v", objs)
+	}
+	if hash, ok := ParseDedupKey(objs[0].Key()); !ok || refs[hash] != 2 {
+		t.Fatalf("deduplicated object %s: %d references", objs[0].Key(), refs[hash])
+	}
+
+	// read it back without cache
+	conf.CacheDir = t.TempDir()
+	store = NewCachedStore(mem, conf, nil)
+	p := NewPage(make([]byte, 5))
+	if n, err := store.NewReader(41, len(data)).ReadAt(context.Background(), p, 5); n != 5 || err != nil {
+		t.Fatalf("read deduplicated chunk: %d %s", n, err)
+	} else if string(p.Data) != "dedup" {
+		t.Fatalf("not expected: %q", p.Data)
+	}
+	if err := store.Remove(40, len(data)); err != nil {
+		t.Fatalf("remove deduplicated chunk: %s", err)
+	}
+	if _, err := mem.Head(objs[0].Key()); err != nil {
+		t.Fatalf("deduplicated object should be kept after removing a slice: %s", err)
+	}
+	hash, _ := ParseDedupKey(objs[0].Key())
+	if err := store.RemoveBlock(hash); err != nil {
+		t.Fatalf("remove block: %s", err)
+	}
+	if _, err := mem.Head(objs[0].Key()); err == nil {
+		t.Fatalf("deduplicated object should be deleted")
+	}
+
+	// the references of an aborted slice are released
+	var released []uint64
+	conf.Release = func(chunkid uint64) error {
+		released = append(released, chunkid)
+		return nil
+	}
+	store = NewCachedStore(mem, conf, nil)
+	w := store.NewWriter(42)
+	_, _ = w.WriteAt(data, 0)
+	_ = w.FlushTo(len(data))
+	w.Abort()
+	if len(released) != 1 || released[0] != 42 {
+		t.Fatalf("released slices: %v", released)
+	}
+
+	// keyed hash doesn't reveal the content
+	conf.HashKey = []byte("secret")
+	store = NewCachedStore(mem, conf, nil)
+	w = store.NewWriter(43)
+	_, _ = w.WriteAt(data, 0)
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	sum := sha256.Sum256(data)
+	if h := hashes[43][0]; h == "" || h == hex.EncodeToString(sum[:]) {
+		t.Fatalf("hash of block should be keyed: %s", h)
+	}
+}
+
+func TestStoreTier(t *testing.T) {
+	os.Setenv("JFS_ARCHIVE_RESTORE_DELAY", "500ms")
+	defer os.Unsetenv("JFS_ARCHIVE_RESTORE_DELAY")
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	archive, err := object.CreateStorage("archive", t.TempDir(), "", "", "")
+	if err != nil {
+		t.Fatalf("create archive: %s", err)
+	}
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	store := NewCachedStore(mem, conf, nil)
+	data := bytes.Repeat([]byte("cold"), 1000)
+	w := store.NewWriter(50)
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+
+	// move it to tier storage
+	key := BlockKey(50, 0, len(data), false)
+	in, err := mem.Get(key, 0, -1)
+	if err != nil {
+		t.Fatalf("get %s: %s", key, err)
+	}
+	if err = archive.Put(key, in); err != nil {
+		t.Fatalf("put %s: %s", key, err)
+	}
+	_ = mem.Delete(key)
+	conf.CacheDir = t.TempDir()
+	conf.TierStorage = archive
+	conf.Tiers = func(chunkid uint64) (uint8, error) {
+		if chunkid == 50 {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	store = NewCachedStore(mem, conf, nil)
+	p := NewPage(make([]byte, 4))
+	if _, err := store.NewReader(50, len(data)).ReadAt(context.Background(), p, 4); err == nil {
+		t.Fatalf("read archived block should fail before restored")
+	}
+	if _, ok := store.(*cachedStore).tiers.restoring[key]; !ok {
+		t.Fatalf("archived block %s is not requested to restore", key)
+	}
+	time.Sleep(time.Millisecond * 600)
+	if n, err := store.NewReader(50, len(data)).ReadAt(context.Background(), p, 4); n != 4 || err != nil {
+		t.Fatalf("read restored block: %d %s", n, err)
+	} else if string(p.Data) != "cold" {
+		t.Fatalf("not expected: %q", p.Data)
+	}
+	if err := store.Remove(50, len(data)); err != nil {
+		t.Fatalf("remove archived chunk: %s", err)
+	}
+	if _, err := archive.Head(key); err == nil {
+		t.Fatalf("archived object should be deleted")
+	}
+}
+
+func TestScrubBlock(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.Compress = "lz4"
+	store := NewCachedStore(mem, conf, nil)
+	data := bytes.Repeat([]byte("scrub"), 1000)
+	w := store.NewWriter(60)
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	sums := w.Checksums()
+	conf.Checksums = func(chunkid uint64) ([]uint32, error) { return sums, nil }
+	store = NewCachedStore(mem, conf, nil)
+
+	key := BlockKey(60, 0, len(data), false)
+	if n, err := store.ScrubBlock(key); err != nil || n == 0 || n >= len(data) {
+		t.Fatalf("scrub compressed block: %d %s", n, err)
+	}
+	if _, err := store.ScrubBlock(BlockKey(61, 0, len(data), false)); err == nil {
+		t.Fatalf("scrub missing block should fail")
+	}
+	_ = mem.Put(key, bytes.NewReader([]byte("broken")))
+	if _, err := store.ScrubBlock(key); err == nil {
+		t.Fatalf("scrub undecompressable block should fail")
+	}
+
+	conf.Compress = "none"
+	store = NewCachedStore(mem, conf, nil)
+	_ = mem.Put(key, bytes.NewReader(data[:len(data)-1]))
+	if _, err := store.ScrubBlock(key); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("scrub short block: %v", err)
+	}
+	_ = mem.Put(key, bytes.NewReader(append(data, 'x')))
+	if _, err := store.ScrubBlock(key); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("scrub long block: %v", err)
+	}
+	corrupt := append([]byte{}, data...)
+	corrupt[0] = 'S'
+	_ = mem.Put(key, bytes.NewReader(corrupt))
+	if _, err := store.ScrubBlock(key); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("scrub corrupt block: %v", err)
+	}
+	_ = mem.Put(key, bytes.NewReader(data))
+	if n, err := store.ScrubBlock(key); err != nil || n != len(data) {
+		t.Fatalf("scrub block: %d %s", n, err)
+	}
+}
+
+func TestStoreChaos(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	blob, _ := object.NewChaos(mem, "")
+	conf := defaultConf
+	conf.CacheDir = "memory"
+	conf.CacheSize = 0
+	store := NewCachedStore(blob, conf, nil)
+
+	// find a seed that fails the first request and passes the second one
+	var seed int64
+	for ; ; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		if r.Float64() < 0.5 && r.Float64() >= 0.5 {
+			break
+		}
+	}
+	_ = object.ConfigureChaos(blob, fmt.Sprintf("seed=%d&put-error=0.5", seed))
+	data := bytes.Repeat([]byte("abcd"), 100)
+	w := store.NewWriter(1)
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("upload should be retried: %s", err)
+	}
+
+	_ = object.ConfigureChaos(blob, fmt.Sprintf("seed=%d&get-error=0.5", seed))
+	p := NewPage(make([]byte, len(data)))
+	defer p.Release()
+	if _, err := store.NewReader(1, len(data)).ReadAt(context.Background(), p, 0); err != nil {
+		t.Fatalf("download should be retried: %s", err)
+	}
+	if !bytes.Equal(p.Data, data) {
+		t.Fatalf("read unexpected data")
+	}
+
+	_ = object.ConfigureChaos(blob, "truncate=1")
+	if _, err := store.NewReader(1, len(data)).ReadAt(context.Background(), p, 0); err == nil {
+		t.Fatalf("read truncated block should fail")
+	}
+}
+
+// rangedStorage records the ranges of GET requests
+type rangedStorage struct {
+	object.ObjectStorage
+	sync.Mutex
+	gets [][2]int64
+}
+
+func (s *rangedStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	s.Lock()
+	s.gets = append(s.gets, [2]int64{off, limit})
+	s.Unlock()
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+func (s *rangedStorage) first(n int) [][2]int64 {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.gets) < n {
+		n = len(s.gets)
+	}
+	return append([][2]int64{}, s.gets[:n]...)
+}
+
+// blockedStorage blocks uploads until release is closed
+type blockedStorage struct {
+	object.ObjectStorage
+	sync.Mutex
+	started int
+	release chan struct{}
+}
+
+func (s *blockedStorage) Put(key string, in io.Reader) error {
+	s.Lock()
+	s.started++
+	s.Unlock()
+	<-s.release
+	return s.ObjectStorage.Put(key, in)
+}
+
+func (s *blockedStorage) puts() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.started
+}
+
+// partedStorage keeps multipart uploads in memory, and fails the parts in fails.
+type partedStorage struct {
+	object.ObjectStorage
+	sync.Mutex
+	next     int
+	uploads  map[string]map[int][]byte
+	uploaded map[int]int // times of parts uploaded
+	fails    map[int]int // number of failures of parts
+	aborted  int
+}
+
+func (s *partedStorage) CreateMultipartUpload(key string) (*object.MultipartUpload, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.next++
+	id := fmt.Sprint(s.next)
+	s.uploads[id] = make(map[int][]byte)
+	return &object.MultipartUpload{UploadID: id, MinPartSize: 100 << 10, MaxCount: 100}, nil
+}
+
+func (s *partedStorage) UploadPart(key string, uploadID string, num int, body []byte) (*object.Part, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.fails[num] > 0 {
+		s.fails[num]--
+		return nil, errors.New("injected")
+	}
+	s.uploads[uploadID][num] = append([]byte{}, body...)
+	s.uploaded[num]++
+	return &object.Part{Num: num, Size: len(body), ETag: fmt.Sprint(num)}, nil
+}
+
+func (s *partedStorage) AbortUpload(key string, uploadID string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.uploads, uploadID)
+	s.aborted++
+}
+
+func (s *partedStorage) CompleteUpload(key string, uploadID string, parts []*object.Part) error {
+	s.Lock()
+	defer s.Unlock()
+	var data []byte
+	for _, p := range parts {
+		data = append(data, s.uploads[uploadID][p.Num]...)
+	}
+	delete(s.uploads, uploadID)
+	return s.ObjectStorage.Put(key, bytes.NewReader(data))
+}
+
+func TestStoreMultipart(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	blob := &partedStorage{ObjectStorage: mem, uploads: make(map[string]map[int][]byte),
+		uploaded: make(map[int]int), fails: map[int]int{3: 1}}
+	conf := defaultConf
+	conf.CacheDir = "memory"
+	conf.CacheSize = 0
+	conf.MaxRetries = 1
+	conf.PartThreshold = 512 << 10
+	store := NewCachedStore(blob, conf, nil)
+
+	data := make([]byte, conf.BlockSize)
+	rand.Read(data)
+	w := store.NewWriter(1)
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("upload should be retried: %s", err)
+	}
+	for num := 1; num <= 11; num++ {
+		if blob.uploaded[num] != 1 {
+			t.Fatalf("part %d is uploaded %d times", num, blob.uploaded[num])
+		}
+	}
+	p := NewPage(make([]byte, len(data)))
+	defer p.Release()
+	if _, err := store.NewReader(1, len(data)).ReadAt(context.Background(), p, 0); err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !bytes.Equal(p.Data, data) {
+		t.Fatalf("read unexpected data")
+	}
+
+	// the upload is aborted after all the tries failed
+	blob.fails[2] = 10
+	w = store.NewWriter(2)
+	_, _ = w.WriteAt(data, 0)
+	if err := w.Finish(len(data)); err == nil {
+		t.Fatalf("upload should fail")
+	}
+	if blob.aborted != 1 || len(blob.uploads) != 0 {
+		t.Fatalf("the failed upload should be aborted: %d aborted, %d left", blob.aborted, len(blob.uploads))
+	}
+
+	// fall back to PUT if multipart upload is not supported
+	store = NewCachedStore(mem, conf, nil)
+	w = store.NewWriter(3)
+	_, _ = w.WriteAt(data, 0)
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("upload without multipart: %s", err)
+	}
+	if _, err := mem.Head("chunks/0/0/3_0_1048576"); err != nil {
+		t.Fatalf("block is not uploaded: %s", err)
+	}
+}
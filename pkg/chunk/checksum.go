@@ -0,0 +1,93 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned when the data of a block does not match the checksum in metadata.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+const maxCachedSums = 10000
+
+// parseBlockKey returns the chunkid and index of a block from its key
+func parseBlockKey(key string) (chunkid uint64, indx int, ok bool) {
+	ps := strings.Split(key[strings.LastIndexByte(key, '/')+1:], "_")
+	if len(ps) != 3 {
+		return 0, 0, false
+	}
+	var err error
+	if chunkid, err = strconv.ParseUint(ps[0], 10, 64); err != nil {
+		return 0, 0, false
+	}
+	if indx, err = strconv.Atoi(ps[1]); err != nil {
+		return 0, 0, false
+	}
+	return chunkid, indx, true
+}
+
+// sumCache keeps the checksums of recently read chunks, they never change since a chunk is immutable.
+type sumCache struct {
+	lookup func(chunkid uint64) ([]uint32, error)
+	sums   *lruCache
+}
+
+func newSumCache(lookup func(chunkid uint64) ([]uint32, error)) *sumCache {
+	return &sumCache{lookup: lookup, sums: newLRUCache(maxCachedSums)}
+}
+
+func (c *sumCache) get(chunkid uint64) ([]uint32, error) {
+	if sums, ok := c.sums.get(chunkid); ok {
+		return sums.([]uint32), nil
+	}
+	sums, err := c.lookup(chunkid)
+	if err != nil {
+		return nil, err
+	}
+	c.sums.put(chunkid, sums) // nil for slices written without checksums
+	return sums, nil
+}
+
+// verify checks the data of a whole block against the checksum recorded in metadata, it's
+// skipped if the checksum is unknown. Partial reads of a block are not verified.
+func (store *cachedStore) verify(key string, data []byte) error {
+	if store.sums == nil {
+		return nil
+	}
+	chunkid, indx, ok := parseBlockKey(key)
+	if !ok {
+		return nil
+	}
+	sums, err := store.sums.get(chunkid)
+	if err != nil {
+		logger.Warnf("Get checksums of chunk %d: %s", chunkid, err)
+		return nil
+	}
+	if indx >= len(sums) {
+		return nil
+	}
+	if sum := crc32.Checksum(data, crc32cTable); sum != sums[indx] {
+		store.objectChecksumErrors.Add(1)
+		return fmt.Errorf("%w of %s: %08x != %08x", ErrChecksumMismatch, key, sum, sums[indx])
+	}
+	return nil
+}
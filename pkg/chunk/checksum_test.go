@@ -0,0 +1,86 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestBlockChecksums(t *testing.T) {
+	if id, indx, ok := parseBlockKey("chunks/0/1/1234_5_1024"); !ok || id != 1234 || indx != 5 {
+		t.Fatalf("parse block key: %d %d %t", id, indx, ok)
+	}
+
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = "memory"
+	conf.CacheSize = 0
+	store := NewCachedStore(mem, conf, nil)
+	data := bytes.Repeat([]byte("abcd"), conf.BlockSize/4+100)
+	w := store.NewWriter(1)
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	sums := w.Checksums()
+	if len(sums) != 2 {
+		t.Fatalf("expect 2 checksums, got %v", sums)
+	}
+
+	conf.Checksums = func(chunkid uint64) ([]uint32, error) { return sums, nil }
+	store = NewCachedStore(mem, conf, nil)
+	p := NewPage(make([]byte, 400))
+	defer p.Release()
+	if _, err := store.NewReader(1, len(data)).ReadAt(context.Background(), p, conf.BlockSize); err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !bytes.Equal(p.Data, data[conf.BlockSize:]) {
+		t.Fatalf("read unexpected data")
+	}
+
+	_ = mem.Put("chunks/0/0/1_1_400", bytes.NewReader(bytes.Repeat([]byte("x"), 400)))
+	if _, err := store.NewReader(1, len(data)).ReadAt(context.Background(), p, conf.BlockSize); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expect checksum mismatch, got %v", err)
+	}
+
+	// ranged reads of a block are not verified, but reads of the whole block are
+	key := fmt.Sprintf("chunks/0/0/1_0_%d", conf.BlockSize)
+	corrupt := append([]byte{}, data[:conf.BlockSize]...)
+	corrupt[1000] ^= 0xFF
+	_ = mem.Put(key, bytes.NewReader(corrupt))
+	small := NewPage(make([]byte, 100))
+	defer small.Release()
+	if _, err := store.NewReader(1, len(data)).ReadAt(context.Background(), small, 950); err != nil {
+		t.Fatalf("partial read: %s", err)
+	}
+	if !bytes.Equal(small.Data, corrupt[950:1050]) {
+		t.Fatalf("partial read unexpected data")
+	}
+	whole := NewPage(make([]byte, conf.BlockSize))
+	defer whole.Release()
+	if _, err := store.NewReader(1, len(data)).ReadAt(context.Background(), whole, 0); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expect checksum mismatch of whole read, got %v", err)
+	}
+}
@@ -29,15 +29,27 @@ type Writer interface {
 	io.WriterAt
 	ID() uint64
 	SetID(chunkid uint64)
+	SetInode(inode uint64, indx uint32) // the file and chunk index the data belongs to
 	FlushTo(offset int) error
 	Finish(length int) error
 	Abort()
+	Checksums() []uint32 // CRC32C of every block, valid after Finish
+	AllowPacking()       // the data could be stored in a shared object if it's small
+	Packed() *Pack       // location in the shared object, or nil if it's stored as blocks, valid after Finish
+	AllowInline()        // the data could be kept in metadata engine if it's small enough
+	Inlined() []byte     // data to be stored in metadata engine, or nil if it's uploaded, valid after Finish
 }
 
 type ChunkStore interface {
 	NewReader(chunkid uint64, length int) Reader
 	NewWriter(chunkid uint64) Writer
 	Remove(chunkid uint64, length int) error
+	RemoveBlock(hash string) error // delete a deduplicated object which is not referenced any more
 	FillCache(chunkid uint64, length uint32) error
+	PinCache(chunkid uint64, length uint32) error
+	UnpinCache(chunkid uint64, length uint32) error
+	EvictCache(chunkid uint64, length uint32) error
+	CheckCache(chunkid uint64, length uint32) (uint64, error)
+	ScrubBlock(key string) (int, error) // read a block from object storage and check its content
 	UsedMemory() int64
 }
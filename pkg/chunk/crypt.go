@@ -0,0 +1,156 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// blocks on local disk are sealed in segments, so a partial read only decrypts the segments it covers
+const cryptSegment = 64 << 10
+
+// cacheCrypter seals every segment of a block with AES-GCM and a random nonce prepended, the key of
+// block, the index of segment and the size of block are bound as additional data, so the segments
+// can't be swapped, truncated or moved to another block.
+type cacheCrypter struct {
+	aead     cipher.AEAD
+	overhead int64
+	segments sync.Pool // buffers of sealed segments
+}
+
+func newCacheCrypter(key []byte) (*cacheCrypter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &cacheCrypter{aead: aead, overhead: int64(aead.NonceSize() + aead.Overhead())}
+	c.segments.New = func() interface{} {
+		buf := make([]byte, cryptSegment+c.overhead)
+		return &buf
+	}
+	return c, nil
+}
+
+// aad returns the additional data of a segment
+func (c *cacheCrypter) aad(key string, indx, size int64) []byte {
+	buf := make([]byte, len(key)+16)
+	n := copy(buf, key)
+	binary.BigEndian.PutUint64(buf[n:], uint64(indx))
+	binary.BigEndian.PutUint64(buf[n+8:], uint64(size))
+	return buf
+}
+
+func (c *cacheCrypter) encrypt(key string, data []byte) ([]byte, error) {
+	segs := (int64(len(data)) + cryptSegment - 1) / cryptSegment
+	buf := make([]byte, 0, int64(len(data))+segs*c.overhead)
+	nonceSize := c.aead.NonceSize()
+	for off := 0; off < len(data); off += cryptSegment {
+		end := off + cryptSegment
+		if end > len(data) {
+			end = len(data)
+		}
+		nonce := buf[len(buf) : len(buf)+nonceSize]
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		buf = c.aead.Seal(buf[:len(buf)+nonceSize], nonce, data[off:end], c.aad(key, int64(off/cryptSegment), int64(len(data))))
+	}
+	return buf, nil
+}
+
+// plainSize returns the size of plaintext for an encrypted file
+func (c *cacheCrypter) plainSize(size int64) int64 {
+	full := cryptSegment + c.overhead
+	segs := (size + full - 1) / full
+	return size - segs*c.overhead
+}
+
+// open returns a reader of the encrypted file of block key
+func (c *cacheCrypter) open(f *os.File, key string) (*cryptFile, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	size := c.plainSize(fi.Size())
+	if size < 0 {
+		_ = f.Close()
+		return nil, fmt.Errorf("invalid encrypted file %s: size %d", f.Name(), fi.Size())
+	}
+	return &cryptFile{File: f, c: c, key: key, size: size}, nil
+}
+
+type cryptFile struct {
+	*os.File
+	c    *cacheCrypter
+	key  string
+	size int64
+	off  int64
+}
+
+func (f *cryptFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	var n int
+	bufp := f.c.segments.Get().(*[]byte)
+	defer f.c.segments.Put(bufp)
+	buf := *bufp
+	nonceSize := int64(f.c.aead.NonceSize())
+	for n < len(p) && off < f.size {
+		indx := off / cryptSegment
+		plen := f.size - indx*cryptSegment
+		if plen > cryptSegment {
+			plen = cryptSegment
+		}
+		sealed := buf[:plen+f.c.overhead]
+		if _, err := f.File.ReadAt(sealed, indx*(cryptSegment+f.c.overhead)); err != nil {
+			return n, err
+		}
+		plain, err := f.c.aead.Open(sealed[nonceSize:nonceSize], sealed[:nonceSize], sealed[nonceSize:], f.c.aad(f.key, indx, f.size))
+		if err != nil {
+			return n, fmt.Errorf("decrypt %s segment %d: %s", f.Name(), indx, err)
+		}
+		c := copy(p[n:], plain[off-indx*cryptSegment:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *cryptFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,119 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestCacheCrypter(t *testing.T) {
+	c, err := newCacheCrypter(bytes.Repeat([]byte{0x2}, 32))
+	if err != nil {
+		t.Fatalf("new crypter: %s", err)
+	}
+	data := make([]byte, cryptSegment*2+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	sealed, err := c.encrypt("chunks/0/0/1_0_131172", data)
+	if err != nil {
+		t.Fatalf("encrypt: %s", err)
+	}
+	if size := c.plainSize(int64(len(sealed))); size != int64(len(data)) {
+		t.Fatalf("plain size %d != %d", size, len(data))
+	}
+	path := filepath.Join(t.TempDir(), "block")
+	if err = os.WriteFile(path, sealed, 0600); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	fd, _ := os.Open(path)
+	f, err := c.open(fd, "chunks/0/0/1_0_131172")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer f.Close()
+	buf := make([]byte, 300)
+	if n, err := f.ReadAt(buf, cryptSegment*2-100); err != io.EOF || n != 200 {
+		t.Fatalf("read at the end: %d %s", n, err)
+	} else if !bytes.Equal(buf[:n], data[cryptSegment*2-100:]) {
+		t.Fatalf("read unexpected data")
+	}
+	all, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Fatalf("read all: %d %s", len(all), err)
+	}
+
+	other, _ := newCacheCrypter(bytes.Repeat([]byte{0x3}, 32))
+	fd, _ = os.Open(path)
+	f2, _ := other.open(fd, "chunks/0/0/1_0_131172")
+	defer f2.Close()
+	if _, err = f2.ReadAt(buf, 0); err == nil {
+		t.Fatalf("read with a wrong key should fail")
+	}
+
+	// the segments are bound to the block, their positions and the size of block
+	fd, _ = os.Open(path)
+	f3, _ := c.open(fd, "chunks/0/0/2_0_131172")
+	defer f3.Close()
+	if _, err = f3.ReadAt(buf, 0); err == nil {
+		t.Fatalf("read as another block should fail")
+	}
+	full := cryptSegment + int(c.overhead)
+	swapped := append(append(append([]byte{}, sealed[full:2*full]...), sealed[:full]...), sealed[2*full:]...)
+	truncated := sealed[:2*full]
+	for i, bad := range [][]byte{swapped, truncated} {
+		p := filepath.Join(t.TempDir(), "bad")
+		_ = os.WriteFile(p, bad, 0600)
+		fd, _ = os.Open(p)
+		fb, _ := c.open(fd, "chunks/0/0/1_0_131172")
+		if _, err = fb.ReadAt(buf, 0); err == nil {
+			t.Fatalf("read of tampered file %d should fail", i)
+		}
+		fb.Close()
+	}
+}
+
+func TestEncryptedStaging(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.CacheKey = bytes.Repeat([]byte{0x1}, 32)
+	c, _ := newCacheCrypter(conf.CacheKey)
+	sealed, _ := c.encrypt("chunks/0/0/123_0_4", []byte("good"))
+	p := filepath.Join(conf.CacheDir, stagingDir, "chunks/0/0/123_0_4")
+	_ = os.MkdirAll(filepath.Dir(p), 0744)
+	_ = os.WriteFile(p, sealed, 0600)
+
+	conf.Writeback = true
+	_ = NewCachedStore(mem, conf, nil)
+	time.Sleep(time.Millisecond * 50) // wait for scan to finish
+	in, err := mem.Get("chunks/0/0/123_0_4", 0, -1)
+	if err != nil {
+		t.Fatalf("staging object should be upload")
+	}
+	data, _ := io.ReadAll(in)
+	if string(data) != "good" {
+		t.Fatalf("data %s != expect good", data)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const maxCachedHashes = 10000
+
+// DedupKey returns the key of a deduplicated object, which is named by the hash of its content.
+func DedupKey(hash string) string {
+	return fmt.Sprintf("chunks/dedup/%s/%s", hash[:2], hash)
+}
+
+// ParseDedupKey returns the content hash of a deduplicated object from its key.
+func ParseDedupKey(key string) (string, bool) {
+	ps := strings.Split(key, "/")
+	if len(ps) < 3 || ps[len(ps)-3] != "dedup" || len(ps[len(ps)-1]) != sha256.Size*2 {
+		return "", false
+	}
+	return ps[len(ps)-1], true
+}
+
+// hashCache keeps the content hashes of blocks in recently read chunks.
+type hashCache struct {
+	lookup func(chunkid uint64) ([]string, error)
+	hashes *lruCache
+}
+
+func newHashCache(lookup func(chunkid uint64) ([]string, error)) *hashCache {
+	return &hashCache{lookup: lookup, hashes: newLRUCache(maxCachedHashes)}
+}
+
+func (c *hashCache) get(chunkid uint64) ([]string, error) {
+	if hashes, ok := c.hashes.get(chunkid); ok {
+		return hashes.([]string), nil
+	}
+	hashes, err := c.lookup(chunkid)
+	if err != nil {
+		return nil, err
+	}
+	c.hashes.put(chunkid, hashes) // nil for chunks without deduplicated blocks
+	return hashes, nil
+}
+
+func (c *hashCache) forget(chunkid uint64) {
+	c.hashes.remove(chunkid)
+}
+
+// dedupKey returns the deduplicated object of a block, or the key itself if it's stored alone.
+func (store *cachedStore) dedupKey(key string) (string, error) {
+	if store.hashes == nil {
+		return key, nil
+	}
+	chunkid, indx, ok := parseBlockKey(key)
+	if !ok {
+		return key, nil
+	}
+	hashes, err := store.hashes.get(chunkid)
+	if err != nil {
+		return "", fmt.Errorf("locate %s: %s", key, err)
+	}
+	if indx < len(hashes) && hashes[indx] != "" {
+		return DedupKey(hashes[indx]), nil
+	}
+	return key, nil
+}
+
+// hashBlock returns the hash of a block to find the object with the same content, it's keyed if
+// HashKey is set, so the names of objects don't reveal the content on encrypted volumes.
+func (store *cachedStore) hashBlock(data []byte) string {
+	if len(store.conf.HashKey) > 0 {
+		h := hmac.New(sha256.New, store.conf.HashKey)
+		_, _ = h.Write(data)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// dedup adds a reference from the block to the object with the same content, and returns the key to
+// upload the block, or an empty string if the object is stored already.
+func (store *cachedStore) dedup(key string, data []byte) (string, error) {
+	chunkid, indx, ok := parseBlockKey(key)
+	if !ok {
+		return key, nil
+	}
+	hash := store.hashBlock(data)
+	refs, err := store.conf.Dedup(chunkid, indx, hash, len(data))
+	if err != nil {
+		return "", fmt.Errorf("dedup block %s: %s", key, err)
+	}
+	if refs == 0 {
+		return key, nil // the object is being deleted, store it alone
+	}
+	obj := DedupKey(hash)
+	if refs > 1 {
+		if _, err = store.storage.Head(obj); err == nil {
+			logger.Debugf("block %s is stored as %s already", key, obj)
+			store.dedupedBlocks.Add(1)
+			store.dedupedBytes.Add(float64(len(data)))
+			return "", nil
+		}
+	}
+	return obj, nil
+}
@@ -17,7 +17,9 @@
 package chunk
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
 	"hash/fnv"
 	"io"
 	"math"
@@ -37,6 +39,7 @@ import (
 var (
 	stagingDir = "rawstaging"
 	cacheDir   = "raw"
+	pinnedFile = "pinned"
 )
 
 type cacheItem struct {
@@ -59,15 +62,23 @@ type cacheStore struct {
 	pending   chan pendingFile
 	pages     map[string]*Page
 	m         *cacheManager
+	crypter   *cacheCrypter
 
 	used     int64
 	keys     map[string]cacheItem
 	scanned  bool
 	full     bool
 	uploader func(key, path string, force bool) bool
+	journal  *stagingJournal
+
+	// pinned blocks are never evicted, they are counted in pinnedUsed instead of used
+	pinCapacity int64
+	pinnedUsed  int64
+	pinned      map[string]int32
+	pinDirty    bool
 }
 
-func newCacheStore(m *cacheManager, dir string, cacheSize int64, pendingPages int, config *Config, uploader func(key, path string, force bool) bool) *cacheStore {
+func newCacheStore(m *cacheManager, dir string, cacheSize, pinnedSize int64, pendingPages int, config *Config, uploader func(key, path string, force bool) bool) *cacheStore {
 	if config.CacheMode == 0 {
 		config.CacheMode = 0600 // only owner can read/write cache
 	}
@@ -84,17 +95,37 @@ func newCacheStore(m *cacheManager, dir string, cacheSize int64, pendingPages in
 		pending:   make(chan pendingFile, pendingPages),
 		pages:     make(map[string]*Page),
 		uploader:  uploader,
+
+		pinCapacity: pinnedSize,
+		pinned:      make(map[string]int32),
+	}
+	if len(config.CacheKey) > 0 {
+		var err error
+		if c.crypter, err = newCacheCrypter(config.CacheKey); err != nil {
+			logger.Fatalf("Invalid key to encrypt cache: %s", err)
+		}
 	}
 	c.createDir(c.dir)
+	c.loadPinned()
+	if uploader != nil {
+		var err error
+		if c.journal, err = openJournal(c.dir, c.mode); err != nil {
+			logger.Warnf("Open staging journal in %s: %s", c.dir, err)
+		}
+	}
 	br, fr := c.curFreeRatio()
 	if br < c.freeRatio || fr < c.freeRatio {
 		logger.Warnf("not enough space (%d%%) or inodes (%d%%) for caching in %s: free ratio should be >= %d%%", int(br*100), int(fr*100), c.dir, int(c.freeRatio*100))
 	}
 	logger.Infof("Disk cache (%s): capacity (%d MB), free ratio (%d%%), max pending pages (%d)", c.dir, c.capacity>>20, int(c.freeRatio*100), pendingPages)
+	if c.pinCapacity > 0 || len(c.pinned) > 0 {
+		logger.Infof("Disk cache (%s): pinned capacity (%d MB), %d pinned blocks (%d MB)", c.dir, c.pinCapacity>>20, len(c.pinned), c.pinnedUsed>>20)
+	}
 	go c.flush()
 	go c.checkFreeSpace()
 	go c.refreshCacheKeys()
 	go c.scanStaging()
+	go c.persistPinned()
 	return c
 }
 
@@ -105,7 +136,7 @@ func (c *cacheStore) usedMemory() int64 {
 func (cache *cacheStore) stats() (int64, int64) {
 	cache.Lock()
 	defer cache.Unlock()
-	return int64(len(cache.pages) + len(cache.keys)), cache.used + cache.usedMemory()
+	return int64(len(cache.pages) + len(cache.keys)), cache.used + cache.pinnedUsed + cache.usedMemory()
 }
 
 func (cache *cacheStore) checkFreeSpace() {
@@ -169,13 +200,19 @@ func (cache *cacheStore) curFreeRatio() (float32, float32) {
 	return float32(free) / float32(total), float32(ffree) / float32(files)
 }
 
-func (cache *cacheStore) flushPage(path string, data []byte) (err error) {
+func (cache *cacheStore) flushPage(key, path string, data []byte) (err error) {
 	start := time.Now()
 	cache.m.cacheWrites.Add(1)
 	cache.m.cacheWriteBytes.Add(float64(len(data)))
 	defer func() {
 		cache.m.cacheWriteHist.Observe(time.Since(start).Seconds())
 	}()
+	if cache.crypter != nil {
+		if data, err = cache.crypter.encrypt(key, data); err != nil {
+			logger.Warnf("Encrypt cache file %s failed: %s", path, err)
+			return err
+		}
+	}
 	cache.createDir(filepath.Dir(path))
 	tmp := path + ".tmp"
 	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE, cache.mode)
@@ -224,24 +261,21 @@ func (cache *cacheStore) remove(key string) {
 	cache.Lock()
 	path := cache.cachePath(key)
 	if it, ok := cache.keys[key]; ok {
-		if it.size > 0 {
-			cache.used -= int64(it.size + 4096)
-		}
+		cache.release(key, it)
 		delete(cache.keys, key)
 	} else if cache.scanned {
 		path = "" // not existed
 	}
+	if size, ok := cache.pinned[key]; ok {
+		// the block is deleted, release its pinned quota
+		delete(cache.pinned, key)
+		cache.pinnedUsed -= int64(size + 4096)
+		cache.pinDirty = true
+	}
 	cache.Unlock()
 	if path != "" {
 		_ = os.Remove(path)
-		stagingPath := cache.stagePath(key)
-		if fi, err := os.Stat(stagingPath); err == nil {
-			size := fi.Size()
-			if err = os.Remove(stagingPath); err == nil {
-				cache.m.stageBlocks.Sub(1)
-				cache.m.stageBlockBytes.Sub(float64(size))
-			}
-		}
+		cache.removeStage(key)
 	}
 }
 
@@ -255,7 +289,14 @@ func (cache *cacheStore) load(key string) (ReadCloser, error) {
 		return nil, errors.New("not cached")
 	}
 	cache.Unlock()
-	f, err := os.Open(cache.cachePath(key))
+	var f ReadCloser
+	fd, err := os.Open(cache.cachePath(key))
+	if err == nil {
+		f = fd
+		if cache.crypter != nil {
+			f, err = cache.crypter.open(fd, key)
+		}
+	}
 	cache.Lock()
 	if err == nil {
 		if it, ok := cache.keys[key]; ok {
@@ -263,14 +304,51 @@ func (cache *cacheStore) load(key string) (ReadCloser, error) {
 			cache.keys[key] = cacheItem{it.size, uint32(time.Now().Unix())}
 		}
 	} else if it, ok := cache.keys[key]; ok {
-		if it.size > 0 {
-			cache.used -= int64(it.size + 4096)
-		}
+		cache.release(key, it)
 		delete(cache.keys, key)
 	}
 	return f, err
 }
 
+func (cache *cacheStore) exist(key string) bool {
+	cache.Lock()
+	defer cache.Unlock()
+	if _, ok := cache.pages[key]; ok {
+		return true
+	}
+	if cache.scanned {
+		_, ok := cache.keys[key]
+		return ok
+	}
+	_, err := os.Stat(cache.cachePath(key))
+	return err == nil
+}
+
+// evict removes the cached block from disk, but keeps the staging one and the pinned one
+func (cache *cacheStore) evict(key string) {
+	cache.Lock()
+	if _, ok := cache.pinned[key]; ok {
+		cache.Unlock()
+		return
+	}
+	if it, ok := cache.keys[key]; ok {
+		cache.release(key, it)
+		delete(cache.keys, key)
+	}
+	cache.Unlock()
+	if err := os.Remove(cache.cachePath(key)); err == nil {
+		cache.m.cacheEvicts.Add(1)
+	}
+}
+
+// fileSize returns the size of block stored in the file
+func (cache *cacheStore) fileSize(fi os.FileInfo) int64 {
+	if cache.crypter != nil {
+		return cache.crypter.plainSize(fi.Size())
+	}
+	return fi.Size()
+}
+
 func (cache *cacheStore) cachePath(key string) string {
 	return filepath.Join(cache.dir, cacheDir, key)
 }
@@ -284,7 +362,7 @@ func (cache *cacheStore) flush() {
 	for {
 		w := <-cache.pending
 		path := cache.cachePath(w.key)
-		if cache.capacity > 0 && cache.flushPage(path, w.page.Data) == nil {
+		if cache.capacity > 0 && cache.flushPage(w.key, path, w.page.Data) == nil {
 			cache.add(w.key, int32(len(w.page.Data)), uint32(time.Now().Unix()))
 		}
 		cache.Lock()
@@ -299,8 +377,8 @@ func (cache *cacheStore) add(key string, size int32, atime uint32) {
 	cache.Lock()
 	defer cache.Unlock()
 	it, ok := cache.keys[key]
-	if ok && it.size > 0 {
-		cache.used -= int64(it.size + 4096)
+	if ok {
+		cache.release(key, it)
 	}
 	if atime == 0 {
 		// update size of staging block
@@ -308,7 +386,7 @@ func (cache *cacheStore) add(key string, size int32, atime uint32) {
 	} else {
 		cache.keys[key] = cacheItem{size, atime}
 	}
-	if size > 0 {
+	if _, pinned := cache.pinned[key]; size > 0 && !pinned {
 		cache.used += int64(size + 4096)
 	}
 
@@ -318,15 +396,18 @@ func (cache *cacheStore) add(key string, size int32, atime uint32) {
 	}
 }
 
-func (cache *cacheStore) stage(key string, data []byte, keepCache bool) (string, error) {
+func (cache *cacheStore) stage(key string, data []byte, keepCache bool, inode uint64, indx uint32) (string, error) {
 	stagingPath := cache.stagePath(key)
 	if cache.full {
 		return stagingPath, errors.New("Space not enough on device")
 	}
-	err := cache.flushPage(stagingPath, data)
+	err := cache.flushPage(key, stagingPath, data)
 	if err == nil {
 		cache.m.stageBlocks.Add(1)
 		cache.m.stageBlockBytes.Add(float64(len(data)))
+		if cache.journal != nil {
+			cache.journal.add(key, inode, indx, time.Now())
+		}
 		if cache.capacity > 0 && keepCache {
 			path := cache.cachePath(key)
 			cache.createDir(filepath.Dir(path))
@@ -340,10 +421,151 @@ func (cache *cacheStore) stage(key string, data []byte, keepCache bool) (string,
 	return stagingPath, err
 }
 
+// removeStage removes the block from staging directory after it's uploaded or deleted
+func (cache *cacheStore) removeStage(key string) {
+	stagingPath := cache.stagePath(key)
+	var removed bool
+	if fi, err := os.Stat(stagingPath); err == nil {
+		size := cache.fileSize(fi)
+		if err = os.Remove(stagingPath); err == nil {
+			cache.m.stageBlocks.Sub(1)
+			cache.m.stageBlockBytes.Sub(float64(size))
+			removed = true
+		}
+	}
+	if cache.journal != nil && cache.journal.remove(key) && !removed {
+		// removed by others, e.g. `juicefs status --pending --flush`
+		cache.m.stageBlocks.Sub(1)
+		cache.m.stageBlockBytes.Sub(float64(parseObjOrigSize(key)))
+	}
+}
+
 func (cache *cacheStore) uploaded(key string, size int) {
 	cache.add(key, int32(size), 0)
 }
 
+// locked
+func (cache *cacheStore) release(key string, it cacheItem) {
+	if _, pinned := cache.pinned[key]; it.size > 0 && !pinned {
+		cache.used -= int64(it.size + 4096)
+	}
+}
+
+func (cache *cacheStore) pin(key string) error {
+	cache.Lock()
+	defer cache.Unlock()
+	if _, ok := cache.pinned[key]; ok {
+		return nil
+	}
+	size := int32(parseObjOrigSize(key))
+	if cache.pinCapacity == 0 {
+		return errors.New("pinned cache is disabled")
+	}
+	if cache.pinnedUsed+int64(size+4096) > cache.pinCapacity {
+		return fmt.Errorf("pinned cache is full (%s): %d + %d > %d", cache.dir, cache.pinnedUsed, size+4096, cache.pinCapacity)
+	}
+	if it, ok := cache.keys[key]; ok {
+		cache.release(key, it)
+	}
+	cache.pinned[key] = size
+	cache.pinnedUsed += int64(size + 4096)
+	cache.pinDirty = true
+	return nil
+}
+
+func (cache *cacheStore) unpin(key string) {
+	cache.Lock()
+	defer cache.Unlock()
+	size, ok := cache.pinned[key]
+	if !ok {
+		return
+	}
+	delete(cache.pinned, key)
+	cache.pinnedUsed -= int64(size + 4096)
+	cache.pinDirty = true
+	if it, ok := cache.keys[key]; ok && it.size > 0 {
+		// it's a normal cached block now
+		cache.used += int64(it.size + 4096)
+		if cache.used > cache.capacity {
+			cache.cleanup()
+		}
+	}
+}
+
+func (cache *cacheStore) pinnedPath() string {
+	return filepath.Join(cache.dir, pinnedFile)
+}
+
+func (cache *cacheStore) loadPinned() {
+	f, err := os.Open(cache.pinnedPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("Load pinned blocks from %s: %s", cache.pinnedPath(), err)
+		}
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" {
+			continue
+		}
+		size := int32(parseObjOrigSize(key))
+		cache.pinned[key] = size
+		cache.pinnedUsed += int64(size + 4096)
+	}
+	if err = scanner.Err(); err != nil {
+		logger.Warnf("Read pinned blocks from %s: %s", cache.pinnedPath(), err)
+	}
+	if cache.pinnedUsed > cache.pinCapacity {
+		logger.Warnf("Pinned blocks (%d MB) exceed pinned capacity (%d MB) in %s, unpin some of them", cache.pinnedUsed>>20, cache.pinCapacity>>20, cache.dir)
+	}
+}
+
+func (cache *cacheStore) savePinned() error {
+	cache.Lock()
+	if !cache.pinDirty {
+		cache.Unlock()
+		return nil
+	}
+	keys := make([]string, 0, len(cache.pinned))
+	for key := range cache.pinned {
+		keys = append(keys, key)
+	}
+	cache.pinDirty = false
+	cache.Unlock()
+
+	sort.Strings(keys)
+	var data []byte
+	for _, key := range keys {
+		data = append(data, key...)
+		data = append(data, '\n')
+	}
+	path := cache.pinnedPath()
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, data, cache.mode)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		cache.Lock()
+		cache.pinDirty = true
+		cache.Unlock()
+	}
+	return err
+}
+
+func (cache *cacheStore) persistPinned() {
+	for {
+		if err := cache.savePinned(); err != nil {
+			logger.Warnf("Save pinned blocks into %s: %s", cache.pinnedPath(), err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
 // locked
 func (cache *cacheStore) cleanup() {
 	if !cache.scanned {
@@ -383,6 +605,9 @@ func (cache *cacheStore) cleanup() {
 		if value.size < 0 {
 			continue // staging
 		}
+		if _, ok := cache.pinned[key]; ok {
+			continue
+		}
 		if cnt == 0 || lastValue.atime > value.atime {
 			lastKey = key
 			lastValue = value
@@ -494,10 +719,11 @@ func (cache *cacheStore) scanCached() {
 					key = strings.ReplaceAll(key, "\\", "/")
 				}
 				atime := uint32(getAtime(fi).Unix())
+				size := cache.fileSize(fi)
 				if getNlink(fi) > 1 {
-					cache.add(key, -int32(fi.Size()), atime)
+					cache.add(key, -int32(size), atime)
 				} else {
-					cache.add(key, int32(fi.Size()), atime)
+					cache.add(key, int32(size), atime)
 				}
 			}
 		}
@@ -518,6 +744,9 @@ func (cache *cacheStore) scanStaging() {
 	var start = time.Now()
 	var oneMinAgo = start.Add(-time.Minute)
 	var count int
+	var found = make(map[string]bool)
+	var keys, paths []string
+	var missing []*PendingBlock
 	stagingPrefix := filepath.Join(cache.dir, stagingDir)
 	logger.Debugf("Scan %s to find staging blocks", stagingPrefix)
 	_ = filepath.Walk(stagingPrefix, func(path string, fi os.FileInfo, err error) error {
@@ -530,19 +759,38 @@ func (cache *cacheStore) scanStaging() {
 					}
 				}
 			} else {
-				logger.Debugf("Found staging block: %s", path)
 				cache.m.stageBlocks.Add(1)
-				cache.m.stageBlockBytes.Add(float64(fi.Size()))
+				cache.m.stageBlockBytes.Add(float64(cache.fileSize(fi)))
 				key := path[len(stagingPrefix)+1:]
 				if runtime.GOOS == "windows" {
 					key = strings.ReplaceAll(key, "\\", "/")
 				}
-				cache.uploader(key, path, false)
+				found[key] = true
+				if b := cache.journal.get(key); b != nil {
+					logger.Debugf("Found staging block: %s (inode %d, staged at %s)", path, b.Inode, b.Staged)
+				} else {
+					// staged by an old client, or the journal is lost
+					logger.Debugf("Found staging block: %s (not in journal)", path)
+					missing = append(missing, newPendingBlock(cache.dir, key, 0, 0, fi.ModTime()))
+				}
+				keys = append(keys, key)
+				paths = append(paths, path)
 				count++
 			}
 		}
 		return nil
 	})
+	// add them before uploading, otherwise the record could be added after it's removed
+	cache.journal.addAll(missing)
+	for i, key := range keys {
+		cache.uploader(key, paths[i], false)
+	}
+	for _, b := range cache.journal.list() {
+		if !found[b.Key] {
+			logger.Debugf("Staging block %s of inode %d is gone", b.Key, b.Inode)
+			cache.journal.remove(b.Key)
+		}
+	}
 	if count > 0 {
 		logger.Infof("Found %d staging blocks (%d bytes) in %s with %s", count, cache.used, cache.dir, time.Since(start))
 	}
@@ -608,9 +856,14 @@ func expandDir(pattern string) []string {
 type CacheManager interface {
 	cache(key string, p *Page, force bool)
 	remove(key string)
+	evict(key string)
+	exist(key string) bool
 	load(key string) (ReadCloser, error)
 	uploaded(key string, size int)
-	stage(key string, data []byte, keepCache bool) (string, error)
+	pin(key string) error
+	unpin(key string)
+	stage(key string, data []byte, keepCache bool, inode uint64, indx uint32) (string, error)
+	removeStage(key string)
 	stagePath(key string) string
 	stats() (int64, int64)
 	usedMemory() int64
@@ -640,6 +893,8 @@ func newCacheManager(config *Config, reg prometheus.Registerer, uploader func(ke
 	sort.Strings(dirs)
 	dirCacheSize := config.CacheSize << 20
 	dirCacheSize /= int64(len(dirs))
+	dirPinnedSize := config.PinnedCacheSize << 20
+	dirPinnedSize /= int64(len(dirs))
 	m := &cacheManager{
 		stores: make([]*cacheStore, len(dirs)),
 
@@ -681,16 +936,66 @@ func newCacheManager(config *Config, reg prometheus.Registerer, uploader func(ke
 		reg.MustRegister(m.cacheWriteHist)
 		reg.MustRegister(m.stageBlocks)
 		reg.MustRegister(m.stageBlockBytes)
+		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "staging_block_delay_seconds",
+			Help: "Age of the oldest block in the staging path.",
+		}, m.stageDelay))
+		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "staging_pending_blocks",
+			Help: "Number of staged blocks waiting to be uploaded.",
+		}, func() float64 {
+			n, _ := m.stagePending()
+			return float64(n)
+		}))
+		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "staging_pending_bytes",
+			Help: "Total bytes of staged blocks waiting to be uploaded.",
+		}, func() float64 {
+			_, size := m.stagePending()
+			return float64(size)
+		}))
 	}
 
 	// 20% of buffer could be used for pending pages
 	pendingPages := config.BufferSize * 2 / 10 / config.BlockSize / len(dirs)
 	for i, d := range dirs {
-		m.stores[i] = newCacheStore(m, strings.TrimSpace(d)+string(filepath.Separator), dirCacheSize, pendingPages, config, uploader)
+		m.stores[i] = newCacheStore(m, strings.TrimSpace(d)+string(filepath.Separator), dirCacheSize, dirPinnedSize, pendingPages, config, uploader)
 	}
 	return m
 }
 
+// stagePending returns the number and total size of the blocks waiting to be uploaded
+func (m *cacheManager) stagePending() (int, int64) {
+	var count int
+	var size int64
+	for _, s := range m.stores {
+		if s == nil || s.journal == nil {
+			continue
+		}
+		n, b := s.journal.pending()
+		count += n
+		size += b
+	}
+	return count, size
+}
+
+// stageDelay returns the seconds since the oldest pending block was staged
+func (m *cacheManager) stageDelay() float64 {
+	var oldest time.Time
+	for _, s := range m.stores {
+		if s == nil || s.journal == nil {
+			continue
+		}
+		if t := s.journal.oldest(); !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest).Seconds()
+}
+
 func (m *cacheManager) getStore(key string) *cacheStore {
 	return m.stores[keyHash(key)%uint32(len(m.stores))]
 }
@@ -731,8 +1036,20 @@ func (m *cacheManager) remove(key string) {
 	m.getStore(key).remove(key)
 }
 
-func (m *cacheManager) stage(key string, data []byte, keepCache bool) (string, error) {
-	return m.getStore(key).stage(key, data, keepCache)
+func (m *cacheManager) evict(key string) {
+	m.getStore(key).evict(key)
+}
+
+func (m *cacheManager) exist(key string) bool {
+	return m.getStore(key).exist(key)
+}
+
+func (m *cacheManager) stage(key string, data []byte, keepCache bool, inode uint64, indx uint32) (string, error) {
+	return m.getStore(key).stage(key, data, keepCache, inode, indx)
+}
+
+func (m *cacheManager) removeStage(key string) {
+	m.getStore(key).removeStage(key)
 }
 
 func (m *cacheManager) stagePath(key string) string {
@@ -742,3 +1059,11 @@ func (m *cacheManager) stagePath(key string) string {
 func (m *cacheManager) uploaded(key string, size int) {
 	m.getStore(key).uploaded(key, size)
 }
+
+func (m *cacheManager) pin(key string) error {
+	return m.getStore(key).pin(key)
+}
+
+func (m *cacheManager) unpin(key string) {
+	m.getStore(key).unpin(key)
+}
@@ -0,0 +1,163 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	hedgeSamples    = 1000 // number of recent requests to calculate the threshold
+	hedgeMinSamples = 50   // don't hedge before having enough samples
+	hedgeMaxTokens  = 10   // max burst of extra requests
+)
+
+// hedger decides when to issue an extra request for a slow one, the threshold is the percentile
+// of the latency to first byte of recent requests, and the extra requests are limited by a budget,
+// which grows by a ratio of normal requests.
+type hedger struct {
+	sync.Mutex
+	percentile float64
+	budget     float64
+	samples    []time.Duration
+	next       int
+	added      int
+	threshold  time.Duration
+	tokens     float64
+}
+
+func newHedger(percentile, budget float64) *hedger {
+	return &hedger{
+		percentile: percentile,
+		budget:     budget,
+		samples:    make([]time.Duration, 0, hedgeSamples),
+	}
+}
+
+// begin adds the budget for a new request, and returns how long to wait before hedging,
+// or 0 if there are not enough samples yet.
+func (h *hedger) begin() time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	h.tokens += h.budget
+	if h.tokens > hedgeMaxTokens {
+		h.tokens = hedgeMaxTokens
+	}
+	return h.threshold
+}
+
+func (h *hedger) current() time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	return h.threshold
+}
+
+func (h *hedger) observe(used time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, used)
+	} else {
+		h.samples[h.next] = used
+		h.next = (h.next + 1) % hedgeSamples
+	}
+	h.added++
+	if len(h.samples) >= hedgeMinSamples && (h.threshold == 0 || h.added >= hedgeSamples/10) {
+		sorted := make([]time.Duration, len(h.samples))
+		copy(sorted, h.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		h.threshold = sorted[int(float64(len(sorted)-1)*h.percentile)]
+		h.added = 0
+	}
+}
+
+// acquire takes a token from the budget for an extra request.
+func (h *hedger) acquire() bool {
+	h.Lock()
+	defer h.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// get reads an object from the storage, and sends another request if the first one doesn't respond in time,
+// the response comes first will be used.
+func (store *cachedStore) get(key string, off, limit int64) (io.ReadCloser, error) {
+	storage, err := store.storageOf(key)
+	if err != nil {
+		return nil, err
+	}
+	h := store.hedger
+	if h == nil {
+		return storage.Get(key, off, limit)
+	}
+	type result struct {
+		in     io.ReadCloser
+		err    error
+		hedged bool
+	}
+	results := make(chan result, 2)
+	start := time.Now()
+	do := func(hedged bool) {
+		in, err := storage.Get(key, off, limit)
+		if !hedged && err == nil {
+			h.observe(time.Since(start))
+		}
+		results <- result{in, err, hedged}
+	}
+	go do(false)
+	delay := h.begin()
+	if delay == 0 {
+		r := <-results
+		return r.in, r.err
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending := 1
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err != nil && pending > 0 {
+				continue // wait for the other one
+			}
+			if r.err == nil && r.hedged {
+				store.hedgeWins.Add(1)
+			}
+			if pending > 0 {
+				go func() {
+					if r := <-results; r.in != nil {
+						_ = r.in.Close()
+					}
+				}()
+			}
+			return r.in, r.err
+		case <-timer.C:
+			if pending == 1 && h.acquire() {
+				logger.Debugf("GET %s has no response after %s, send another request", key, delay)
+				store.hedgedRequests.Add(1)
+				pending++
+				go do(true)
+			}
+		}
+	}
+}
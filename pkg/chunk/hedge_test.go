@@ -0,0 +1,96 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowStorage delays the first GET request
+type slowStorage struct {
+	object.ObjectStorage
+	gets int32
+}
+
+func (s *slowStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if atomic.AddInt32(&s.gets, 1) == 1 {
+		time.Sleep(time.Second)
+	}
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+func TestHedger(t *testing.T) {
+	h := newHedger(0.9, 0.25)
+	if d := h.begin(); d != 0 {
+		t.Fatalf("hedge without samples: %s", d)
+	}
+	for i := 1; i <= hedgeMinSamples; i++ {
+		h.observe(time.Millisecond * time.Duration(i))
+	}
+	if d := h.current(); d != time.Millisecond*45 {
+		t.Fatalf("threshold of p90: %s", d)
+	}
+	h.tokens = 0
+	for i := 0; i < 3; i++ {
+		h.begin()
+	}
+	if h.acquire() {
+		t.Fatalf("extra request should be limited by budget")
+	}
+	h.begin()
+	if !h.acquire() {
+		t.Fatalf("extra request should be allowed")
+	}
+
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	_ = mem.Put("key", bytes.NewReader([]byte("hello")))
+	conf := defaultConf
+	conf.CacheDir = "memory"
+	conf.HedgePercentile = 0.9
+	conf.HedgeBudget = 0.5
+	slow := &slowStorage{ObjectStorage: mem, gets: 1}
+	store := NewCachedStore(slow, conf, nil).(*cachedStore)
+	for i := 0; i < hedgeMinSamples; i++ {
+		store.hedger.observe(time.Millisecond * 10)
+	}
+	store.hedger.tokens = 1
+	slow.gets = 0
+	start := time.Now()
+	in, err := store.get("key", 0, -1)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	data, _ := ioutil.ReadAll(in)
+	_ = in.Close()
+	if string(data) != "hello" || time.Since(start) > time.Millisecond*500 {
+		t.Fatalf("hedged get: %q in %s", data, time.Since(start))
+	}
+	if n := testutil.ToFloat64(store.hedgedRequests); n != 1 {
+		t.Fatalf("hedged requests: %f", n)
+	}
+	if n := testutil.ToFloat64(store.hedgeWins); n != 1 {
+		t.Fatalf("hedged wins: %f", n)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// MaxInlineSize is the limit of data stored in metadata engine for a slice.
+const MaxInlineSize = 64 << 10
+
+const maxCachedOutlines = 100000
+
+// outlineCache keeps the recently read slices whose first blocks are stored in object storage,
+// it never changes for a slice, so the lookups of inline data are skipped for them.
+type outlineCache struct {
+	slices *lruCache
+}
+
+func newOutlineCache() *outlineCache {
+	return &outlineCache{slices: newLRUCache(maxCachedOutlines)}
+}
+
+func (c *outlineCache) has(chunkid uint64) bool {
+	_, ok := c.slices.get(chunkid)
+	return ok
+}
+
+func (c *outlineCache) add(chunkid uint64) {
+	c.slices.put(chunkid, struct{}{})
+}
+
+// inline keeps the data of a small slice in memory, it will be stored in metadata engine by the caller.
+func (c *wChunk) inline() {
+	key := c.key(0)
+	data := make([]byte, c.length)
+	var off int
+	for _, b := range c.pages[0] {
+		off += copy(data[off:], b.Data)
+		freePage(b)
+	}
+	c.pages[0] = nil
+	c.sums[0] = crc32.Checksum(data, crc32cTable)
+	block := NewPage(data)
+	c.store.bcache.cache(key, block, false)
+	block.Release()
+	c.inlined = data
+	c.uploaded = c.length
+	c.store.inlinedSlices.Add(1)
+}
+
+// isInline returns true if the block could be stored in metadata engine, the current InlineSize is not used
+// since it could be changed after the data is written.
+func (store *cachedStore) isInline(key string) bool {
+	if store.conf.Inlines == nil {
+		return false
+	}
+	_, indx, ok := parseBlockKey(key)
+	return ok && indx == 0 && parseObjOrigSize(key) <= MaxInlineSize
+}
+
+// loadInline reads the block stored in metadata engine, it returns false if it's stored in object storage.
+func (store *cachedStore) loadInline(key string, page *Page) (bool, error) {
+	chunkid, _, _ := parseBlockKey(key)
+	if store.outlines.has(chunkid) {
+		return false, nil
+	}
+	data, err := store.conf.Inlines(chunkid)
+	if err != nil {
+		return false, fmt.Errorf("get inline data of %s: %s", key, err)
+	}
+	if data == nil {
+		store.outlines.add(chunkid)
+		return false, nil
+	}
+	if len(data) != len(page.Data) {
+		return false, fmt.Errorf("inline data of %s has %d bytes, expect %d", key, len(data), len(page.Data))
+	}
+	copy(page.Data, data)
+	return true, nil
+}
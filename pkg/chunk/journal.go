@@ -0,0 +1,390 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+var journalFile = "staging.journal"
+
+// journalLock is locked by the client using the journal, so others can't change it underneath.
+var journalLock = "staging.journal.lock"
+
+// PendingBlock is a block in the staging directory which is not uploaded yet.
+type PendingBlock struct {
+	Key     string
+	Inode   uint64 // 0 means unknown
+	Indx    uint32 // index of the chunk in the file
+	Chunkid uint64
+	Size    int
+	Staged  time.Time
+	Dir     string `json:"-"` // cache directory
+}
+
+func newPendingBlock(dir, key string, inode uint64, indx uint32, staged time.Time) *PendingBlock {
+	b := &PendingBlock{Key: key, Inode: inode, Indx: indx, Staged: staged, Dir: dir, Size: parseObjOrigSize(key)}
+	b.Chunkid, _, _ = parseBlockKey(key)
+	return b
+}
+
+// stagingJournal records the blocks in the staging directory with the files they belong to.
+// It's an append-only log, "+ KEY INODE INDX STAGED" is added for a staged block, and "- KEY" after
+// it's uploaded or deleted. A record without trailing newline is ignored, so it's safe to crash in
+// the middle of appending.
+type stagingJournal struct {
+	sync.Mutex
+	dir     string
+	path    string
+	mode    os.FileMode
+	lock    *os.File
+	f       *os.File
+	blocks  map[string]*PendingBlock
+	records int
+	written uint64 // number of records appended
+
+	syncMu sync.Mutex // serializes fsync, so concurrent writers share one
+	synced uint64     // number of records synced, protected by syncMu
+}
+
+func loadJournal(dir, path string) (map[string]*PendingBlock, int, error) {
+	blocks := make(map[string]*PendingBlock)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return blocks, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var records int
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break // incomplete record
+		}
+		records++
+		ps := strings.Fields(line)
+		switch {
+		case len(ps) == 5 && ps[0] == "+":
+			inode, _ := strconv.ParseUint(ps[2], 10, 64)
+			indx, _ := strconv.ParseUint(ps[3], 10, 32)
+			staged, _ := strconv.ParseInt(ps[4], 10, 64)
+			blocks[ps[1]] = newPendingBlock(dir, ps[1], inode, uint32(indx), time.Unix(staged, 0))
+		case len(ps) == 2 && ps[0] == "-":
+			delete(blocks, ps[1])
+		default:
+			logger.Warnf("Invalid record in journal %s: %q", path, line)
+		}
+	}
+	return blocks, records, nil
+}
+
+func formatAdd(b *PendingBlock) string {
+	return fmt.Sprintf("+ %s %d %d %d\n", b.Key, b.Inode, b.Indx, b.Staged.Unix())
+}
+
+func formatRemove(key string) string {
+	return fmt.Sprintf("- %s\n", key)
+}
+
+// lockJournal locks the journal in dir, it fails if the journal is used by another process.
+func lockJournal(dir string, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, journalLock), os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err = tryLock(f); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("journal in %s is used by another process: %s", dir, err)
+	}
+	return f, nil
+}
+
+// openJournal always returns a usable journal, it only lives in memory if the file can't be written
+// or it's locked by another process.
+func openJournal(dir string, mode os.FileMode) (*stagingJournal, error) {
+	path := filepath.Join(dir, journalFile)
+	lock, err := lockJournal(dir, mode)
+	if err != nil {
+		return &stagingJournal{dir: dir, path: path, mode: mode, blocks: make(map[string]*PendingBlock)}, err
+	}
+	blocks, _, err := loadJournal(dir, path)
+	if err != nil {
+		_ = lock.Close()
+		return &stagingJournal{dir: dir, path: path, mode: mode, blocks: make(map[string]*PendingBlock)}, err
+	}
+	j := &stagingJournal{dir: dir, path: path, mode: mode, lock: lock, blocks: blocks}
+	j.Lock()
+	defer j.Unlock()
+	return j, j.compact()
+}
+
+// compact rewrites the journal with the pending blocks only, locked
+func (j *stagingJournal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, j.mode)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, b := range j.blocks {
+		_, _ = w.WriteString(formatAdd(b))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	_ = f.Close()
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if j.f != nil {
+		_ = j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, j.mode)
+	j.records = len(j.blocks)
+	return err
+}
+
+// locked
+func (j *stagingJournal) append(record string) {
+	if j.f == nil {
+		return
+	}
+	if _, err := j.f.WriteString(record); err != nil {
+		logger.Warnf("Write journal %s: %s", j.path, err)
+	}
+	j.records++
+	j.written++
+}
+
+func (j *stagingJournal) add(key string, inode uint64, indx uint32, staged time.Time) {
+	j.addAll([]*PendingBlock{newPendingBlock(j.dir, key, inode, indx, staged)})
+}
+
+// addAll adds the blocks and persists them with one fsync
+func (j *stagingJournal) addAll(bs []*PendingBlock) {
+	if len(bs) == 0 {
+		return
+	}
+	j.Lock()
+	for _, b := range bs {
+		j.blocks[b.Key] = b
+		j.append(formatAdd(b))
+	}
+	seq := j.written
+	j.Unlock()
+	// the staging block is useless if we can't find it after crash
+	j.sync(seq)
+}
+
+// sync makes sure the first seq records are persisted. It's called without holding the journal lock,
+// and the callers waiting for the same fsync are served by one call.
+func (j *stagingJournal) sync(seq uint64) {
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	if j.synced >= seq {
+		return
+	}
+	j.Lock()
+	f, written := j.f, j.written
+	j.Unlock()
+	if f != nil {
+		// the file could be closed by compact(), which has synced all the records
+		_ = f.Sync()
+	}
+	j.synced = written
+}
+
+// remove returns true if the block was in the journal
+func (j *stagingJournal) remove(key string) bool {
+	j.Lock()
+	defer j.Unlock()
+	if _, ok := j.blocks[key]; !ok {
+		return false
+	}
+	delete(j.blocks, key)
+	j.append(formatRemove(key))
+	if j.records > 1024 && j.records > len(j.blocks)*2 {
+		if err := j.compact(); err != nil {
+			logger.Warnf("Compact journal %s: %s", j.path, err)
+		}
+	}
+	return true
+}
+
+func (j *stagingJournal) get(key string) *PendingBlock {
+	j.Lock()
+	defer j.Unlock()
+	return j.blocks[key]
+}
+
+func (j *stagingJournal) list() []*PendingBlock {
+	j.Lock()
+	defer j.Unlock()
+	bs := make([]*PendingBlock, 0, len(j.blocks))
+	for _, b := range j.blocks {
+		bs = append(bs, b)
+	}
+	return bs
+}
+
+// pending returns the number and total size of the pending blocks
+func (j *stagingJournal) pending() (int, int64) {
+	j.Lock()
+	defer j.Unlock()
+	var size int64
+	for _, b := range j.blocks {
+		size += int64(b.Size)
+	}
+	return len(j.blocks), size
+}
+
+// oldest returns the time of the oldest pending block
+func (j *stagingJournal) oldest() time.Time {
+	j.Lock()
+	defer j.Unlock()
+	var t time.Time
+	for _, b := range j.blocks {
+		if t.IsZero() || b.Staged.Before(t) {
+			t = b.Staged
+		}
+	}
+	return t
+}
+
+// ListPending returns the blocks that are not uploaded yet in the staging directories of cacheDirs,
+// they are ordered by the staged time.
+func ListPending(cacheDirs string) ([]*PendingBlock, error) {
+	var bs []*PendingBlock
+	for _, d := range utils.SplitDir(cacheDirs) {
+		for _, dir := range expandDir(d) {
+			dir = strings.TrimSpace(dir) + string(filepath.Separator)
+			blocks, _, err := loadJournal(dir, filepath.Join(dir, journalFile))
+			if err != nil {
+				return nil, err
+			}
+			for _, b := range blocks {
+				bs = append(bs, b)
+			}
+		}
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].Staged.Before(bs[j].Staged) })
+	return bs, nil
+}
+
+// LockPending locks the staging journals in cacheDirs, so the pending blocks can be flushed or dropped.
+// It fails if any of them is used by a running client, which may compact the journal or upload the
+// blocks at the same time. The returned function releases the locks.
+func LockPending(cacheDirs string) (func(), error) {
+	var locks []*os.File
+	unlock := func() {
+		for _, f := range locks {
+			_ = f.Close()
+		}
+	}
+	for _, d := range utils.SplitDir(cacheDirs) {
+		for _, dir := range expandDir(d) {
+			dir = strings.TrimSpace(dir) + string(filepath.Separator)
+			if _, err := os.Stat(filepath.Join(dir, journalFile)); os.IsNotExist(err) {
+				continue
+			}
+			f, err := lockJournal(dir, 0600)
+			if err != nil {
+				unlock()
+				return nil, err
+			}
+			locks = append(locks, f)
+		}
+	}
+	return unlock, nil
+}
+
+// FlushPending uploads the pending block to the object storage and then removes it from staging directory.
+// The journal should be locked by LockPending. The block is stored under its own key, so it should not
+// be used for volumes with deduplication or packing enabled.
+func FlushPending(storage object.ObjectStorage, conf *Config, b *PendingBlock) error {
+	path := filepath.Join(b.Dir, stagingDir, b.Key)
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	var f ReadCloser = fd
+	if len(conf.CacheKey) > 0 {
+		c, err := newCacheCrypter(conf.CacheKey)
+		if err != nil {
+			_ = fd.Close()
+			return err
+		}
+		if f, err = c.open(fd, b.Key); err != nil {
+			return err
+		}
+	}
+	data := make([]byte, b.Size)
+	_, err = f.ReadAt(data, 0)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("read %s: %s", path, err)
+	}
+	compressor, err := newCompressor(conf)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, compressor.CompressBound(len(data)))
+	n, err := compressor.Compress(buf, data)
+	if err != nil {
+		return fmt.Errorf("compress %s: %s", b.Key, err)
+	}
+	if err = storage.Put(b.Key, bytes.NewReader(buf[:n])); err != nil {
+		return err
+	}
+	return DropPending(b)
+}
+
+// DropPending removes the pending block from staging directory without uploading it.
+// The journal should be locked by LockPending.
+func DropPending(b *PendingBlock) error {
+	err := os.Remove(filepath.Join(b.Dir, stagingDir, b.Key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(b.Dir, journalFile), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(formatRemove(b.Key))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestStagingJournal(t *testing.T) {
+	dir := t.TempDir()
+	j, err := openJournal(dir, 0600)
+	if err != nil {
+		t.Fatalf("open journal: %s", err)
+	}
+	now := time.Now()
+	j.add("chunks/0/0/1_0_1024", 100, 0, now)
+	j.add("chunks/0/0/2_0_1024", 100, 1, now.Add(-time.Minute))
+	j.add("chunks/0/0/3_0_4096", 101, 2, now)
+	if j.synced != j.written || j.written != 3 {
+		t.Fatalf("%d of %d records are synced", j.synced, j.written)
+	}
+	if !j.remove("chunks/0/0/1_0_1024") || j.remove("chunks/0/0/1_0_1024") {
+		t.Fatalf("remove should return true only once")
+	}
+	if n, size := j.pending(); n != 2 || size != 1024+4096 {
+		t.Fatalf("pending %d blocks of %d bytes", n, size)
+	}
+	if o := j.oldest(); o.Unix() != now.Add(-time.Minute).Unix() {
+		t.Fatalf("oldest %s != %s", o, now.Add(-time.Minute))
+	}
+	if j2, err := openJournal(dir, 0600); err == nil || j2.f != nil {
+		t.Fatalf("journal used by others should be kept in memory: %v", err)
+	}
+	// a record interrupted by crash
+	_, _ = j.f.WriteString("- chunks/0/0/3_0")
+	_ = j.f.Close()
+	_ = j.lock.Close()
+
+	blocks, records, err := loadJournal(dir, filepath.Join(dir, journalFile))
+	if err != nil || records != 4 || len(blocks) != 2 {
+		t.Fatalf("load journal: %d records, %d blocks: %v", records, len(blocks), err)
+	}
+	b := blocks["chunks/0/0/3_0_4096"]
+	if b == nil || b.Inode != 101 || b.Indx != 2 || b.Chunkid != 3 || b.Size != 4096 {
+		t.Fatalf("unexpected block: %+v", b)
+	}
+
+	j, err = openJournal(dir, 0600)
+	if err != nil || len(j.list()) != 2 || j.records != 2 {
+		t.Fatalf("reopen journal: %d blocks, %d records: %v", len(j.list()), j.records, err)
+	}
+	if j.get("chunks/0/0/2_0_1024").Inode != 100 {
+		t.Fatalf("inode of block 2 should be 100")
+	}
+	j.addAll([]*PendingBlock{newPendingBlock(dir, "chunks/0/0/4_0_1024", 0, 0, now), newPendingBlock(dir, "chunks/0/0/5_0_1024", 0, 0, now)})
+	if len(j.list()) != 4 || j.synced != j.written || j.written != 2 {
+		t.Fatalf("add blocks: %d blocks, %d of %d records are synced", len(j.list()), j.synced, j.written)
+	}
+}
+
+func TestPendingBlocks(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.Writeback = true
+	conf.UploadDelay = time.Hour
+	store := NewCachedStore(mem, conf, nil)
+	time.Sleep(time.Millisecond * 100) // wait for scan to finish
+
+	w := store.NewWriter(10)
+	w.SetInode(2, 3)
+	if _, err := w.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(5); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	bs, err := ListPending(conf.CacheDir)
+	if err != nil || len(bs) != 1 {
+		t.Fatalf("list pending: %+v %v", bs, err)
+	}
+	if _, err = LockPending(conf.CacheDir); err == nil {
+		t.Fatalf("journal used by the running client should not be locked")
+	}
+	if n, size := store.(*cachedStore).bcache.(*cacheManager).stagePending(); n != 1 || size != 5 {
+		t.Fatalf("pending %d blocks of %d bytes", n, size)
+	}
+	if b := bs[0]; b.Key != "chunks/0/0/10_0_5" || b.Inode != 2 || b.Indx != 3 || b.Chunkid != 10 {
+		t.Fatalf("unexpected pending block %+v", b)
+	}
+	if err = FlushPending(mem, &conf, bs[0]); err != nil {
+		t.Fatalf("flush pending: %s", err)
+	}
+	in, err := mem.Get("chunks/0/0/10_0_5", 0, -1)
+	if err != nil {
+		t.Fatalf("get uploaded block: %s", err)
+	}
+	data, _ := io.ReadAll(in)
+	if string(data) != "hello" {
+		t.Fatalf("data %s != expect hello", data)
+	}
+	if _, err = os.Stat(filepath.Join(conf.CacheDir, stagingDir, bs[0].Key)); !os.IsNotExist(err) {
+		t.Fatalf("staging block should be removed: %v", err)
+	}
+	if bs, _ = ListPending(conf.CacheDir); len(bs) != 0 {
+		t.Fatalf("no pending blocks expected: %+v", bs)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"container/list"
+	"sync"
+)
+
+type lruItem struct {
+	key   interface{}
+	value interface{}
+}
+
+// lruCache keeps at most limit items, the least recently used one is evicted to add a new one.
+type lruCache struct {
+	sync.Mutex
+	limit int
+	items map[interface{}]*list.Element
+	order *list.List // the most recently used one is at front
+}
+
+func newLRUCache(limit int) *lruCache {
+	return &lruCache{limit: limit, items: make(map[interface{}]*list.Element), order: list.New()}
+}
+
+func (c *lruCache) get(key interface{}) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruItem).value, true
+}
+
+func (c *lruCache) put(key, value interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruItem).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	for c.order.Len() >= c.limit && c.order.Len() > 0 {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*lruItem).key)
+	}
+	c.items[key] = c.order.PushFront(&lruItem{key, value})
+}
+
+func (c *lruCache) remove(key interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.order.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+func (c *lruCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,40 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import "testing"
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.put(1, "a")
+	c.put(2, "b")
+	if v, ok := c.get(1); !ok || v != "a" {
+		t.Fatalf("get 1: %v %t", v, ok)
+	}
+	c.put(3, "c") // evicts 2, which is the least recently used
+	if _, ok := c.get(2); ok {
+		t.Fatalf("2 should be evicted")
+	}
+	if _, ok := c.get(1); !ok || c.len() != 2 {
+		t.Fatalf("1 should be kept: %d items", c.len())
+	}
+	c.put(1, "d")
+	c.remove(3)
+	if v, ok := c.get(1); !ok || v != "d" || c.len() != 1 {
+		t.Fatalf("get 1: %v %t, %d items", v, ok, c.len())
+	}
+}
@@ -121,6 +121,17 @@ func (c *memcache) remove(key string) {
 	}
 }
 
+func (c *memcache) evict(key string) {
+	c.remove(key)
+}
+
+func (c *memcache) exist(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.pages[key]
+	return ok
+}
+
 func (c *memcache) load(key string) (ReadCloser, error) {
 	c.Lock()
 	defer c.Unlock()
@@ -156,8 +167,14 @@ func (c *memcache) cleanup() {
 	}
 }
 
-func (c *memcache) stage(key string, data []byte, keepCache bool) (string, error) {
+func (c *memcache) stage(key string, data []byte, keepCache bool, inode uint64, indx uint32) (string, error) {
 	return "", errors.New("not supported")
 }
+func (c *memcache) removeStage(key string)        {}
 func (c *memcache) uploaded(key string, size int) {}
 func (c *memcache) stagePath(key string) string   { return "" }
+
+func (c *memcache) pin(key string) error {
+	return errors.New("not supported")
+}
+func (c *memcache) unpin(key string) {}
@@ -0,0 +1,132 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+const minPartSize = 1 << 20 // for the storages without a minimum size of parts
+
+// multipartUpload is a block being uploaded in parts, it's kept across retries so only the
+// failed parts are uploaded again.
+type multipartUpload struct {
+	upload   *object.MultipartUpload
+	partSize int
+	parts    []*object.Part
+}
+
+// inParts returns whether a block of size bytes should be uploaded in parts.
+func (store *cachedStore) inParts(size int) bool {
+	return store.conf.PartThreshold > 0 && size >= store.conf.PartThreshold && atomic.LoadInt32(&store.noMultipart) == 0
+}
+
+// putParts uploads a block in parts: it starts a multipart upload at the first call, then uploads
+// the parts missing in mu and completes the upload, so it can be called again after a failure.
+// It falls back to a single PUT if the storage doesn't support multipart upload.
+func (store *cachedStore) putParts(key string, p *Page, mu *multipartUpload) error {
+	if mu.upload == nil {
+		upload, err := store.storage.CreateMultipartUpload(key)
+		if err == utils.ENOTSUP {
+			if atomic.CompareAndSwapInt32(&store.noMultipart, 0, 1) {
+				logger.Infof("Multipart upload is not supported by %s, upload blocks in one request", store.storage)
+			}
+			return store.put(key, p)
+		} else if err != nil {
+			return fmt.Errorf("create multipart upload: %s", err)
+		}
+		size := len(p.Data)
+		partSize := upload.MinPartSize
+		if partSize <= 0 {
+			partSize = minPartSize
+		}
+		if upload.MaxCount > 0 && (size-1)/partSize+1 > upload.MaxCount {
+			partSize = (size-1)/upload.MaxCount + 1
+		}
+		mu.upload, mu.partSize = upload, partSize
+		mu.parts = make([]*object.Part, (size-1)/partSize+1)
+	}
+	for i := range mu.parts {
+		if mu.parts[i] != nil {
+			continue
+		}
+		off := i * mu.partSize
+		end := off + mu.partSize
+		if end > len(p.Data) {
+			end = len(p.Data)
+		}
+		part, err := store.uploadPart(key, mu.upload.UploadID, i+1, p, off, end)
+		if err != nil {
+			return fmt.Errorf("upload part %d of %s: %s", i+1, key, err)
+		}
+		mu.parts[i] = part
+	}
+	st := time.Now()
+	err := store.storage.CompleteUpload(key, mu.upload.UploadID, mu.parts)
+	used := time.Since(st)
+	logger.Debugf("COMPLETE_UPLOAD %s (%d parts, %s, %.3fs)", key, len(mu.parts), err, used.Seconds())
+	store.objectReqsHistogram.WithLabelValues("COMPLETE_UPLOAD").Observe(used.Seconds())
+	if err != nil {
+		store.objectReqErrors.Add(1)
+		return fmt.Errorf("complete multipart upload: %s", err)
+	}
+	mu.upload = nil
+	return nil
+}
+
+func (store *cachedStore) uploadPart(key, uploadID string, num int, p *Page, off, end int) (*object.Part, error) {
+	if store.upLimit != nil {
+		store.upLimit.Wait(int64(end - off))
+	}
+	var part *object.Part
+	p.Acquire()
+	err := utils.WithTimeout(func() error {
+		defer p.Release()
+		st := time.Now()
+		pt, err := store.storage.UploadPart(key, uploadID, num, p.Data[off:end])
+		used := time.Since(st)
+		logger.Debugf("UPLOAD_PART %s #%d (%s, %.3fs)", key, num, err, used.Seconds())
+		if used > SlowRequest {
+			logger.Infof("slow request: UPLOAD_PART %v #%d (%v, %.3fs)", key, num, err, used.Seconds())
+		}
+		store.objectDataBytes.WithLabelValues("UPLOAD_PART").Add(float64(end - off))
+		store.objectReqsHistogram.WithLabelValues("UPLOAD_PART").Observe(used.Seconds())
+		if err != nil {
+			store.objectReqErrors.Add(1)
+			return err
+		}
+		part = pt
+		return nil
+	}, store.conf.PutTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return part, nil
+}
+
+// abortParts aborts an unfinished multipart upload, so the uploaded parts are not charged.
+func (store *cachedStore) abortParts(key string, mu *multipartUpload) {
+	if mu.upload != nil {
+		store.storage.AbortUpload(key, mu.upload.UploadID)
+		mu.upload = nil
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxCachedPacks = 10000
+
+// Pack is the location of a small slice which is stored in a shared object together with others.
+type Pack struct {
+	ID  uint64 // id of the shared object, which is the id of its first slice
+	Off uint32
+	Len uint32 // length of the stored (maybe compressed) data
+}
+
+// PackKey returns the key of a shared object.
+func PackKey(id uint64, hashPrefix bool) string {
+	if hashPrefix {
+		return fmt.Sprintf("chunks/%02X/%v/%v.pack", id%256, id/1000/1000, id)
+	}
+	return fmt.Sprintf("chunks/%v/%v/%v.pack", id/1000/1000, id/1000, id)
+}
+
+// ParsePackKey returns the id of a shared object from its key.
+func ParsePackKey(key string) (uint64, bool) {
+	name := key[strings.LastIndexByte(key, '/')+1:]
+	if !strings.HasSuffix(name, ".pack") {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, ".pack"), 10, 64)
+	return id, err == nil
+}
+
+// pack is a shared object being filled, it's uploaded when it's full or too old.
+type pack struct {
+	id   uint64
+	data []byte
+	done chan struct{}
+	err  error
+}
+
+// packer concatenates the small slices written within a short time window into one object,
+// to save the requests and the number of objects in object storage. Without a delay, a shared
+// object is uploaded at once unless another one is being uploaded, the slices added meanwhile
+// are packed into the next one.
+type packer struct {
+	sync.Mutex
+	store   *cachedStore
+	current *pack
+	busy    bool // a shared object is being uploaded without delay
+}
+
+func (p *packer) add(id uint64, data []byte) (*pack, int) {
+	p.Lock()
+	defer p.Unlock()
+	pk := p.current
+	if pk == nil {
+		pk = &pack{id: id, done: make(chan struct{})}
+		p.current = pk
+		if delay := p.store.conf.PackDelay; delay > 0 {
+			time.AfterFunc(delay, func() { p.seal(pk) })
+		}
+	}
+	off := len(pk.data)
+	pk.data = append(pk.data, data...)
+	if len(pk.data) >= p.store.conf.BlockSize {
+		p.current = nil
+		go p.upload(pk)
+	} else if p.store.conf.PackDelay == 0 && !p.busy {
+		p.current = nil
+		p.busy = true
+		go p.flush(pk)
+	}
+	return pk, off
+}
+
+// flush uploads the shared objects one after another until no more slices are added.
+func (p *packer) flush(pk *pack) {
+	for pk != nil {
+		p.upload(pk)
+		p.Lock()
+		pk = p.current
+		p.current = nil
+		p.busy = pk != nil
+		p.Unlock()
+	}
+}
+
+func (p *packer) seal(pk *pack) {
+	p.Lock()
+	if p.current != pk {
+		p.Unlock()
+		return // uploaded since it's full
+	}
+	p.current = nil
+	p.Unlock()
+	p.upload(pk)
+}
+
+func (p *packer) upload(pk *pack) {
+	defer close(pk.done)
+	store := p.store
+	store.currentUpload <- true
+	defer func() { <-store.currentUpload }()
+	key := PackKey(pk.id, store.conf.HashPrefix)
+	page := NewPage(pk.data)
+	defer page.Release()
+	for try := 0; try <= store.conf.MaxRetries; try++ {
+		time.Sleep(time.Second * time.Duration(try*try))
+		if pk.err = store.put(key, page); pk.err == nil {
+			return
+		}
+		logger.Warnf("Upload %s: %s (try %d)", key, pk.err, try+1)
+	}
+	pk.err = fmt.Errorf("(max tries) upload pack %s: %s", key, pk.err)
+}
+
+// pack stores the data of a small slice into a shared object, instead of uploading it as a block.
+func (c *wChunk) pack() error {
+	key := c.key(0)
+	pages := c.pages[0]
+	c.pages[0] = nil
+	block := NewOffPage(c.length)
+	var off int
+	for _, b := range pages {
+		off += copy(block.Data[off:], b.Data)
+		freePage(b)
+	}
+	c.sums[0] = crc32.Checksum(block.Data, crc32cTable)
+	c.store.bcache.cache(key, block, false)
+	buf := make([]byte, c.store.compressor.CompressBound(c.length))
+	n, err := c.store.compressor.Compress(buf, block.Data)
+	block.Release()
+	if err != nil {
+		return fmt.Errorf("Compress block key %s: %s", key, err)
+	}
+	pk, poff := c.store.packer.add(c.id, buf[:n])
+	<-pk.done
+	if pk.err != nil {
+		return pk.err
+	}
+	c.packed = &Pack{pk.id, uint32(poff), uint32(n)}
+	c.uploaded = c.length
+	c.store.packedSlices.Add(1)
+	return nil
+}
+
+// packCache keeps the locations of recently read slices, a slice stored alone is never packed,
+// but a packed one could be moved when the shared object is rewritten.
+type packCache struct {
+	lookup func(chunkid uint64) (*Pack, error)
+	packs  *lruCache
+}
+
+func newPackCache(lookup func(chunkid uint64) (*Pack, error)) *packCache {
+	return &packCache{lookup: lookup, packs: newLRUCache(maxCachedPacks)}
+}
+
+func (c *packCache) get(chunkid uint64) (*Pack, error) {
+	if p, ok := c.packs.get(chunkid); ok {
+		return p.(*Pack), nil
+	}
+	p, err := c.lookup(chunkid)
+	if err != nil {
+		return nil, err
+	}
+	c.packs.put(chunkid, p) // nil for slices stored alone
+	return p, nil
+}
+
+func (c *packCache) forget(chunkid uint64) {
+	c.packs.remove(chunkid)
+}
+
+// locate returns the object and the range where a block is stored, it could be a part of a shared object.
+func (store *cachedStore) locate(key string) (string, int64, int64, error) {
+	if obj, err := store.dedupKey(key); err != nil || obj != key {
+		return obj, 0, -1, err
+	}
+	if store.packs == nil {
+		return key, 0, -1, nil
+	}
+	chunkid, indx, ok := parseBlockKey(key)
+	if !ok || indx > 0 || parseObjOrigSize(key) >= store.conf.BlockSize {
+		return key, 0, -1, nil // only small slices are packed
+	}
+	p, err := store.packs.get(chunkid)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("locate %s: %s", key, err)
+	}
+	if p == nil {
+		return key, 0, -1, nil
+	}
+	return PackKey(p.ID, store.conf.HashPrefix), int64(p.Off), int64(p.Len), nil
+}
@@ -0,0 +1,82 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// ErrSizeMismatch is returned when the data of a block is not as large as the size in its key.
+var ErrSizeMismatch = errors.New("size mismatch")
+
+// ScrubBlock reads a block from object storage bypassing the cache, then checks that it can be
+// decrypted, decompressed into the size in its key and matches the checksum. It returns the
+// number of bytes downloaded, archived blocks fail with object.ErrNotRestored without being restored.
+func (store *cachedStore) ScrubBlock(key string) (int, error) {
+	size := parseObjOrigSize(key)
+	if size == 0 || size > store.conf.BlockSize {
+		return 0, fmt.Errorf("invalid size of %s: %d", key, size)
+	}
+	page := NewOffPage(size)
+	defer page.Release()
+	if store.isInline(key) {
+		if inlined, err := store.loadInline(key, page); err != nil {
+			return 0, err
+		} else if inlined {
+			return 0, store.verify(key, page.Data)
+		}
+	}
+	obj, off, limit, err := store.locate(key)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	in, err := store.get(obj, off, limit)
+	if err != nil {
+		store.objectReqErrors.Add(1)
+		return 0, fmt.Errorf("get %s: %w", obj, err)
+	}
+	bound := store.compressor.CompressBound(size)
+	buf, err := ioutil.ReadAll(io.LimitReader(in, int64(bound)+1))
+	_ = in.Close()
+	used := time.Since(start)
+	logger.Debugf("GET %s (%v, %.3fs)", obj, err, used.Seconds())
+	store.objectDataBytes.WithLabelValues("GET").Add(float64(len(buf)))
+	store.objectReqsHistogram.WithLabelValues("GET").Observe(used.Seconds())
+	if store.downLimit != nil {
+		store.downLimit.Wait(int64(len(buf)))
+	}
+	if err != nil {
+		store.objectReqErrors.Add(1)
+		return len(buf), fmt.Errorf("read %s: %w", obj, err)
+	}
+	if len(buf) > bound {
+		return len(buf), fmt.Errorf("%w of %s: more than %d bytes stored", ErrSizeMismatch, key, bound)
+	}
+	n, err := store.compressor.Decompress(page.Data, buf)
+	if err != nil {
+		return len(buf), fmt.Errorf("decompress %s: %s", key, err)
+	}
+	if n != size {
+		return len(buf), fmt.Errorf("%w of %s: %d != %d", ErrSizeMismatch, key, n, size)
+	}
+	return len(buf), store.verify(key, page.Data)
+}
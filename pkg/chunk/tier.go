@@ -0,0 +1,117 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+const (
+	maxCachedTiers  = 10000
+	restoreInterval = time.Minute
+)
+
+// tierCache keeps the tiers of recently read slices, a slice could be moved to tier storage
+// by another client at any time, so it's forgotten when a block can't be found.
+type tierCache struct {
+	sync.Mutex
+	lookup    func(chunkid uint64) (uint8, error)
+	tiers     map[uint64]uint8
+	restoring map[string]time.Time // last restore request of objects
+}
+
+func newTierCache(lookup func(chunkid uint64) (uint8, error)) *tierCache {
+	return &tierCache{lookup: lookup, tiers: make(map[uint64]uint8), restoring: make(map[string]time.Time)}
+}
+
+func (c *tierCache) get(chunkid uint64) (uint8, error) {
+	c.Lock()
+	tier, ok := c.tiers[chunkid]
+	c.Unlock()
+	if ok {
+		return tier, nil
+	}
+	tier, err := c.lookup(chunkid)
+	if err != nil {
+		return 0, err
+	}
+	c.Lock()
+	if len(c.tiers) >= maxCachedTiers {
+		c.tiers = make(map[uint64]uint8)
+	}
+	c.tiers[chunkid] = tier
+	c.Unlock()
+	return tier, nil
+}
+
+func (c *tierCache) forget(chunkid uint64) {
+	c.Lock()
+	delete(c.tiers, chunkid)
+	c.Unlock()
+}
+
+// storageOf returns the object storage where a block is stored, shared and deduplicated
+// objects are never moved.
+func (store *cachedStore) storageOf(key string) (object.ObjectStorage, error) {
+	if store.tiers == nil {
+		return store.storage, nil
+	}
+	chunkid, _, ok := parseBlockKey(key)
+	if !ok {
+		return store.storage, nil
+	}
+	tier, err := store.tiers.get(chunkid)
+	if err != nil {
+		return nil, fmt.Errorf("locate %s: %s", key, err)
+	}
+	if tier > 0 {
+		return store.conf.TierStorage, nil
+	}
+	return store.storage, nil
+}
+
+// restore requests to restore an archived object, at most once in a while for the same object.
+func (store *cachedStore) restore(key string) {
+	r, ok := store.conf.TierStorage.(object.SupportRestore)
+	if !ok || store.tiers == nil {
+		return
+	}
+	c := store.tiers
+	now := time.Now()
+	c.Lock()
+	if last, ok := c.restoring[key]; ok && now.Sub(last) < restoreInterval {
+		c.Unlock()
+		return
+	}
+	for k, t := range c.restoring {
+		if now.Sub(t) >= restoreInterval {
+			delete(c.restoring, k)
+		}
+	}
+	c.restoring[key] = now
+	c.Unlock()
+	if err := r.Restore(key); err != nil {
+		logger.Warnf("Restore %s: %s", key, err)
+		return
+	}
+	logger.Infof("Requested to restore archived object %s", key)
+	store.restoreRequests.Add(1)
+}
@@ -41,6 +41,11 @@ func getDiskUsage(path string) (uint64, uint64, uint64, uint64) {
 	}
 }
 
+// tryLock takes an exclusive lock of the file without waiting, it's released when the file is closed.
+func tryLock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
 func changeMode(dir string, st os.FileInfo, mode os.FileMode) {
 	sst := st.Sys().(*syscall.Stat_t)
 	if os.Getuid() == int(sst.Uid) {
@@ -47,4 +47,9 @@ func getDiskUsage(path string) (uint64, uint64, uint64, uint64) {
 	return total, freeBytes, 1, 1
 }
 
+// tryLock takes an exclusive lock of the file without waiting, it's released when the file is closed.
+func tryLock(f *os.File) error {
+	return sys.LockFileEx(sys.Handle(f.Fd()), sys.LOCKFILE_EXCLUSIVE_LOCK|sys.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &sys.Overlapped{})
+}
+
 func changeMode(dir string, st os.FileInfo, mode os.FileMode) {}
@@ -18,15 +18,20 @@ package compress
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
 	"github.com/hungys/go-lz4"
 )
 
 // ZSTD_LEVEL compression level used by Zstd
 const ZSTD_LEVEL = 1 // fastest
 
+// ZSTD_MAX_LEVEL the highest compression level of Zstd
+const ZSTD_MAX_LEVEL = 22
+
 // Compressor interface to be implemented by a compression algo
 type Compressor interface {
 	Name() string
@@ -35,13 +40,22 @@ type Compressor interface {
 	Decompress(dst, src []byte) (int, error)
 }
 
-// NewCompressor returns a struct implementing Compressor interface
+// NewCompressor returns a struct implementing Compressor interface,
+// the level of Zstd can be specified as "zstd:LEVEL".
 func NewCompressor(algr string) Compressor {
 	algr = strings.ToLower(algr)
 	if algr == "zstd" {
 		return ZStandard{ZSTD_LEVEL}
+	} else if strings.HasPrefix(algr, "zstd:") {
+		level, err := strconv.Atoi(algr[5:])
+		if err != nil || level < 1 || level > ZSTD_MAX_LEVEL {
+			return nil
+		}
+		return ZStandard{level}
 	} else if algr == "lz4" {
 		return LZ4{}
+	} else if algr == "snappy" {
+		return Snappy{}
 	} else if algr == "none" || algr == "" {
 		return noOp{}
 	}
@@ -120,3 +134,135 @@ func (l LZ4) Compress(dst, src []byte) (int, error) {
 func (l LZ4) Decompress(dst, src []byte) (int, error) {
 	return lz4.DecompressSafe(src, dst)
 }
+
+// Snappy implements Compressor using Snappy library
+type Snappy struct{}
+
+// Name returns name of the algorithm Snappy
+func (s Snappy) Name() string { return "Snappy" }
+
+// CompressBound max size of compressed data
+func (s Snappy) CompressBound(size int) int { return snappy.MaxEncodedLen(size) }
+
+// Compress using Snappy algorithm
+func (s Snappy) Compress(dst, src []byte) (int, error) {
+	if n := snappy.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, fmt.Errorf("buffer too short: %d < %d", len(dst), n)
+	}
+	return len(snappy.Encode(dst, src)), nil
+}
+
+// Decompress using Snappy algorithm
+func (s Snappy) Decompress(dst, src []byte) (int, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return 0, err
+	}
+	if len(dst) < n {
+		return 0, fmt.Errorf("buffer too short: %d < %d", len(dst), n)
+	}
+	d, err := snappy.Decode(dst, src)
+	return len(d), err
+}
+
+// The blocks written by Adaptive start with a header byte telling how the rest is stored.
+const (
+	blockCompressed byte = 1
+	blockRaw        byte = 2
+)
+
+// sampleSize is the size of data compressed to estimate the saving of a block
+const sampleSize = 64 << 10
+
+// Adaptive wraps a Compressor to store the blocks uncompressed when the saving of compression
+// is less than the threshold. Every block starts with a header byte of its kind, so raw and
+// compressed blocks can be mixed in a volume, but the blocks without header can't be read by it.
+type Adaptive struct {
+	Compressor
+	threshold float64
+}
+
+// NewAdaptive returns a Compressor that skips compression if it saves less than threshold (0 to 1),
+// a zero threshold means always compress, but the uncompressed blocks can still be read.
+// It should only be used for the volumes formatted with block header.
+func NewAdaptive(c Compressor, threshold float64) Compressor {
+	if _, ok := c.(noOp); ok {
+		return c
+	}
+	return Adaptive{c, threshold}
+}
+
+// CompressBound max size of compressed data
+func (a Adaptive) CompressBound(size int) int {
+	n := a.Compressor.CompressBound(size)
+	if n < size {
+		n = size
+	}
+	return n + 1
+}
+
+func (a Adaptive) saved(n, size int) bool {
+	return float64(size-n) >= float64(size)*a.threshold
+}
+
+func (a Adaptive) raw(dst, src []byte) (int, error) {
+	if len(dst) < len(src)+1 {
+		return 0, fmt.Errorf("buffer too short: %d < %d", len(dst), len(src)+1)
+	}
+	dst[0] = blockRaw
+	return copy(dst[1:], src) + 1, nil
+}
+
+func (a Adaptive) compress(dst, src []byte) (int, error) {
+	if len(dst) < 1 {
+		return 0, fmt.Errorf("buffer too short: %d < 1", len(dst))
+	}
+	n, err := a.Compressor.Compress(dst[1:], src)
+	if err != nil {
+		return 0, err
+	}
+	dst[0] = blockCompressed
+	return n + 1, nil
+}
+
+// Compress compresses a sample of the block first, and then the whole block if it's compressible
+func (a Adaptive) Compress(dst, src []byte) (int, error) {
+	if a.threshold <= 0 {
+		return a.compress(dst, src)
+	}
+	if len(src) > sampleSize*2 {
+		sample := src[(len(src)-sampleSize)/2:][:sampleSize]
+		buf := make([]byte, a.Compressor.CompressBound(sampleSize))
+		if n, err := a.Compressor.Compress(buf, sample); err == nil && !a.saved(n, sampleSize) {
+			return a.raw(dst, src)
+		}
+	}
+	n, err := a.compress(dst, src)
+	if err != nil || !a.saved(n-1, len(src)) {
+		return a.raw(dst, src)
+	}
+	return n, nil
+}
+
+// IsRaw returns whether the block written by Adaptive was stored without compression
+func IsRaw(src []byte) bool {
+	return len(src) > 0 && src[0] == blockRaw
+}
+
+// Decompress copies the block if it's stored uncompressed, or decompresses it
+func (a Adaptive) Decompress(dst, src []byte) (int, error) {
+	if len(src) == 0 {
+		return 0, fmt.Errorf("empty block without header")
+	}
+	switch src[0] {
+	case blockRaw:
+		if len(dst) < len(src)-1 {
+			return 0, fmt.Errorf("buffer too short: %d < %d", len(dst), len(src)-1)
+		}
+		return copy(dst, src[1:]), nil
+	case blockCompressed:
+		return a.Compressor.Decompress(dst, src[1:])
+	default:
+		return 0, fmt.Errorf("unknown block header: %d", src[0])
+	}
+}
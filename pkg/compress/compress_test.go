@@ -17,7 +17,9 @@
 package compress
 
 import (
+	"bytes"
 	"io"
+	"math/rand"
 	"os"
 	"testing"
 )
@@ -59,6 +61,63 @@ func TestLZ4(t *testing.T) {
 	testCompress(t, NewCompressor("lz4"))
 }
 
+func TestSnappy(t *testing.T) {
+	testCompress(t, NewCompressor("snappy"))
+}
+
+func TestZstdLevel(t *testing.T) {
+	testCompress(t, NewCompressor("zstd:10"))
+	for _, algr := range []string{"zstd:0", "zstd:23", "zstd:x", "brotli"} {
+		if NewCompressor(algr) != nil {
+			t.Fatalf("%s should be invalid", algr)
+		}
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	testCompress(t, NewAdaptive(NewCompressor("lz4"), 0.1))
+	if _, ok := NewAdaptive(NewCompressor("none"), 0.1).(noOp); !ok {
+		t.Fatalf("adaptive of none should be none")
+	}
+
+	random := make([]byte, 1<<20)
+	rand.Read(random)
+	zeros := make([]byte, 1<<20)
+	for _, c := range []Compressor{NewAdaptive(LZ4{}, 0.1), NewAdaptive(ZStandard{3}, 0.1), NewAdaptive(Snappy{}, 0.1)} {
+		for i, src := range [][]byte{random, zeros, random[:1000]} {
+			dst := make([]byte, c.CompressBound(len(src)))
+			n, err := c.Compress(dst, src)
+			if err != nil {
+				t.Fatalf("compress %d with %s: %s", i, c.Name(), err)
+			}
+			if raw := IsRaw(dst[:n]); raw != (i != 1) {
+				t.Fatalf("block %d compressed by %s: raw %v, size %d", i, c.Name(), raw, n)
+			}
+			// can be read without threshold
+			out := make([]byte, len(src))
+			if n, err = NewAdaptive(c.(Adaptive).Compressor, 0).Decompress(out, dst[:n]); err != nil || n != len(src) || !bytes.Equal(out, src) {
+				t.Fatalf("decompress block %d by %s: %d %s", i, c.Name(), n, err)
+			}
+		}
+	}
+
+	// the header is explicit, raw data looking like a compressed block is not mistaken
+	c := NewAdaptive(LZ4{}, 0.1)
+	src := []byte("\x00JFSRAW\x00")
+	dst := make([]byte, c.CompressBound(len(src)))
+	n, err := c.Compress(dst, src)
+	if err != nil || !IsRaw(dst[:n]) || n != len(src)+1 {
+		t.Fatalf("compress short block: %d %v", n, err)
+	}
+	out := make([]byte, len(src))
+	if n, err = c.Decompress(out, dst[:n]); err != nil || !bytes.Equal(out[:n], src) {
+		t.Fatalf("decompress short block: %d %v", n, err)
+	}
+	if _, err = c.Decompress(out, []byte{9, 1, 2}); err == nil {
+		t.Fatalf("block with unknown header should fail")
+	}
+}
+
 func benchmarkDecompress(b *testing.B, comp Compressor) {
 	f, _ := os.Open(os.Getenv("PAYLOAD"))
 	var c = make([]byte, 5<<20)
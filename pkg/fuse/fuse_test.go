@@ -94,7 +94,7 @@ func mount(url, mp string) {
 	m.OnMsg(meta.CompactChunk, meta.MsgCallback(func(args ...interface{}) error {
 		slices := args[0].([]meta.Slice)
 		chunkid := args[1].(uint64)
-		return vfs.Compact(chunkConf, store, slices, chunkid)
+		return vfs.Compact(chunkConf, store, slices, chunkid, args[2].(*[]uint32))
 	}))
 
 	conf := &vfs.Config{
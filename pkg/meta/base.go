@@ -39,6 +39,15 @@ const (
 	nlocks        = 1024
 )
 
+// chunks with many slices or much overwritten data are compacted in background
+const (
+	fragmentedSlices = 5
+	fragmentedRatio  = 0.5
+	maxFragmented    = 10000
+	scanChunksBatch  = 100000 // inodes in SQL (or keys of chunks in Redis) scanned in a part, TKV has 256 parts
+	maxScannedParts  = 10     // parts scanned for fragmented chunks in one round
+)
+
 type engine interface {
 	// Get the value of counter name.
 	getCounter(name string) (int64, error)
@@ -59,7 +68,34 @@ type engine interface {
 	doDeleteFileData(inode Ino, length uint64)
 	doCleanupSlices()
 	doCleanupDelayedSlices(edge int64, limit int) (int, error)
+	// Call fn with the slices of every chunk that has more than one slice, in a part of chunks starting from
+	// cursor, and return the cursor of the next part, which is 0 after the last one.
+	doScanChunks(cursor uint64, fn func(inode Ino, indx uint32, ss []*slice)) (uint64, error)
+	// Compact the slices of a chunk, return true if some of them are compacted.
+	compactChunk(inode Ino, indx uint32, force bool) bool
 	doDeleteSlice(chunkid uint64, size uint32) error
+	doGetChecksums(chunkid uint64) ([]byte, error)
+	doListChecksums() (map[uint64][]byte, error)
+	doGetPack(chunkid uint64) ([]byte, error)
+	doListPacks() (map[uint64][]byte, error)
+	doMovePack(chunkid uint64, from uint64, to []byte) (bool, error)
+	doGetInline(chunkid uint64) ([]byte, error)
+	doListInlines() (map[uint64][]byte, error)
+	doGetHashes(chunkid uint64) (map[uint32]string, error)
+	doListHashes() (map[uint64]map[uint32]string, error)
+	// Add a reference to the deduplicated object, return 0 if it's being deleted, added is false if it's referred already.
+	doAcquireBlock(chunkid uint64, indx uint32, hash string, size uint32) (refs int64, added bool, err error)
+	// Drop the references from blocks of a slice.
+	doReleaseBlocks(chunkid uint64) ([]releasedBlock, error)
+	doListBlocks() (map[string]dedupRef, error)
+	// Mark an object without references as being deleted.
+	doLockBlock(hash string) (bool, error)
+	// Remove the deleted object, or unlock it if it's not removed.
+	doDropBlock(hash string, removed bool) error
+	doGetTier(chunkid uint64) (uint8, error)
+	doListTiers() (map[uint64]uint8, error)
+	// Update the tier of a slice only if it's still used by the chunk.
+	doSetTier(inode Ino, indx uint32, chunkid uint64, tier uint8) (bool, error)
 
 	doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno
 	doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno
@@ -105,6 +141,11 @@ type baseMeta struct {
 
 	usedSpaceG  prometheus.Gauge
 	usedInodesG prometheus.Gauge
+	dedupRatioG prometheus.Gauge
+	fragmentedG prometheus.Gauge
+	compactedC  prometheus.Counter
+	compactIOC  prometheus.Counter
+	reclaimedC  prometheus.Counter
 	txDist      prometheus.Histogram
 	txRestart   prometheus.Counter
 	opDist      prometheus.Histogram
@@ -140,6 +181,26 @@ func newBaseMeta(addr string, conf *Config) *baseMeta {
 			Name: "used_inodes",
 			Help: "Total number of inodes.",
 		}),
+		dedupRatioG: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dedup_ratio",
+			Help: "Ratio of referenced bytes to stored bytes of deduplicated blocks.",
+		}),
+		fragmentedG: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "fragmented_chunks",
+			Help: "Fragmented chunks waiting for background compaction.",
+		}),
+		compactedC: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "compacted_chunks",
+			Help: "Fragmented chunks compacted in background.",
+		}),
+		compactIOC: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "compaction_io_bytes",
+			Help: "Bytes read and written by background compaction.",
+		}),
+		reclaimedC: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "compaction_reclaimed_bytes",
+			Help: "Bytes of overwritten data reclaimed by background compaction.",
+		}),
 		txDist: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name:    "transaction_durations_histogram_seconds",
 			Help:    "Transactions latency distributions.",
@@ -166,6 +227,15 @@ func (m *baseMeta) InitMetrics(reg prometheus.Registerer) {
 	reg.MustRegister(m.txDist)
 	reg.MustRegister(m.txRestart)
 	reg.MustRegister(m.opDist)
+	if m.fmt.Dedup {
+		reg.MustRegister(m.dedupRatioG)
+	}
+	if m.conf.CompactBudget > 0 {
+		reg.MustRegister(m.fragmentedG)
+		reg.MustRegister(m.compactedC)
+		reg.MustRegister(m.compactIOC)
+		reg.MustRegister(m.reclaimedC)
+	}
 
 	go func() {
 		for {
@@ -175,6 +245,10 @@ func (m *baseMeta) InitMetrics(reg prometheus.Registerer) {
 				m.usedSpaceG.Set(float64(totalSpace - availSpace))
 				m.usedInodesG.Set(float64(iused))
 			}
+			var logical, stored uint64
+			if m.fmt.Dedup && m.DedupStat(Background, &logical, &stored) == 0 && stored > 0 {
+				m.dedupRatioG.Set(float64(logical) / float64(stored))
+			}
 			utils.SleepWithJitter(time.Second * 10)
 		}
 	}()
@@ -270,6 +344,9 @@ func (m *baseMeta) NewSession() error {
 		go m.cleanupDeletedFiles()
 		go m.cleanupSlices()
 		go m.cleanupTrash()
+		if m.conf.CompactBudget > 0 {
+			go m.compactFragmented()
+		}
 	}
 	return nil
 }
@@ -407,6 +484,135 @@ func (m *baseMeta) cleanupSlices() {
 	}
 }
 
+// fragChunk is a chunk with too many slices or too much overwritten data.
+type fragChunk struct {
+	inode     Ino
+	indx      uint32
+	slices    int
+	size      uint32 // bytes to rewrite
+	reclaimed uint32 // bytes of overwritten data
+}
+
+// checkFragmented returns the cost and benefit of compacting a chunk, ok is false if it's not fragmented.
+func checkFragmented(ss []*slice) (c fragChunk, ok bool) {
+	var total, used uint32
+	for _, s := range ss {
+		if s.chunkid > 0 {
+			total += s.len
+		}
+	}
+	_, size, chunk := compactChunk(ss)
+	for _, s := range chunk {
+		if s.Chunkid > 0 {
+			used += s.Len
+		}
+	}
+	c = fragChunk{slices: len(ss), size: size, reclaimed: total - used}
+	ok = len(ss) >= fragmentedSlices || len(ss) > 1 && float64(c.reclaimed) >= float64(total)*fragmentedRatio
+	return
+}
+
+func sortFragmented(cs []fragChunk) {
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].reclaimed != cs[j].reclaimed {
+			return cs[i].reclaimed > cs[j].reclaimed
+		}
+		return cs[i].slices > cs[j].slices
+	})
+}
+
+// inCompactWindow returns whether background compaction is allowed at the time of day.
+func (m *baseMeta) inCompactWindow(t time.Time) bool {
+	start, end := m.conf.CompactWindow[0], m.conf.CompactWindow[1]
+	if start == end {
+		return true
+	}
+	h, mi, sec := t.Clock()
+	now := time.Duration(h)*time.Hour + time.Duration(mi)*time.Minute + time.Duration(sec)*time.Second
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end // across midnight
+}
+
+func (m *baseMeta) compactFragmented() {
+	for {
+		utils.SleepWithJitter(time.Minute)
+		if !m.inCompactWindow(time.Now()) {
+			continue
+		}
+		if ok, err := m.en.setIfSmall("lastCompaction", time.Now().Unix(), 3600); err != nil {
+			logger.Warnf("checking counter lastCompaction: %s", err)
+		} else if ok {
+			m.doCompactFragmented()
+		}
+	}
+}
+
+// doCompactFragmented compacts the most fragmented chunks until the IO budget of an hour is used up.
+// Chunks are scanned in parts from the cursor saved in the last round, so every round is cheap.
+func (m *baseMeta) doCompactFragmented() {
+	start := time.Now()
+	cursor, err := m.en.getCounter("compactCursor")
+	if err != nil {
+		logger.Warnf("get counter compactCursor: %s", err)
+		return
+	}
+	var cs []fragChunk
+	next := uint64(cursor)
+	for i := 0; i < maxScannedParts && len(cs) < maxFragmented; i++ {
+		next, err = m.en.doScanChunks(next, func(inode Ino, indx uint32, ss []*slice) {
+			if c, ok := checkFragmented(ss); ok {
+				c.inode, c.indx = inode, indx
+				cs = append(cs, c)
+				if len(cs) >= maxFragmented*2 {
+					sortFragmented(cs)
+					cs = cs[:maxFragmented]
+				}
+			}
+		})
+		if err != nil {
+			logger.Warnf("scan fragmented chunks: %s", err)
+			return
+		}
+		if next == 0 {
+			break
+		}
+	}
+	if int64(next) != cursor {
+		if _, err = m.en.incrCounter("compactCursor", int64(next)-cursor); err != nil {
+			logger.Warnf("update counter compactCursor: %s", err)
+		}
+	}
+	sortFragmented(cs)
+	if len(cs) > maxFragmented {
+		cs = cs[:maxFragmented]
+	}
+	m.fragmentedG.Set(float64(len(cs)))
+	var used int64
+	var count int
+	var reclaimed uint64
+	for _, c := range cs {
+		if used >= m.conf.CompactBudget || time.Since(start) > time.Hour || !m.inCompactWindow(time.Now()) {
+			break
+		}
+		logger.Debugf("compact fragmented chunk %d:%d (%d slices, %d bytes overwritten)", c.inode, c.indx, c.slices, c.reclaimed)
+		m.fragmentedG.Dec()
+		if !m.en.compactChunk(c.inode, c.indx, true) {
+			continue
+		}
+		used += int64(c.size) * 2
+		count++
+		reclaimed += uint64(c.reclaimed)
+		m.compactedC.Inc()
+		m.compactIOC.Add(float64(c.size) * 2)
+		m.reclaimedC.Add(float64(c.reclaimed))
+	}
+	if count > 0 {
+		logger.Infof("compacted %d fragmented chunks in %v: %d bytes reclaimed", count, time.Since(start), reclaimed)
+	}
+}
+
 func (m *baseMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
 	defer m.timeit(time.Now())
 	var used, inodes int64
@@ -856,6 +1062,214 @@ func (m *baseMeta) NewChunk(ctx Context, chunkid *uint64) syscall.Errno {
 	return 0
 }
 
+func (m *baseMeta) GetChecksums(ctx Context, chunkid uint64) ([]uint32, syscall.Errno) {
+	buf, err := m.en.doGetChecksums(chunkid)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if buf == nil {
+		return nil, 0
+	}
+	return readChecksums(buf), 0
+}
+
+func (m *baseMeta) GetPack(ctx Context, chunkid uint64) (*Pack, syscall.Errno) {
+	buf, err := m.en.doGetPack(chunkid)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if buf == nil {
+		return nil, 0
+	}
+	return readPack(buf), 0
+}
+
+func (m *baseMeta) ListPacks(ctx Context, packs map[uint64][]Slice) syscall.Errno {
+	all, err := m.en.doListPacks()
+	if err != nil {
+		return errno(err)
+	}
+	for chunkid, buf := range all {
+		if p := readPack(buf); p != nil {
+			packs[p.ID] = append(packs[p.ID], Slice{Chunkid: chunkid, Pack: p})
+		}
+	}
+	for _, ss := range packs {
+		sort.Slice(ss, func(i, j int) bool { return ss[i].Pack.Off < ss[j].Pack.Off })
+	}
+	return 0
+}
+
+func (m *baseMeta) MovePack(ctx Context, chunkid uint64, from uint64, to Pack) syscall.Errno {
+	ok, err := m.en.doMovePack(chunkid, from, marshalPack(&to))
+	if err != nil {
+		return errno(err)
+	}
+	if !ok {
+		return syscall.ENOENT
+	}
+	return 0
+}
+
+func (m *baseMeta) GetInline(ctx Context, chunkid uint64) ([]byte, syscall.Errno) {
+	data, err := m.en.doGetInline(chunkid)
+	return data, errno(err)
+}
+
+func (m *baseMeta) GetHashes(ctx Context, chunkid uint64) ([]string, syscall.Errno) {
+	all, err := m.en.doGetHashes(chunkid)
+	if err != nil || len(all) == 0 {
+		return nil, errno(err)
+	}
+	var hashes []string
+	for indx, hash := range all {
+		for int(indx) >= len(hashes) {
+			hashes = append(hashes, "")
+		}
+		hashes[indx] = hash
+	}
+	return hashes, 0
+}
+
+func (m *baseMeta) AcquireBlock(ctx Context, chunkid uint64, indx uint32, hash string, size uint32) (int64, syscall.Errno) {
+	refs, added, err := m.en.doAcquireBlock(chunkid, indx, hash, size)
+	if err != nil {
+		return 0, errno(err)
+	}
+	if added {
+		m.updateDedupStats(int64(size), refs == 1)
+	}
+	return refs, 0
+}
+
+// updateDedupStats updates the bytes of references, and the bytes of stored objects if it's the first or last reference.
+func (m *baseMeta) updateDedupStats(size int64, stored bool) {
+	if _, err := m.en.incrCounter(dedupLogical, size); err != nil {
+		logger.Warnf("update counter %s: %s", dedupLogical, err)
+	}
+	if stored {
+		if _, err := m.en.incrCounter(dedupStored, size); err != nil {
+			logger.Warnf("update counter %s: %s", dedupStored, err)
+		}
+	}
+}
+
+func (m *baseMeta) ListBlocks(ctx Context, blocks map[string]int64) syscall.Errno {
+	all, err := m.en.doListBlocks()
+	if err != nil {
+		return errno(err)
+	}
+	for hash, r := range all {
+		blocks[hash] = r.refs
+	}
+	return 0
+}
+
+func (m *baseMeta) GetTier(ctx Context, chunkid uint64) (uint8, syscall.Errno) {
+	tier, err := m.en.doGetTier(chunkid)
+	return tier, errno(err)
+}
+
+func (m *baseMeta) ListTiers(ctx Context, tiers map[uint64]uint8) syscall.Errno {
+	all, err := m.en.doListTiers()
+	if err != nil {
+		return errno(err)
+	}
+	for chunkid, tier := range all {
+		tiers[chunkid] = tier
+	}
+	return 0
+}
+
+func (m *baseMeta) SetTier(ctx Context, inode Ino, indx uint32, chunkid uint64, tier uint8) syscall.Errno {
+	ok, err := m.en.doSetTier(inode, indx, chunkid, tier)
+	if err != nil {
+		return errno(err)
+	}
+	if !ok {
+		return syscall.ENOENT
+	}
+	return 0
+}
+
+func (m *baseMeta) RemoveBlock(ctx Context, hash string) syscall.Errno {
+	ok, err := m.en.doLockBlock(hash)
+	if err != nil {
+		return errno(err)
+	}
+	if !ok {
+		return syscall.EBUSY
+	}
+	err = m.newMsg(DeleteBlock, hash)
+	removed := err == nil || strings.Contains(err.Error(), "NoSuchKey") || strings.Contains(err.Error(), "not found")
+	if e := m.en.doDropBlock(hash, removed); e != nil {
+		return errno(e)
+	}
+	if !removed {
+		if !strings.Contains(err.Error(), "skip deleting") {
+			logger.Warnf("delete block %s: %s", hash, err)
+		}
+		return syscall.EIO
+	}
+	return 0
+}
+
+// releaseBlocks drops the references from a deleted slice, and deletes the objects not used by others.
+func (m *baseMeta) releaseBlocks(chunkid uint64) error {
+	blocks, err := m.en.doReleaseBlocks(chunkid)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		m.updateDedupStats(-int64(b.size), b.refs == 0)
+		if b.refs == 0 {
+			_ = m.RemoveBlock(Background, b.hash) // the ones failed to delete will be cleaned by gc
+		}
+	}
+	return nil
+}
+
+func (m *baseMeta) ReleaseBlocks(ctx Context, chunkid uint64) syscall.Errno {
+	if !m.fmt.Dedup {
+		return 0
+	}
+	return errno(m.releaseBlocks(chunkid))
+}
+
+func (m *baseMeta) DedupStat(ctx Context, logical, stored *uint64) syscall.Errno {
+	l, err := m.en.getCounter(dedupLogical)
+	if err != nil {
+		return errno(err)
+	}
+	s, err := m.en.getCounter(dedupStored)
+	if err != nil {
+		return errno(err)
+	}
+	*logical, *stored = uint64(l), uint64(s)
+	return 0
+}
+
+// shouldPromote returns true if a file with data stored in metadata engine grows beyond the inline size,
+// then its first chunk should be compacted into object storage.
+func (m *baseMeta) shouldPromote(slice Slice, oldLength, newLength uint64) bool {
+	limit := uint64(m.fmt.InlineSize) << 10
+	return limit > 0 && slice.Inline == nil && oldLength > 0 && oldLength <= limit && newLength > limit
+}
+
+// singleInline returns true if the only slice of the first chunk is stored in metadata engine while the
+// file has grown beyond the inline size, it's compacted alone to promote the data into object storage.
+func (m *baseMeta) singleInline(inode Ino, indx uint32, ss []*slice) bool {
+	if indx > 0 || len(ss) != 1 || ss[0].chunkid == 0 {
+		return false
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(Background, inode, &attr); st != 0 || attr.Length <= uint64(m.fmt.InlineSize)<<10 {
+		return false
+	}
+	data, err := m.en.doGetInline(ss[0].chunkid)
+	return err == nil && data != nil
+}
+
 func (m *baseMeta) Close(ctx Context, inode Ino) syscall.Errno {
 	if m.of.Close(inode) {
 		m.Lock()
@@ -962,6 +1376,10 @@ func (m *baseMeta) deleteSlice(chunkid uint64, size uint32) {
 	if err := m.newMsg(DeleteChunk, chunkid, size); err == nil || strings.Contains(err.Error(), "NoSuchKey") || strings.Contains(err.Error(), "not found") {
 		if err = m.en.doDeleteSlice(chunkid, size); err != nil {
 			logger.Errorf("delete slice %d: %s", chunkid, err)
+		} else if m.fmt.Dedup {
+			if err = m.releaseBlocks(chunkid); err != nil {
+				logger.Warnf("release blocks of slice %d: %s", chunkid, err)
+			}
 		}
 	} else if !strings.Contains(err.Error(), "skip deleting") {
 		logger.Warnf("delete chunk %d (%d bytes): %s", chunkid, size, err)
@@ -31,6 +31,7 @@ import (
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestRedisClient(t *testing.T) {
@@ -66,6 +67,11 @@ func testMeta(t *testing.T, m Meta) {
 	testCompaction(t, m, false)
 	time.Sleep(time.Second)
 	testCompaction(t, m, true)
+	testCompactFragmented(t, m)
+	testPacks(t, m)
+	testInline(t, m)
+	testDedup(t, m)
+	testTiers(t, m)
 	testCopyFileRange(t, m)
 	testCloseSession(t, m)
 	testConcurrentDir(t, m)
@@ -801,7 +807,7 @@ func testCaseIncensi(t *testing.T, m Meta) {
 }
 
 type compactor interface {
-	compactChunk(inode Ino, indx uint32, force bool)
+	compactChunk(inode Ino, indx uint32, force bool) bool
 }
 
 func testCompaction(t *testing.T, m Meta, trash bool) {
@@ -820,6 +826,7 @@ func testCompaction(t *testing.T, m Meta, trash bool) {
 		return nil
 	})
 	m.OnMsg(CompactChunk, func(args ...interface{}) error {
+		*args[2].(*[]uint32) = []uint32{7}
 		return nil
 	})
 	ctx := Background
@@ -836,7 +843,10 @@ func testCompaction(t *testing.T, m Meta, trash bool) {
 	// random write
 	var chunkid uint64
 	m.NewChunk(ctx, &chunkid)
-	_ = m.Write(ctx, inode, 1, uint32(0), Slice{Chunkid: chunkid, Size: 64 << 20, Len: 64 << 20})
+	_ = m.Write(ctx, inode, 1, uint32(0), Slice{Chunkid: chunkid, Size: 64 << 20, Len: 64 << 20, Checksums: []uint32{1, 2, 3}})
+	if sums, st := m.GetChecksums(ctx, chunkid); st != 0 || len(sums) != 3 || sums[2] != 3 {
+		t.Fatalf("checksums of chunk %d: %v %s", chunkid, sums, st)
+	}
 	m.NewChunk(ctx, &chunkid)
 	_ = m.Write(ctx, inode, 1, uint32(30<<20), Slice{Chunkid: chunkid, Size: 8, Len: 8})
 	m.NewChunk(ctx, &chunkid)
@@ -854,6 +864,9 @@ func testCompaction(t *testing.T, m Meta, trash bool) {
 	if len(cs) != 1 {
 		t.Fatalf("expect 1 slice, but got %+v", cs)
 	}
+	if sums, st := m.GetChecksums(ctx, cs[0].Chunkid); st != 0 || len(sums) != 1 || sums[0] != 7 {
+		t.Fatalf("checksums of compacted chunk %d: %v %s", cs[0].Chunkid, sums, st)
+	}
 
 	// append
 	var size uint32 = 100000
@@ -980,7 +993,7 @@ func testTruncateAndDelete(t *testing.T, m Meta) {
 	if st := m.NewChunk(ctx, &cid); st != 0 {
 		t.Fatalf("new chunk: %s", st)
 	}
-	if st := m.Write(ctx, inode, 0, 100, Slice{cid, 100, 0, 100}); st != 0 {
+	if st := m.Write(ctx, inode, 0, 100, Slice{Chunkid: cid, Size: 100, Len: 100}); st != 0 {
 		t.Fatalf("write file %s", st)
 	}
 	if st := m.Truncate(ctx, inode, 0, 200<<20, attr); st != 0 {
@@ -1020,6 +1033,372 @@ func testTruncateAndDelete(t *testing.T, m Meta) {
 	}
 }
 
+func testCompactFragmented(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	m.OnMsg(CompactChunk, func(args ...interface{}) error {
+		return nil
+	})
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "frag", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer func() {
+		_ = m.Unlink(ctx, 1, "frag")
+	}()
+	// the second slice overwrites the first one
+	var chunkid uint64
+	_ = m.NewChunk(ctx, &chunkid)
+	_ = m.Write(ctx, inode, 0, 0, Slice{Chunkid: chunkid, Size: 4 << 20, Len: 4 << 20})
+	_ = m.NewChunk(ctx, &chunkid)
+	_ = m.Write(ctx, inode, 0, 0, Slice{Chunkid: chunkid, Size: 4 << 20, Len: 4 << 20})
+	// not fragmented
+	_ = m.NewChunk(ctx, &chunkid)
+	_ = m.Write(ctx, inode, 1, 0, Slice{Chunkid: chunkid, Size: 4 << 20, Len: 4 << 20})
+	_ = m.NewChunk(ctx, &chunkid)
+	_ = m.Write(ctx, inode, 1, 4<<20, Slice{Chunkid: chunkid, Size: 1 << 20, Len: 1 << 20})
+
+	base := m.getBase()
+	base.conf.CompactBudget = 1 << 20
+	defer func() { base.conf.CompactBudget = 0 }()
+	base.conf.CompactWindow = [2]time.Duration{time.Hour, time.Hour * 2}
+	if base.inCompactWindow(time.Date(2022, 1, 1, 3, 0, 0, 0, time.Local)) {
+		t.Fatalf("3:00 should not be in window 1:00-2:00")
+	}
+	base.conf.CompactWindow = [2]time.Duration{time.Hour * 23, time.Hour * 2}
+	if !base.inCompactWindow(time.Date(2022, 1, 1, 1, 0, 0, 0, time.Local)) {
+		t.Fatalf("1:00 should be in window 23:00-2:00")
+	}
+	base.conf.CompactWindow = [2]time.Duration{}
+	compacted := testutil.ToFloat64(base.compactedC)
+	// chunks are scanned in parts, the fragmented one is found in a cycle
+	for i := 0; i < 30 && testutil.ToFloat64(base.compactedC) == compacted; i++ {
+		base.doCompactFragmented()
+	}
+	if n := testutil.ToFloat64(base.compactedC) - compacted; n != 1 {
+		t.Fatalf("expect 1 compacted chunk, but got %v", n)
+	}
+	var cs []Slice
+	if st := m.Read(ctx, inode, 0, &cs); st != 0 || len(cs) != 1 {
+		t.Fatalf("chunk 0 should be compacted: %+v %s", cs, st)
+	}
+	if st := m.Read(ctx, inode, 1, &cs); st != 0 || len(cs) != 2 {
+		t.Fatalf("chunk 1 should not be compacted: %+v %s", cs, st)
+	}
+}
+
+func testPacks(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	format, _ := m.Load(false)
+	trashDays := format.TrashDays
+	format.TrashDays = 0
+	_ = m.Init(*format, false)
+	defer func() {
+		format.TrashDays = trashDays
+		_ = m.Init(*format, false)
+	}()
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "p", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	var c1, c2 uint64
+	_ = m.NewChunk(ctx, &c1)
+	_ = m.NewChunk(ctx, &c2)
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: c1, Size: 100, Len: 100, Pack: &Pack{c1, 0, 100}}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 100, Slice{Chunkid: c2, Size: 50, Len: 50, Pack: &Pack{c1, 100, 30}}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if p, st := m.GetPack(ctx, c2); st != 0 || p == nil || *p != (Pack{c1, 100, 30}) {
+		t.Fatalf("get pack of %d: %+v %s", c2, p, st)
+	}
+	packs := make(map[uint64][]Slice)
+	if st := m.ListPacks(ctx, packs); st != 0 || len(packs[c1]) != 2 || packs[c1][1].Chunkid != c2 {
+		t.Fatalf("list packs: %+v %s", packs, st)
+	}
+	if st := m.MovePack(ctx, c2, c2, Pack{c2 + 100, 0, 30}); st != syscall.ENOENT {
+		t.Fatalf("move pack from a wrong one: %s", st)
+	}
+	if st := m.MovePack(ctx, c2, c1, Pack{c2 + 100, 0, 30}); st != 0 {
+		t.Fatalf("move pack: %s", st)
+	}
+	if p, st := m.GetPack(ctx, c2); st != 0 || p == nil || p.ID != c2+100 {
+		t.Fatalf("get pack of %d: %+v %s", c2, p, st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Unlink(ctx, 1, "p"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	for i := 0; ; i++ {
+		packs = make(map[uint64][]Slice)
+		if st := m.ListPacks(ctx, packs); st != 0 {
+			t.Fatalf("list packs: %s", st)
+		}
+		if len(packs) == 0 {
+			break
+		} else if i > 50 {
+			t.Fatalf("packs of deleted slices: %+v", packs)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func testInline(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	compacted := make(chan []Slice, 1)
+	m.OnMsg(CompactChunk, func(args ...interface{}) error {
+		compacted <- args[0].([]Slice)
+		return fmt.Errorf("not found")
+	})
+	format, _ := m.Load(false)
+	old := *format
+	format.TrashDays = 0
+	format.InlineSize = 4
+	_ = m.Init(*format, false)
+	defer func() { _ = m.Init(old, false) }()
+	if f, _ := m.Load(false); f.InlineSize != 4 {
+		t.Fatalf("inline size is not updated: %d", f.InlineSize)
+	}
+
+	ctx := Background
+	var totalspace, availspace, iused, iavail uint64
+	_ = m.StatFS(ctx, &totalspace, &availspace, &iused, &iavail)
+	used := totalspace - availspace
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "i", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	var c1, c2 uint64
+	_ = m.NewChunk(ctx, &c1)
+	_ = m.NewChunk(ctx, &c2)
+	data := []byte("hello inline")
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: c1, Size: 12, Len: 12, Inline: data}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if d, st := m.GetInline(ctx, c1); st != 0 || !bytes.Equal(d, data) {
+		t.Fatalf("get inline data of %d: %q %s", c1, d, st)
+	}
+	if d, st := m.GetInline(ctx, c2); st != 0 || d != nil {
+		t.Fatalf("get inline data of %d: %q %s", c2, d, st)
+	}
+	_ = m.StatFS(ctx, &totalspace, &availspace, &iused, &iavail)
+	if totalspace-availspace != used+4096 {
+		t.Fatalf("used space of inline file: %d, expect %d", totalspace-availspace, used+4096)
+	}
+
+	// grow beyond the inline size
+	if st := m.Write(ctx, inode, 0, 12, Slice{Chunkid: c2, Size: 8 << 10, Len: 8 << 10}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	select {
+	case ss := <-compacted:
+		if len(ss) != 2 || ss[0].Chunkid != c1 || ss[1].Chunkid != c2 {
+			t.Fatalf("compacted slices: %+v", ss)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the first chunk is not compacted after growing")
+	}
+
+	// a single inline slice is promoted when the file grows in other chunks
+	var inode2 Ino
+	if st := m.Create(ctx, 1, "j", 0650, 022, 0, &inode2, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	var c3, c4 uint64
+	_ = m.NewChunk(ctx, &c3)
+	_ = m.NewChunk(ctx, &c4)
+	if st := m.Write(ctx, inode2, 0, 0, Slice{Chunkid: c3, Size: 12, Len: 12, Inline: data}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.Write(ctx, inode2, 1, 0, Slice{Chunkid: c4, Size: 8 << 10, Len: 8 << 10}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	select {
+	case ss := <-compacted:
+		if len(ss) != 1 || ss[0].Chunkid != c3 {
+			t.Fatalf("compacted slices: %+v", ss)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the single inline slice is not promoted after growing")
+	}
+	_ = m.Close(ctx, inode2)
+	if st := m.Unlink(ctx, 1, "j"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+
+	_ = m.Close(ctx, inode)
+	if st := m.Unlink(ctx, 1, "i"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	for i := 0; ; i++ {
+		if d, st := m.GetInline(ctx, c1); st != 0 {
+			t.Fatalf("get inline data: %s", st)
+		} else if d == nil {
+			break
+		} else if i > 50 {
+			t.Fatalf("inline data of deleted slice: %q", d)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func testDedup(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	deleted := make(chan string, 10)
+	m.OnMsg(DeleteBlock, func(args ...interface{}) error {
+		deleted <- args[0].(string)
+		return nil
+	})
+	format, _ := m.Load(false)
+	old := *format
+	format.TrashDays = 0
+	format.Dedup = true
+	if err := m.Init(*format, false); err == nil {
+		t.Fatalf("dedup should not be enabled for existing volume")
+	}
+	_ = m.Init(*format, true)
+	defer func() { _ = m.Init(old, true) }()
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "d", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	var c1, c2 uint64
+	_ = m.NewChunk(ctx, &c1)
+	_ = m.NewChunk(ctx, &c2)
+	h1, h2 := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	for _, a := range []struct {
+		chunkid uint64
+		indx    uint32
+		hash    string
+		size    uint32
+		refs    int64
+	}{{c1, 0, h1, 100, 1}, {c1, 0, h1, 100, 1}, {c2, 0, h1, 100, 2}, {c2, 1, h2, 50, 1}} {
+		if refs, st := m.AcquireBlock(ctx, a.chunkid, a.indx, a.hash, a.size); st != 0 || refs != a.refs {
+			t.Fatalf("acquire block %d_%d: %d %s, expect %d", a.chunkid, a.indx, refs, st, a.refs)
+		}
+	}
+	if hs, st := m.GetHashes(ctx, c2); st != 0 || len(hs) != 2 || hs[0] != h1 || hs[1] != h2 {
+		t.Fatalf("hashes of %d: %v %s", c2, hs, st)
+	}
+	var logical, stored uint64
+	if st := m.DedupStat(ctx, &logical, &stored); st != 0 || logical != 250 || stored != 150 {
+		t.Fatalf("dedup stat: %d %d %s", logical, stored, st)
+	}
+	if st := m.RemoveBlock(ctx, h1); st != syscall.EBUSY {
+		t.Fatalf("remove referenced block: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: c1, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 100, Slice{Chunkid: c2, Size: 150, Len: 150}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Unlink(ctx, 1, "d"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	removed := make(map[string]bool)
+	for len(removed) < 2 {
+		select {
+		case h := <-deleted:
+			removed[h] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("blocks are not deleted: %v", removed)
+		}
+	}
+	for i := 0; ; i++ {
+		blocks := make(map[string]int64)
+		if st := m.ListBlocks(ctx, blocks); st != 0 {
+			t.Fatalf("list blocks: %s", st)
+		} else if len(blocks) == 0 {
+			break
+		} else if i > 50 {
+			t.Fatalf("blocks of deleted slices: %v", blocks)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if st := m.DedupStat(ctx, &logical, &stored); st != 0 || logical != 0 || stored != 0 {
+		t.Fatalf("dedup stat: %d %d %s", logical, stored, st)
+	}
+}
+
+func testTiers(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	format, _ := m.Load(false)
+	trashDays := format.TrashDays
+	format.TrashDays = 0
+	_ = m.Init(*format, false)
+	defer func() {
+		format.TrashDays = trashDays
+		_ = m.Init(*format, false)
+	}()
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "t", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	var c1, c2 uint64
+	_ = m.NewChunk(ctx, &c1)
+	_ = m.NewChunk(ctx, &c2)
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: c1, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if tier, st := m.GetTier(ctx, c1); st != 0 || tier != TierPrimary {
+		t.Fatalf("get tier of %d: %d %s", c1, tier, st)
+	}
+	if st := m.SetTier(ctx, inode, 0, c2, TierArchive); st != syscall.ENOENT {
+		t.Fatalf("set tier of an unused slice: %s", st)
+	}
+	if st := m.SetTier(ctx, inode, 0, c1, TierArchive); st != 0 {
+		t.Fatalf("set tier: %s", st)
+	}
+	if tier, st := m.GetTier(ctx, c1); st != 0 || tier != TierArchive {
+		t.Fatalf("get tier of %d: %d %s", c1, tier, st)
+	}
+	tiers := make(map[uint64]uint8)
+	if st := m.ListTiers(ctx, tiers); st != 0 || len(tiers) != 1 || tiers[c1] != TierArchive {
+		t.Fatalf("list tiers: %+v %s", tiers, st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Unlink(ctx, 1, "t"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	for i := 0; ; i++ {
+		tiers = make(map[uint64]uint8)
+		if st := m.ListTiers(ctx, tiers); st != 0 {
+			t.Fatalf("list tiers: %s", st)
+		}
+		if len(tiers) == 0 {
+			break
+		} else if i > 50 {
+			t.Fatalf("tiers of deleted slices: %+v", tiers)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
 func testCopyFileRange(t *testing.T, m Meta) {
 	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
 		return nil
@@ -1039,10 +1418,10 @@ func testCopyFileRange(t *testing.T, m Meta) {
 		t.Fatalf("create file %s", st)
 	}
 	defer m.Unlink(ctx, 1, "fout")
-	m.Write(ctx, iin, 0, 100, Slice{10, 200, 0, 100})
-	m.Write(ctx, iin, 1, 100<<10, Slice{11, 40 << 20, 0, 40 << 20})
-	m.Write(ctx, iin, 3, 0, Slice{12, 63 << 20, 10 << 20, 30 << 20})
-	m.Write(ctx, iout, 2, 10<<20, Slice{13, 50 << 20, 10 << 20, 30 << 20})
+	m.Write(ctx, iin, 0, 100, Slice{Chunkid: 10, Size: 200, Len: 100})
+	m.Write(ctx, iin, 1, 100<<10, Slice{Chunkid: 11, Size: 40 << 20, Len: 40 << 20})
+	m.Write(ctx, iin, 3, 0, Slice{Chunkid: 12, Size: 63 << 20, Off: 10 << 20, Len: 30 << 20})
+	m.Write(ctx, iout, 2, 10<<20, Slice{Chunkid: 13, Size: 50 << 20, Off: 10 << 20, Len: 30 << 20})
 	var copied uint64
 	if st := m.CopyFileRange(ctx, iin, 150, iout, 30<<20, 200<<20, 0, &copied); st != 0 {
 		t.Fatalf("copy file range: %s", st)
@@ -1052,10 +1431,10 @@ func testCopyFileRange(t *testing.T, m Meta) {
 		t.Fatalf("expect copy %d bytes, but got %d", expected, copied)
 	}
 	var expectedChunks = [][]Slice{
-		{{0, 30 << 20, 0, 30 << 20}, {10, 200, 50, 50}, {0, 0, 200, ChunkSize - 30<<20 - 50}},
-		{{0, 0, 150 + (ChunkSize - 30<<20), 30<<20 - 150}, {0, 0, 0, 100 << 10}, {11, 40 << 20, 0, (34 << 20) + 150 - (100 << 10)}},
-		{{11, 40 << 20, (34 << 20) + 150 - (100 << 10), 6<<20 - 150 + 100<<10}, {0, 0, 40<<20 + 100<<10, ChunkSize - 40<<20 - 100<<10}, {0, 0, 0, 150 + (ChunkSize - 30<<20)}},
-		{{0, 0, 150 + (ChunkSize - 30<<20), 30<<20 - 150}, {12, 63 << 20, 10 << 20, (8 << 20) + 150}},
+		{{Size: 30 << 20, Len: 30 << 20}, {Chunkid: 10, Size: 200, Off: 50, Len: 50}, {Off: 200, Len: ChunkSize - 30<<20 - 50}},
+		{{Off: 150 + (ChunkSize - 30<<20), Len: 30<<20 - 150}, {Len: 100 << 10}, {Chunkid: 11, Size: 40 << 20, Len: (34 << 20) + 150 - (100 << 10)}},
+		{{Chunkid: 11, Size: 40 << 20, Off: (34 << 20) + 150 - (100 << 10), Len: 6<<20 - 150 + 100<<10}, {Off: 40<<20 + 100<<10, Len: ChunkSize - 40<<20 - 100<<10}, {Len: 150 + (ChunkSize - 30<<20)}},
+		{{Off: 150 + (ChunkSize - 30<<20), Len: 30<<20 - 150}, {Chunkid: 12, Size: 63 << 20, Off: 10 << 20, Len: (8 << 20) + 150}},
 	}
 	for i := uint32(0); i < 4; i++ {
 		var chunks []Slice
@@ -1066,7 +1445,7 @@ func testCopyFileRange(t *testing.T, m Meta) {
 			t.Fatalf("expect chunk %d: %+v, but got %+v", i, expectedChunks[i], chunks)
 		}
 		for j, s := range chunks {
-			if s != expectedChunks[i][j] {
+			if !reflect.DeepEqual(s, expectedChunks[i][j]) {
 				t.Fatalf("expect slice %d,%d: %+v, but got %+v", i, j, expectedChunks[i][j], s)
 			}
 		}
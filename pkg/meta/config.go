@@ -21,10 +21,13 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"path"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/version"
@@ -41,28 +44,57 @@ type Config struct {
 	Heartbeat   time.Duration
 	MountPoint  string
 	Subdir      string
+
+	CompactBudget int64            // bytes read and written by background compaction per hour (0 means disabled)
+	CompactWindow [2]time.Duration // time of day to run background compaction, the same start and end means anytime
 }
 
 type Format struct {
-	Name             string
-	UUID             string
-	Storage          string
-	Bucket           string
-	AccessKey        string `json:",omitempty"`
-	SecretKey        string `json:",omitempty"`
-	SessionToken     string `json:",omitempty"`
-	BlockSize        int
-	Compression      string `json:",omitempty"`
-	Shards           int    `json:",omitempty"`
-	HashPrefix       bool   `json:",omitempty"`
-	Capacity         uint64 `json:",omitempty"`
-	Inodes           uint64 `json:",omitempty"`
-	EncryptKey       string `json:",omitempty"`
-	KeyEncrypted     bool   `json:",omitempty"`
-	TrashDays        int    `json:",omitempty"`
-	MetaVersion      int    `json:",omitempty"`
-	MinClientVersion string `json:",omitempty"`
-	MaxClientVersion string `json:",omitempty"`
+	Name              string
+	UUID              string
+	Storage           string
+	Bucket            string
+	AccessKey         string `json:",omitempty"`
+	SecretKey         string `json:",omitempty"`
+	SessionToken      string `json:",omitempty"`
+	StorageClass      string `json:",omitempty"` // storage class of new objects, the default of bucket if it's empty
+	BlockSize         int
+	Compression       string  `json:",omitempty"`
+	CompressThreshold float64 `json:",omitempty"`
+	BlockHeader       bool    `json:",omitempty"` // compressed blocks start with a header byte of their kind
+	PackSize          int     `json:",omitempty"` // in KiB
+	InlineSize        int     `json:",omitempty"` // in KiB
+	Packed            bool    `json:",omitempty"` // some slices were packed, even if pack size is unset now
+	Inlined           bool    `json:",omitempty"` // some slices were inlined, even if inline size is unset now
+	Shards            int     `json:",omitempty"`
+	ParityShards      int     `json:",omitempty"`
+	ReplicaStorage    string  `json:",omitempty"`
+	ReplicaBucket     string  `json:",omitempty"`
+	ReplicaAccessKey  string  `json:",omitempty"`
+	ReplicaSecretKey  string  `json:",omitempty"`
+	ReplicaMode       string  `json:",omitempty"` // sync (default) or async
+	TierStorage       string  `json:",omitempty"`
+	TierBucket        string  `json:",omitempty"`
+	TierAccessKey     string  `json:",omitempty"`
+	TierSecretKey     string  `json:",omitempty"`
+	HashPrefix        bool    `json:",omitempty"`
+	Dedup             bool    `json:",omitempty"` // store identical blocks only once
+	Capacity          uint64  `json:",omitempty"`
+	Inodes            uint64  `json:",omitempty"`
+	EncryptKey        string  `json:",omitempty"`
+	KeyEncrypted      bool    `json:",omitempty"`
+	MasterKey         bool    `json:",omitempty"` // secrets are encrypted with the master key in JFS_MASTER_KEY
+	EncryptSegment    int     `json:",omitempty"` // in KiB, seal encrypted objects in segments of this size
+	TrashDays         int     `json:",omitempty"`
+	MetaVersion       int     `json:",omitempty"`
+	MinClientVersion  string  `json:",omitempty"`
+	MaxClientVersion  string  `json:",omitempty"`
+
+	TierPolicies map[string]int `json:",omitempty"` // days before moving untouched files under a directory to the tier storage
+	EncryptKeys  map[int]string `json:",omitempty"` // more private keys by id, EncryptKey is the one of id 0
+	EncryptKeyID int            `json:",omitempty"` // id of the key to seal new data keys
+
+	EncryptCacheKey string `json:",omitempty"` // key to encrypt local cache sealed by the key provider, in base64
 }
 
 func (f *Format) update(old *Format, force bool) error {
@@ -79,10 +111,16 @@ func (f *Format) update(old *Format, force bool) error {
 			args = []interface{}{"block size", old.BlockSize, f.BlockSize}
 		case f.Compression != old.Compression:
 			args = []interface{}{"compression", old.Compression, f.Compression}
+		case f.BlockHeader != old.BlockHeader:
+			args = []interface{}{"block header", old.BlockHeader, f.BlockHeader}
 		case f.Shards != old.Shards:
 			args = []interface{}{"shards", old.Shards, f.Shards}
+		case f.ParityShards != old.ParityShards:
+			args = []interface{}{"parity shards", old.ParityShards, f.ParityShards}
 		case f.HashPrefix != old.HashPrefix:
 			args = []interface{}{"hash prefix", old.HashPrefix, f.HashPrefix}
+		case f.Dedup != old.Dedup:
+			args = []interface{}{"dedup", old.Dedup, f.Dedup}
 		case f.MetaVersion != old.MetaVersion:
 			args = []interface{}{"meta version", old.MetaVersion, f.MetaVersion}
 		}
@@ -92,9 +130,21 @@ func (f *Format) update(old *Format, force bool) error {
 			return fmt.Errorf("cannot update volume %s from %v to %v", args...)
 		}
 	}
+	f.Packed = f.Packed || old.HasPacks()
+	f.Inlined = f.Inlined || old.HasInlines()
 	return nil
 }
 
+// HasPacks returns true if small slices could be packed together into shared objects.
+func (f *Format) HasPacks() bool {
+	return f.PackSize > 0 || f.Packed
+}
+
+// HasInlines returns true if small slices could be stored in metadata engine.
+func (f *Format) HasInlines() bool {
+	return f.InlineSize > 0 || f.Inlined
+}
+
 func (f *Format) RemoveSecret() {
 	if f.SecretKey != "" {
 		f.SecretKey = "removed"
@@ -105,6 +155,19 @@ func (f *Format) RemoveSecret() {
 	if f.EncryptKey != "" {
 		f.EncryptKey = "removed"
 	}
+	if len(f.EncryptKeys) > 0 {
+		keys := make(map[int]string, len(f.EncryptKeys)) // don't touch the map shared with others
+		for id := range f.EncryptKeys {
+			keys[id] = "removed"
+		}
+		f.EncryptKeys = keys
+	}
+	if f.ReplicaSecretKey != "" {
+		f.ReplicaSecretKey = "removed"
+	}
+	if f.TierSecretKey != "" {
+		f.TierSecretKey = "removed"
+	}
 }
 
 func (f *Format) String() string {
@@ -114,6 +177,24 @@ func (f *Format) String() string {
 	return string(s)
 }
 
+// TierDays returns the days before moving untouched files in directory `dir` to the tier storage,
+// which is set by the policy of the nearest ancestor, 0 means never.
+func (f *Format) TierDays(dir string) int {
+	if f.TierBucket == "" {
+		return 0
+	}
+	dir = path.Clean("/" + dir)
+	for {
+		if days, ok := f.TierPolicies[dir]; ok {
+			return days
+		}
+		if dir == "/" {
+			return 0
+		}
+		dir = path.Dir(dir)
+	}
+}
+
 func (f *Format) CheckVersion() error {
 	if f.MetaVersion > 1 {
 		return fmt.Errorf("incompatible metadata version: %d; please upgrade the client", f.MetaVersion)
@@ -140,12 +221,30 @@ func (f *Format) CheckVersion() error {
 	return nil
 }
 
+// secretsKey returns the key to encrypt secrets, which is derived from the master key supplied by operator
+// if it's enabled, or from UUID of the volume, which can be read by anyone who can access the metadata.
+func (f *Format) secretsKey() ([]byte, error) {
+	if f.MasterKey {
+		mk := os.Getenv("JFS_MASTER_KEY")
+		if mk == "" {
+			return nil, fmt.Errorf("secrets are encrypted with master key, please set it in environment variable JFS_MASTER_KEY")
+		}
+		key := sha256.Sum256([]byte(f.UUID + ":" + mk))
+		return key[:], nil
+	}
+	key := md5.Sum([]byte(f.UUID))
+	return key[:], nil
+}
+
 func (f *Format) Encrypt() error {
-	if f.KeyEncrypted || f.SecretKey == "" && f.EncryptKey == "" && f.SessionToken == "" {
+	if f.KeyEncrypted || f.SecretKey == "" && f.EncryptKey == "" && len(f.EncryptKeys) == 0 && f.SessionToken == "" && f.ReplicaSecretKey == "" && f.TierSecretKey == "" {
 		return nil
 	}
-	key := md5.Sum([]byte(f.UUID))
-	block, err := aes.NewCipher(key[:])
+	key, err := f.secretsKey()
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return fmt.Errorf("new cipher: %s", err)
 	}
@@ -171,16 +270,35 @@ func (f *Format) Encrypt() error {
 	encrypt(&f.SecretKey)
 	encrypt(&f.SessionToken)
 	encrypt(&f.EncryptKey)
+	f.EncryptKeys = eachKey(f.EncryptKeys, encrypt)
+	encrypt(&f.ReplicaSecretKey)
+	encrypt(&f.TierSecretKey)
 	f.KeyEncrypted = true
 	return nil
 }
 
+// eachKey applies fn to every key in a copy of keys.
+func eachKey(keys map[int]string, fn func(*string)) map[int]string {
+	if len(keys) == 0 {
+		return keys
+	}
+	r := make(map[int]string, len(keys))
+	for id, k := range keys {
+		fn(&k)
+		r[id] = k
+	}
+	return r
+}
+
 func (f *Format) Decrypt() error {
 	if !f.KeyEncrypted {
 		return nil
 	}
-	key := md5.Sum([]byte(f.UUID))
-	block, err := aes.NewCipher(key[:])
+	key, err := f.secretsKey()
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return fmt.Errorf("new cipher: %s", err)
 	}
@@ -201,8 +319,15 @@ func (f *Format) Decrypt() error {
 			err = fmt.Errorf("decode key: %s", e)
 			return
 		}
+		if len(buf) < 12 {
+			err = fmt.Errorf("decode key: too short")
+			return
+		}
 		plaintext, e := aesgcm.Open(nil, buf[:12], buf[12:], nil)
-		if e != nil {
+		if e != nil && f.MasterKey {
+			err = fmt.Errorf("open cipher: %s (is JFS_MASTER_KEY correct?)", e)
+			return
+		} else if e != nil {
 			err = fmt.Errorf("open cipher: %s", e)
 			return
 		}
@@ -210,8 +335,11 @@ func (f *Format) Decrypt() error {
 	}
 
 	decrypt(&f.EncryptKey)
+	f.EncryptKeys = eachKey(f.EncryptKeys, decrypt)
 	decrypt(&f.SecretKey)
 	decrypt(&f.SessionToken)
+	decrypt(&f.ReplicaSecretKey)
+	decrypt(&f.TierSecretKey)
 	f.KeyEncrypted = false
 	return err
 }
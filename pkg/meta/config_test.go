@@ -22,15 +22,19 @@ import (
 )
 
 func TestRemoveSecret(t *testing.T) {
-	format := Format{Name: "test", SecretKey: "testSecret", EncryptKey: "testEncrypt", SessionToken: "token"}
+	keys := map[int]string{1: "testEncrypt1"}
+	format := Format{Name: "test", SecretKey: "testSecret", EncryptKey: "testEncrypt", SessionToken: "token", EncryptKeys: keys}
 	if err := format.Encrypt(); err != nil {
 		t.Fatal(err)
 	}
 
 	format.RemoveSecret()
-	if format.SecretKey != "removed" || format.EncryptKey != "removed" || format.SessionToken != "removed" {
+	if format.SecretKey != "removed" || format.EncryptKey != "removed" || format.SessionToken != "removed" || format.EncryptKeys[1] != "removed" {
 		t.Fatalf("invalid format: %+v", format)
 	}
+	if keys[1] != "testEncrypt1" {
+		t.Fatalf("the shared keys should not be changed: %+v", keys)
+	}
 
 	if err := format.Decrypt(); err != nil && !strings.Contains(err.Error(), "secret was removed") {
 		t.Fatal(err)
@@ -38,17 +42,59 @@ func TestRemoveSecret(t *testing.T) {
 }
 
 func TestEncrypt(t *testing.T) {
-	format := Format{Name: "test", SecretKey: "testSecret", SessionToken: "token", EncryptKey: "testEncrypt"}
+	format := Format{Name: "test", SecretKey: "testSecret", SessionToken: "token", EncryptKey: "testEncrypt", EncryptKeys: map[int]string{1: "testEncrypt1"}}
 	if err := format.Encrypt(); err != nil {
 		t.Fatalf("Format encrypt: %s", err)
 	}
-	if format.SecretKey == "testSecret" || format.SessionToken == "token" || format.EncryptKey == "testEncrypt" {
+	if format.SecretKey == "testSecret" || format.SessionToken == "token" || format.EncryptKey == "testEncrypt" || format.EncryptKeys[1] == "testEncrypt1" {
 		t.Fatalf("invalid format: %+v", format)
 	}
 	if err := format.Decrypt(); err != nil {
 		t.Fatalf("Format decrypt: %s", err)
 	}
-	if format.SecretKey != "testSecret" || format.SessionToken != "token" || format.EncryptKey != "testEncrypt" {
+	if format.SecretKey != "testSecret" || format.SessionToken != "token" || format.EncryptKey != "testEncrypt" || format.EncryptKeys[1] != "testEncrypt1" {
 		t.Fatalf("invalid format: %+v", format)
 	}
 }
+
+func TestMasterKey(t *testing.T) {
+	format := Format{Name: "test", UUID: "uuid", SecretKey: "testSecret", MasterKey: true}
+	t.Setenv("JFS_MASTER_KEY", "")
+	if err := format.Encrypt(); err == nil {
+		t.Fatalf("encrypt without master key should fail")
+	}
+	t.Setenv("JFS_MASTER_KEY", "master")
+	if err := format.Encrypt(); err != nil {
+		t.Fatalf("Format encrypt: %s", err)
+	}
+	plain := Format{Name: "test", UUID: "uuid", SecretKey: "testSecret"}
+	_ = plain.Encrypt()
+	plain.SecretKey = format.SecretKey
+	if err := plain.Decrypt(); err == nil {
+		t.Fatalf("decrypt without master key should fail")
+	}
+
+	f := format
+	t.Setenv("JFS_MASTER_KEY", "wrong")
+	if err := f.Decrypt(); err == nil || !strings.Contains(err.Error(), "JFS_MASTER_KEY") {
+		t.Fatalf("decrypt with wrong master key: %v", err)
+	}
+	t.Setenv("JFS_MASTER_KEY", "master")
+	if err := format.Decrypt(); err != nil || format.SecretKey != "testSecret" {
+		t.Fatalf("Format decrypt: %s %s", format.SecretKey, err)
+	}
+}
+
+func TestStickyFeatures(t *testing.T) {
+	old := Format{Name: "test", PackSize: 1024, InlineSize: 4}
+	format := Format{Name: "test"}
+	if format.HasPacks() || format.HasInlines() {
+		t.Fatalf("invalid format: %+v", format)
+	}
+	if err := format.update(&old, false); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	if !format.HasPacks() || !format.HasInlines() {
+		t.Fatalf("packs and inlines should be kept after disabled: %+v", format)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"unicode/utf8"
 
@@ -53,6 +54,40 @@ type DumpedSustained struct {
 	Inodes []Ino  `json:"inodes"`
 }
 
+type DumpedPack struct {
+	Chunkid uint64 `json:"chunkid"`
+	ID      uint64 `json:"id"`
+	Off     uint32 `json:"off"`
+	Len     uint32 `json:"len"`
+}
+
+type DumpedSum struct {
+	Chunkid uint64   `json:"chunkid"`
+	Sums    []uint32 `json:"sums"`
+}
+
+type DumpedInline struct {
+	Chunkid uint64 `json:"chunkid"`
+	Data    []byte `json:"data"`
+}
+
+type DumpedTier struct {
+	Chunkid uint64 `json:"chunkid"`
+	Tier    uint8  `json:"tier"`
+}
+
+type DumpedBlock struct {
+	Hash string `json:"hash"`
+	Refs int64  `json:"refs"`
+	Size uint32 `json:"size"`
+}
+
+type DumpedHash struct {
+	Chunkid uint64 `json:"chunkid"`
+	Indx    uint32 `json:"indx"`
+	Hash    string `json:"hash"`
+}
+
 type DumpedAttr struct {
 	Inode     Ino    `json:"inode"`
 	Type      string `json:"type"`
@@ -243,8 +278,14 @@ type DumpedMeta struct {
 	Counters  *DumpedCounters
 	Sustained []*DumpedSustained
 	DelFiles  []*DumpedDelFile
-	FSTree    *DumpedEntry `json:",omitempty"`
-	Trash     *DumpedEntry `json:",omitempty"`
+	Packs     []*DumpedPack   `json:",omitempty"`
+	Sums      []*DumpedSum    `json:",omitempty"`
+	Inlines   []*DumpedInline `json:",omitempty"`
+	Blocks    []*DumpedBlock  `json:",omitempty"`
+	Hashes    []*DumpedHash   `json:",omitempty"`
+	Tiers     []*DumpedTier   `json:",omitempty"`
+	FSTree    *DumpedEntry    `json:",omitempty"`
+	Trash     *DumpedEntry    `json:",omitempty"`
 }
 
 func (dm *DumpedMeta) writeJsonWithOutTree(w io.Writer) (*bufio.Writer, error) {
@@ -262,6 +303,104 @@ func (dm *DumpedMeta) writeJsonWithOutTree(w io.Writer) (*bufio.Writer, error) {
 	return bw, nil
 }
 
+// dumpPacks returns the locations of all the slices stored in shared objects.
+func (m *baseMeta) dumpPacks() ([]*DumpedPack, error) {
+	all, err := m.en.doListPacks()
+	if err != nil {
+		return nil, err
+	}
+	packs := make([]*DumpedPack, 0, len(all))
+	for chunkid, buf := range all {
+		if p := readPack(buf); p != nil {
+			packs = append(packs, &DumpedPack{chunkid, p.ID, p.Off, p.Len})
+		}
+	}
+	sort.Slice(packs, func(i, j int) bool { return packs[i].Chunkid < packs[j].Chunkid })
+	return packs, nil
+}
+
+// dumpSums returns the checksums of blocks of all the slices.
+func (m *baseMeta) dumpSums() ([]*DumpedSum, error) {
+	all, err := m.en.doListChecksums()
+	if err != nil {
+		return nil, err
+	}
+	sums := make([]*DumpedSum, 0, len(all))
+	for chunkid, buf := range all {
+		if s := readChecksums(buf); s != nil {
+			sums = append(sums, &DumpedSum{chunkid, s})
+		}
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i].Chunkid < sums[j].Chunkid })
+	return sums, nil
+}
+
+// dumpInlines returns the data of all the slices stored in metadata engine.
+func (m *baseMeta) dumpInlines() ([]*DumpedInline, error) {
+	all, err := m.en.doListInlines()
+	if err != nil {
+		return nil, err
+	}
+	inlines := make([]*DumpedInline, 0, len(all))
+	for chunkid, data := range all {
+		inlines = append(inlines, &DumpedInline{chunkid, data})
+	}
+	sort.Slice(inlines, func(i, j int) bool { return inlines[i].Chunkid < inlines[j].Chunkid })
+	return inlines, nil
+}
+
+// dumpTiers returns the tiers of all the slices moved out of the primary object storage.
+func (m *baseMeta) dumpTiers() ([]*DumpedTier, error) {
+	all, err := m.en.doListTiers()
+	if err != nil {
+		return nil, err
+	}
+	tiers := make([]*DumpedTier, 0, len(all))
+	for chunkid, tier := range all {
+		tiers = append(tiers, &DumpedTier{chunkid, tier})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Chunkid < tiers[j].Chunkid })
+	return tiers, nil
+}
+
+// dumpBlocks returns all the deduplicated objects and the blocks referring to them.
+func (m *baseMeta) dumpBlocks() ([]*DumpedBlock, []*DumpedHash, error) {
+	all, err := m.en.doListBlocks()
+	if err != nil {
+		return nil, nil, err
+	}
+	blocks := make([]*DumpedBlock, 0, len(all))
+	for hash, r := range all {
+		blocks = append(blocks, &DumpedBlock{hash, r.refs, r.size})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Hash < blocks[j].Hash })
+	chunks, err := m.en.doListHashes()
+	if err != nil {
+		return nil, nil, err
+	}
+	var hashes []*DumpedHash
+	for chunkid, hs := range chunks {
+		for indx, hash := range hs {
+			hashes = append(hashes, &DumpedHash{chunkid, indx, hash})
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return hashes[i].Chunkid < hashes[j].Chunkid || hashes[i].Chunkid == hashes[j].Chunkid && hashes[i].Indx < hashes[j].Indx
+	})
+	return blocks, hashes, nil
+}
+
+// dedupCounters returns the bytes of references and the bytes of referenced objects.
+func dedupCounters(blocks []*DumpedBlock) (logical, stored int64) {
+	for _, b := range blocks {
+		if b.Refs > 0 {
+			logical += b.Refs * int64(b.Size)
+			stored += int64(b.Size)
+		}
+	}
+	return
+}
+
 func dumpAttr(a *Attr, d *DumpedAttr) {
 	d.Type = typeToString(a.Typ)
 	d.Mode = a.Mode
@@ -343,6 +482,18 @@ func loadEntries(r io.Reader, load func(*DumpedEntry), addChunk func(*chunkKey))
 			err = dec.Decode(&dm.Sustained)
 		case "DelFiles":
 			err = dec.Decode(&dm.DelFiles)
+		case "Packs":
+			err = dec.Decode(&dm.Packs)
+		case "Sums":
+			err = dec.Decode(&dm.Sums)
+		case "Inlines":
+			err = dec.Decode(&dm.Inlines)
+		case "Blocks":
+			err = dec.Decode(&dm.Blocks)
+		case "Hashes":
+			err = dec.Decode(&dm.Hashes)
+		case "Tiers":
+			err = dec.Decode(&dm.Tiers)
 		case "FSTree":
 			_, err = decodeEntry(dec, 1, counters, parents, refs, bar, load, addChunk)
 		case "Trash":
@@ -44,6 +44,8 @@ const (
 	Info = 1003
 	// FillCache is a message to build cache for target directories/files
 	FillCache = 1004
+	// DeleteBlock is a message to delete a deduplicated block from object store.
+	DeleteBlock = 1005
 )
 
 const (
@@ -91,6 +93,8 @@ type internalNode struct {
 
 // Type of control messages
 const CPROGRESS = 0xFE // 16 bytes: progress increment
+const CCACHED = 0xFD   // 8 bytes: cached bytes of checked files
+const CFAILED = 0xFC   // 8 bytes: number of failed files
 
 // MsgCallback is a callback for messages from meta service.
 type MsgCallback func(...interface{}) error
@@ -195,10 +199,26 @@ type Entry struct {
 // Slice is a slice of a chunk.
 // Multiple slices could be combined together as a chunk.
 type Slice struct {
-	Chunkid uint64
-	Size    uint32
-	Off     uint32
-	Len     uint32
+	Chunkid   uint64
+	Size      uint32
+	Off       uint32
+	Len       uint32
+	Checksums []uint32 `json:",omitempty"` // CRC32C of blocks, only used by Write
+	Pack      *Pack    `json:",omitempty"` // stored in a shared object, only used by Write and ListPacks
+	Inline    []byte   `json:",omitempty"` // data stored in metadata engine, only used by Write
+}
+
+// Tiers of object storage where blocks are stored.
+const (
+	TierPrimary uint8 = iota // the object storage of the volume
+	TierArchive              // the tier storage for cold data
+)
+
+// Pack is the location of a small slice which is stored in a shared object together with others.
+type Pack struct {
+	ID  uint64 // id of the shared object
+	Off uint32
+	Len uint32 // length of the stored (maybe compressed) data
 }
 
 // Summary represents the total number of files/directories and
@@ -313,6 +333,37 @@ type Meta interface {
 	NewChunk(ctx Context, chunkid *uint64) syscall.Errno
 	// Write put a slice of data on top of the given chunk.
 	Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno
+	// GetChecksums returns the checksums of blocks in a slice, or nil if they are not recorded.
+	GetChecksums(ctx Context, chunkid uint64) ([]uint32, syscall.Errno)
+	// GetPack returns the location of a slice in a shared object, or nil if it's stored alone.
+	GetPack(ctx Context, chunkid uint64) (*Pack, syscall.Errno)
+	// ListPacks returns all the slices stored in shared objects, grouped by the id of objects.
+	ListPacks(ctx Context, packs map[uint64][]Slice) syscall.Errno
+	// MovePack updates the location of a slice only if it's still stored in the shared object `from`.
+	MovePack(ctx Context, chunkid uint64, from uint64, to Pack) syscall.Errno
+	// GetInline returns the data of a slice stored in metadata engine, or nil if it's stored in object storage.
+	GetInline(ctx Context, chunkid uint64) ([]byte, syscall.Errno)
+	// GetHashes returns the content hashes of the deduplicated blocks in a slice, indexed by block (empty for blocks stored alone).
+	GetHashes(ctx Context, chunkid uint64) ([]string, syscall.Errno)
+	// AcquireBlock adds a reference from a block of a slice to the deduplicated object with the given hash,
+	// it returns the number of references, or 0 if the object is being deleted.
+	AcquireBlock(ctx Context, chunkid uint64, indx uint32, hash string, size uint32) (int64, syscall.Errno)
+	// ListBlocks returns the number of references of all the deduplicated objects.
+	ListBlocks(ctx Context, blocks map[string]int64) syscall.Errno
+	// RemoveBlock deletes a deduplicated object which is not referenced, it returns EBUSY if it's still in use.
+	RemoveBlock(ctx Context, hash string) syscall.Errno
+	// GetTier returns the tier where the blocks of a slice are stored.
+	GetTier(ctx Context, chunkid uint64) (uint8, syscall.Errno)
+	// ListTiers returns the tiers of all the slices not stored in the primary object storage.
+	ListTiers(ctx Context, tiers map[uint64]uint8) syscall.Errno
+	// SetTier records the tier of a slice after its blocks are moved, it returns ENOENT if the slice
+	// is not used by the chunk anymore.
+	SetTier(ctx Context, inode Ino, indx uint32, chunkid uint64, tier uint8) syscall.Errno
+	// ReleaseBlocks drops the references from the blocks of a slice which is never committed, and deletes
+	// the deduplicated objects not used by others.
+	ReleaseBlocks(ctx Context, chunkid uint64) syscall.Errno
+	// DedupStat returns the bytes of all the references to deduplicated objects and the bytes of referenced objects.
+	DedupStat(ctx Context, logical, stored *uint64) syscall.Errno
 	// InvalidateChunkCache invalidate chunk cache
 	InvalidateChunkCache(ctx Context, inode Ino, indx uint32) syscall.Errno
 	// CopyFileRange copies part of a file to another one.
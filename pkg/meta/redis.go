@@ -62,6 +62,12 @@ import (
 
 	Removed files: delfiles -> [$inode:$length -> seconds]
 	Slices refs: k$chunkid_$size -> refcount
+	Block checksums: sliceSums -> { $chunkid -> [checksum] }
+	Packed slices: slicePacks -> { $chunkid -> $packid,$off,$len }
+	Inline slices: sliceData -> { $chunkid -> $data }
+	Block hashes: h$chunkid -> { $indx -> $hash }
+	Deduplicated blocks: b$hash -> DedupRef{refs,size}
+	Slice tiers: sliceTiers -> { $chunkid -> $tier }
 
 	Redis features:
 	  Sorted Set: 1.2+
@@ -211,7 +217,345 @@ func (m *redisMeta) Shutdown() error {
 }
 
 func (m *redisMeta) doDeleteSlice(chunkid uint64, size uint32) error {
-	return m.rdb.HDel(Background, m.sliceRefs(), m.sliceKey(chunkid, size)).Err()
+	_, err := m.rdb.Pipelined(Background, func(pipe redis.Pipeliner) error {
+		pipe.HDel(Background, m.sliceRefs(), m.sliceKey(chunkid, size))
+		pipe.HDel(Background, m.sliceSums(), strconv.FormatUint(chunkid, 10))
+		pipe.HDel(Background, m.slicePacks(), strconv.FormatUint(chunkid, 10))
+		pipe.HDel(Background, m.sliceData(), strconv.FormatUint(chunkid, 10))
+		pipe.HDel(Background, m.sliceTiers(), strconv.FormatUint(chunkid, 10))
+		return nil
+	})
+	return err
+}
+
+func (m *redisMeta) doGetChecksums(chunkid uint64) ([]byte, error) {
+	buf, err := m.rdb.HGet(Background, m.sliceSums(), strconv.FormatUint(chunkid, 10)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return buf, err
+}
+
+func (m *redisMeta) doListChecksums() (map[uint64][]byte, error) {
+	sums := make(map[uint64][]byte)
+	err := m.hscan(Background, m.sliceSums(), func(keys []string) error {
+		for i := 0; i < len(keys); i += 2 {
+			chunkid, _ := strconv.ParseUint(keys[i], 10, 64)
+			sums[chunkid] = []byte(keys[i+1])
+		}
+		return nil
+	})
+	return sums, err
+}
+
+func (m *redisMeta) doGetPack(chunkid uint64) ([]byte, error) {
+	buf, err := m.rdb.HGet(Background, m.slicePacks(), strconv.FormatUint(chunkid, 10)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return buf, err
+}
+
+func (m *redisMeta) doListPacks() (map[uint64][]byte, error) {
+	packs := make(map[uint64][]byte)
+	err := m.hscan(Background, m.slicePacks(), func(keys []string) error {
+		for i := 0; i < len(keys); i += 2 {
+			chunkid, _ := strconv.ParseUint(keys[i], 10, 64)
+			packs[chunkid] = []byte(keys[i+1])
+		}
+		return nil
+	})
+	return packs, err
+}
+
+func (m *redisMeta) doMovePack(chunkid uint64, from uint64, to []byte) (bool, error) {
+	var moved bool
+	field := strconv.FormatUint(chunkid, 10)
+	err := m.txn(Background, func(tx *redis.Tx) error {
+		buf, err := tx.HGet(Background, m.slicePacks(), field).Bytes()
+		if err == redis.Nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if p := readPack(buf); p == nil || p.ID != from {
+			return nil
+		}
+		_, err = tx.TxPipelined(Background, func(pipe redis.Pipeliner) error {
+			pipe.HSet(Background, m.slicePacks(), field, to)
+			return nil
+		})
+		moved = err == nil
+		return err
+	}, m.slicePacks())
+	return moved, err
+}
+
+func (m *redisMeta) doGetInline(chunkid uint64) ([]byte, error) {
+	data, err := m.rdb.HGet(Background, m.sliceData(), strconv.FormatUint(chunkid, 10)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (m *redisMeta) doListInlines() (map[uint64][]byte, error) {
+	inlines := make(map[uint64][]byte)
+	err := m.hscan(Background, m.sliceData(), func(keys []string) error {
+		for i := 0; i < len(keys); i += 2 {
+			chunkid, _ := strconv.ParseUint(keys[i], 10, 64)
+			inlines[chunkid] = []byte(keys[i+1])
+		}
+		return nil
+	})
+	return inlines, err
+}
+
+func (m *redisMeta) doGetHashes(chunkid uint64) (map[uint32]string, error) {
+	vals, err := m.rdb.HGetAll(Background, m.hashesKey(chunkid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[uint32]string, len(vals))
+	for k, v := range vals {
+		indx, _ := strconv.ParseUint(k, 10, 32)
+		hashes[uint32(indx)] = v
+	}
+	return hashes, nil
+}
+
+func (m *redisMeta) doListHashes() (map[uint64]map[uint32]string, error) {
+	ctx := Background
+	all := make(map[uint64]map[uint32]string)
+	err := m.scan(ctx, "h*", func(keys []string) error {
+		for _, key := range keys {
+			chunkid, err := strconv.ParseUint(key[len(m.prefix)+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			if all[chunkid], err = m.doGetHashes(chunkid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return all, err
+}
+
+func (m *redisMeta) doAcquireBlock(chunkid uint64, indx uint32, hash string, size uint32) (int64, bool, error) {
+	ctx := Background
+	var refs int64
+	var added bool
+	key := m.blockKey(hash)
+	field := strconv.FormatUint(uint64(indx), 10)
+	err := m.txn(ctx, func(tx *redis.Tx) error {
+		refs, added = 0, false
+		old, err := tx.HGet(ctx, m.hashesKey(chunkid), field).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		var r dedupRef
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err == nil {
+			r = readDedupRef(buf)
+		} else if err != redis.Nil {
+			return err
+		}
+		if old == hash { // acquired already
+			refs = r.refs
+			return nil
+		}
+		if r.refs < 0 {
+			return nil
+		}
+		if buf == nil {
+			r.size = size
+		}
+		r.refs++
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, marshalDedupRef(r), 0)
+			pipe.HSet(ctx, m.hashesKey(chunkid), field, hash)
+			return nil
+		})
+		if err == nil {
+			refs, added = r.refs, true
+		}
+		return err
+	}, key)
+	return refs, added, err
+}
+
+func (m *redisMeta) doReleaseBlocks(chunkid uint64) ([]releasedBlock, error) {
+	ctx := Background
+	var released []releasedBlock
+	key := m.hashesKey(chunkid)
+	err := m.txn(ctx, func(tx *redis.Tx) error {
+		released = nil
+		vals, err := tx.HGetAll(ctx, key).Result()
+		if err != nil || len(vals) == 0 {
+			return err
+		}
+		var keys []string
+		for _, hash := range vals {
+			keys = append(keys, m.blockKey(hash))
+		}
+		if err = tx.Watch(ctx, keys...).Err(); err != nil {
+			return err
+		}
+		refs := make(map[string]dedupRef)
+		var blocks []releasedBlock
+		for _, hash := range vals {
+			r, ok := refs[hash]
+			if !ok {
+				buf, err := tx.Get(ctx, m.blockKey(hash)).Bytes()
+				if err == redis.Nil {
+					logger.Warnf("block %s used by slice %d is not found", hash, chunkid)
+					continue
+				} else if err != nil {
+					return err
+				}
+				r = readDedupRef(buf)
+			}
+			r.refs--
+			refs[hash] = r
+			blocks = append(blocks, releasedBlock{hash, r})
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for hash, r := range refs {
+				pipe.Set(ctx, m.blockKey(hash), marshalDedupRef(r), 0)
+			}
+			pipe.Del(ctx, key)
+			return nil
+		})
+		if err == nil {
+			released = blocks
+		}
+		return err
+	}, key)
+	return released, err
+}
+
+func (m *redisMeta) doListBlocks() (map[string]dedupRef, error) {
+	ctx := Background
+	blocks := make(map[string]dedupRef)
+	err := m.scan(ctx, "b*", func(keys []string) error {
+		vals, err := m.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range vals {
+			if v, ok := v.(string); ok {
+				blocks[keys[i][len(m.prefix)+1:]] = readDedupRef([]byte(v))
+			}
+		}
+		return nil
+	})
+	return blocks, err
+}
+
+func (m *redisMeta) doLockBlock(hash string) (bool, error) {
+	ctx := Background
+	var locked bool
+	key := m.blockKey(hash)
+	err := m.txn(ctx, func(tx *redis.Tx) error {
+		var r dedupRef
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err == nil {
+			r = readDedupRef(buf)
+		} else if err != redis.Nil {
+			return err
+		}
+		if r.refs != 0 {
+			return nil
+		}
+		r.refs = -1
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, marshalDedupRef(r), 0)
+			return nil
+		})
+		locked = err == nil
+		return err
+	}, key)
+	return locked, err
+}
+
+func (m *redisMeta) doDropBlock(hash string, removed bool) error {
+	ctx := Background
+	key := m.blockKey(hash)
+	return m.txn(ctx, func(tx *redis.Tx) error {
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		r := readDedupRef(buf)
+		if r.refs != -1 {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if removed {
+				pipe.Del(ctx, key)
+			} else {
+				r.refs = 0
+				pipe.Set(ctx, key, marshalDedupRef(r), 0)
+			}
+			return nil
+		})
+		return err
+	}, key)
+}
+
+func (m *redisMeta) doGetTier(chunkid uint64) (uint8, error) {
+	tier, err := m.rdb.HGet(Background, m.sliceTiers(), strconv.FormatUint(chunkid, 10)).Int()
+	if err == redis.Nil {
+		return TierPrimary, nil
+	}
+	return uint8(tier), err
+}
+
+func (m *redisMeta) doListTiers() (map[uint64]uint8, error) {
+	tiers := make(map[uint64]uint8)
+	err := m.hscan(Background, m.sliceTiers(), func(keys []string) error {
+		for i := 0; i < len(keys); i += 2 {
+			chunkid, _ := strconv.ParseUint(keys[i], 10, 64)
+			tier, _ := strconv.ParseUint(keys[i+1], 10, 8)
+			tiers[chunkid] = uint8(tier)
+		}
+		return nil
+	})
+	return tiers, err
+}
+
+func (m *redisMeta) doSetTier(inode Ino, indx uint32, chunkid uint64, tier uint8) (bool, error) {
+	var used bool
+	key := m.chunkKey(inode, indx)
+	err := m.txn(Background, func(tx *redis.Tx) error {
+		vals, err := tx.LRange(Background, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		used = false
+		for _, s := range readSlices(vals) {
+			if s.chunkid == chunkid {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return nil
+		}
+		_, err = tx.TxPipelined(Background, func(pipe redis.Pipeliner) error {
+			if tier == TierPrimary {
+				pipe.HDel(Background, m.sliceTiers(), strconv.FormatUint(chunkid, 10))
+			} else {
+				pipe.HSet(Background, m.sliceTiers(), strconv.FormatUint(chunkid, 10), tier)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	return used, err
 }
 
 func (m *redisMeta) Name() string {
@@ -548,6 +892,30 @@ func (m *redisMeta) sliceRefs() string {
 	return m.prefix + "sliceRef"
 }
 
+func (m *redisMeta) sliceSums() string {
+	return m.prefix + "sliceSums"
+}
+
+func (m *redisMeta) slicePacks() string {
+	return m.prefix + "slicePacks"
+}
+
+func (m *redisMeta) sliceData() string {
+	return m.prefix + "sliceData"
+}
+
+func (m *redisMeta) sliceTiers() string {
+	return m.prefix + "sliceTiers"
+}
+
+func (m *redisMeta) hashesKey(chunkid uint64) string {
+	return m.prefix + "h" + strconv.FormatUint(chunkid, 10)
+}
+
+func (m *redisMeta) blockKey(hash string) string {
+	return m.prefix + "b" + hash
+}
+
 func (m *redisMeta) packEntry(_type uint8, inode Ino) []byte {
 	wb := utils.NewBuffer(9)
 	wb.Put8(_type)
@@ -1965,7 +2333,7 @@ func (m *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 	}
 	defer func() { m.of.InvalidateChunk(inode, indx) }()
 	var newSpace int64
-	var needCompact bool
+	var needCompact, promote bool
 	err := m.txn(ctx, func(tx *redis.Tx) error {
 		var attr Attr
 		a, err := tx.Get(ctx, m.inodeKey(inode)).Bytes()
@@ -1977,6 +2345,7 @@ func (m *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 			return syscall.EPERM
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
+		promote = m.shouldPromote(slice, attr.Length, newleng)
 		if newleng > attr.Length {
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
@@ -1993,6 +2362,15 @@ func (m *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 		var rpush *redis.IntCmd
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			rpush = pipe.RPush(ctx, m.chunkKey(inode, indx), marshalSlice(off, slice.Chunkid, slice.Size, slice.Off, slice.Len))
+			if len(slice.Checksums) > 0 {
+				pipe.HSet(ctx, m.sliceSums(), strconv.FormatUint(slice.Chunkid, 10), marshalChecksums(slice.Checksums))
+			}
+			if slice.Pack != nil {
+				pipe.HSet(ctx, m.slicePacks(), strconv.FormatUint(slice.Chunkid, 10), marshalPack(slice.Pack))
+			}
+			if slice.Inline != nil {
+				pipe.HSet(ctx, m.sliceData(), strconv.FormatUint(slice.Chunkid, 10), slice.Inline)
+			}
 			// most of chunk are used by single inode, so use that as the default (1 == not exists)
 			// pipe.Incr(ctx, r.sliceKey(slice.Chunkid, slice.Size))
 			pipe.Set(ctx, m.inodeKey(inode), m.marshal(&attr), 0)
@@ -2010,6 +2388,9 @@ func (m *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 		if needCompact {
 			go m.compactChunk(inode, indx, false)
 		}
+		if promote && (indx > 0 || !needCompact) {
+			go m.compactChunk(inode, 0, false)
+		}
 		m.updateStats(newSpace, 0)
 	}
 	return errno(err)
@@ -2456,14 +2837,14 @@ func (r *redisMeta) doCleanupDelayedSlices(edge int64, limit int) (int, error) {
 	return count, err
 }
 
-func (m *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
+func (m *redisMeta) compactChunk(inode Ino, indx uint32, force bool) bool {
 	// avoid too many or duplicated compaction
 	if !force {
 		m.Lock()
 		k := uint64(inode) + (uint64(indx) << 32)
 		if len(m.compacting) > 10 || m.compacting[k] {
 			m.Unlock()
-			return
+			return false
 		}
 		m.compacting[k] = true
 		m.Unlock()
@@ -2477,29 +2858,30 @@ func (m *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	var ctx = Background
 	vals, err := m.rdb.LRange(ctx, m.chunkKey(inode, indx), 0, 1000).Result()
 	if err != nil {
-		return
+		return false
 	}
 
 	ss := readSlices(vals)
 	skipped := skipSome(ss)
 	ss = ss[skipped:]
 	pos, size, chunks := compactChunk(ss)
-	if len(ss) < 2 || size == 0 {
-		return
+	if len(ss) < 2 && !m.singleInline(inode, indx, ss) || size == 0 {
+		return false
 	}
 
 	var chunkid uint64
 	st := m.NewChunk(ctx, &chunkid)
 	if st != 0 {
-		return
+		return false
 	}
 	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
-	err = m.newMsg(CompactChunk, chunks, chunkid)
+	var sums []uint32
+	err = m.newMsg(CompactChunk, chunks, chunkid, &sums)
 	if err != nil {
 		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
 			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
 		}
-		return
+		return false
 	}
 	var buf []byte         // trash enabled: track delayed slices
 	var rs []*redis.IntCmd // trash disabled: check reference of slices
@@ -2535,6 +2917,9 @@ func (m *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 				pipe.LPush(ctx, key, vals[i-1])
 			}
 			pipe.HSet(ctx, m.sliceRefs(), m.sliceKey(chunkid, size), "0") // create the key to tracking it
+			if len(sums) > 0 {
+				pipe.HSet(ctx, m.sliceSums(), strconv.FormatUint(chunkid, 10), marshalChecksums(sums))
+			}
 			if trash {
 				if len(buf) > 0 {
 					pipe.HSet(ctx, m.delSlices(), fmt.Sprintf("%d_%d", chunkid, time.Now().Unix()), buf)
@@ -2578,14 +2963,14 @@ func (m *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	}
 
 	if force {
-		m.compactChunk(inode, indx, force)
-	} else {
-		go func() {
-			// wait for the current compaction to finish
-			time.Sleep(time.Millisecond * 10)
-			m.compactChunk(inode, indx, force)
-		}()
+		return m.compactChunk(inode, indx, force) || errno == 0
 	}
+	go func() {
+		// wait for the current compaction to finish
+		time.Sleep(time.Millisecond * 10)
+		m.compactChunk(inode, indx, force)
+	}()
+	return errno == 0
 }
 
 func (m *redisMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
@@ -2617,6 +3002,52 @@ func (m *redisMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
 	}))
 }
 
+func (m *redisMeta) doScanChunks(cursor uint64, fn func(inode Ino, indx uint32, ss []*slice)) (uint64, error) {
+	ctx := Background
+	var rdb *redis.Client
+	if c, ok := m.rdb.(*redis.ClusterClient); ok {
+		var err error
+		rdb, err = c.MasterForKey(ctx, m.prefix)
+		if err != nil {
+			return cursor, err
+		}
+	} else {
+		rdb = m.rdb.(*redis.Client)
+	}
+	for scanned := 0; scanned < scanChunksBatch; {
+		keys, c, err := rdb.Scan(ctx, cursor, m.prefix+"c*_*", 10000).Result()
+		if err != nil {
+			return cursor, err
+		}
+		scanned += len(keys)
+		if len(keys) > 0 {
+			p := m.rdb.Pipeline()
+			for _, key := range keys {
+				_ = p.LRange(ctx, key, 0, 1000)
+			}
+			cmds, err := p.Exec(ctx)
+			if err != nil {
+				return cursor, err
+			}
+			for i, cmd := range cmds {
+				vals := cmd.(*redis.StringSliceCmd).Val()
+				if len(vals) < 2 {
+					continue
+				}
+				var inode uint64
+				var indx uint32
+				if n, err := fmt.Sscanf(keys[i], m.prefix+"c%d_%d", &inode, &indx); err == nil && n == 2 {
+					fn(Ino(inode), indx, readSlices(vals))
+				}
+			}
+		}
+		if cursor = c; cursor == 0 {
+			break
+		}
+	}
+	return cursor, nil
+}
+
 func (m *redisMeta) cleanupLeakedInodes(delete bool) {
 	var ctx = Background
 	var foundInodes = make(map[Ino]struct{})
@@ -3189,6 +3620,21 @@ func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		Sustained: sessions,
 		DelFiles:  dels,
 	}
+	if dm.Packs, err = m.dumpPacks(); err != nil {
+		return err
+	}
+	if dm.Sums, err = m.dumpSums(); err != nil {
+		return err
+	}
+	if dm.Inlines, err = m.dumpInlines(); err != nil {
+		return err
+	}
+	if dm.Blocks, dm.Hashes, err = m.dumpBlocks(); err != nil {
+		return err
+	}
+	if dm.Tiers, err = m.dumpTiers(); err != nil {
+		return err
+	}
 	if dm.Setting.SecretKey != "" {
 		dm.Setting.SecretKey = "removed"
 		logger.Warnf("Secret key is removed for the sake of safety")
@@ -3197,6 +3643,14 @@ func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		dm.Setting.SessionToken = "removed"
 		logger.Warnf("Session token is removed for the sake of safety")
 	}
+	if dm.Setting.ReplicaSecretKey != "" {
+		dm.Setting.ReplicaSecretKey = "removed"
+		logger.Warnf("Secret key of replica is removed for the sake of safety")
+	}
+	if dm.Setting.TierSecretKey != "" {
+		dm.Setting.TierSecretKey = "removed"
+		logger.Warnf("Secret key of tier storage is removed for the sake of safety")
+	}
 	bw, err := dm.writeJsonWithOutTree(w)
 	if err != nil {
 		return err
@@ -3357,6 +3811,7 @@ func (m *redisMeta) LoadMeta(r io.Reader) (err error) {
 	cs[m.prefix+"nextchunk"] = counters.NextChunk - 1
 	cs[m.prefix+"nextsession"] = counters.NextSession
 	cs[m.prefix+"nextTrash"] = counters.NextTrash
+	cs[m.prefix+dedupLogical], cs[m.prefix+dedupStored] = dedupCounters(dm.Blocks)
 	p.MSet(ctx, cs)
 	if l := len(dm.DelFiles); l > 0 {
 		if l > 100 {
@@ -3376,6 +3831,62 @@ func (m *redisMeta) LoadMeta(r io.Reader) (err error) {
 		}
 		p.ZAdd(ctx, m.delfiles(), zs...)
 	}
+	packs := make(map[string]interface{})
+	for _, d := range dm.Packs {
+		if len(packs) > 100 {
+			p.HSet(ctx, m.slicePacks(), packs)
+			tryExec()
+			packs = make(map[string]interface{})
+		}
+		packs[strconv.FormatUint(d.Chunkid, 10)] = marshalPack(&Pack{d.ID, d.Off, d.Len})
+	}
+	if len(packs) > 0 {
+		p.HSet(ctx, m.slicePacks(), packs)
+	}
+	sums := make(map[string]interface{})
+	for _, d := range dm.Sums {
+		if len(sums) > 100 {
+			p.HSet(ctx, m.sliceSums(), sums)
+			tryExec()
+			sums = make(map[string]interface{})
+		}
+		sums[strconv.FormatUint(d.Chunkid, 10)] = marshalChecksums(d.Sums)
+	}
+	if len(sums) > 0 {
+		p.HSet(ctx, m.sliceSums(), sums)
+	}
+	inlines := make(map[string]interface{})
+	for _, d := range dm.Inlines {
+		if len(inlines) > 100 {
+			p.HSet(ctx, m.sliceData(), inlines)
+			tryExec()
+			inlines = make(map[string]interface{})
+		}
+		inlines[strconv.FormatUint(d.Chunkid, 10)] = d.Data
+	}
+	if len(inlines) > 0 {
+		p.HSet(ctx, m.sliceData(), inlines)
+	}
+	for _, d := range dm.Blocks {
+		p.Set(ctx, m.blockKey(d.Hash), marshalDedupRef(dedupRef{d.Refs, d.Size}), 0)
+		tryExec()
+	}
+	for _, d := range dm.Hashes {
+		p.HSet(ctx, m.hashesKey(d.Chunkid), strconv.FormatUint(uint64(d.Indx), 10), d.Hash)
+		tryExec()
+	}
+	tiers := make(map[string]interface{})
+	for _, d := range dm.Tiers {
+		if len(tiers) > 100 {
+			p.HSet(ctx, m.sliceTiers(), tiers)
+			tryExec()
+			tiers = make(map[string]interface{})
+		}
+		tiers[strconv.FormatUint(d.Chunkid, 10)] = d.Tier
+	}
+	if len(tiers) > 0 {
+		p.HSet(ctx, m.sliceTiers(), tiers)
+	}
 	slices := make(map[string]interface{})
 	for k, v := range refs {
 		if v > 1 {
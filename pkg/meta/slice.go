@@ -100,6 +100,73 @@ func marshalSlice(pos uint32, chunkid uint64, size, off, len uint32) []byte {
 	return w.Bytes()
 }
 
+func marshalChecksums(sums []uint32) []byte {
+	w := utils.NewBuffer(uint32(len(sums) * 4))
+	for _, s := range sums {
+		w.Put32(s)
+	}
+	return w.Bytes()
+}
+
+func readChecksums(buf []byte) []uint32 {
+	if len(buf)%4 != 0 {
+		logger.Errorf("corrupt checksums: len=%d", len(buf))
+		return nil
+	}
+	rb := utils.ReadBuffer(buf)
+	sums := make([]uint32, len(buf)/4)
+	for i := range sums {
+		sums[i] = rb.Get32()
+	}
+	return sums
+}
+
+// dedupRef is the number of references to a deduplicated object and the size of it,
+// refs is -1 when the object is being deleted.
+type dedupRef struct {
+	refs int64
+	size uint32
+}
+
+// releasedBlock is a dropped reference to a deduplicated object, refs is the number of references left.
+type releasedBlock struct {
+	hash string
+	dedupRef
+}
+
+func marshalDedupRef(r dedupRef) []byte {
+	w := utils.NewBuffer(12)
+	w.Put64(uint64(r.refs))
+	w.Put32(r.size)
+	return w.Bytes()
+}
+
+func readDedupRef(buf []byte) dedupRef {
+	if len(buf) != 12 {
+		logger.Errorf("corrupt dedup ref: len=%d", len(buf))
+		return dedupRef{}
+	}
+	rb := utils.ReadBuffer(buf)
+	return dedupRef{int64(rb.Get64()), rb.Get32()}
+}
+
+func marshalPack(p *Pack) []byte {
+	w := utils.NewBuffer(16)
+	w.Put64(p.ID)
+	w.Put32(p.Off)
+	w.Put32(p.Len)
+	return w.Bytes()
+}
+
+func readPack(buf []byte) *Pack {
+	if len(buf) != 16 {
+		logger.Errorf("corrupt pack: len=%d", len(buf))
+		return nil
+	}
+	rb := utils.ReadBuffer(buf)
+	return &Pack{ID: rb.Get64(), Off: rb.Get32(), Len: rb.Get32()}
+}
+
 func readSlices(vals []string) []*slice {
 	slices := make([]slice, len(vals))
 	ss := make([]*slice, len(vals))
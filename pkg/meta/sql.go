@@ -96,6 +96,40 @@ type chunkRef struct {
 	Refs    int    `xorm:"notnull"`
 }
 
+type chunkSum struct {
+	Chunkid uint64 `xorm:"pk"`
+	Sums    []byte `xorm:"blob notnull"`
+}
+
+type chunkPack struct {
+	Chunkid uint64 `xorm:"pk"`
+	Packid  uint64 `xorm:"notnull"`
+	Off     uint32 `xorm:"notnull"`
+	Len     uint32 `xorm:"notnull"`
+}
+
+type chunkData struct {
+	Chunkid uint64 `xorm:"pk"`
+	Data    []byte `xorm:"blob notnull"`
+}
+
+type chunkTier struct {
+	Chunkid uint64 `xorm:"pk"`
+	Tier    uint8  `xorm:"notnull"`
+}
+
+type blockHash struct {
+	Chunkid uint64 `xorm:"pk"`
+	Indx    uint32 `xorm:"pk"`
+	Hash    string `xorm:"varchar(64) notnull"`
+}
+
+type blockRef struct {
+	Hash string `xorm:"varchar(64) pk"`
+	Refs int64  `xorm:"notnull"`
+	Size uint32 `xorm:"notnull"`
+}
+
 type delslices struct {
 	Chunkid uint64 `xorm:"pk"`
 	Deleted int64  `xorm:"notnull"` // timestamp
@@ -223,8 +257,310 @@ func (m *dbMeta) Name() string {
 func (m *dbMeta) doDeleteSlice(chunkid uint64, size uint32) error {
 	return m.txn(func(s *xorm.Session) error {
 		_, err := s.Exec("delete from jfs_chunk_ref where chunkid=?", chunkid)
+		if err == nil {
+			_, err = s.Exec("delete from jfs_chunk_sum where chunkid=?", chunkid)
+		}
+		if err == nil {
+			_, err = s.Exec("delete from jfs_chunk_pack where chunkid=?", chunkid)
+		}
+		if err == nil {
+			_, err = s.Exec("delete from jfs_chunk_data where chunkid=?", chunkid)
+		}
+		if err == nil {
+			_, err = s.Exec("delete from jfs_chunk_tier where chunkid=?", chunkid)
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doGetChecksums(chunkid uint64) ([]byte, error) {
+	var c = chunkSum{Chunkid: chunkid}
+	var ok bool
+	err := m.roTxn(func(s *xorm.Session) (err error) {
+		ok, err = s.Get(&c)
+		return err
+	})
+	if err != nil || !ok {
+		return nil, err
+	}
+	return c.Sums, nil
+}
+
+func (m *dbMeta) doListChecksums() (map[uint64][]byte, error) {
+	sums := make(map[uint64][]byte)
+	err := m.roTxn(func(s *xorm.Session) error {
+		return s.Iterate(new(chunkSum), func(idx int, bean interface{}) error {
+			c := bean.(*chunkSum)
+			sums[c.Chunkid] = c.Sums
+			return nil
+		})
+	})
+	return sums, err
+}
+
+func (m *dbMeta) doGetPack(chunkid uint64) ([]byte, error) {
+	var c = chunkPack{Chunkid: chunkid}
+	var ok bool
+	err := m.roTxn(func(s *xorm.Session) (err error) {
+		ok, err = s.Get(&c)
+		return err
+	})
+	if err != nil || !ok {
+		return nil, err
+	}
+	return marshalPack(&Pack{c.Packid, c.Off, c.Len}), nil
+}
+
+func (m *dbMeta) doListPacks() (map[uint64][]byte, error) {
+	packs := make(map[uint64][]byte)
+	err := m.roTxn(func(s *xorm.Session) error {
+		return s.Iterate(new(chunkPack), func(idx int, bean interface{}) error {
+			c := bean.(*chunkPack)
+			packs[c.Chunkid] = marshalPack(&Pack{c.Packid, c.Off, c.Len})
+			return nil
+		})
+	})
+	return packs, err
+}
+
+func (m *dbMeta) doMovePack(chunkid uint64, from uint64, to []byte) (bool, error) {
+	p := readPack(to)
+	var moved bool
+	err := m.txn(func(s *xorm.Session) error {
+		n, err := s.Cols("packid", "off", "len").Update(&chunkPack{Packid: p.ID, Off: p.Off, Len: p.Len}, &chunkPack{Chunkid: chunkid, Packid: from})
+		moved = n == 1
+		return err
+	})
+	return moved, err
+}
+
+func (m *dbMeta) doGetInline(chunkid uint64) ([]byte, error) {
+	var c = chunkData{Chunkid: chunkid}
+	var ok bool
+	err := m.roTxn(func(s *xorm.Session) (err error) {
+		ok, err = s.Get(&c)
+		return err
+	})
+	if err != nil || !ok {
+		return nil, err
+	}
+	return c.Data, nil
+}
+
+func (m *dbMeta) doListInlines() (map[uint64][]byte, error) {
+	inlines := make(map[uint64][]byte)
+	err := m.roTxn(func(s *xorm.Session) error {
+		return s.Iterate(new(chunkData), func(idx int, bean interface{}) error {
+			c := bean.(*chunkData)
+			inlines[c.Chunkid] = c.Data
+			return nil
+		})
+	})
+	return inlines, err
+}
+
+func (m *dbMeta) doGetHashes(chunkid uint64) (map[uint32]string, error) {
+	hashes := make(map[uint32]string)
+	err := m.roTxn(func(s *xorm.Session) error {
+		var rows []blockHash
+		if err := s.Find(&rows, &blockHash{Chunkid: chunkid}); err != nil {
+			return err
+		}
+		for _, h := range rows {
+			hashes[h.Indx] = h.Hash
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+func (m *dbMeta) doListHashes() (map[uint64]map[uint32]string, error) {
+	all := make(map[uint64]map[uint32]string)
+	err := m.roTxn(func(s *xorm.Session) error {
+		return s.Iterate(new(blockHash), func(idx int, bean interface{}) error {
+			h := bean.(*blockHash)
+			if all[h.Chunkid] == nil {
+				all[h.Chunkid] = make(map[uint32]string)
+			}
+			all[h.Chunkid][h.Indx] = h.Hash
+			return nil
+		})
+	})
+	return all, err
+}
+
+func (m *dbMeta) doAcquireBlock(chunkid uint64, indx uint32, hash string, size uint32) (int64, bool, error) {
+	var refs int64
+	var added bool
+	err := m.txn(func(s *xorm.Session) error {
+		refs, added = 0, false
+		var h blockHash
+		acquired, err := s.Where("chunkid=? AND indx=?", chunkid, indx).Get(&h)
+		if err != nil {
+			return err
+		}
+		var r = blockRef{Hash: hash}
+		ok, err := s.ForUpdate().Get(&r)
+		if err != nil {
+			return err
+		}
+		if acquired && h.Hash == hash {
+			refs = r.Refs
+			return nil
+		}
+		if r.Refs < 0 {
+			return nil
+		}
+		r.Refs++
+		if ok {
+			_, err = s.Cols("refs").Update(&blockRef{Refs: r.Refs}, &blockRef{Hash: hash})
+		} else {
+			r.Size = size
+			err = mustInsert(s, &r)
+		}
+		if err == nil {
+			err = mustInsert(s, &blockHash{chunkid, indx, hash})
+		}
+		if err == nil {
+			refs, added = r.Refs, true
+		}
+		return err
+	})
+	return refs, added, err
+}
+
+func (m *dbMeta) doReleaseBlocks(chunkid uint64) ([]releasedBlock, error) {
+	var released []releasedBlock
+	err := m.txn(func(s *xorm.Session) error {
+		released = nil
+		var rows []blockHash
+		if err := s.Find(&rows, &blockHash{Chunkid: chunkid}); err != nil || len(rows) == 0 {
+			return err
+		}
+		var blocks []releasedBlock
+		for _, h := range rows {
+			var r = blockRef{Hash: h.Hash}
+			ok, err := s.ForUpdate().Get(&r)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				logger.Warnf("block %s used by slice %d is not found", h.Hash, chunkid)
+				continue
+			}
+			if _, err = s.Exec("UPDATE jfs_block_ref SET refs=refs-1 WHERE hash=?", h.Hash); err != nil {
+				return err
+			}
+			blocks = append(blocks, releasedBlock{h.Hash, dedupRef{r.Refs - 1, r.Size}})
+		}
+		_, err := s.Exec("DELETE FROM jfs_block_hash WHERE chunkid=?", chunkid)
+		if err == nil {
+			released = blocks
+		}
+		return err
+	})
+	return released, err
+}
+
+func (m *dbMeta) doListBlocks() (map[string]dedupRef, error) {
+	blocks := make(map[string]dedupRef)
+	err := m.roTxn(func(s *xorm.Session) error {
+		return s.Iterate(new(blockRef), func(idx int, bean interface{}) error {
+			r := bean.(*blockRef)
+			blocks[r.Hash] = dedupRef{r.Refs, r.Size}
+			return nil
+		})
+	})
+	return blocks, err
+}
+
+func (m *dbMeta) doLockBlock(hash string) (bool, error) {
+	var locked bool
+	err := m.txn(func(s *xorm.Session) error {
+		locked = false
+		var r = blockRef{Hash: hash}
+		ok, err := s.ForUpdate().Get(&r)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			err = mustInsert(s, &blockRef{Hash: hash, Refs: -1})
+		} else if r.Refs == 0 {
+			_, err = s.Exec("UPDATE jfs_block_ref SET refs=-1 WHERE hash=?", hash)
+		} else {
+			return nil
+		}
+		locked = err == nil
+		return err
+	})
+	return locked, err
+}
+
+func (m *dbMeta) doDropBlock(hash string, removed bool) error {
+	return m.txn(func(s *xorm.Session) error {
+		var r = blockRef{Hash: hash}
+		ok, err := s.ForUpdate().Get(&r)
+		if err != nil || !ok || r.Refs != -1 {
+			return err
+		}
+		if removed {
+			_, err = s.Delete(&blockRef{Hash: hash})
+		} else {
+			_, err = s.Exec("UPDATE jfs_block_ref SET refs=0 WHERE hash=?", hash)
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doGetTier(chunkid uint64) (uint8, error) {
+	var c = chunkTier{Chunkid: chunkid}
+	var ok bool
+	err := m.roTxn(func(s *xorm.Session) (err error) {
+		ok, err = s.Get(&c)
+		return err
+	})
+	if err != nil || !ok {
+		return TierPrimary, err
+	}
+	return c.Tier, nil
+}
+
+func (m *dbMeta) doListTiers() (map[uint64]uint8, error) {
+	tiers := make(map[uint64]uint8)
+	err := m.roTxn(func(s *xorm.Session) error {
+		return s.Iterate(new(chunkTier), func(idx int, bean interface{}) error {
+			c := bean.(*chunkTier)
+			tiers[c.Chunkid] = c.Tier
+			return nil
+		})
+	})
+	return tiers, err
+}
+
+func (m *dbMeta) doSetTier(inode Ino, indx uint32, chunkid uint64, tier uint8) (bool, error) {
+	var used bool
+	err := m.txn(func(s *xorm.Session) error {
+		used = false
+		var ck = chunk{Inode: inode, Indx: indx}
+		ok, err := s.ForUpdate().MustCols("indx").Get(&ck)
+		if err != nil || !ok {
+			return err
+		}
+		for _, sl := range readSliceBuf(ck.Slices) {
+			if sl.chunkid == chunkid {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return nil
+		}
+		if _, err = s.Delete(&chunkTier{Chunkid: chunkid}); err == nil && tier != TierPrimary {
+			err = mustInsert(s, &chunkTier{chunkid, tier})
+		}
 		return err
 	})
+	return used, err
 }
 
 func (m *dbMeta) syncTable(beans ...interface{}) error {
@@ -245,8 +581,11 @@ func (m *dbMeta) Init(format Format, force bool) error {
 	if err := m.syncTable(new(node), new(symlink), new(xattr)); err != nil {
 		return fmt.Errorf("create table node, symlink, xattr: %s", err)
 	}
-	if err := m.syncTable(new(chunk), new(chunkRef), new(delslices)); err != nil {
-		return fmt.Errorf("create table chunk, chunk_ref, delslices: %s", err)
+	if err := m.syncTable(new(chunk), new(chunkRef), new(chunkSum), new(chunkPack), new(chunkData), new(chunkTier), new(delslices)); err != nil {
+		return fmt.Errorf("create table chunk, chunk_ref, chunk_sum, chunk_pack, chunk_data, chunk_tier, delslices: %s", err)
+	}
+	if err := m.syncTable(new(blockHash), new(blockRef)); err != nil {
+		return fmt.Errorf("create table block_hash, block_ref: %s", err)
 	}
 	if err := m.syncTable(new(session2), new(sustained), new(delfile)); err != nil {
 		return fmt.Errorf("create table session2, sustaind, delfile: %s", err)
@@ -335,7 +674,8 @@ func (m *dbMeta) Init(format Format, force bool) error {
 func (m *dbMeta) Reset() error {
 	return m.db.DropTables(&setting{}, &counter{},
 		&node{}, &edge{}, &symlink{}, &xattr{},
-		&chunk{}, &chunkRef{}, &delslices{},
+		&chunk{}, &chunkRef{}, &chunkSum{}, &chunkPack{}, &chunkData{}, &chunkTier{}, &delslices{},
+		&blockHash{}, &blockRef{},
 		&session{}, &session2{}, &sustained{}, &delfile{},
 		&flock{}, &plock{})
 }
@@ -359,9 +699,9 @@ func (m *dbMeta) doLoad() (data []byte, err error) {
 
 func (m *dbMeta) doNewSession(sinfo []byte) error {
 	// add new table
-	err := m.syncTable(new(session2), new(delslices))
+	err := m.syncTable(new(session2), new(delslices), new(chunkSum), new(chunkPack), new(chunkData), new(chunkTier), new(blockHash), new(blockRef))
 	if err != nil {
-		return fmt.Errorf("update table session2, delslices: %s", err)
+		return fmt.Errorf("update table session2, delslices, chunk_sum, chunk_pack, chunk_data, chunk_tier, block_hash, block_ref: %s", err)
 	}
 	// add primary key
 	if err = m.syncTable(new(edge), new(chunk), new(xattr), new(sustained)); err != nil {
@@ -540,7 +880,7 @@ func (m *dbMeta) incrCounter(name string, value int64) (int64, error) {
 			return err
 		}
 		v = c.Value + value
-		if value > 0 {
+		if value != 0 {
 			c.Value = v
 			if ok {
 				_, err = s.Cols("value").Update(&c, &counter{Name: name})
@@ -1958,7 +2298,7 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 	}
 	defer func() { m.of.InvalidateChunk(inode, indx) }()
 	var newSpace int64
-	var needCompact bool
+	var needCompact, promote bool
 	err := m.txn(func(s *xorm.Session) error {
 		var n = node{Inode: inode}
 		ok, err := s.ForUpdate().Get(&n)
@@ -1972,6 +2312,7 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 			return syscall.EPERM
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
+		promote = m.shouldPromote(slice, n.Length, newleng)
 		if newleng > n.Length {
 			newSpace = align4K(newleng) - align4K(n.Length)
 			n.Length = newleng
@@ -2001,6 +2342,21 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if err = mustInsert(s, chunkRef{slice.Chunkid, slice.Size, 1}); err != nil {
 			return err
 		}
+		if len(slice.Checksums) > 0 {
+			if err = mustInsert(s, &chunkSum{slice.Chunkid, marshalChecksums(slice.Checksums)}); err != nil {
+				return err
+			}
+		}
+		if p := slice.Pack; p != nil {
+			if err = mustInsert(s, &chunkPack{slice.Chunkid, p.ID, p.Off, p.Len}); err != nil {
+				return err
+			}
+		}
+		if slice.Inline != nil {
+			if err = mustInsert(s, &chunkData{slice.Chunkid, slice.Inline}); err != nil {
+				return err
+			}
+		}
 		_, err = s.Cols("length", "mtime", "ctime").Update(&n, &node{Inode: inode})
 		if err == nil {
 			needCompact = (len(ck.Slices)/sliceBytes)%100 == 99
@@ -2011,6 +2367,9 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if needCompact {
 			go m.compactChunk(inode, indx, false)
 		}
+		if promote && (indx > 0 || !needCompact) {
+			go m.compactChunk(inode, 0, false)
+		}
 		m.updateStats(newSpace, 0)
 	}
 	return errno(err)
@@ -2299,14 +2658,14 @@ func (m *dbMeta) doCleanupDelayedSlices(edge int64, limit int) (int, error) {
 	return count, nil
 }
 
-func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
+func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) bool {
 	if !force {
 		// avoid too many or duplicated compaction
 		m.Lock()
 		k := uint64(inode) + (uint64(indx) << 32)
 		if len(m.compacting) > 10 || m.compacting[k] {
 			m.Unlock()
-			return
+			return false
 		}
 		m.compacting[k] = true
 		m.Unlock()
@@ -2323,29 +2682,30 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		return err
 	})
 	if err != nil {
-		return
+		return false
 	}
 
 	ss := readSliceBuf(c.Slices)
 	skipped := skipSome(ss)
 	ss = ss[skipped:]
 	pos, size, chunks := compactChunk(ss)
-	if len(ss) < 2 || size == 0 {
-		return
+	if len(ss) < 2 && !m.singleInline(inode, indx, ss) || size == 0 {
+		return false
 	}
 
 	var chunkid uint64
 	st := m.NewChunk(Background, &chunkid)
 	if st != 0 {
-		return
+		return false
 	}
 	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
-	err = m.newMsg(CompactChunk, chunks, chunkid)
+	var sums []uint32
+	err = m.newMsg(CompactChunk, chunks, chunkid, &sums)
 	if err != nil {
 		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
 			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
 		}
-		return
+		return false
 	}
 	var buf []byte
 	trash := m.toTrash(0)
@@ -2375,6 +2735,11 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		if err = mustInsert(s, chunkRef{chunkid, size, 1}); err != nil {
 			return err
 		}
+		if len(sums) > 0 {
+			if err = mustInsert(s, &chunkSum{chunkid, marshalChecksums(sums)}); err != nil {
+				return err
+			}
+		}
 		if trash {
 			if len(buf) > 0 {
 				if err = mustInsert(s, &delslices{chunkid, time.Now().Unix(), buf}); err != nil {
@@ -2439,14 +2804,14 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	}
 
 	if force {
-		m.compactChunk(inode, indx, force)
-	} else {
-		go func() {
-			// wait for the current compaction to finish
-			time.Sleep(time.Millisecond * 10)
-			m.compactChunk(inode, indx, force)
-		}()
+		return m.compactChunk(inode, indx, force) || err == nil
 	}
+	go func() {
+		// wait for the current compaction to finish
+		time.Sleep(time.Millisecond * 10)
+		m.compactChunk(inode, indx, force)
+	}()
+	return err == nil
 }
 
 func dup(b []byte) []byte {
@@ -2474,6 +2839,28 @@ func (m *dbMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
 	return 0
 }
 
+func (m *dbMeta) doScanChunks(cursor uint64, fn func(inode Ino, indx uint32, ss []*slice)) (uint64, error) {
+	end := cursor + scanChunksBatch
+	err := m.roTxn(func(s *xorm.Session) error {
+		// length() of SQLite stops at the first zero byte, so the number of slices is checked here
+		return s.Where("inode >= ? AND inode < ?", cursor, end).Iterate(new(chunk), func(idx int, bean interface{}) error {
+			if c := bean.(*chunk); len(c.Slices) >= sliceBytes*2 {
+				fn(c.Inode, c.Indx, readSliceBuf(c.Slices))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return cursor, err
+	}
+	if next, err := m.getCounter("nextInode"); err != nil {
+		return end, err
+	} else if end >= uint64(next) {
+		end = 0
+	}
+	return end, nil
+}
+
 func (m *dbMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, showProgress func()) syscall.Errno {
 	if delete {
 		m.doCleanupSlices()
@@ -2934,6 +3321,22 @@ func (m *dbMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 			Sustained: sessions,
 			DelFiles:  dels,
 		}
+		var err error
+		if dm.Packs, err = m.dumpPacks(); err != nil {
+			return err
+		}
+		if dm.Sums, err = m.dumpSums(); err != nil {
+			return err
+		}
+		if dm.Inlines, err = m.dumpInlines(); err != nil {
+			return err
+		}
+		if dm.Blocks, dm.Hashes, err = m.dumpBlocks(); err != nil {
+			return err
+		}
+		if dm.Tiers, err = m.dumpTiers(); err != nil {
+			return err
+		}
 		if dm.Setting.SecretKey != "" {
 			dm.Setting.SecretKey = "removed"
 			logger.Warnf("Secret key is removed for the sake of safety")
@@ -2942,6 +3345,14 @@ func (m *dbMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 			dm.Setting.SessionToken = "removed"
 			logger.Warnf("Session token is removed for the sake of safety")
 		}
+		if dm.Setting.ReplicaSecretKey != "" {
+			dm.Setting.ReplicaSecretKey = "removed"
+			logger.Warnf("Secret key of replica is removed for the sake of safety")
+		}
+		if dm.Setting.TierSecretKey != "" {
+			dm.Setting.TierSecretKey = "removed"
+			logger.Warnf("Secret key of tier storage is removed for the sake of safety")
+		}
 		bw, err := dm.writeJsonWithOutTree(w)
 		if err != nil {
 			return err
@@ -3048,8 +3459,11 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	if err = m.syncTable(new(node), new(edge), new(symlink), new(xattr)); err != nil {
 		return fmt.Errorf("create table node, edge, symlink, xattr: %s", err)
 	}
-	if err = m.syncTable(new(chunk), new(chunkRef), new(delslices)); err != nil {
-		return fmt.Errorf("create table chunk, chunk_ref, delslices: %s", err)
+	if err = m.syncTable(new(chunk), new(chunkRef), new(chunkSum), new(chunkPack), new(chunkData), new(chunkTier), new(delslices)); err != nil {
+		return fmt.Errorf("create table chunk, chunk_ref, chunk_sum, chunk_pack, chunk_data, chunk_tier, delslices: %s", err)
+	}
+	if err = m.syncTable(new(blockHash), new(blockRef)); err != nil {
+		return fmt.Errorf("create table block_hash, block_ref: %s", err)
 	}
 	if err = m.syncTable(new(session2), new(sustained), new(delfile)); err != nil {
 		return fmt.Errorf("create table session2, sustaind, delfile: %s", err)
@@ -3121,9 +3535,30 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	chs[5] <- &counter{"nextChunk", counters.NextChunk}
 	chs[5] <- &counter{"nextSession", counters.NextSession}
 	chs[5] <- &counter{"nextTrash", counters.NextTrash}
+	logical, stored := dedupCounters(dm.Blocks)
+	chs[5] <- &counter{dedupLogical, logical}
+	chs[5] <- &counter{dedupStored, stored}
 	for _, d := range dm.DelFiles {
 		chs[5] <- &delfile{d.Inode, d.Length, d.Expire}
 	}
+	for _, d := range dm.Packs {
+		chs[5] <- &chunkPack{d.Chunkid, d.ID, d.Off, d.Len}
+	}
+	for _, d := range dm.Sums {
+		chs[5] <- &chunkSum{d.Chunkid, marshalChecksums(d.Sums)}
+	}
+	for _, d := range dm.Inlines {
+		chs[5] <- &chunkData{d.Chunkid, d.Data}
+	}
+	for _, d := range dm.Blocks {
+		chs[5] <- &blockRef{d.Hash, d.Refs, d.Size}
+	}
+	for _, d := range dm.Hashes {
+		chs[5] <- &blockHash{d.Chunkid, d.Indx, d.Hash}
+	}
+	for _, d := range dm.Tiers {
+		chs[5] <- &chunkTier{d.Chunkid, d.Tier}
+	}
 	for _, c := range chs {
 		close(c)
 	}
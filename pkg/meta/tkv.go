@@ -101,7 +101,267 @@ func (m *kvMeta) Name() string {
 }
 
 func (m *kvMeta) doDeleteSlice(chunkid uint64, size uint32) error {
-	return m.deleteKeys(m.sliceKey(chunkid, size))
+	return m.deleteKeys(m.sliceKey(chunkid, size), m.sumKey(chunkid), m.packKey(chunkid), m.dataKey(chunkid), m.tierKey(chunkid))
+}
+
+func (m *kvMeta) doGetChecksums(chunkid uint64) ([]byte, error) {
+	return m.get(m.sumKey(chunkid))
+}
+
+func (m *kvMeta) doListChecksums() (map[uint64][]byte, error) {
+	vals, err := m.scanValues(m.fmtKey("B"), -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[uint64][]byte, len(vals))
+	for k, v := range vals {
+		if len(k) == 9 {
+			sums[utils.FromBuffer([]byte(k[1:])).Get64()] = v
+		}
+	}
+	return sums, nil
+}
+
+func (m *kvMeta) doGetPack(chunkid uint64) ([]byte, error) {
+	return m.get(m.packKey(chunkid))
+}
+
+func (m *kvMeta) doListPacks() (map[uint64][]byte, error) {
+	vals, err := m.scanValues(m.fmtKey("G"), -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	packs := make(map[uint64][]byte, len(vals))
+	for k, v := range vals {
+		if len(k) == 9 {
+			packs[utils.FromBuffer([]byte(k[1:])).Get64()] = v
+		}
+	}
+	return packs, nil
+}
+
+func (m *kvMeta) doMovePack(chunkid uint64, from uint64, to []byte) (bool, error) {
+	var moved bool
+	err := m.txn(func(tx kvTxn) error {
+		buf := tx.get(m.packKey(chunkid))
+		if buf == nil {
+			return nil
+		}
+		if p := readPack(buf); p == nil || p.ID != from {
+			return nil
+		}
+		tx.set(m.packKey(chunkid), to)
+		moved = true
+		return nil
+	})
+	return moved, err
+}
+
+func (m *kvMeta) doGetInline(chunkid uint64) ([]byte, error) {
+	return m.get(m.dataKey(chunkid))
+}
+
+func (m *kvMeta) doListInlines() (map[uint64][]byte, error) {
+	vals, err := m.scanValues(m.fmtKey("N"), -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	inlines := make(map[uint64][]byte, len(vals))
+	for k, v := range vals {
+		if len(k) == 9 {
+			inlines[utils.FromBuffer([]byte(k[1:])).Get64()] = v
+		}
+	}
+	return inlines, nil
+}
+
+func (m *kvMeta) doGetHashes(chunkid uint64) (map[uint32]string, error) {
+	vals, err := m.scanValues(m.fmtKey("H", chunkid), -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[uint32]string, len(vals))
+	for k, v := range vals {
+		if len(k) == 13 {
+			hashes[utils.FromBuffer([]byte(k[9:])).Get32()] = string(v)
+		}
+	}
+	return hashes, nil
+}
+
+func (m *kvMeta) doListHashes() (map[uint64]map[uint32]string, error) {
+	vals, err := m.scanValues(m.fmtKey("H"), -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[uint64]map[uint32]string)
+	for k, v := range vals {
+		if len(k) != 13 {
+			continue
+		}
+		rb := utils.FromBuffer([]byte(k[1:]))
+		chunkid := rb.Get64()
+		if all[chunkid] == nil {
+			all[chunkid] = make(map[uint32]string)
+		}
+		all[chunkid][rb.Get32()] = string(v)
+	}
+	return all, nil
+}
+
+func (m *kvMeta) doAcquireBlock(chunkid uint64, indx uint32, hash string, size uint32) (int64, bool, error) {
+	var refs int64
+	var added bool
+	err := m.txn(func(tx kvTxn) error {
+		refs, added = 0, false
+		old := tx.get(m.hashKey(chunkid, indx))
+		buf := tx.get(m.blockKey(hash))
+		var r dedupRef
+		if buf != nil {
+			r = readDedupRef(buf)
+		}
+		if string(old) == hash { // acquired already
+			refs = r.refs
+			return nil
+		}
+		if r.refs < 0 {
+			return nil
+		}
+		if buf == nil {
+			r.size = size
+		}
+		r.refs++
+		tx.set(m.blockKey(hash), marshalDedupRef(r))
+		tx.set(m.hashKey(chunkid, indx), []byte(hash))
+		refs, added = r.refs, true
+		return nil
+	})
+	return refs, added, err
+}
+
+func (m *kvMeta) doReleaseBlocks(chunkid uint64) ([]releasedBlock, error) {
+	var released []releasedBlock
+	err := m.txn(func(tx kvTxn) error {
+		released = nil
+		refs := make(map[string]dedupRef)
+		for k, v := range tx.scanValues(m.fmtKey("H", chunkid), -1, nil) {
+			tx.dels([]byte(k))
+			hash := string(v)
+			r, ok := refs[hash]
+			if !ok {
+				buf := tx.get(m.blockKey(hash))
+				if buf == nil {
+					logger.Warnf("block %s used by slice %d is not found", hash, chunkid)
+					continue
+				}
+				r = readDedupRef(buf)
+			}
+			r.refs--
+			refs[hash] = r
+			released = append(released, releasedBlock{hash, r})
+		}
+		for hash, r := range refs {
+			tx.set(m.blockKey(hash), marshalDedupRef(r))
+		}
+		return nil
+	})
+	return released, err
+}
+
+func (m *kvMeta) doListBlocks() (map[string]dedupRef, error) {
+	vals, err := m.scanValues(m.fmtKey("R"), -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(map[string]dedupRef, len(vals))
+	for k, v := range vals {
+		blocks[k[1:]] = readDedupRef(v)
+	}
+	return blocks, nil
+}
+
+func (m *kvMeta) doLockBlock(hash string) (bool, error) {
+	var locked bool
+	err := m.txn(func(tx kvTxn) error {
+		locked = false
+		var r dedupRef
+		if buf := tx.get(m.blockKey(hash)); buf != nil {
+			r = readDedupRef(buf)
+		}
+		if r.refs != 0 {
+			return nil
+		}
+		r.refs = -1
+		tx.set(m.blockKey(hash), marshalDedupRef(r))
+		locked = true
+		return nil
+	})
+	return locked, err
+}
+
+func (m *kvMeta) doDropBlock(hash string, removed bool) error {
+	return m.txn(func(tx kvTxn) error {
+		buf := tx.get(m.blockKey(hash))
+		if buf == nil {
+			return nil
+		}
+		r := readDedupRef(buf)
+		if r.refs != -1 {
+			return nil
+		}
+		if removed {
+			tx.dels(m.blockKey(hash))
+		} else {
+			r.refs = 0
+			tx.set(m.blockKey(hash), marshalDedupRef(r))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doGetTier(chunkid uint64) (uint8, error) {
+	buf, err := m.get(m.tierKey(chunkid))
+	if err != nil || len(buf) == 0 {
+		return TierPrimary, err
+	}
+	return buf[0], nil
+}
+
+func (m *kvMeta) doListTiers() (map[uint64]uint8, error) {
+	vals, err := m.scanValues(m.fmtKey("T"), -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	tiers := make(map[uint64]uint8, len(vals))
+	for k, v := range vals {
+		if len(k) == 9 && len(v) == 1 {
+			tiers[utils.FromBuffer([]byte(k[1:])).Get64()] = v[0]
+		}
+	}
+	return tiers, nil
+}
+
+func (m *kvMeta) doSetTier(inode Ino, indx uint32, chunkid uint64, tier uint8) (bool, error) {
+	var used bool
+	err := m.txn(func(tx kvTxn) error {
+		used = false
+		for _, s := range readSliceBuf(tx.get(m.chunkKey(inode, indx))) {
+			if s.chunkid == chunkid {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return nil
+		}
+		if tier == TierPrimary {
+			tx.dels(m.tierKey(chunkid))
+		} else {
+			tx.set(m.tierKey(chunkid), []byte{tier})
+		}
+		return nil
+	})
+	return used, err
 }
 
 func (m *kvMeta) keyLen(args ...interface{}) int {
@@ -167,6 +427,12 @@ All keys:
   Fiiiiiiii          Flocks
   Piiiiiiii          POSIX locks
   Kccccccccnnnn      slice refs
+  Bcccccccc          block checksums of slice
+  Gcccccccc          packed slice
+  Ncccccccc          data of inline slice
+  Hccccccccnnnn      content hash of deduplicated block
+  R...               references of deduplicated object
+  Tcccccccc          tier of slice
   Lttttttttcccccccc  delayed slices
   SEssssssss         session expire time
   SHssssssss         session heartbeat // for legacy client
@@ -194,6 +460,30 @@ func (m *kvMeta) sliceKey(chunkid uint64, size uint32) []byte {
 	return m.fmtKey("K", chunkid, size)
 }
 
+func (m *kvMeta) sumKey(chunkid uint64) []byte {
+	return m.fmtKey("B", chunkid)
+}
+
+func (m *kvMeta) packKey(chunkid uint64) []byte {
+	return m.fmtKey("G", chunkid)
+}
+
+func (m *kvMeta) dataKey(chunkid uint64) []byte {
+	return m.fmtKey("N", chunkid)
+}
+
+func (m *kvMeta) hashKey(chunkid uint64, indx uint32) []byte {
+	return m.fmtKey("H", chunkid, indx)
+}
+
+func (m *kvMeta) tierKey(chunkid uint64) []byte {
+	return m.fmtKey("T", chunkid)
+}
+
+func (m *kvMeta) blockKey(hash string) []byte {
+	return m.fmtKey("R", hash)
+}
+
 func (m *kvMeta) delSliceKey(ts int64, chunkid uint64) []byte {
 	return m.fmtKey("L", uint64(ts), chunkid)
 }
@@ -1666,7 +1956,7 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 	}
 	defer func() { m.of.InvalidateChunk(inode, indx) }()
 	var newSpace int64
-	var needCompact bool
+	var needCompact, promote bool
 	err := m.txn(func(tx kvTxn) error {
 		var attr Attr
 		a := tx.get(m.inodeKey(inode))
@@ -1678,6 +1968,7 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 			return syscall.EPERM
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
+		promote = m.shouldPromote(slice, attr.Length, newleng)
 		if newleng > attr.Length {
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
@@ -1691,6 +1982,15 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		attr.Ctime = now.Unix()
 		attr.Ctimensec = uint32(now.Nanosecond())
 		val := tx.append(m.chunkKey(inode, indx), marshalSlice(off, slice.Chunkid, slice.Size, slice.Off, slice.Len))
+		if len(slice.Checksums) > 0 {
+			tx.set(m.sumKey(slice.Chunkid), marshalChecksums(slice.Checksums))
+		}
+		if slice.Pack != nil {
+			tx.set(m.packKey(slice.Chunkid), marshalPack(slice.Pack))
+		}
+		if slice.Inline != nil {
+			tx.set(m.dataKey(slice.Chunkid), slice.Inline)
+		}
 		tx.set(m.inodeKey(inode), m.marshal(&attr))
 		needCompact = (len(val)/sliceBytes)%100 == 99
 		return nil
@@ -1699,6 +1999,9 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if needCompact {
 			go m.compactChunk(inode, indx, false)
 		}
+		if promote && (indx > 0 || !needCompact) {
+			go m.compactChunk(inode, 0, false)
+		}
 		m.updateStats(newSpace, 0)
 	}
 	return errno(err)
@@ -1967,14 +2270,14 @@ func (m *kvMeta) doCleanupDelayedSlices(edge int64, limit int) (int, error) {
 	return count, nil
 }
 
-func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
+func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) bool {
 	if !force {
 		// avoid too many or duplicated compaction
 		m.Lock()
 		k := uint64(inode) + (uint64(indx) << 32)
 		if len(m.compacting) > 10 || m.compacting[k] {
 			m.Unlock()
-			return
+			return false
 		}
 		m.compacting[k] = true
 		m.Unlock()
@@ -1987,7 +2290,7 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 
 	buf, err := m.get(m.chunkKey(inode, indx))
 	if err != nil {
-		return
+		return false
 	}
 
 	if len(buf) > sliceBytes*100 {
@@ -1997,22 +2300,23 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	skipped := skipSome(ss)
 	ss = ss[skipped:]
 	pos, size, chunks := compactChunk(ss)
-	if len(ss) < 2 || size == 0 {
-		return
+	if len(ss) < 2 && !m.singleInline(inode, indx, ss) || size == 0 {
+		return false
 	}
 
 	var chunkid uint64
 	st := m.NewChunk(Background, &chunkid)
 	if st != 0 {
-		return
+		return false
 	}
 	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
-	err = m.newMsg(CompactChunk, chunks, chunkid)
+	var sums []uint32
+	err = m.newMsg(CompactChunk, chunks, chunkid, &sums)
 	if err != nil {
 		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
 			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
 		}
-		return
+		return false
 	}
 	var dsbuf []byte
 	trash := m.toTrash(0)
@@ -2034,6 +2338,9 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		tx.set(m.chunkKey(inode, indx), buf2)
 		// create the key to tracking it
 		tx.set(m.sliceKey(chunkid, size), make([]byte, 8))
+		if len(sums) > 0 {
+			tx.set(m.sumKey(chunkid), marshalChecksums(sums))
+		}
 		if trash {
 			if len(dsbuf) > 0 {
 				tx.set(m.delSliceKey(time.Now().Unix(), chunkid), dsbuf)
@@ -2083,14 +2390,14 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	}
 
 	if force {
-		m.compactChunk(inode, indx, force)
-	} else {
-		go func() {
-			// wait for the current compaction to finish
-			time.Sleep(time.Millisecond * 10)
-			m.compactChunk(inode, indx, force)
-		}()
+		return m.compactChunk(inode, indx, force) || err == nil
 	}
+	go func() {
+		// wait for the current compaction to finish
+		time.Sleep(time.Millisecond * 10)
+		m.compactChunk(inode, indx, force)
+	}()
+	return err == nil
 }
 
 func (r *kvMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
@@ -2116,6 +2423,23 @@ func (r *kvMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
 	return 0
 }
 
+func (m *kvMeta) doScanChunks(cursor uint64, fn func(inode Ino, indx uint32, ss []*slice)) (uint64, error) {
+	// AiiiiiiiiCnnnn     file chunks
+	// inodes are encoded in little endian, so chunks are split into 256 parts by the lowest byte of inode
+	klen := 1 + 8 + 1 + 4
+	result, err := m.scanValues(m.fmtKey("A", byte(cursor)), -1, func(k, v []byte) bool {
+		return len(k) == klen && k[1+8] == 'C' && len(v) > sliceBytes
+	})
+	if err != nil {
+		return cursor, err
+	}
+	for k, v := range result {
+		key := []byte(k[1:])
+		fn(m.decodeInode(key[:8]), binary.BigEndian.Uint32(key[9:]), readSliceBuf(v))
+	}
+	return (cursor + 1) % 256, nil
+}
+
 func (m *kvMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, showProgress func()) syscall.Errno {
 	if delete {
 		m.doCleanupSlices()
@@ -2522,6 +2846,21 @@ func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		Sustained: sessions,
 		DelFiles:  dels,
 	}
+	if dm.Packs, err = m.dumpPacks(); err != nil {
+		return err
+	}
+	if dm.Sums, err = m.dumpSums(); err != nil {
+		return err
+	}
+	if dm.Inlines, err = m.dumpInlines(); err != nil {
+		return err
+	}
+	if dm.Blocks, dm.Hashes, err = m.dumpBlocks(); err != nil {
+		return err
+	}
+	if dm.Tiers, err = m.dumpTiers(); err != nil {
+		return err
+	}
 	if dm.Setting.SecretKey != "" {
 		dm.Setting.SecretKey = "removed"
 		logger.Warnf("Secret key is removed for the sake of safety")
@@ -2530,6 +2869,14 @@ func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		dm.Setting.SessionToken = "removed"
 		logger.Warnf("Session token is removed for the sake of safety")
 	}
+	if dm.Setting.ReplicaSecretKey != "" {
+		dm.Setting.ReplicaSecretKey = "removed"
+		logger.Warnf("Secret key of replica is removed for the sake of safety")
+	}
+	if dm.Setting.TierSecretKey != "" {
+		dm.Setting.TierSecretKey = "removed"
+		logger.Warnf("Secret key of tier storage is removed for the sake of safety")
+	}
 	bw, err := dm.writeJsonWithOutTree(w)
 	if err != nil {
 		return err
@@ -2668,9 +3015,30 @@ func (m *kvMeta) LoadMeta(r io.Reader) error {
 	kv <- &pair{m.counterKey("nextChunk"), packCounter(counters.NextChunk)}
 	kv <- &pair{m.counterKey("nextSession"), packCounter(counters.NextSession)}
 	kv <- &pair{m.counterKey("nextTrash"), packCounter(counters.NextTrash)}
+	logical, stored := dedupCounters(dm.Blocks)
+	kv <- &pair{m.counterKey(dedupLogical), packCounter(logical)}
+	kv <- &pair{m.counterKey(dedupStored), packCounter(stored)}
 	for _, d := range dm.DelFiles {
 		kv <- &pair{m.delfileKey(d.Inode, d.Length), m.packInt64(d.Expire)}
 	}
+	for _, d := range dm.Packs {
+		kv <- &pair{m.packKey(d.Chunkid), marshalPack(&Pack{d.ID, d.Off, d.Len})}
+	}
+	for _, d := range dm.Sums {
+		kv <- &pair{m.sumKey(d.Chunkid), marshalChecksums(d.Sums)}
+	}
+	for _, d := range dm.Inlines {
+		kv <- &pair{m.dataKey(d.Chunkid), d.Data}
+	}
+	for _, d := range dm.Blocks {
+		kv <- &pair{m.blockKey(d.Hash), marshalDedupRef(dedupRef{d.Refs, d.Size})}
+	}
+	for _, d := range dm.Hashes {
+		kv <- &pair{m.hashKey(d.Chunkid, d.Indx), []byte(d.Hash)}
+	}
+	for _, d := range dm.Tiers {
+		kv <- &pair{m.tierKey(d.Chunkid), []byte{d.Tier}}
+	}
 	for k, v := range refs {
 		if v > 1 {
 			kv <- &pair{m.sliceKey(k.id, k.size), packCounter(v - 1)}
@@ -35,6 +35,8 @@ import (
 const (
 	usedSpace      = "usedSpace"
 	totalInodes    = "totalInodes"
+	dedupLogical   = "dedupLogical" // bytes of all the references to deduplicated objects
+	dedupStored    = "dedupStored"  // bytes of referenced deduplicated objects
 	legacySessions = "sessions"
 )
 
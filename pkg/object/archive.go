@@ -0,0 +1,123 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotRestored is returned when reading an archived object which is not restored yet.
+var ErrNotRestored = errors.New("object is archived and not restored")
+
+// SupportRestore is implemented by object storages which archive objects, they can't be read
+// until a restore request is finished.
+type SupportRestore interface {
+	// Restore requests a temporary readable copy of an archived object, it returns
+	// immediately and could be called again while the restore is in progress.
+	Restore(key string) error
+}
+
+// archive emulates an archive storage class with local disk: objects can be listed and deleted,
+// but they can be read only in a while after a restore request, and are archived again after
+// the restored copy expires.
+type archive struct {
+	ObjectStorage
+	markers ObjectStorage // restore requests, their mtime is the time of request
+	delay   time.Duration
+	expire  time.Duration
+}
+
+func (a *archive) String() string {
+	return strings.Replace(a.ObjectStorage.String(), "file://", "archive://", 1)
+}
+
+func (a *archive) restored(key string) bool {
+	o, err := a.markers.Head(key)
+	if err != nil {
+		return false
+	}
+	age := time.Since(o.Mtime())
+	if age > a.delay+a.expire {
+		_ = a.markers.Delete(key)
+	}
+	return age >= a.delay && age <= a.delay+a.expire
+}
+
+func (a *archive) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if _, err := a.ObjectStorage.Head(key); err != nil {
+		return nil, err
+	}
+	if !a.restored(key) {
+		return nil, ErrNotRestored
+	}
+	return a.ObjectStorage.Get(key, off, limit)
+}
+
+func (a *archive) Put(key string, in io.Reader) error {
+	if err := a.ObjectStorage.Put(key, in); err != nil {
+		return err
+	}
+	return a.markers.Delete(key)
+}
+
+func (a *archive) Delete(key string) error {
+	if err := a.ObjectStorage.Delete(key); err != nil {
+		return err
+	}
+	return a.markers.Delete(key)
+}
+
+func (a *archive) Restore(key string) error {
+	if _, err := a.ObjectStorage.Head(key); err != nil {
+		return err
+	}
+	if o, err := a.markers.Head(key); err == nil && time.Since(o.Mtime()) <= a.delay+a.expire {
+		return nil // in progress or restored
+	}
+	return a.markers.Put(key, bytes.NewReader(nil))
+}
+
+func newArchive(root, accesskey, secretkey, token string) (ObjectStorage, error) {
+	if !strings.HasSuffix(root, dirSuffix) {
+		root += dirSuffix
+	}
+	objects, err := newDisk(root+"objects/", accesskey, secretkey, token)
+	if err != nil {
+		return nil, err
+	}
+	markers, err := newDisk(root+"restore/", accesskey, secretkey, token)
+	if err != nil {
+		return nil, err
+	}
+	delay := time.Minute
+	if v := os.Getenv("JFS_ARCHIVE_RESTORE_DELAY"); v != "" {
+		if delay, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid restore delay %s: %s", v, err)
+		}
+	}
+	return &archive{objects, markers, delay, time.Hour * 24}, nil
+}
+
+func init() {
+	Register("archive", newArchive)
+}
@@ -0,0 +1,68 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	os.Setenv("JFS_ARCHIVE_RESTORE_DELAY", "200ms")
+	defer os.Unsetenv("JFS_ARCHIVE_RESTORE_DELAY")
+	s, err := CreateStorage("archive", t.TempDir(), "", "", "")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	s = WithPrefix(s, "vol/")
+	if err = s.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if o, err := s.Head("a"); err != nil || o.Size() != 5 {
+		t.Fatalf("head: %+v %s", o, err)
+	}
+	if _, err = s.Get("a", 0, -1); err != ErrNotRestored {
+		t.Fatalf("get archived object: %s", err)
+	}
+	if err = s.(SupportRestore).Restore("a"); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if _, err = s.Get("a", 0, -1); err != ErrNotRestored {
+		t.Fatalf("get object being restored: %s", err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	in, err := s.Get("a", 1, 3)
+	if err != nil {
+		t.Fatalf("get restored object: %s", err)
+	}
+	if d, _ := ioutil.ReadAll(in); string(d) != "ell" {
+		t.Fatalf("expect ell, got %s", d)
+	}
+	_ = in.Close()
+	if err = s.(SupportRestore).Restore("b"); err == nil {
+		t.Fatalf("restore a missing object should fail")
+	}
+	if err = s.Delete("a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err = s.Get("a", 0, -1); err == nil || err == ErrNotRestored {
+		t.Fatalf("get deleted object: %s", err)
+	}
+}
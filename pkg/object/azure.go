@@ -35,6 +35,7 @@ type wasb struct {
 	container *azblob.ContainerClient
 	cName     string
 	marker    string
+	sc        string
 }
 
 func (b *wasb) String() string {
@@ -69,16 +70,43 @@ func (b *wasb) Head(key string) (Object, error) {
 func (b *wasb) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	download, err := b.container.NewBlockBlobClient(key).Download(ctx, &azblob.DownloadBlobOptions{Offset: &off, Count: &limit})
 	if err != nil {
+		if strings.Contains(err.Error(), string(azblob.StorageErrorCodeBlobArchived)) {
+			err = ErrNotRestored
+		} else if strings.Contains(err.Error(), string(azblob.StorageErrorCodeBlobNotFound)) {
+			err = os.ErrNotExist
+		}
 		return nil, err
 	}
 	return download.BlobDownloadResponse.RawResponse.Body, err
 }
 
 func (b *wasb) Put(key string, data io.Reader) error {
-	_, err := b.container.NewBlockBlobClient(key).UploadStreamToBlockBlob(ctx, data, azblob.UploadStreamToBlockBlobOptions{})
+	options := azblob.UploadStreamToBlockBlobOptions{}
+	if b.sc != "" {
+		tier := azblob.AccessTier(b.sc)
+		options.AccessTier = &tier
+	}
+	_, err := b.container.NewBlockBlobClient(key).UploadStreamToBlockBlob(ctx, data, options)
 	return err
 }
 
+func (b *wasb) SetStorageClass(sc string) error {
+	if sc != "" {
+		var valid bool
+		for _, t := range azblob.PossibleAccessTierValues() {
+			if strings.EqualFold(sc, string(t)) {
+				sc, valid = string(t), true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid access tier %s, expect one of %v", sc, azblob.PossibleAccessTierValues())
+		}
+	}
+	b.sc = sc
+	return nil
+}
+
 func (b *wasb) Copy(dst, src string) error {
 	_, err := b.container.NewBlockBlobClient(dst).CopyFromURL(ctx, b.container.NewBlockBlobClient(src).URL(),
 		&azblob.CopyBlockBlobFromURLOptions{})
@@ -0,0 +1,456 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// ErrInjected is returned by the chaos object storage for the injected failures.
+var ErrInjected = errors.New("injected failure")
+
+var chaosOps = []string{"head", "get", "put", "delete", "list", "upload"}
+
+type latency struct {
+	kind byte // 0: fixed, 'u': uniform in [min, max], 'e': exponential with the mean
+	min  time.Duration
+	max  time.Duration
+}
+
+func parseLatency(s string) (latency, error) {
+	if strings.HasPrefix(s, "exp:") {
+		d, err := time.ParseDuration(s[4:])
+		return latency{'e', d, d}, err
+	}
+	if p := strings.Index(s, "-"); p > 0 {
+		min, err := time.ParseDuration(s[:p])
+		if err != nil {
+			return latency{}, err
+		}
+		max, err := time.ParseDuration(s[p+1:])
+		if err != nil || max < min {
+			return latency{}, fmt.Errorf("invalid range of latency: %s", s)
+		}
+		return latency{'u', min, max}, nil
+	}
+	d, err := time.ParseDuration(s)
+	return latency{0, d, d}, err
+}
+
+func (l latency) sample(r *rand.Rand) time.Duration {
+	switch l.kind {
+	case 'u':
+		return l.min + time.Duration(r.Int63n(int64(l.max-l.min)+1))
+	case 'e':
+		return time.Duration(r.ExpFloat64() * float64(l.min))
+	}
+	return l.min
+}
+
+// chaosConf is the faults to inject, which is parsed from a query string like
+// "seed=1&latency=10ms-50ms&get-error=0.1&truncate=0.01&stale-list=0.1&bwlimit=100".
+type chaosConf struct {
+	latency   map[string]latency // by operation, "" for all
+	errors    map[string]float64 // ratio of failures by operation, "" for all
+	truncate  float64            // ratio of truncated bodies of Get
+	staleList float64            // ratio of List and ListAll returning the previous result
+	limiter   *ratelimit.Bucket  // bandwidth cap of Get and Put
+}
+
+func parseChaosConf(s string) (*chaosConf, int64, error) {
+	vs, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse %s: %s", s, err)
+	}
+	c := &chaosConf{latency: make(map[string]latency), errors: make(map[string]float64)}
+	var seed int64
+	ratio := func(k, v string) (float64, error) {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 || r > 1 {
+			return 0, fmt.Errorf("invalid %s: %s", k, v)
+		}
+		return r, nil
+	}
+	for k := range vs {
+		v := vs.Get(k)
+		switch {
+		case k == "conf": // handled by NewChaos
+		case k == "seed":
+			if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, 0, fmt.Errorf("invalid seed: %s", v)
+			}
+		case k == "latency" || strings.HasSuffix(k, "-latency"):
+			op := strings.TrimSuffix(strings.TrimSuffix(k, "latency"), "-")
+			l, err := parseLatency(v)
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid %s: %s", k, v)
+			}
+			c.latency[op] = l
+		case k == "error" || strings.HasSuffix(k, "-error"):
+			op := strings.TrimSuffix(strings.TrimSuffix(k, "error"), "-")
+			if c.errors[op], err = ratio(k, v); err != nil {
+				return nil, 0, err
+			}
+		case k == "truncate":
+			if c.truncate, err = ratio(k, v); err != nil {
+				return nil, 0, err
+			}
+		case k == "stale-list":
+			if c.staleList, err = ratio(k, v); err != nil {
+				return nil, 0, err
+			}
+		case k == "bwlimit":
+			mbps, err := strconv.ParseFloat(v, 64)
+			if err != nil || mbps < 0 {
+				return nil, 0, fmt.Errorf("invalid bwlimit: %s", v)
+			}
+			if bps := mbps * 1e6 / 8; bps > 0 {
+				c.limiter = ratelimit.NewBucketWithRate(bps, int64(bps))
+			}
+		default:
+			return nil, 0, fmt.Errorf("unknown option of chaos: %s", k)
+		}
+	}
+	for op := range c.latency {
+		if op != "" && !validChaosOp(op) {
+			return nil, 0, fmt.Errorf("unknown operation of latency: %s", op)
+		}
+	}
+	for op := range c.errors {
+		if op != "" && !validChaosOp(op) {
+			return nil, 0, fmt.Errorf("unknown operation of error: %s", op)
+		}
+	}
+	return c, seed, nil
+}
+
+func validChaosOp(op string) bool {
+	for _, o := range chaosOps {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// chaos injects latency, failures, truncated bodies, stale listings and bandwidth caps into
+// the operations of another object storage, to test how the client behaves when the object
+// storage misbehaves. The faults are decided by a random generator with the seed, so they
+// are deterministic for the same sequence of operations.
+type chaos struct {
+	ObjectStorage
+	sync.Mutex
+	conf    *chaosConf
+	rand    *rand.Rand
+	lists   map[string][]Object // the previous result of List and ListAll
+	path    string              // file to reload the configuration from
+	mtime   time.Time
+	checked time.Time
+}
+
+// NewChaos returns an object storage injecting the faults configured by conf into s, which is a
+// query string of options:
+//
+//	seed=N                       seed of the random generator (default: 0)
+//	latency=D, OP-latency=D      latency of all or one operation: a duration (10ms), a uniform
+//	                             range (10ms-50ms), or an exponential distribution (exp:20ms)
+//	error=R, OP-error=R          ratio of failed requests of all or one operation
+//	truncate=R                   ratio of bodies of Get truncated with io.ErrUnexpectedEOF
+//	stale-list=R                 ratio of List and ListAll returning the previous result of the same request
+//	bwlimit=N                    bandwidth cap of Get and Put in Mbps
+//	conf=PATH                    file to reload the options from when it's changed
+//
+// OP is one of head, get, put, delete, list and upload (multipart uploads).
+func NewChaos(s ObjectStorage, conf string) (ObjectStorage, error) {
+	c, seed, err := parseChaosConf(conf)
+	if err != nil {
+		return nil, err
+	}
+	vs, _ := url.ParseQuery(conf)
+	ch := &chaos{ObjectStorage: s, conf: c, rand: rand.New(rand.NewSource(seed)), lists: make(map[string][]Object), path: vs.Get("conf")}
+	return ch, nil
+}
+
+// ConfigureChaos changes the faults injected by a chaos object storage at runtime.
+func ConfigureChaos(s ObjectStorage, conf string) error {
+	ch, ok := s.(*chaos)
+	if !ok {
+		return notSupported
+	}
+	c, seed, err := parseChaosConf(conf)
+	if err != nil {
+		return err
+	}
+	ch.Lock()
+	ch.conf = c
+	ch.rand = rand.New(rand.NewSource(seed))
+	ch.lists = make(map[string][]Object)
+	ch.Unlock()
+	return nil
+}
+
+func (c *chaos) String() string {
+	return fmt.Sprintf("chaos(%s)", c.ObjectStorage)
+}
+
+// reload reads the configuration from file if it's changed, it should be called with lock held.
+func (c *chaos) reload() {
+	if c.path == "" || time.Since(c.checked) < time.Second {
+		return
+	}
+	c.checked = time.Now()
+	fi, err := os.Stat(c.path)
+	if err != nil || fi.ModTime().Equal(c.mtime) {
+		return
+	}
+	c.mtime = fi.ModTime()
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		logger.Warnf("read chaos configuration from %s: %s", c.path, err)
+		return
+	}
+	conf, seed, err := parseChaosConf(strings.TrimSpace(string(data)))
+	if err != nil {
+		logger.Warnf("invalid chaos configuration in %s: %s", c.path, err)
+		return
+	}
+	logger.Infof("Reloaded chaos configuration from %s", c.path)
+	c.conf = conf
+	c.rand = rand.New(rand.NewSource(seed))
+}
+
+func (c *chaos) ratio(m map[string]float64, op string) float64 {
+	if r, ok := m[op]; ok {
+		return r
+	}
+	return m[""]
+}
+
+// inject sleeps for the latency of the operation, and returns an error if it should fail.
+func (c *chaos) inject(op string) (*chaosConf, error) {
+	c.Lock()
+	c.reload()
+	conf := c.conf
+	l, ok := conf.latency[op]
+	if !ok {
+		l = conf.latency[""]
+	}
+	d := l.sample(c.rand)
+	// only draw for the operations with failures, so the seed decides them regardless of others
+	ratio := c.ratio(conf.errors, op)
+	fail := ratio > 0 && c.rand.Float64() < ratio
+	c.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+	if fail {
+		return conf, fmt.Errorf("%s: %w", op, ErrInjected)
+	}
+	return conf, nil
+}
+
+// roll returns true with the probability of r.
+func (c *chaos) roll(r float64) bool {
+	if r <= 0 {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.rand.Float64() < r
+}
+
+func (c *chaos) Head(key string) (Object, error) {
+	if _, err := c.inject("head"); err != nil {
+		return nil, err
+	}
+	return c.ObjectStorage.Head(key)
+}
+
+func (c *chaos) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	conf, err := c.inject("get")
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.ObjectStorage.Get(key, off, limit)
+	if err != nil {
+		return nil, err
+	}
+	if c.roll(conf.truncate) {
+		data, err := ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			return nil, err
+		}
+		c.Lock()
+		n := c.rand.Intn(len(data) + 1)
+		c.Unlock()
+		r = ioutil.NopCloser(io.MultiReader(bytes.NewReader(data[:n]), errReader{io.ErrUnexpectedEOF}))
+	}
+	if conf.limiter != nil {
+		r = struct {
+			io.Reader
+			io.Closer
+		}{ratelimit.Reader(r, conf.limiter), r}
+	}
+	return r, nil
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func (c *chaos) Put(key string, in io.Reader) error {
+	conf, err := c.inject("put")
+	if err != nil {
+		return err
+	}
+	if conf.limiter != nil {
+		in = ratelimit.Reader(in, conf.limiter)
+	}
+	return c.ObjectStorage.Put(key, in)
+}
+
+func (c *chaos) Delete(key string) error {
+	if _, err := c.inject("delete"); err != nil {
+		return err
+	}
+	return c.ObjectStorage.Delete(key)
+}
+
+func (c *chaos) List(prefix, marker string, limit int64) ([]Object, error) {
+	conf, err := c.inject("list")
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s\x00%s\x00%d", prefix, marker, limit)
+	if c.roll(conf.staleList) {
+		c.Lock()
+		objs, ok := c.lists[key]
+		c.Unlock()
+		if ok {
+			return objs, nil
+		}
+	}
+	objs, err := c.ObjectStorage.List(prefix, marker, limit)
+	if err == nil && conf.staleList > 0 {
+		c.Lock()
+		c.lists[key] = objs
+		c.Unlock()
+	}
+	return objs, err
+}
+
+func (c *chaos) ListAll(prefix, marker string) (<-chan Object, error) {
+	conf, err := c.inject("list")
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s\x00%s\x00all", prefix, marker)
+	if c.roll(conf.staleList) {
+		c.Lock()
+		objs, ok := c.lists[key]
+		c.Unlock()
+		if ok {
+			out := make(chan Object, len(objs))
+			for _, o := range objs {
+				out <- o
+			}
+			close(out)
+			return out, nil
+		}
+	}
+	ch, err := c.ObjectStorage.ListAll(prefix, marker)
+	if err != nil || conf.staleList == 0 {
+		return ch, err
+	}
+	out := make(chan Object, maxResults)
+	go func() {
+		defer close(out)
+		var objs []Object
+		for o := range ch {
+			out <- o
+			if o == nil {
+				return // failed listing is not remembered
+			}
+			objs = append(objs, o)
+		}
+		c.Lock()
+		c.lists[key] = objs
+		c.Unlock()
+	}()
+	return out, nil
+}
+
+func (c *chaos) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	if _, err := c.inject("upload"); err != nil {
+		return nil, err
+	}
+	return c.ObjectStorage.CreateMultipartUpload(key)
+}
+
+func (c *chaos) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	conf, err := c.inject("upload")
+	if err != nil {
+		return nil, err
+	}
+	if conf.limiter != nil {
+		conf.limiter.Wait(int64(len(body)))
+	}
+	return c.ObjectStorage.UploadPart(key, uploadID, num, body)
+}
+
+func (c *chaos) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if _, err := c.inject("upload"); err != nil {
+		return err
+	}
+	return c.ObjectStorage.CompleteUpload(key, uploadID, parts)
+}
+
+// newChaos creates the chaos object storage from an endpoint like NAME://ENDPOINT#OPTIONS, where
+// NAME and ENDPOINT are the type and endpoint of the object storage to wrap.
+func newChaos(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+	var conf string
+	if p := strings.LastIndex(endpoint, "#"); p >= 0 {
+		endpoint, conf = endpoint[:p], endpoint[p+1:]
+	}
+	p := strings.Index(endpoint, "://")
+	if p <= 0 {
+		return nil, fmt.Errorf("invalid endpoint of chaos: %s, expect NAME://ENDPOINT#OPTIONS", endpoint)
+	}
+	s, err := CreateStorage(endpoint[:p], endpoint[p+3:], accessKey, secretKey, token)
+	if err != nil {
+		return nil, err
+	}
+	return NewChaos(s, conf)
+}
+
+func init() {
+	Register("chaos", newChaos)
+}
@@ -0,0 +1,143 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChaos(t *testing.T) {
+	mem, _ := CreateStorage("mem", "", "", "", "")
+	_ = mem.Put("a", bytes.NewReader([]byte("hello")))
+	failures := func(conf string) []bool {
+		s, err := NewChaos(mem, conf)
+		if err != nil {
+			t.Fatalf("chaos %s: %s", conf, err)
+		}
+		var r []bool
+		for i := 0; i < 100; i++ {
+			_, err := s.Head("a")
+			if err != nil && !errors.Is(err, ErrInjected) {
+				t.Fatalf("head: %s", err)
+			}
+			r = append(r, err != nil)
+			if _, err = s.Get("a", 0, -1); err != nil {
+				t.Fatalf("get should not fail: %s", err)
+			}
+		}
+		return r
+	}
+	r1 := failures("seed=3&head-error=0.5")
+	if r2 := failures("seed=3&head-error=0.5&get-error=0"); len(r1) != len(r2) {
+		t.Fatalf("unexpected results")
+	} else {
+		var n int
+		for i := range r1 {
+			if r1[i] != r2[i] {
+				t.Fatalf("failures should be the same with the same seed")
+			}
+			if r1[i] {
+				n++
+			}
+		}
+		if n < 20 || n > 80 {
+			t.Fatalf("%d failures out of 100", n)
+		}
+	}
+
+	s, err := CreateStorage("chaos", "mem://#truncate=1&seed=1", "", "", "")
+	if err != nil {
+		t.Fatalf("create chaos: %s", err)
+	}
+	_ = s.Put("b", bytes.NewReader(bytes.Repeat([]byte("x"), 1000)))
+	r, err := s.Get("b", 0, -1)
+	if err != nil {
+		t.Fatalf("get b: %s", err)
+	}
+	if d, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF || len(d) >= 1000 {
+		t.Fatalf("body should be truncated: %d %v", len(d), err)
+	}
+
+	// stale listing
+	if err = ConfigureChaos(s, "stale-list=1"); err != nil {
+		t.Fatalf("configure: %s", err)
+	}
+	objs, _ := s.List("", "", 10)
+	// mem does not support ListAll, so it's listed from a local disk
+	disk, _ := CreateStorage("file", t.TempDir()+"/", "", "", "")
+	ds, _ := NewChaos(disk, "stale-list=1")
+	_ = disk.Put("a", bytes.NewReader(nil))
+	count := func() (n int) {
+		ch, _ := ListAll(ds, "", "")
+		for range ch {
+			n++
+		}
+		return
+	}
+	all := count()
+	_ = s.Put("c", bytes.NewReader(nil))
+	_ = disk.Put("c", bytes.NewReader(nil))
+	if objs2, _ := s.List("", "", 10); len(objs2) != len(objs) {
+		t.Fatalf("list should be stale: %d != %d", len(objs2), len(objs))
+	}
+	if n := count(); n != all {
+		t.Fatalf("list all should be stale: %d != %d", n, all)
+	}
+	_ = ConfigureChaos(s, "")
+	_ = ConfigureChaos(ds, "")
+	if objs2, _ := s.List("", "", 10); len(objs2) != len(objs)+1 {
+		t.Fatalf("list should be fresh: %d", len(objs2))
+	}
+	if n := count(); n != all+1 {
+		t.Fatalf("list all should be fresh: %d", n)
+	}
+
+	// latency and bandwidth
+	_ = ConfigureChaos(s, "put-latency=50ms-60ms&bwlimit=0.8")
+	start := time.Now()
+	_ = s.Put("d", bytes.NewReader(make([]byte, 10<<10)))
+	if used := time.Since(start); used < 50*time.Millisecond {
+		t.Fatalf("put should be slow: %s", used)
+	}
+	start = time.Now()
+	r, _ = s.Get("d", 0, -1)
+	_, _ = ioutil.ReadAll(r)
+	if used := time.Since(start); used > 40*time.Millisecond {
+		t.Fatalf("get should not be delayed: %s", used)
+	}
+
+	for _, conf := range []string{"error=2", "xx-error=0.1", "latency=abc", "foo=1"} {
+		if err = ConfigureChaos(s, conf); err == nil {
+			t.Fatalf("invalid conf %s should fail", conf)
+		}
+	}
+
+	// reload the options from file
+	path := filepath.Join(t.TempDir(), "chaos.conf")
+	_ = os.WriteFile(path, []byte("delete-error=1"), 0644)
+	s, _ = NewChaos(mem, "conf="+path)
+	if err = s.Delete("a"); !errors.Is(err, ErrInjected) {
+		t.Fatalf("delete should fail: %v", err)
+	}
+}
@@ -38,6 +38,7 @@ const cosChecksumKey = "x-cos-meta-" + checksumAlgr
 type COS struct {
 	c        *cos.Client
 	endpoint string
+	sc       string
 }
 
 func (c *COS) String() string {
@@ -88,6 +89,11 @@ func (c *COS) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	}
 	resp, err := c.c.Object.Get(ctx, key, params)
 	if err != nil {
+		if e, ok := err.(*cos.ErrorResponse); ok && e.Code == "InvalidObjectState" {
+			err = ErrNotRestored
+		} else if ok && e.Response != nil && e.Response.StatusCode == http.StatusNotFound {
+			err = os.ErrNotExist
+		}
 		return nil, err
 	}
 	if off == 0 && limit == -1 {
@@ -97,12 +103,12 @@ func (c *COS) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (c *COS) Put(key string, in io.Reader) error {
-	var options *cos.ObjectPutOptions
+	options := &cos.ObjectPutOptions{ObjectPutHeaderOptions: &cos.ObjectPutHeaderOptions{XCosStorageClass: c.sc}}
 	if ins, ok := in.(io.ReadSeeker); ok {
 		header := http.Header(map[string][]string{
 			cosChecksumKey: {generateChecksum(ins)},
 		})
-		options = &cos.ObjectPutOptions{ObjectPutHeaderOptions: &cos.ObjectPutHeaderOptions{XCosMetaXXX: &header}}
+		options.XCosMetaXXX = &header
 	}
 	_, err := c.c.Object.Put(ctx, key, in, options)
 	return err
@@ -110,10 +116,19 @@ func (c *COS) Put(key string, in io.Reader) error {
 
 func (c *COS) Copy(dst, src string) error {
 	source := fmt.Sprintf("%s/%s", c.endpoint, src)
-	_, _, err := c.c.Object.Copy(ctx, dst, source, nil)
+	var options *cos.ObjectCopyOptions
+	if c.sc != "" {
+		options = &cos.ObjectCopyOptions{ObjectCopyHeaderOptions: &cos.ObjectCopyHeaderOptions{XCosStorageClass: c.sc}}
+	}
+	_, _, err := c.c.Object.Copy(ctx, dst, source, options)
 	return err
 }
 
+func (c *COS) SetStorageClass(sc string) error {
+	c.sc = sc
+	return nil
+}
+
 func (c *COS) Delete(key string) error {
 	_, err := c.c.Object.Delete(ctx, key)
 	return err
@@ -148,7 +163,11 @@ func (c *COS) ListAll(prefix, marker string) (<-chan Object, error) {
 }
 
 func (c *COS) CreateMultipartUpload(key string) (*MultipartUpload, error) {
-	resp, _, err := c.c.Object.InitiateMultipartUpload(ctx, key, nil)
+	var options *cos.InitiateMultipartUploadOptions
+	if c.sc != "" {
+		options = &cos.InitiateMultipartUploadOptions{ObjectPutHeaderOptions: &cos.ObjectPutHeaderOptions{XCosStorageClass: c.sc}}
+	}
+	resp, _, err := c.c.Object.InitiateMultipartUpload(ctx, key, options)
 	if err != nil {
 		return nil, err
 	}
@@ -251,9 +270,15 @@ func newCOS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		},
 	})
 	client.UserAgent = UserAgent
-	return &COS{client, uri.Host}, nil
+	return &COS{c: client, endpoint: uri.Host}, nil
 }
 
 func init() {
 	Register("cos", newCOS)
+	statusCoders = append(statusCoders, func(err error) int {
+		if e, ok := err.(*cos.ErrorResponse); ok && e.Response != nil {
+			return e.Response.StatusCode
+		}
+		return 0
+	})
 }
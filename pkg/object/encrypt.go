@@ -24,12 +24,16 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Encryptor interface {
@@ -114,29 +118,93 @@ func (e *rsaEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
 	return rsa.DecryptOAEP(sha256.New(), rand.Reader, e.privKey, ciphertext, e.label)
 }
 
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type gcmEncryptor struct {
+	aead cipher.AEAD
+}
+
+// NewGCMEncryptor returns an Encryptor which seals messages with the AES key directly,
+// the random nonce is prepended to every sealed message.
+func NewGCMEncryptor(key []byte) (Encryptor, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmEncryptor{aead}, nil
+}
+
+func (e *gcmEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	nonceSize := e.aead.NonceSize()
+	buf := make([]byte, nonceSize+len(plaintext)+e.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, buf[:nonceSize]); err != nil {
+		return nil, err
+	}
+	ciphertext := e.aead.Seal(buf[nonceSize:nonceSize], buf[:nonceSize], plaintext, nil)
+	return buf[:nonceSize+len(ciphertext)], nil
+}
+
+func (e *gcmEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	nonceSize := e.aead.NonceSize()
+	if len(ciphertext) < nonceSize+e.aead.Overhead() {
+		return nil, fmt.Errorf("misformed ciphertext: %d", len(ciphertext))
+	}
+	return e.aead.Open(ciphertext[nonceSize:nonceSize], ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+}
+
 type aesEncryptor struct {
-	keyEncryptor Encryptor
-	keyLen       int
+	keys    map[uint16]Encryptor // encryptors of data keys by id
+	active  uint16               // id of the key to seal new data keys
+	keyLen  int
+	segSize int // seal every segment of the plaintext separately if it's not zero
 }
 
 func NewAESEncryptor(keyEncryptor Encryptor) Encryptor {
-	return &aesEncryptor{keyEncryptor, 32} //  AES-256-GCM
+	return &aesEncryptor{map[uint16]Encryptor{0: keyEncryptor}, 0, 32, 0} //  AES-256-GCM
 }
 
-func (e *aesEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+// NewSegmentedAESEncryptor returns an Encryptor like NewAESEncryptor, but the plaintext is sealed
+// in segments of segSize bytes, so part of it can be decrypted without the whole ciphertext.
+// The ciphertext sealed as a whole can be decrypted too.
+func NewSegmentedAESEncryptor(keyEncryptor Encryptor, segSize int) Encryptor {
+	return NewKeyRingEncryptor(map[uint16]Encryptor{0: keyEncryptor}, 0, segSize)
+}
+
+// NewKeyRingEncryptor returns an Encryptor which seals data keys with the active one of the key
+// encryptors and writes its id into the header, the ciphertext sealed with any of them can be
+// decrypted. The plaintext is sealed in segments of segSize bytes if it's not zero.
+func NewKeyRingEncryptor(keys map[uint16]Encryptor, active uint16, segSize int) Encryptor {
+	return &aesEncryptor{keys, active, 32, segSize}
+}
+
+// newDataKey generates a random data key and returns it with the sealed one.
+func (e *aesEncryptor) newDataKey() (cipher.AEAD, []byte, error) {
 	key := make([]byte, e.keyLen)
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	cipherkey, err := e.keyEncryptor.Encrypt(key)
+	cipherkey, err := e.keys[e.active].Encrypt(key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	block, err := aes.NewCipher(key)
+	aesgcm, err := newGCM(key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	return aesgcm, cipherkey, nil
+}
+
+func (e *aesEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	if e.segSize > 0 || e.active != 0 {
+		return e.encryptSegments(plaintext)
 	}
-	aesgcm, err := cipher.NewGCM(block)
+	aesgcm, cipherkey, err := e.newDataKey()
 	if err != nil {
 		return nil, err
 	}
@@ -160,6 +228,12 @@ func (e *aesEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
 }
 
 func (e *aesEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	if segmentedHeaderSize(ciphertext) > 0 {
+		return e.decryptSegments(ciphertext)
+	}
+	if len(ciphertext) < 3 {
+		return nil, fmt.Errorf("misformed ciphertext: %d", len(ciphertext))
+	}
 	keyLen := int(ciphertext[0])<<8 + int(ciphertext[1])
 	nonceLen := int(ciphertext[2])
 	if 3+keyLen+nonceLen >= len(ciphertext) {
@@ -170,36 +244,159 @@ func (e *aesEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
 	nonce := ciphertext[keyLen : keyLen+nonceLen]
 	ciphertext = ciphertext[keyLen+nonceLen:]
 
-	key, err := e.keyEncryptor.Decrypt(cipherkey)
+	key, err := e.unwrapKey(0, cipherkey)
 	if err != nil {
-		return nil, errors.New("decryt key: " + err.Error())
+		return nil, err
 	}
-	block, err := aes.NewCipher(key)
+	aesgcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
-	aesgcm, err := cipher.NewGCM(block)
+	return aesgcm.Open(ciphertext[:0], nonce, ciphertext, nil)
+}
+
+// unwrapKey decrypts a data key sealed with the key of id.
+func (e *aesEncryptor) unwrapKey(id uint16, cipherkey []byte) ([]byte, error) {
+	kc, ok := e.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("decrypt key: unknown key id %d", id)
+	}
+	key, err := kc.Decrypt(cipherkey)
+	if err != nil {
+		return nil, errors.New("decryt key: " + err.Error())
+	}
+	return key, nil
+}
+
+// rewrap seals the data key of ciphertext with the active key, it returns nil if it's sealed with the
+// active key already. Only the header is changed if the id of key is in it, or it's encrypted again.
+func (e *aesEncryptor) rewrap(ciphertext []byte) ([]byte, error) {
+	if segmentedHeaderSize(ciphertext) > 0 {
+		h, cipherkey, err := parseSegmentHeader(ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		if h.keyID == e.active {
+			return nil, nil
+		}
+		if ciphertext[4] == keyRingVersion {
+			key, err := e.unwrapKey(h.keyID, cipherkey)
+			if err != nil {
+				return nil, err
+			}
+			if cipherkey, err = e.keys[e.active].Encrypt(key); err != nil {
+				return nil, err
+			}
+			buf := make([]byte, len(h.aad)+4+len(cipherkey)+len(ciphertext)-h.size)
+			copy(buf, h.aad)
+			p := buf[len(h.aad):]
+			binary.BigEndian.PutUint16(p[0:2], e.active)
+			binary.BigEndian.PutUint16(p[2:4], uint16(len(cipherkey)))
+			copy(p[4:], cipherkey)
+			copy(p[4+len(cipherkey):], ciphertext[h.size:])
+			return buf, nil
+		}
+	} else if e.active == 0 {
+		return nil, nil
+	}
+	plain, err := e.Decrypt(ciphertext)
 	if err != nil {
 		return nil, err
 	}
-	return aesgcm.Open(ciphertext[:0], nonce, ciphertext, nil)
+	return e.Encrypt(plain)
 }
 
 type encrypted struct {
 	ObjectStorage
-	enc Encryptor
+	enc     Encryptor
+	mu      sync.Mutex
+	headers map[string]*segmentHeader // headers of recently read segmented objects
+}
+
+// SupportRekey is implemented by encrypted object storages, which can seal the data key of an
+// object with the active key again.
+type SupportRekey interface {
+	// Rekey re-wraps the data key of an object with the active key, it returns false if
+	// the object is sealed with the active key already.
+	Rekey(key string) (bool, error)
 }
 
 // NewEncrypted returns a encrypted object storage
 func NewEncrypted(o ObjectStorage, enc Encryptor) ObjectStorage {
-	return &encrypted{o, enc}
+	return &encrypted{ObjectStorage: o, enc: enc, headers: make(map[string]*segmentHeader)}
 }
 
 func (e *encrypted) String() string {
 	return fmt.Sprintf("%s(encrypted)", e.ObjectStorage)
 }
 
+func (e *encrypted) Repair(key string) (bool, error) {
+	if r, ok := e.ObjectStorage.(SupportRepair); ok {
+		return r.Repair(key)
+	}
+	return false, notSupported
+}
+
+func (e *encrypted) Reconcile(prefix string, before time.Time) (int, error) {
+	if r, ok := e.ObjectStorage.(SupportReconcile); ok {
+		return r.Reconcile(prefix, before)
+	}
+	return 0, notSupported
+}
+
+func (e *encrypted) Restore(key string) error {
+	if r, ok := e.ObjectStorage.(SupportRestore); ok {
+		return r.Restore(key)
+	}
+	return notSupported
+}
+
+func (e *encrypted) CheckSSE(key string) error {
+	if c, ok := e.ObjectStorage.(SupportSSE); ok {
+		return c.CheckSSE(key)
+	}
+	return notSupported
+}
+
+func (e *encrypted) Rekey(key string) (bool, error) {
+	enc, ok := e.enc.(*aesEncryptor)
+	if !ok {
+		return false, notSupported
+	}
+	data, err := e.getAll(key, 0, headerProbeSize)
+	if err != nil {
+		return false, err
+	}
+	if id, err := keyIDOf(data); err != nil {
+		return false, err
+	} else if id == enc.active {
+		return false, nil
+	}
+	if len(data) == headerProbeSize {
+		if data, err = e.getAll(key, 0, -1); err != nil {
+			return false, err
+		}
+	}
+	sealed, err := enc.rewrap(data)
+	if err != nil || sealed == nil {
+		return false, err
+	}
+	// Objects are never overwritten except by rekey, so check it again to not bring back an object
+	// deleted in the meantime (there is no conditional PUT for all the storages).
+	if _, err = e.ObjectStorage.Head(key); errors.Is(err, os.ErrNotExist) {
+		logger.Debugf("skip rekeying %s: deleted", key)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	e.forget(key)
+	return true, e.ObjectStorage.Put(key, bytes.NewReader(sealed))
+}
+
 func (e *encrypted) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if enc, ok := e.enc.(*aesEncryptor); ok && (off > 0 || limit > 0) {
+		return e.getRange(enc, key, off, limit)
+	}
 	r, err := e.ObjectStorage.Get(key, 0, -1)
 	if err != nil {
 		return nil, err
@@ -213,15 +410,18 @@ func (e *encrypted) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Decrypt: %s", err)
 	}
+	return ioutil.NopCloser(bytes.NewBuffer(cutRange(plain, off, limit))), nil
+}
+
+func cutRange(plain []byte, off, limit int64) []byte {
 	l := int64(len(plain))
 	if off > l {
 		off = l
 	}
-	if limit == -1 || off+limit > l {
+	if limit <= 0 || off+limit > l {
 		limit = l - off
 	}
-	data := plain[off : off+limit]
-	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
+	return plain[off : off+limit]
 }
 
 func (e *encrypted) Put(key string, in io.Reader) error {
@@ -233,7 +433,350 @@ func (e *encrypted) Put(key string, in io.Reader) error {
 	if err != nil {
 		return err
 	}
+	e.forget(key)
 	return e.ObjectStorage.Put(key, bytes.NewReader(ciphertext))
 }
 
+// CreateMultipartUpload is not supported, since the parts can't be encrypted separately as
+// one object.
+func (e *encrypted) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return nil, notSupported
+}
+
+func (e *encrypted) Delete(key string) error {
+	e.forget(key)
+	return e.ObjectStorage.Delete(key)
+}
+
 var _ ObjectStorage = &encrypted{}
+
+const (
+	segmentMagic       = "JFSE"
+	segmentVersion     = 2 // the data key is sealed with the first key, the header is authenticated
+	keyRingVersion     = 3 // the data key is sealed with the key of id in header, which are not authenticated
+	segmentFixedHeader = 20
+	headerProbeSize    = 4096 // enough for the header with a sealed key of RSA-16384
+	maxCachedHeaders   = 10000
+)
+
+// segmentHeader describes an object sealed in segments, the layout of version 2 is
+//
+//	magic(4) | version(1) | segment size(4) | plaintext size(8) | key length(2) | nonce length(1) | sealed key | nonce | segments
+//
+// and version 3 is
+//
+//	magic(4) | version(1) | segment size(4) | plaintext size(8) | nonce length(1) | nonce | key id(2) | key length(2) | sealed key | segments
+//
+// Every segment is sealed with the data key, the nonce XORed with its index, and the authenticated part
+// of header as additional data; the ciphertext of a segment is longer than its plaintext by the size
+// of tag. The sealed key of version 3 can be replaced without touching the segments.
+type segmentHeader struct {
+	size      int
+	aad       []byte
+	segSize   int
+	plainSize int64
+	nonce     []byte
+	keyID     uint16
+	aead      cipher.AEAD
+}
+
+// segmentedHeaderSize returns the size of header if the ciphertext is sealed in segments, or 0 otherwise.
+func segmentedHeaderSize(buf []byte) int {
+	if len(buf) < segmentFixedHeader || string(buf[:4]) != segmentMagic {
+		return 0
+	}
+	switch buf[4] {
+	case segmentVersion:
+		return segmentFixedHeader + int(binary.BigEndian.Uint16(buf[17:19])) + int(buf[19])
+	case keyRingVersion:
+		p := 18 + int(buf[17])
+		if len(buf) < p+4 {
+			return 0
+		}
+		return p + 4 + int(binary.BigEndian.Uint16(buf[p+2:p+4]))
+	}
+	return 0
+}
+
+// keyIDOf returns the id of key sealing the data key, the beginning of ciphertext is enough.
+// KeyIDOf returns the id of key which seals the data key of ciphertext.
+func KeyIDOf(ciphertext []byte) (uint16, error) {
+	return keyIDOf(ciphertext)
+}
+
+// Rewrap seals the data key of ciphertext with the active key of enc, which should be returned by
+// NewKeyRingEncryptor. It returns the ciphertext itself if it's sealed with the active key already.
+func Rewrap(enc Encryptor, ciphertext []byte) ([]byte, error) {
+	ae, ok := enc.(*aesEncryptor)
+	if !ok {
+		return nil, notSupported
+	}
+	sealed, err := ae.rewrap(ciphertext)
+	if err != nil || sealed == nil {
+		return ciphertext, err
+	}
+	return sealed, nil
+}
+
+func keyIDOf(buf []byte) (uint16, error) {
+	if segmentedHeaderSize(buf) == 0 {
+		return 0, nil
+	}
+	h, _, err := parseSegmentHeader(buf)
+	if err != nil {
+		return 0, err
+	}
+	return h.keyID, nil
+}
+
+func (h *segmentHeader) segments() int {
+	n := int((h.plainSize + int64(h.segSize) - 1) / int64(h.segSize))
+	if n == 0 {
+		n = 1 // an empty segment to authenticate the header
+	}
+	return n
+}
+
+// offset returns the position of a segment in the ciphertext.
+func (h *segmentHeader) offset(indx int) int64 {
+	return int64(h.size) + int64(indx)*int64(h.segSize+h.aead.Overhead())
+}
+
+// plainLen returns the size of plaintext in a segment.
+func (h *segmentHeader) plainLen(indx int) int {
+	if indx == h.segments()-1 {
+		return int(h.plainSize - int64(indx)*int64(h.segSize))
+	}
+	return h.segSize
+}
+
+func (h *segmentHeader) segmentNonce(indx int) []byte {
+	nonce := make([]byte, len(h.nonce))
+	copy(nonce, h.nonce)
+	var idx [8]byte
+	binary.BigEndian.PutUint64(idx[:], uint64(indx))
+	for i := 0; i < 8 && i < len(nonce); i++ {
+		nonce[len(nonce)-1-i] ^= idx[7-i]
+	}
+	return nonce
+}
+
+// open decrypts the contiguous segments starting from first.
+func (h *segmentHeader) open(first int, sealed []byte) ([]byte, error) {
+	var plain []byte
+	for indx := first; len(sealed) > 0; indx++ {
+		if indx >= h.segments() {
+			return nil, fmt.Errorf("misformed ciphertext: more than %d segments", h.segments())
+		}
+		n := h.plainLen(indx) + h.aead.Overhead()
+		if len(sealed) < n {
+			return nil, fmt.Errorf("misformed ciphertext: segment %d has %d bytes, expect %d", indx, len(sealed), n)
+		}
+		var err error
+		if plain, err = h.aead.Open(plain, h.segmentNonce(indx), sealed[:n], h.aad); err != nil {
+			return nil, fmt.Errorf("segment %d: %s", indx, err)
+		}
+		sealed = sealed[n:]
+	}
+	return plain, nil
+}
+
+func (e *aesEncryptor) encryptSegments(plaintext []byte) ([]byte, error) {
+	aesgcm, cipherkey, err := e.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	segSize := e.segSize
+	if segSize == 0 {
+		segSize = len(plaintext) // as a whole
+		if segSize == 0 {
+			segSize = 1
+		}
+	}
+	p := 18 + aesgcm.NonceSize()
+	h := &segmentHeader{size: p + 4 + len(cipherkey), segSize: segSize, plainSize: int64(len(plaintext)), keyID: e.active, aead: aesgcm}
+	n := h.segments()
+	buf := make([]byte, h.size+len(plaintext)+n*aesgcm.Overhead())
+	copy(buf, segmentMagic)
+	buf[4] = keyRingVersion
+	binary.BigEndian.PutUint32(buf[5:9], uint32(segSize))
+	binary.BigEndian.PutUint64(buf[9:17], uint64(len(plaintext)))
+	buf[17] = byte(aesgcm.NonceSize())
+	h.nonce = buf[18:p]
+	if _, err := io.ReadFull(rand.Reader, h.nonce); err != nil {
+		return nil, err
+	}
+	h.aad = buf[:p]
+	binary.BigEndian.PutUint16(buf[p:p+2], e.active)
+	binary.BigEndian.PutUint16(buf[p+2:p+4], uint16(len(cipherkey)))
+	copy(buf[p+4:], cipherkey)
+	for indx := 0; indx < n; indx++ {
+		p := plaintext[indx*segSize : indx*segSize+h.plainLen(indx)]
+		aesgcm.Seal(buf[h.offset(indx):h.offset(indx)], h.segmentNonce(indx), p, h.aad)
+	}
+	return buf, nil
+}
+
+// parseSegmentHeader parses the header without decrypting the data key, which is returned.
+func parseSegmentHeader(buf []byte) (*segmentHeader, []byte, error) {
+	hsize := segmentedHeaderSize(buf)
+	if hsize == 0 || len(buf) < hsize {
+		return nil, nil, fmt.Errorf("misformed header: %d bytes", len(buf))
+	}
+	h := &segmentHeader{
+		size:      hsize,
+		segSize:   int(binary.BigEndian.Uint32(buf[5:9])),
+		plainSize: int64(binary.BigEndian.Uint64(buf[9:17])),
+	}
+	if h.segSize == 0 || h.plainSize < 0 {
+		return nil, nil, fmt.Errorf("misformed header: segment size %d, plaintext size %d", h.segSize, h.plainSize)
+	}
+	var cipherkey []byte
+	if buf[4] == segmentVersion {
+		keyLen := int(binary.BigEndian.Uint16(buf[17:19]))
+		cipherkey = buf[segmentFixedHeader : segmentFixedHeader+keyLen]
+		h.nonce = buf[segmentFixedHeader+keyLen : hsize]
+		h.aad = buf[:hsize:hsize]
+	} else {
+		p := 18 + int(buf[17])
+		h.nonce = buf[18:p]
+		h.aad = buf[:p:p]
+		h.keyID = binary.BigEndian.Uint16(buf[p : p+2])
+		cipherkey = buf[p+4 : hsize]
+	}
+	return h, cipherkey, nil
+}
+
+func (e *aesEncryptor) parseHeader(buf []byte) (*segmentHeader, error) {
+	h, cipherkey, err := parseSegmentHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	key, err := e.unwrapKey(h.keyID, cipherkey)
+	if err != nil {
+		return nil, err
+	}
+	if h.aead, err = newGCM(key); err != nil {
+		return nil, err
+	}
+	if len(h.nonce) != h.aead.NonceSize() {
+		return nil, fmt.Errorf("misformed header: nonce length %d", len(h.nonce))
+	}
+	return h, nil
+}
+
+func (e *aesEncryptor) decryptSegments(ciphertext []byte) ([]byte, error) {
+	h, err := e.parseHeader(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	last := h.segments() - 1
+	if size := h.offset(last) + int64(h.plainLen(last)+h.aead.Overhead()); int64(len(ciphertext)) != size {
+		return nil, fmt.Errorf("misformed ciphertext: %d bytes, expect %d", len(ciphertext), size)
+	}
+	return h.open(0, ciphertext[h.size:])
+}
+
+func (e *encrypted) forget(key string) {
+	e.mu.Lock()
+	delete(e.headers, key)
+	e.mu.Unlock()
+}
+
+// header returns the header of an object sealed in segments, it's nil for the objects sealed
+// as a whole, then the whole object is returned. The beginning of object could also be returned.
+func (e *encrypted) header(enc *aesEncryptor, key string) (*segmentHeader, []byte, error) {
+	e.mu.Lock()
+	h := e.headers[key]
+	e.mu.Unlock()
+	if h != nil {
+		return h, nil, nil
+	}
+	data, err := e.getAll(key, 0, headerProbeSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	hsize := segmentedHeaderSize(data)
+	if hsize == 0 {
+		if len(data) < headerProbeSize {
+			return nil, data, nil
+		}
+		data, err = e.getAll(key, 0, -1)
+		return nil, data, err
+	}
+	if hsize > len(data) {
+		if data, err = e.getAll(key, 0, int64(hsize)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if h, err = enc.parseHeader(data); err != nil {
+		return nil, nil, err
+	}
+	h.aad = append([]byte(nil), h.aad...) // don't hold the probed data
+	h.nonce = append([]byte(nil), h.nonce...)
+	e.mu.Lock()
+	if len(e.headers) >= maxCachedHeaders {
+		e.headers = make(map[string]*segmentHeader)
+	}
+	e.headers[key] = h
+	e.mu.Unlock()
+	return h, data, nil
+}
+
+func (e *encrypted) getAll(key string, off, limit int64) ([]byte, error) {
+	r, err := e.ObjectStorage.Get(key, off, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// getRange reads and decrypts only the segments covering the range, the object sealed as a whole
+// is downloaded fully.
+func (e *encrypted) getRange(enc *aesEncryptor, key string, off, limit int64) (io.ReadCloser, error) {
+	for tried := 0; ; tried++ {
+		h, data, err := e.header(enc, key)
+		if err != nil {
+			return nil, err
+		}
+		if h == nil {
+			plain, err := enc.Decrypt(data)
+			if err != nil {
+				return nil, fmt.Errorf("Decrypt: %s", err)
+			}
+			return ioutil.NopCloser(bytes.NewReader(cutRange(plain, off, limit))), nil
+		}
+		if off >= h.plainSize {
+			return ioutil.NopCloser(bytes.NewReader(nil)), nil
+		}
+		if limit <= 0 || off+limit > h.plainSize {
+			limit = h.plainSize - off
+		}
+		first := int(off / int64(h.segSize))
+		last := int((off + limit - 1) / int64(h.segSize))
+		start, end := h.offset(first), h.offset(last)+int64(h.plainLen(last)+h.aead.Overhead())
+		var sealed []byte
+		if int64(len(data)) >= end {
+			sealed = data[start:end]
+		} else {
+			sealed, err = e.getAll(key, start, end-start)
+		}
+		var plain []byte
+		if err == nil {
+			plain, err = h.open(first, sealed)
+		}
+		if err == nil && len(plain) != int(end-start)-(last-first+1)*h.aead.Overhead() {
+			err = fmt.Errorf("misformed ciphertext: %d bytes in range [%d, %d)", len(sealed), start, end)
+		}
+		if err != nil {
+			e.forget(key)
+			if data == nil && tried == 0 {
+				continue // the cached header could be stale
+			}
+			return nil, fmt.Errorf("Decrypt: %w", err)
+		}
+		skip := off - int64(first)*int64(h.segSize)
+		return ioutil.NopCloser(bytes.NewReader(plain[skip : skip+limit])), nil
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"io"
 	"io/ioutil"
 	"path/filepath"
 	"testing"
@@ -136,6 +137,31 @@ func TestAESGCM(t *testing.T) {
 	}
 }
 
+func TestGCM(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	dc, err := NewGCMEncryptor(key)
+	if err != nil {
+		t.Fatalf("new gcm encryptor: %s", err)
+	}
+	data := []byte("hello")
+	ciphertext, _ := dc.Encrypt(data)
+	plaintext, err := dc.Decrypt(ciphertext)
+	if err != nil || !bytes.Equal(data, plaintext) {
+		t.Fatalf("decrypt fail: %s", err)
+	}
+	ciphertext[len(ciphertext)-1] ^= 1
+	if _, err = dc.Decrypt(ciphertext); err == nil {
+		t.Fatalf("decrypt corrupted ciphertext should fail")
+	}
+	if _, err = dc.Decrypt(ciphertext[:10]); err == nil {
+		t.Fatalf("decrypt short ciphertext should fail")
+	}
+	if _, err = NewGCMEncryptor(key[:7]); err == nil {
+		t.Fatalf("invalid key size should fail")
+	}
+}
+
 func TestEncryptedStore(t *testing.T) {
 	s, _ := CreateStorage("mem", "", "", "", "")
 	kc := NewRSAEncryptor(testkey)
@@ -158,3 +184,183 @@ func TestEncryptedStore(t *testing.T) {
 		t.Fail()
 	}
 }
+
+type rangeRecorder struct {
+	ObjectStorage
+	ranges [][2]int64
+}
+
+func (r *rangeRecorder) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r.ranges = append(r.ranges, [2]int64{off, limit})
+	return r.ObjectStorage.Get(key, off, limit)
+}
+
+func TestSegmentedEncryptedStore(t *testing.T) {
+	mem, _ := CreateStorage("mem", "", "", "", "")
+	s := &rangeRecorder{ObjectStorage: mem}
+	kc := NewRSAEncryptor(testkey)
+	dc := NewSegmentedAESEncryptor(kc, 16)
+	es := NewEncrypted(s, dc)
+	data := make([]byte, 100)
+	_, _ = rand.Read(data)
+	if err := es.Put("a", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put a: %s", err)
+	}
+	get := func(key string, off, limit int64) ([]byte, error) {
+		r, err := es.Get(key, off, limit)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	for _, c := range [][2]int64{{0, -1}, {1, 2}, {15, 2}, {16, 16}, {30, 70}, {90, 20}, {99, 1}, {0, 100}} {
+		d, err := get("a", c[0], c[1])
+		if err != nil {
+			t.Fatalf("get a %v: %s", c, err)
+		}
+		end := c[0] + c[1]
+		if c[1] < 0 || end > 100 {
+			end = 100
+		}
+		if !bytes.Equal(d, data[c[0]:end]) {
+			t.Fatalf("get a %v: unexpected data", c)
+		}
+	}
+	if d, err := get("a", 120, 10); err != nil || len(d) != 0 {
+		t.Fatalf("get a beyond the end: %d %s", len(d), err)
+	}
+
+	// only the covered segments are read once the header is known
+	s.ranges = nil
+	if _, err := get("a", 40, 8); err != nil {
+		t.Fatalf("get a: %s", err)
+	}
+	ov := int64(16 + 16) // segment size + tag
+	if len(s.ranges) != 1 || s.ranges[0][1] != ov {
+		t.Fatalf("expect reading one segment, got %v", s.ranges)
+	}
+
+	// a corrupt segment doesn't break reading the others
+	r, _ := mem.Get("a", 0, -1)
+	sealed, _ := ioutil.ReadAll(r)
+	sealed[len(sealed)-1] ^= 1
+	_ = mem.Put("a", bytes.NewReader(sealed))
+	if d, err := get("a", 0, 16); err != nil || !bytes.Equal(d, data[:16]) {
+		t.Fatalf("get the first segment: %s", err)
+	}
+	if _, err := get("a", 96, 4); err == nil {
+		t.Fatalf("get the corrupt segment should fail")
+	}
+	if _, err := dc.Decrypt(sealed); err == nil {
+		t.Fatalf("decrypt the corrupt object should fail")
+	}
+	if _, err := dc.Decrypt(sealed[:int64(len(sealed))-ov]); err == nil {
+		t.Fatalf("decrypt the truncated object should fail")
+	}
+
+	// objects sealed as a whole are still readable
+	old, _ := NewAESEncryptor(kc).Encrypt(data)
+	_ = mem.Put("b", bytes.NewReader(old))
+	for _, c := range [][2]int64{{0, -1}, {10, 20}} {
+		d, err := get("b", c[0], c[1])
+		if err != nil {
+			t.Fatalf("get b %v: %s", c, err)
+		}
+		if c[1] < 0 {
+			c[1] = 100 - c[0]
+		}
+		if !bytes.Equal(d, data[c[0]:c[0]+c[1]]) {
+			t.Fatalf("get b %v: unexpected data", c)
+		}
+	}
+
+	// empty objects
+	_ = es.Put("c", bytes.NewReader(nil))
+	if d, err := get("c", 0, -1); err != nil || len(d) != 0 {
+		t.Fatalf("get c: %d %s", len(d), err)
+	}
+}
+
+func TestRekeyEncryptedStore(t *testing.T) {
+	mem, _ := CreateStorage("mem", "", "", "", "")
+	k0 := NewRSAEncryptor(testkey)
+	k1 := NewRSAEncryptor(GenerateRsaKeyPair())
+	data := make([]byte, 100)
+	_, _ = rand.Read(data)
+	old, _ := NewAESEncryptor(k0).Encrypt(data)
+	_ = mem.Put("a", bytes.NewReader(old))
+	segmented, _ := NewSegmentedAESEncryptor(k0, 16).Encrypt(data)
+	_ = mem.Put("b", bytes.NewReader(segmented))
+
+	ring := NewKeyRingEncryptor(map[uint16]Encryptor{0: k0, 1: k1}, 1, 16)
+	es := NewEncrypted(mem, ring)
+	_ = es.Put("c", bytes.NewReader(data))
+	for _, key := range []string{"a", "b", "c"} {
+		done, err := es.(SupportRekey).Rekey(key)
+		if err != nil {
+			t.Fatalf("rekey %s: %s", key, err)
+		}
+		if done != (key != "c") {
+			t.Fatalf("rekey %s: %v", key, done)
+		}
+		if done, err = es.(SupportRekey).Rekey(key); err != nil || done {
+			t.Fatalf("rekey %s again: %v %s", key, done, err)
+		}
+	}
+
+	// key 0 is not needed any more
+	es = NewEncrypted(mem, NewKeyRingEncryptor(map[uint16]Encryptor{1: k1}, 1, 16))
+	for _, key := range []string{"a", "b", "c"} {
+		r, err := es.Get(key, 10, 20)
+		if err != nil {
+			t.Fatalf("get %s: %s", key, err)
+		}
+		if d, _ := ioutil.ReadAll(r); !bytes.Equal(d, data[10:30]) {
+			t.Fatalf("get %s: unexpected data", key)
+		}
+		r, _ = mem.Get(key, 0, -1)
+		sealed, _ := ioutil.ReadAll(r)
+		if id, err := keyIDOf(sealed); err != nil || id != 1 {
+			t.Fatalf("key id of %s: %d %s", key, id, err)
+		}
+		if key == "b" && !bytes.Equal(sealed[len(sealed)-100:], segmented[len(segmented)-100:]) {
+			t.Fatalf("segments of b should not be changed")
+		}
+	}
+	if _, err := NewAESEncryptor(k0).Decrypt(segmented[:len(segmented)-1]); err == nil {
+		t.Fatalf("decrypt the truncated object should fail")
+	}
+	if _, err := NewKeyRingEncryptor(map[uint16]Encryptor{1: k1}, 1, 0).Decrypt(segmented); err == nil {
+		t.Fatalf("decrypt with unknown key should fail")
+	}
+	if sealed, err := Rewrap(ring, segmented); err != nil {
+		t.Fatalf("rewrap: %s", err)
+	} else if id, _ := KeyIDOf(sealed); id != 1 {
+		t.Fatalf("rewrapped with key %d", id)
+	} else if again, _ := Rewrap(ring, sealed); !bytes.Equal(again, sealed) {
+		t.Fatalf("rewrap with the active key should not change it")
+	}
+
+	// the object deleted during rekey should not be brought back
+	_ = mem.Put("d", bytes.NewReader(old))
+	es = NewEncrypted(&deleteOnGet{mem}, ring)
+	if done, err := es.(SupportRekey).Rekey("d"); err != nil || done {
+		t.Fatalf("rekey deleted object: %v %s", done, err)
+	}
+	if _, err := mem.Head("d"); err == nil {
+		t.Fatalf("deleted object is brought back")
+	}
+}
+
+// deleteOnGet deletes an object after it's read
+type deleteOnGet struct {
+	ObjectStorage
+}
+
+func (d *deleteOnGet) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	r, err := d.ObjectStorage.Get(key, off, limit)
+	if err == nil {
+		_ = d.ObjectStorage.Delete(key)
+	}
+	return r, err
+}
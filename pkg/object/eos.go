@@ -77,9 +77,9 @@ func newEos(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &eos{s3client{bucket, s3.New(ses), ses}}, nil
+	return &eos{s3client{bucket: bucket, s3: s3.New(ses), ses: ses}}, nil
 }
 
 func init() {
-	Register("eos", newEos)
+	Register("eos", withSSE(newEos))
 }
@@ -0,0 +1,500 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// every shard starts with the size of the object and the checksum of the shard
+const shardHeaderSize = 12
+
+// SupportRepair is implemented by object storages which keep redundancy for objects.
+type SupportRepair interface {
+	// Repair rebuilds the missing or corrupt pieces of an object, it returns true if anything is rewritten.
+	Repair(key string) (bool, error)
+}
+
+// erasure splits an object into data shards and parity shards with Reed-Solomon coding,
+// and stores them into different object storages, so any parity shards can be lost.
+type erasure struct {
+	DefaultObjectStorage
+	stores  []ObjectStorage
+	data    int
+	parity  int
+	enc     reedsolomon.Encoder
+	repairs chan string    // keys of the objects with missing or corrupt shards
+	queued  sync.WaitGroup // the repairs not done yet
+}
+
+// maxRepairs is the number of objects waiting to be repaired in background
+const maxRepairs = 10000
+
+func (s *erasure) String() string {
+	return fmt.Sprintf("ec%d+%d://%s", s.data, s.parity, s.stores[0])
+}
+
+func (s *erasure) Create() error {
+	for _, o := range s.stores {
+		if err := o.Create(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *erasure) SetStorageClass(sc string) error {
+	for _, o := range s.stores {
+		c, ok := o.(SupportStorageClass)
+		if !ok {
+			return notSupported
+		}
+		if err := c.SetStorageClass(sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start returns the index of the store holding the first shard of key
+func (s *erasure) start(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.stores)))
+}
+
+func (s *erasure) store(key string, shard int) ObjectStorage {
+	return s.stores[(s.start(key)+shard)%len(s.stores)]
+}
+
+func (s *erasure) shardSize(size int) int {
+	return (size + s.data - 1) / s.data
+}
+
+// dataLen returns the length of data in a data shard, they are not padded to save space.
+func (s *erasure) dataLen(size, shard int) int {
+	per := s.shardSize(size)
+	l := size - shard*per
+	if l > per {
+		l = per
+	} else if l < 0 {
+		l = 0
+	}
+	return l
+}
+
+func (s *erasure) encode(data []byte) ([][]byte, error) {
+	shards := make([][]byte, s.data+s.parity)
+	per := s.shardSize(len(data))
+	if per > 0 {
+		padded := make([]byte, per*s.data)
+		copy(padded, data)
+		for i := 0; i < s.data; i++ {
+			shards[i] = padded[i*per : (i+1)*per]
+		}
+		for i := s.data; i < len(shards); i++ {
+			shards[i] = make([]byte, per)
+		}
+		if err := s.enc.Encode(shards); err != nil {
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+func (s *erasure) putShard(key string, shard int, size int, payload []byte) error {
+	if shard < s.data {
+		payload = payload[:s.dataLen(size, shard)]
+	}
+	buf := make([]byte, shardHeaderSize+len(payload))
+	binary.BigEndian.PutUint64(buf, uint64(size))
+	binary.BigEndian.PutUint32(buf[8:], crc32.Checksum(payload, crc32c))
+	copy(buf[shardHeaderSize:], payload)
+	return s.store(key, shard).Put(key, bytes.NewReader(buf))
+}
+
+// getShard returns the size of object and the payload of shard padded to full length
+func (s *erasure) getShard(key string, shard int) (int, []byte, error) {
+	in, err := s.store(key, shard).Get(key, 0, -1)
+	if err != nil {
+		return 0, nil, err
+	}
+	buf, err := ioutil.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(buf) < shardHeaderSize {
+		return 0, nil, fmt.Errorf("shard %d of %s is too short: %d", shard, key, len(buf))
+	}
+	size := int(binary.BigEndian.Uint64(buf))
+	payload := buf[shardHeaderSize:]
+	if crc32.Checksum(payload, crc32c) != binary.BigEndian.Uint32(buf[8:]) {
+		return 0, nil, fmt.Errorf("shard %d of %s is corrupt", shard, key)
+	}
+	expected := s.shardSize(size)
+	if shard < s.data {
+		expected = s.dataLen(size, shard)
+	}
+	if len(payload) != expected {
+		return 0, nil, fmt.Errorf("shard %d of %s has %d bytes, expect %d", shard, key, len(payload), expected)
+	}
+	if per := s.shardSize(size); len(payload) < per {
+		padded := make([]byte, per)
+		copy(padded, payload)
+		payload = padded
+	}
+	return size, payload, nil
+}
+
+// fetch reads the shards in range [from, to) in parallel, returns the first error
+func (s *erasure) fetch(key string, shards [][]byte, sizes []int, from, to int) error {
+	var wg sync.WaitGroup
+	errs := make([]error, to-from)
+	for i := from; i < to; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sizes[i], shards[i], errs[i-from] = s.getShard(key, i)
+			if errs[i-from] != nil {
+				logger.Debugf("Get shard %d of %s from %s: %s", i, key, s.store(key, i), errs[i-from])
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads and reconstructs an object, it returns the shards failed to read.
+func (s *erasure) load(key string, all bool) ([]byte, [][]byte, []int, error) {
+	n := s.data + s.parity
+	shards := make([][]byte, n)
+	sizes := make([]int, n)
+	to := s.data
+	if all {
+		to = n
+	}
+	firstErr := s.fetch(key, shards, sizes, 0, to)
+	if firstErr != nil && !all {
+		_ = s.fetch(key, shards, sizes, s.data, n)
+	}
+	var size = -1
+	var valid int
+	for i := range shards {
+		if shards[i] == nil {
+			continue
+		}
+		if size < 0 {
+			size = sizes[i]
+		}
+		if sizes[i] != size {
+			logger.Warnf("Shard %d of %s has size %d, expect %d", i, key, sizes[i], size)
+			shards[i] = nil
+			continue
+		}
+		valid++
+	}
+	if valid < s.data {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("not enough shards for %s", key)
+		}
+		return nil, nil, nil, fmt.Errorf("read %s: only %d of %d shards: %s", key, valid, s.data, firstErr)
+	}
+	var failed []int
+	for i := 0; i < to; i++ {
+		if shards[i] == nil {
+			failed = append(failed, i)
+		}
+	}
+	if size > 0 && len(failed) > 0 {
+		var err error
+		if all {
+			err = s.enc.Reconstruct(shards)
+		} else {
+			err = s.enc.ReconstructData(shards)
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reconstruct %s: %s", key, err)
+		}
+	}
+	data := make([]byte, 0, size)
+	for i := 0; i < s.data && len(data) < size; i++ {
+		data = append(data, shards[i][:s.dataLen(size, i)]...)
+	}
+	return data, shards, failed, nil
+}
+
+func (s *erasure) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	data, _, failed, err := s.load(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		s.repairLater(key)
+	}
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	data = data[off:]
+	if limit > 0 && limit < int64(len(data)) {
+		data = data[:limit]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *erasure) Put(key string, in io.Reader) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	shards, err := s.encode(data)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(shards))
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.putShard(key, i, len(data), shards[i])
+		}(i)
+	}
+	wg.Wait()
+	// same as the write quorum of MinIO, one more shard is needed to break the tie
+	quorum := s.data
+	if s.data == s.parity {
+		quorum++
+	}
+	var written int
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			written++
+		} else {
+			logger.Warnf("Put shard %d of %s into %s: %s", i, key, s.store(key, i), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if written < quorum {
+		return fmt.Errorf("put %s: only %d of %d shards are written: %s", key, written, len(shards), firstErr)
+	}
+	if written < len(shards) {
+		s.repairLater(key)
+	}
+	return nil
+}
+
+func (s *erasure) Delete(key string) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.stores))
+	for i := range s.stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.store(key, i).Delete(key)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *erasure) Head(key string) (Object, error) {
+	var err error
+	for i := range s.stores {
+		var o Object
+		if o, err = s.store(key, i).Head(key); err != nil {
+			continue
+		}
+		var in io.ReadCloser
+		if in, err = s.store(key, i).Get(key, 0, shardHeaderSize); err != nil {
+			continue
+		}
+		buf := make([]byte, shardHeaderSize)
+		_, err = io.ReadFull(in, buf)
+		_ = in.Close()
+		if err != nil {
+			continue
+		}
+		return &obj{key, int64(binary.BigEndian.Uint64(buf)), o.Mtime(), false}, nil
+	}
+	return nil, err
+}
+
+// Repair reads all the shards of an object, and rewrites the missing or corrupt ones.
+func (s *erasure) Repair(key string) (bool, error) {
+	data, shards, failed, err := s.load(key, true)
+	if err != nil {
+		return false, err
+	}
+	for _, i := range failed {
+		if err = s.putShard(key, i, len(data), shards[i]); err != nil {
+			return false, fmt.Errorf("repair shard %d of %s: %s", i, key, err)
+		}
+		logger.Infof("Repaired shard %d of %s in %s", i, key, s.store(key, i))
+	}
+	return len(failed) > 0, nil
+}
+
+// repairLater queues an object with missing or corrupt shards to be repaired in background,
+// the ones failed to queue or repair are logged, which can be repaired by `juicefs fsck --repair`.
+func (s *erasure) repairLater(key string) {
+	s.queued.Add(1)
+	select {
+	case s.repairs <- key:
+	default:
+		s.queued.Done()
+		logger.Warnf("Repair queue is full, %s is left degraded", key)
+	}
+}
+
+// repairLoop repairs the queued objects one by one
+func (s *erasure) repairLoop() {
+	for key := range s.repairs {
+		if _, err := s.Repair(key); err != nil {
+			logger.Warnf("Repair %s: %s, it's left degraded", key, err)
+		}
+		s.queued.Done()
+	}
+}
+
+type shardObject struct {
+	Object
+	store int
+}
+
+func (s *erasure) ListAll(prefix, marker string) (<-chan Object, error) {
+	heads := &nextObjects{make([]nextKey, 0)}
+	for i := range s.stores {
+		ch, err := ListAll(s.stores[i], prefix, marker)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %s", s.stores[i], err)
+		}
+		tagged := make(chan Object, 1000)
+		go func(i int) {
+			for o := range ch {
+				if o == nil {
+					break
+				}
+				tagged <- &shardObject{o, i}
+			}
+			close(tagged)
+		}(i)
+		first := <-tagged
+		if first != nil {
+			heads.Push(nextKey{first, tagged})
+		}
+	}
+	heap.Init(heads)
+
+	out := make(chan Object, 1000)
+	go func() {
+		var group []*shardObject
+		flush := func() {
+			if len(group) > 0 {
+				out <- s.merge(group)
+				group = group[:0]
+			}
+		}
+		for heads.Len() > 0 {
+			n := heap.Pop(heads).(nextKey)
+			o := n.o.(*shardObject)
+			if len(group) > 0 && group[0].Key() != o.Key() {
+				flush()
+			}
+			group = append(group, o)
+			if next := <-n.ch; next != nil {
+				heap.Push(heads, nextKey{next, n.ch})
+			}
+		}
+		flush()
+		close(out)
+	}()
+	return out, nil
+}
+
+// merge returns the object from the listed shards of it, the size is exact only when all data shards exist.
+func (s *erasure) merge(shards []*shardObject) Object {
+	first := shards[0]
+	if first.IsDir() {
+		return first.Object
+	}
+	start := s.start(first.Key())
+	var size, parity int64
+	var count int
+	for _, o := range shards {
+		shard := (o.store - start + len(s.stores)) % len(s.stores)
+		if shard < s.data {
+			size += o.Size() - shardHeaderSize
+			count++
+		} else {
+			parity = o.Size() - shardHeaderSize
+		}
+	}
+	if count < s.data {
+		size = parity * int64(s.data)
+	}
+	return &obj{first.Key(), size, first.Mtime(), false}
+}
+
+// NewErasureCoded returns an object storage which stores the shards of objects into N buckets,
+// the objects are readable with any `parity` buckets lost.
+func NewErasureCoded(name, endpoint, ak, sk, token string, shards, parity int) (ObjectStorage, error) {
+	if parity <= 0 || parity >= shards {
+		return nil, fmt.Errorf("invalid parity shards %d for %d shards", parity, shards)
+	}
+	if strings.HasSuffix(fmt.Sprintf(endpoint, 0), "%!(EXTRA int=0)") {
+		return nil, fmt.Errorf("can not generate different endpoint using %s", endpoint)
+	}
+	enc, err := reedsolomon.New(shards-parity, parity)
+	if err != nil {
+		return nil, err
+	}
+	stores := make([]ObjectStorage, shards)
+	for i := range stores {
+		stores[i], err = CreateStorage(name, fmt.Sprintf(endpoint, i), ak, sk, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &erasure{stores: stores, data: shards - parity, parity: parity, enc: enc, repairs: make(chan string, maxRepairs)}
+	go s.repairLoop()
+	return s, nil
+}
@@ -0,0 +1,119 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestErasureRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewErasureCoded("file", filepath.Join(dir, "%d")+"/", "", "", "", 5, 2)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	ec := s.(*erasure)
+	data := make([]byte, 100003)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	key := "chunks/0/0/1_0_100003"
+	if err = s.Put(key, bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	check := func(off, limit int64, expect []byte) {
+		in, err := s.Get(key, off, limit)
+		if err != nil {
+			t.Fatalf("get %s: %s", key, err)
+		}
+		got, _ := ioutil.ReadAll(in)
+		if !bytes.Equal(got, expect) {
+			t.Fatalf("get %s (%d,%d): unexpected data", key, off, limit)
+		}
+	}
+	shardPath := func(i int) string {
+		return filepath.Join(dir, strconv.Itoa((ec.start(key)+i)%5), key)
+	}
+
+	// lose one data shard and corrupt another one
+	_ = os.Remove(shardPath(0))
+	buf, _ := ioutil.ReadFile(shardPath(3))
+	buf[shardHeaderSize] ^= 0xFF
+	_ = ioutil.WriteFile(shardPath(3), buf, 0644)
+	check(0, -1, data)
+	check(1000, 10, data[1000:1010])
+	if o, err := s.Head(key); err != nil || o.Size() != int64(len(data)) {
+		t.Fatalf("head %s: %+v %s", key, o, err)
+	}
+
+	ec.queued.Wait() // wait for read repair
+	if repaired, err := ec.Repair(key); err != nil || repaired {
+		t.Fatalf("shards should be repaired in background: %t %s", repaired, err)
+	}
+	_ = os.Remove(shardPath(1))
+	_ = os.Remove(shardPath(4))
+	if repaired, err := ec.Repair(key); err != nil || !repaired {
+		t.Fatalf("repair: %t %s", repaired, err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, _, err := ec.getShard(key, i); err != nil {
+			t.Fatalf("shard %d is not repaired: %s", i, err)
+		}
+	}
+
+	ch, err := ListAll(s, "", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	var objs []Object
+	for o := range ch {
+		if !o.IsDir() {
+			objs = append(objs, o)
+		}
+	}
+	if len(objs) != 1 || objs[0].Key() != key || objs[0].Size() != int64(len(data)) {
+		t.Fatalf("list all: %+v", objs)
+	}
+
+	// the shards failed to write are repaired in background
+	i := (ec.start(key) + 2) % 5
+	orig := ec.stores[i]
+	_ = os.Remove(shardPath(2))
+	ec.stores[i], _ = NewChaos(orig, "put-error=1&get-latency=200ms")
+	if err = s.Put(key, bytes.NewReader(data)); err != nil {
+		t.Fatalf("put with a shard failed: %s", err)
+	}
+	_ = ConfigureChaos(ec.stores[i], "")
+	ec.queued.Wait()
+	ec.stores[i] = orig
+	if _, _, err := ec.getShard(key, 2); err != nil {
+		t.Fatalf("shard 2 is not repaired: %s", err)
+	}
+
+	// too many shards lost
+	for i := 0; i < 3; i++ {
+		_ = os.Remove(shardPath(i))
+	}
+	if _, err = s.Get(key, 0, -1); err == nil {
+		t.Fatalf("get should fail with 3 shards lost")
+	}
+}
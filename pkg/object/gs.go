@@ -40,6 +40,7 @@ type gs struct {
 	bucket    string
 	region    string
 	pageToken string
+	sc        string
 }
 
 func (g *gs) String() string {
@@ -107,6 +108,9 @@ func (g *gs) Head(key string) (Object, error) {
 func (g *gs) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	reader, err := g.client.Bucket(g.bucket).Object(key).NewRangeReader(ctx, off, limit)
 	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			err = os.ErrNotExist
+		}
 		return nil, err
 	}
 	return reader, nil
@@ -114,6 +118,7 @@ func (g *gs) Get(key string, off, limit int64) (io.ReadCloser, error) {
 
 func (g *gs) Put(key string, data io.Reader) error {
 	writer := g.client.Bucket(g.bucket).Object(key).NewWriter(ctx)
+	writer.StorageClass = g.sc
 	_, err := io.Copy(writer, data)
 	if err != nil {
 		return err
@@ -124,10 +129,17 @@ func (g *gs) Put(key string, data io.Reader) error {
 func (g *gs) Copy(dst, src string) error {
 	srcObj := g.client.Bucket(g.bucket).Object(src)
 	dstObj := g.client.Bucket(g.bucket).Object(dst)
-	_, err := dstObj.CopierFrom(srcObj).Run(ctx)
+	copier := dstObj.CopierFrom(srcObj)
+	copier.StorageClass = g.sc
+	_, err := copier.Run(ctx)
 	return err
 }
 
+func (g *gs) SetStorageClass(sc string) error {
+	g.sc = sc
+	return nil
+}
+
 func (g *gs) Delete(key string) error {
 	if err := g.client.Bucket(g.bucket).Object(key).Delete(ctx); err != storage.ErrObjectNotExist {
 		return err
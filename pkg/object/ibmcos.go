@@ -67,6 +67,9 @@ func (s *ibmcos) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	}
 	resp, err := s.s3.GetObject(params)
 	if err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+			err = os.ErrNotExist
+		}
 		return nil, err
 	}
 	return resp.Body, nil
@@ -0,0 +1,389 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backendRequests = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "object_backend_request_durations_histogram_seconds",
+		Help:    "Object storage requests latency distributions by backend and method.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 20),
+	}, []string{"backend", "method"})
+	backendDataBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "object_backend_request_data_bytes",
+		Help:    "Object storage requests size distributions by backend and method.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"backend", "method"})
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "object_backend_request_errors",
+		Help: "failed requests to object storage by backend and method",
+	}, []string{"backend", "method"})
+	backendRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "object_backend_request_retries",
+		Help: "retried requests to object storage by backend and method",
+	}, []string{"backend", "method"})
+)
+
+// RetryPolicy decides how the idempotent requests to object storage are retried.
+type RetryPolicy struct {
+	Attempts   int           // number of attempts, 1 means no retry
+	MinBackoff time.Duration // backoff before the first retry, doubled for the following ones
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is shared by all the object storages created by the clients.
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, MinBackoff: time.Millisecond * 100, MaxBackoff: time.Second * 5}
+
+// backoff returns the duration to wait before the retry after i-th attempt, with jitter.
+func (p RetryPolicy) backoff(i int) time.Duration {
+	d := p.MinBackoff << uint(i)
+	if d <= 0 || d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// statusCoders return the HTTP status code of the failed request in an error or 0 if it's unknown,
+// the object storages add theirs for the errors of SDKs.
+var statusCoders = []func(err error) int{
+	func(err error) int {
+		var e interface{ StatusCode() int } // aws
+		if errors.As(err, &e) {
+			return e.StatusCode()
+		}
+		return 0
+	},
+}
+
+// transientCodes are the error codes of client errors (4xx) which may succeed when retried.
+var transientCodes = map[string]bool{
+	"RequestTimeout":          true,
+	"RequestTimeoutException": true,
+	"ExpiredToken":            true,
+	"ExpiredTokenException":   true,
+	"Throttling":              true,
+	"ThrottlingException":     true,
+	"SlowDown":                true,
+	"TooManyRequests":         true,
+}
+
+// permanent returns true for the client errors (4xx) of requests, which fail the same way when retried.
+func permanent(err error) bool {
+	var status int
+	for _, f := range statusCoders {
+		if status = f(err); status > 0 {
+			break
+		}
+	}
+	switch {
+	case status < 400 || status >= 500:
+		return false
+	case status == http.StatusRequestTimeout, status == http.StatusConflict, status == http.StatusTooManyRequests:
+		return false
+	}
+	var e interface{ Code() string }
+	return !errors.As(err, &e) || !transientCodes[e.Code()]
+}
+
+// retryable returns false for the errors which can not be fixed by retrying.
+func retryable(err error) bool {
+	return !errors.Is(err, os.ErrNotExist) && !os.IsNotExist(err) && !errors.Is(err, notSupported) &&
+		!errors.Is(err, ErrNotRestored) && !permanent(err)
+}
+
+// instrumented records the latency, size and errors of requests to an object storage, and
+// retries the idempotent ones with backoff.
+type instrumented struct {
+	ObjectStorage
+	backend string
+	policy  RetryPolicy
+}
+
+// NewInstrumented returns an object storage which records metrics of requests to s labeled by
+// backend, and retries the failed idempotent requests (all but creating and completing multipart
+// uploads, and Put with a reader that can't be rewound) with the policy.
+func NewInstrumented(s ObjectStorage, backend string, policy RetryPolicy) ObjectStorage {
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	return &instrumented{ObjectStorage: s, backend: backend, policy: policy}
+}
+
+func (s *instrumented) observe(method string, start time.Time, err error) {
+	backendRequests.WithLabelValues(s.backend, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		backendErrors.WithLabelValues(s.backend, method).Inc()
+	}
+}
+
+// call runs f, and retries it with backoff if retry is true.
+func (s *instrumented) call(method string, retry bool, f func() error) (err error) {
+	for i := 0; ; i++ {
+		start := time.Now()
+		err = f()
+		s.observe(method, start, err)
+		if err == nil || !retry || i+1 >= s.policy.Attempts || !retryable(err) {
+			return
+		}
+		backendRetries.WithLabelValues(s.backend, method).Inc()
+		logger.Debugf("%s %s: %s, retry after attempt %d", method, s.backend, err, i+1)
+		time.Sleep(s.policy.backoff(i))
+	}
+}
+
+func (s *instrumented) Head(key string) (o Object, err error) {
+	err = s.call("HEAD", true, func() (err error) {
+		o, err = s.ObjectStorage.Head(key)
+		return
+	})
+	return
+}
+
+// meteredBody records the request of Get when the body is closed, so the time to read it is included.
+type meteredBody struct {
+	io.ReadCloser
+	s      *instrumented
+	start  time.Time
+	n      int64
+	err    error
+	closed uint32
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *meteredBody) Close() error {
+	err := b.ReadCloser.Close()
+	if atomic.CompareAndSwapUint32(&b.closed, 0, 1) {
+		b.s.observe("GET", b.start, b.err)
+		backendDataBytes.WithLabelValues(b.s.backend, "GET").Observe(float64(b.n))
+	}
+	return err
+}
+
+func (s *instrumented) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	var err error
+	for i := 0; ; i++ {
+		start := time.Now()
+		var r io.ReadCloser
+		if r, err = s.ObjectStorage.Get(key, off, limit); err == nil {
+			return &meteredBody{ReadCloser: r, s: s, start: start}, nil
+		}
+		s.observe("GET", start, err)
+		if i+1 >= s.policy.Attempts || !retryable(err) {
+			return nil, err
+		}
+		backendRetries.WithLabelValues(s.backend, "GET").Inc()
+		logger.Debugf("GET %s: %s, retry after attempt %d", s.backend, err, i+1)
+		time.Sleep(s.policy.backoff(i))
+	}
+}
+
+// countingReader counts the bytes read from a reader which can't be rewound.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (s *instrumented) Put(key string, in io.Reader) error {
+	if rs, ok := in.(io.ReadSeeker); ok {
+		if pos, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			if end, err := rs.Seek(0, io.SeekEnd); err == nil {
+				if _, err = rs.Seek(pos, io.SeekStart); err == nil {
+					err = s.call("PUT", true, func() error {
+						if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+							return err
+						}
+						return s.ObjectStorage.Put(key, rs)
+					})
+					if err == nil {
+						backendDataBytes.WithLabelValues(s.backend, "PUT").Observe(float64(end - pos))
+					}
+					return err
+				}
+			}
+		}
+	}
+	cr := &countingReader{Reader: in}
+	err := s.call("PUT", false, func() error { return s.ObjectStorage.Put(key, cr) })
+	if err == nil {
+		backendDataBytes.WithLabelValues(s.backend, "PUT").Observe(float64(cr.n))
+	}
+	return err
+}
+
+func (s *instrumented) Delete(key string) error {
+	return s.call("DELETE", true, func() error { return s.ObjectStorage.Delete(key) })
+}
+
+func (s *instrumented) List(prefix, marker string, limit int64) (objs []Object, err error) {
+	err = s.call("LIST", true, func() (err error) {
+		objs, err = s.ObjectStorage.List(prefix, marker, limit)
+		return
+	})
+	return
+}
+
+func (s *instrumented) ListAll(prefix, marker string) (ch <-chan Object, err error) {
+	err = s.call("LIST_ALL", true, func() (err error) {
+		ch, err = s.ObjectStorage.ListAll(prefix, marker)
+		return
+	})
+	return
+}
+
+func (s *instrumented) CreateMultipartUpload(key string) (upload *MultipartUpload, err error) {
+	err = s.call("CREATE_UPLOAD", false, func() (err error) {
+		upload, err = s.ObjectStorage.CreateMultipartUpload(key)
+		return
+	})
+	return
+}
+
+func (s *instrumented) UploadPart(key string, uploadID string, num int, body []byte) (part *Part, err error) {
+	err = s.call("UPLOAD_PART", true, func() (err error) {
+		part, err = s.ObjectStorage.UploadPart(key, uploadID, num, body)
+		return
+	})
+	if err == nil {
+		backendDataBytes.WithLabelValues(s.backend, "UPLOAD_PART").Observe(float64(len(body)))
+	}
+	return
+}
+
+func (s *instrumented) AbortUpload(key string, uploadID string) {
+	start := time.Now()
+	s.ObjectStorage.AbortUpload(key, uploadID)
+	s.observe("ABORT_UPLOAD", start, nil)
+}
+
+func (s *instrumented) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	return s.call("COMPLETE_UPLOAD", false, func() error { return s.ObjectStorage.CompleteUpload(key, uploadID, parts) })
+}
+
+func (s *instrumented) ListUploads(marker string) (parts []*PendingPart, next string, err error) {
+	err = s.call("LIST_UPLOADS", true, func() (err error) {
+		parts, next, err = s.ObjectStorage.ListUploads(marker)
+		return
+	})
+	return
+}
+
+func (s *instrumented) Symlink(oldName, newName string) error {
+	if w, ok := s.ObjectStorage.(SupportSymlink); ok {
+		return w.Symlink(oldName, newName)
+	}
+	return notSupported
+}
+
+func (s *instrumented) Readlink(name string) (string, error) {
+	if w, ok := s.ObjectStorage.(SupportSymlink); ok {
+		return w.Readlink(name)
+	}
+	return "", notSupported
+}
+
+func (s *instrumented) Chmod(path string, mode os.FileMode) error {
+	if fs, ok := s.ObjectStorage.(FileSystem); ok {
+		return fs.Chmod(path, mode)
+	}
+	return notSupported
+}
+
+func (s *instrumented) Chown(path string, owner, group string) error {
+	if fs, ok := s.ObjectStorage.(FileSystem); ok {
+		return fs.Chown(path, owner, group)
+	}
+	return notSupported
+}
+
+func (s *instrumented) Chtimes(path string, mtime time.Time) error {
+	if fs, ok := s.ObjectStorage.(MtimeChanger); ok {
+		return fs.Chtimes(path, mtime)
+	}
+	return notSupported
+}
+
+func (s *instrumented) Repair(key string) (bool, error) {
+	if r, ok := s.ObjectStorage.(SupportRepair); ok {
+		return r.Repair(key)
+	}
+	return false, notSupported
+}
+
+func (s *instrumented) Reconcile(prefix string, before time.Time) (int, error) {
+	if r, ok := s.ObjectStorage.(SupportReconcile); ok {
+		return r.Reconcile(prefix, before)
+	}
+	return 0, notSupported
+}
+
+func (s *instrumented) Restore(key string) error {
+	if r, ok := s.ObjectStorage.(SupportRestore); ok {
+		return r.Restore(key)
+	}
+	return notSupported
+}
+
+func (s *instrumented) Rekey(key string) (bool, error) {
+	if r, ok := s.ObjectStorage.(SupportRekey); ok {
+		return r.Rekey(key)
+	}
+	return false, notSupported
+}
+
+func (s *instrumented) SetStorageClass(sc string) error {
+	if c, ok := s.ObjectStorage.(SupportStorageClass); ok {
+		return c.SetStorageClass(sc)
+	}
+	return notSupported
+}
+
+func (s *instrumented) CheckSSE(key string) error {
+	if c, ok := s.ObjectStorage.(SupportSSE); ok {
+		return c.CheckSSE(key)
+	}
+	return notSupported
+}
+
+var _ ObjectStorage = &instrumented{}
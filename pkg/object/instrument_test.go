@@ -0,0 +1,123 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumented(t *testing.T) {
+	mem, _ := CreateStorage("mem", "", "", "", "")
+	c, _ := NewChaos(mem, "")
+	s := NewInstrumented(c, "test", RetryPolicy{Attempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 10})
+
+	if err := s.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	r, err := s.Get("a", 0, -1)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if d, _ := ioutil.ReadAll(r); string(d) != "hello" {
+		t.Fatalf("get: %q", d)
+	}
+	_ = r.Close()
+	if n := testutil.CollectAndCount(backendDataBytes); n != 2 {
+		t.Fatalf("expect sizes of 2 methods, got %d", n)
+	}
+	if n := testutil.CollectAndCount(backendRequests); n != 2 {
+		t.Fatalf("expect requests of 2 methods, got %d", n)
+	}
+
+	// a seed which fails the first request and passes the next two
+	_ = ConfigureChaos(c, "seed=6&error=0.5")
+	if err := s.Put("b", bytes.NewReader([]byte("world"))); err != nil {
+		t.Fatalf("put should be retried: %s", err)
+	}
+	if _, err := s.Head("b"); err != nil {
+		t.Fatalf("head should be retried: %s", err)
+	}
+	if n := testutil.ToFloat64(backendRetries.WithLabelValues("test", "PUT")); n < 1 {
+		t.Fatalf("put should be retried")
+	}
+
+	_ = ConfigureChaos(c, "error=1")
+	retries := testutil.ToFloat64(backendRetries.WithLabelValues("test", "PUT"))
+	errs := testutil.ToFloat64(backendErrors.WithLabelValues("test", "PUT"))
+	if err := s.Put("c", bytes.NewReader(nil)); !errors.Is(err, ErrInjected) {
+		t.Fatalf("put should fail: %v", err)
+	}
+	if n := testutil.ToFloat64(backendRetries.WithLabelValues("test", "PUT")) - retries; n != 2 {
+		t.Fatalf("expect 2 retries, got %v", n)
+	}
+	if n := testutil.ToFloat64(backendErrors.WithLabelValues("test", "PUT")) - errs; n != 3 {
+		t.Fatalf("expect 3 errors, got %v", n)
+	}
+	// the reader can't be rewound
+	retries = testutil.ToFloat64(backendRetries.WithLabelValues("test", "PUT"))
+	if err := s.Put("c", strings.NewReader("abc")); err != nil && !errors.Is(err, ErrInjected) {
+		t.Fatalf("put: %s", err)
+	}
+	if err := s.Put("c", ioutil.NopCloser(strings.NewReader("abc"))); !errors.Is(err, ErrInjected) {
+		t.Fatalf("put should fail: %v", err)
+	}
+	if n := testutil.ToFloat64(backendRetries.WithLabelValues("test", "PUT")) - retries; n != 2 {
+		t.Fatalf("only the seekable reader should be retried, got %v retries", n)
+	}
+
+	// not found should not be retried
+	_ = ConfigureChaos(c, "")
+	retries = testutil.ToFloat64(backendRetries.WithLabelValues("test", "HEAD"))
+	if _, err := s.Head("nonexist"); err == nil {
+		t.Fatalf("head of nonexistent key should fail")
+	}
+	if n := testutil.ToFloat64(backendRetries.WithLabelValues("test", "HEAD")); n != retries {
+		t.Fatalf("not found should not be retried")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("connection reset"), true},
+		{ErrInjected, true},
+		{os.ErrNotExist, false},
+		{ErrNotRestored, false},
+		{fmt.Errorf("get: %w", ErrNotRestored), false},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, ""), false},
+		{awserr.NewRequestFailure(awserr.New("InvalidRange", "", nil), 416, ""), false},
+		{awserr.NewRequestFailure(awserr.New("RequestTimeout", "", nil), 400, ""), true},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, ""), true},
+		{awserr.NewRequestFailure(awserr.New("TooManyRequests", "", nil), 429, ""), true},
+	} {
+		if r := retryable(c.err); r != c.retryable {
+			t.Fatalf("retryable of %q should be %t", c.err, c.retryable)
+		}
+	}
+}
@@ -92,3 +92,11 @@ type ObjectStorage interface {
 	// ListUploads lists existing multipart uploads.
 	ListUploads(marker string) ([]*PendingPart, string, error)
 }
+
+// SupportStorageClass is implemented by object storages which can put new objects into a storage
+// class other than the default one of bucket.
+type SupportStorageClass interface {
+	// SetStorageClass sets the storage class of new objects, the default one of bucket is used if
+	// it's empty.
+	SetStorageClass(sc string) error
+}
@@ -74,9 +74,9 @@ func newJSS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		return nil, err
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &jss{s3client{bucket, s3.New(ses), ses}}, nil
+	return &jss{s3client{bucket: bucket, s3: s3.New(ses), ses: ses}}, nil
 }
 
 func init() {
-	Register("jss", newJSS)
+	Register("jss", withSSE(newJSS))
 }
@@ -0,0 +1,261 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxCachedDataKeys = 10000
+
+// IsKeyProvider tells whether uri refers to a key provider supported by NewKeyProvider.
+func IsKeyProvider(uri string) bool {
+	for _, scheme := range []string{"file://", "vault://", "vault+http://", "vault+https://", "exec:"} {
+		if strings.HasPrefix(uri, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLocalKeyProvider tells whether the key provider reads a local file or runs a command on this host.
+func IsLocalKeyProvider(uri string) bool {
+	return strings.HasPrefix(uri, "file://") || strings.HasPrefix(uri, "exec:")
+}
+
+// NewKeyProvider returns an Encryptor which wraps data keys with a master key kept out of JuiceFS,
+// so that it never has to be stored in the metadata engine. The provider is specified by uri:
+//
+//	file:///path/to/key              a local RSA private key in PEM (protected by JFS_RSA_PASSPHRASE),
+//	                                 or an AES-256 key of 32 raw bytes or 64 hex characters
+//	vault://host:port/MOUNT/KEY      the transit secrets engine of HashiCorp Vault (vault+https for TLS),
+//	                                 authenticated by the token in VAULT_TOKEN
+//	exec:COMMAND [ARGS...]           an external command called with an extra argument "encrypt" or "decrypt",
+//	                                 which reads the input from stdin and writes the result into stdout
+//
+// The unwrapped data keys are cached in memory, so the provider is not called for every read.
+func NewKeyProvider(uri string) (Encryptor, error) {
+	var e Encryptor
+	var err error
+	switch {
+	case strings.HasPrefix(uri, "file://"):
+		e, err = newFileKeyProvider(strings.TrimPrefix(uri, "file://"))
+	case strings.HasPrefix(uri, "vault://") || strings.HasPrefix(uri, "vault+http://") || strings.HasPrefix(uri, "vault+https://"):
+		e, err = newVaultKeyProvider(uri)
+	case strings.HasPrefix(uri, "exec:"):
+		e, err = newExecKeyProvider(strings.TrimPrefix(uri, "exec:"))
+	default:
+		return nil, fmt.Errorf("unknown key provider: %s", uri)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cachedKeyProvider{Encryptor: e, keys: make(map[string][]byte)}, nil
+}
+
+func newFileKeyProvider(path string) (Encryptor, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key from %s: %s", path, err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		privKey, err := ParseRsaPrivateKeyFromPem(block, os.Getenv("JFS_RSA_PASSPHRASE"))
+		if err != nil {
+			return nil, fmt.Errorf("parse RSA key from %s: %s", path, err)
+		}
+		return NewRSAEncryptor(privKey), nil
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 64 {
+		if key, err = hex.DecodeString(string(key)); err != nil {
+			return nil, fmt.Errorf("decode key from %s: %s", path, err)
+		}
+	} else if len(data) == 32 {
+		key = data
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key in %s: expect a RSA private key or an AES-256 key", path)
+	}
+	return NewGCMEncryptor(key)
+}
+
+// vaultKeyProvider wraps data keys with the transit secrets engine of Vault.
+type vaultKeyProvider struct {
+	addr  string
+	mount string
+	name  string
+	cli   *http.Client
+}
+
+func newVaultKeyProvider(uri string) (Encryptor, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", uri, err)
+	}
+	scheme := "http"
+	if u.Scheme == "vault+https" {
+		scheme = "https"
+	}
+	ps := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if u.Host == "" || len(ps) < 2 {
+		return nil, fmt.Errorf("invalid vault key %s, expect vault://HOST:PORT/MOUNT/KEY", uri)
+	}
+	if os.Getenv("VAULT_TOKEN") == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN is required to access %s", uri)
+	}
+	return &vaultKeyProvider{
+		addr:  scheme + "://" + u.Host,
+		mount: strings.Join(ps[:len(ps)-1], "/"),
+		name:  ps[len(ps)-1],
+		cli:   &http.Client{Timeout: time.Second * 30},
+	}, nil
+}
+
+func (v *vaultKeyProvider) call(op string, req, resp interface{}) error {
+	body, _ := json.Marshal(req)
+	r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/%s/%s/%s", v.addr, v.mount, op, v.name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		r.Header.Set("X-Vault-Namespace", ns)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := v.cli.Do(r)
+	if err != nil {
+		return fmt.Errorf("vault %s: %s", op, err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("vault %s: %s", op, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct{ Errors []string }
+		_ = json.Unmarshal(data, &e)
+		return fmt.Errorf("vault %s: status %d: %s", op, res.StatusCode, strings.Join(e.Errors, "; "))
+	}
+	if err = json.Unmarshal(data, resp); err != nil {
+		return fmt.Errorf("vault %s: %s", op, err)
+	}
+	return nil
+}
+
+func (v *vaultKeyProvider) Encrypt(plaintext []byte) ([]byte, error) {
+	var resp struct {
+		Data struct{ Ciphertext string }
+	}
+	err := v.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Data.Ciphertext == "" {
+		return nil, fmt.Errorf("vault encrypt: empty ciphertext")
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+func (v *vaultKeyProvider) Decrypt(ciphertext []byte) ([]byte, error) {
+	var resp struct {
+		Data struct{ Plaintext string }
+	}
+	if err := v.call("decrypt", map[string]string{"ciphertext": string(ciphertext)}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+// execKeyProvider wraps data keys with an external command.
+type execKeyProvider struct {
+	args []string
+}
+
+func newExecKeyProvider(cmd string) (Encryptor, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("command of key provider is empty")
+	}
+	return &execKeyProvider{args}, nil
+}
+
+func (c *execKeyProvider) run(op string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	args := append(append([]string{}, c.args[1:]...), op)
+	cmd := exec.CommandContext(ctx, c.args[0], args...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s: %s", c.args[0], op, err, strings.TrimSpace(stderr.String()))
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s %s: empty output", c.args[0], op)
+	}
+	return out, nil
+}
+
+func (c *execKeyProvider) Encrypt(plaintext []byte) ([]byte, error) {
+	return c.run("encrypt", plaintext)
+}
+
+func (c *execKeyProvider) Decrypt(ciphertext []byte) ([]byte, error) {
+	return c.run("decrypt", ciphertext)
+}
+
+// cachedKeyProvider keeps the unwrapped data keys in memory.
+type cachedKeyProvider struct {
+	Encryptor
+	sync.Mutex
+	keys map[string][]byte
+}
+
+func (c *cachedKeyProvider) Decrypt(ciphertext []byte) ([]byte, error) {
+	c.Lock()
+	key, ok := c.keys[string(ciphertext)]
+	c.Unlock()
+	if ok {
+		return key, nil
+	}
+	key, err := c.Encryptor.Decrypt(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	if len(c.keys) >= maxCachedDataKeys {
+		c.keys = make(map[string][]byte)
+	}
+	c.keys[string(ciphertext)] = key
+	c.Unlock()
+	return key, nil
+}
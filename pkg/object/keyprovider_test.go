@@ -0,0 +1,141 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func testKeyProvider(t *testing.T, uri string) {
+	kc, err := NewKeyProvider(uri)
+	if err != nil {
+		t.Fatalf("key provider %s: %s", uri, err)
+	}
+	mem, _ := CreateStorage("mem", "", "", "", "")
+	es := NewEncrypted(mem, NewSegmentedAESEncryptor(kc, 16))
+	if err = es.Put("a", bytes.NewReader([]byte("hello world"))); err != nil {
+		t.Fatalf("put with %s: %s", uri, err)
+	}
+	r, err := es.Get("a", 6, 5)
+	if err != nil {
+		t.Fatalf("get with %s: %s", uri, err)
+	}
+	if d, _ := ioutil.ReadAll(r); string(d) != "world" {
+		t.Fatalf("get with %s: %q", uri, d)
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir := t.TempDir()
+	if err := genrsa(filepath.Join(dir, "key.pem"), ""); err != nil {
+		t.Fatalf("genrsa: %s", err)
+	}
+	testKeyProvider(t, "file://"+filepath.Join(dir, "key.pem"))
+	_ = os.WriteFile(filepath.Join(dir, "key.hex"), []byte(strings.Repeat("0f", 32)+"\n"), 0600)
+	testKeyProvider(t, "file://"+filepath.Join(dir, "key.hex"))
+	_ = os.WriteFile(filepath.Join(dir, "key.bad"), []byte("abc"), 0600)
+	if _, err := NewKeyProvider("file://" + filepath.Join(dir, "key.bad")); err == nil {
+		t.Fatalf("invalid key should fail")
+	}
+	if _, err := NewKeyProvider("kms://abc"); err == nil {
+		t.Fatalf("unknown provider should fail")
+	}
+}
+
+func TestVaultKeyProvider(t *testing.T) {
+	var decrypts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/jfs":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + req["plaintext"]}})
+		case "/v1/transit/decrypt/jfs":
+			decrypts++
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": strings.TrimPrefix(req["ciphertext"], "vault:v1:")}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("VAULT_TOKEN", "token")
+	uri := "vault://" + strings.TrimPrefix(srv.URL, "http://") + "/transit/jfs"
+	testKeyProvider(t, uri)
+	kc, _ := NewKeyProvider(uri)
+	sealed, err := kc.Encrypt([]byte("key"))
+	if err != nil || !strings.HasPrefix(string(sealed), "vault:v1:") {
+		t.Fatalf("encrypt: %q %s", sealed, err)
+	}
+	decrypts = 0
+	for i := 0; i < 3; i++ {
+		if key, err := kc.Decrypt(sealed); err != nil || string(key) != "key" {
+			t.Fatalf("decrypt: %q %s", key, err)
+		}
+	}
+	if decrypts != 1 {
+		t.Fatalf("data keys should be cached: %d decrypts", decrypts)
+	}
+
+	t.Setenv("VAULT_TOKEN", "bad")
+	if _, err = kc.Encrypt([]byte("key")); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("encrypt with bad token: %s", err)
+	}
+	if _, err = NewKeyProvider("vault://localhost:8200/jfs"); err == nil {
+		t.Fatalf("invalid vault key should fail")
+	}
+}
+
+func TestExecKeyProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	script := filepath.Join(t.TempDir(), "kms.sh")
+	_ = os.WriteFile(script, []byte("#!/bin/sh\nif [ \"$2\" = encrypt ]; then base64; else base64 -d; fi\n"), 0700)
+	testKeyProvider(t, "exec:"+script+" --key")
+	kc, _ := NewKeyProvider("exec:" + script + " --key")
+	if _, err := kc.Decrypt([]byte("!!!")); err == nil {
+		t.Fatalf("decrypt invalid data should fail")
+	}
+}
+
+func TestIsKeyProvider(t *testing.T) {
+	for uri, local := range map[string]bool{"file:///tmp/key": true, "exec:kms": true, "vault://127.0.0.1:8200/transit/jfs": false} {
+		if !IsKeyProvider(uri) || IsLocalKeyProvider(uri) != local {
+			t.Fatalf("unexpected type of key provider %s", uri)
+		}
+	}
+	for _, uri := range []string{"", "/tmp/key", "http://127.0.0.1/key", "kms"} {
+		if IsKeyProvider(uri) {
+			t.Fatalf("%s is not a key provider", uri)
+		}
+	}
+}
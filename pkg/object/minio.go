@@ -79,9 +79,9 @@ func newMinio(endpoint, accessKey, secretKey, token string) (ObjectStorage, erro
 		bucket = bucket[len("minio/"):]
 	}
 	bucket = strings.Split(bucket, "/")[0]
-	return &minio{s3client{bucket, s3.New(ses), ses}}, nil
+	return &minio{s3client{bucket: bucket, s3: s3.New(ses), ses: ses}}, nil
 }
 
 func init() {
-	Register("minio", newMinio)
+	Register("minio", withSSE(newMinio))
 }
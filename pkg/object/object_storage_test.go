@@ -569,6 +569,14 @@ func TestSharding(t *testing.T) {
 	testStorage(t, s)
 }
 
+func TestErasureCoded(t *testing.T) {
+	s, err := NewErasureCoded("mem", "%d", "", "", "", 6, 2)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	testStorage(t, s)
+}
+
 func TestSQLite(t *testing.T) {
 	s, err := newSQLStore("sqlite3", "/tmp/teststore.db", "", "")
 	if err != nil {
@@ -41,6 +41,7 @@ const obsDefaultRegion = "cn-north-1"
 type obsClient struct {
 	bucket string
 	region string
+	sc     string
 	c      *obs.ObsClient
 }
 
@@ -90,6 +91,11 @@ func (s *obsClient) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	}
 	resp, err := s.c.GetObject(params)
 	if err != nil {
+		if e, ok := err.(obs.ObsError); ok && e.Code == "InvalidObjectState" {
+			err = ErrNotRestored
+		} else if ok && e.BaseModel.StatusCode == http.StatusNotFound {
+			err = os.ErrNotExist
+		}
 		return nil, err
 	}
 	return resp.Body, nil
@@ -132,6 +138,7 @@ func (s *obsClient) Put(key string, in io.Reader) error {
 	params.ContentLength = vlen
 	params.ContentMD5 = base64.StdEncoding.EncodeToString(sum[:])
 	params.ContentType = mimeType
+	params.StorageClass = obs.StorageClassType(s.sc)
 	resp, err := s.c.PutObject(params)
 	if err == nil && strings.Trim(resp.ETag, "\"") != obs.Hex(sum) {
 		err = fmt.Errorf("unexpected ETag: %s != %s", strings.Trim(resp.ETag, "\""), obs.Hex(sum))
@@ -145,10 +152,16 @@ func (s *obsClient) Copy(dst, src string) error {
 	params.Key = dst
 	params.CopySourceBucket = s.bucket
 	params.CopySourceKey = src
+	params.StorageClass = obs.StorageClassType(s.sc)
 	_, err := s.c.CopyObject(params)
 	return err
 }
 
+func (s *obsClient) SetStorageClass(sc string) error {
+	s.sc = sc
+	return nil
+}
+
 func (s *obsClient) Delete(key string) error {
 	params := obs.DeleteObjectInput{}
 	params.Bucket = s.bucket
@@ -185,6 +198,7 @@ func (s *obsClient) CreateMultipartUpload(key string) (*MultipartUpload, error)
 	params := &obs.InitiateMultipartUploadInput{}
 	params.Bucket = s.bucket
 	params.Key = key
+	params.StorageClass = obs.StorageClassType(s.sc)
 	resp, err := s.c.InitiateMultipartUpload(params)
 	if err != nil {
 		return nil, err
@@ -330,9 +344,15 @@ func newOBS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 	if err != nil {
 		return nil, fmt.Errorf("fail to initialize OBS: %q", err)
 	}
-	return &obsClient{bucketName, region, c}, nil
+	return &obsClient{bucket: bucketName, region: region, c: c}, nil
 }
 
 func init() {
 	Register("obs", newOBS)
+	statusCoders = append(statusCoders, func(err error) int {
+		if e, ok := err.(obs.ObsError); ok {
+			return e.BaseModel.StatusCode
+		}
+		return 0
+	})
 }
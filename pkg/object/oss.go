@@ -41,6 +41,7 @@ const ossDefaultRegionID = "cn-hangzhou"
 type ossClient struct {
 	client *oss.Client
 	bucket *oss.Bucket
+	sc     string
 }
 
 func (o *ossClient) String() string {
@@ -107,23 +108,40 @@ func (o *ossClient) Get(key string, off, limit int64) (resp io.ReadCloser, err e
 				resp.(*oss.Response).Headers.Get(oss.HTTPHeaderOssMetaPrefix+checksumAlgr))
 		}
 	}
+	if e, ok := err.(oss.ServiceError); ok && e.Code == "InvalidObjectState" {
+		err = ErrNotRestored
+	} else if ok && e.StatusCode == http.StatusNotFound {
+		err = os.ErrNotExist
+	}
 	err = o.checkError(err)
 	return
 }
 
+func (o *ossClient) options() []oss.Option {
+	if o.sc == "" {
+		return nil
+	}
+	return []oss.Option{oss.ObjectStorageClass(oss.StorageClassType(o.sc))}
+}
+
 func (o *ossClient) Put(key string, in io.Reader) error {
+	options := o.options()
 	if ins, ok := in.(io.ReadSeeker); ok {
-		option := oss.Meta(checksumAlgr, generateChecksum(ins))
-		return o.checkError(o.bucket.PutObject(key, in, option))
+		options = append(options, oss.Meta(checksumAlgr, generateChecksum(ins)))
 	}
-	return o.checkError(o.bucket.PutObject(key, in))
+	return o.checkError(o.bucket.PutObject(key, in, options...))
 }
 
 func (o *ossClient) Copy(dst, src string) error {
-	_, err := o.bucket.CopyObject(src, dst)
+	_, err := o.bucket.CopyObject(src, dst, o.options()...)
 	return o.checkError(err)
 }
 
+func (o *ossClient) SetStorageClass(sc string) error {
+	o.sc = sc
+	return nil
+}
+
 func (o *ossClient) Delete(key string) error {
 	return o.checkError(o.bucket.DeleteObject(key))
 }
@@ -151,7 +169,7 @@ func (o *ossClient) ListAll(prefix, marker string) (<-chan Object, error) {
 }
 
 func (o *ossClient) CreateMultipartUpload(key string) (*MultipartUpload, error) {
-	r, err := o.bucket.InitiateMultipartUpload(key)
+	r, err := o.bucket.InitiateMultipartUpload(key, o.options()...)
 	if o.checkError(err) != nil {
 		return nil, err
 	}
@@ -400,4 +418,10 @@ func newOSS(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 
 func init() {
 	Register("oss", newOSS)
+	statusCoders = append(statusCoders, func(err error) int {
+		if e, ok := err.(oss.ServiceError); ok {
+			return e.StatusCode
+		}
+		return 0
+	})
 }
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -47,6 +48,48 @@ func (s *withPrefix) Readlink(name string) (string, error) {
 	return "", notSupported
 }
 
+func (s *withPrefix) Repair(key string) (bool, error) {
+	if r, ok := s.os.(SupportRepair); ok {
+		return r.Repair(s.prefix + key)
+	}
+	return false, notSupported
+}
+
+func (s *withPrefix) Reconcile(prefix string, before time.Time) (int, error) {
+	if r, ok := s.os.(SupportReconcile); ok {
+		return r.Reconcile(s.prefix+prefix, before)
+	}
+	return 0, notSupported
+}
+
+func (s *withPrefix) Restore(key string) error {
+	if r, ok := s.os.(SupportRestore); ok {
+		return r.Restore(s.prefix + key)
+	}
+	return notSupported
+}
+
+func (s *withPrefix) Rekey(key string) (bool, error) {
+	if r, ok := s.os.(SupportRekey); ok {
+		return r.Rekey(s.prefix + key)
+	}
+	return false, notSupported
+}
+
+func (s *withPrefix) SetStorageClass(sc string) error {
+	if c, ok := s.os.(SupportStorageClass); ok {
+		return c.SetStorageClass(sc)
+	}
+	return notSupported
+}
+
+func (s *withPrefix) CheckSSE(key string) error {
+	if c, ok := s.os.(SupportSSE); ok {
+		return c.CheckSSE(s.prefix + key)
+	}
+	return notSupported
+}
+
 func (p *withPrefix) String() string {
 	return fmt.Sprintf("%s%s", p.os, p.prefix)
 }
@@ -163,11 +206,20 @@ func (p *withPrefix) CompleteUpload(key string, uploadID string, parts []*Part)
 }
 
 func (p *withPrefix) ListUploads(marker string) ([]*PendingPart, string, error) {
-	parts, nextMarker, err := p.os.ListUploads(marker)
+	parts, nextMarker, err := p.os.ListUploads(p.prefix + marker)
+	var keep []*PendingPart
 	for _, part := range parts {
-		part.Key = part.Key[len(p.prefix):]
+		if strings.HasPrefix(part.Key, p.prefix) {
+			part.Key = part.Key[len(p.prefix):]
+			keep = append(keep, part)
+		}
+	}
+	if strings.HasPrefix(nextMarker, p.prefix) {
+		nextMarker = nextMarker[len(p.prefix):]
+	} else {
+		nextMarker = ""
 	}
-	return parts, nextMarker, err
+	return keep, nextMarker, err
 }
 
 var _ ObjectStorage = &withPrefix{}
@@ -126,6 +126,10 @@ func (q *qiniu) CreateMultipartUpload(key string) (*MultipartUpload, error) {
 	return nil, notSupported
 }
 
+func (q *qiniu) SetStorageClass(sc string) error {
+	return notSupported
+}
+
 func (q *qiniu) Delete(key string) error {
 	err := q.bm.Delete(q.bucket, key)
 	if err != nil && strings.Contains(err.Error(), notexist) {
@@ -201,7 +205,7 @@ func newQiniu(endpoint, accessKey, secretKey, token string) (ObjectStorage, erro
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	s3client := s3client{bucket, s3.New(ses), ses}
+	s3client := s3client{bucket: bucket, s3: s3.New(ses), ses: ses}
 
 	cfg := storage.Config{
 		UseHTTPS: uri.Scheme == "https",
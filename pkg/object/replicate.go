@@ -0,0 +1,429 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	replicationPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "object_replication_pending",
+		Help: "Number of objects waiting to be copied to the other replica.",
+	})
+	replicationLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "object_replication_lag_seconds",
+		Help: "Age of the oldest object waiting to be copied to the other replica.",
+	})
+	replicationCopied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_replication_copied",
+		Help: "Number of objects copied by async replication and reconciliation.",
+	})
+)
+
+// InitMetrics registers the metrics of object storages.
+func InitMetrics(registerer prometheus.Registerer) {
+	if registerer == nil {
+		return
+	}
+	registerer.MustRegister(replicationPending)
+	registerer.MustRegister(replicationLag)
+	registerer.MustRegister(replicationCopied)
+	registerer.MustRegister(backendRequests)
+	registerer.MustRegister(backendDataBytes)
+	registerer.MustRegister(backendErrors)
+	registerer.MustRegister(backendRetries)
+}
+
+// SupportReconcile is implemented by object storages keeping replicas of objects.
+type SupportReconcile interface {
+	// Reconcile copies the objects modified before `before` and existing in only one replica
+	// to the other one, it returns the number of copied objects.
+	Reconcile(prefix string, before time.Time) (int, error)
+}
+
+const (
+	replicaWorkers  = 10
+	maxReplicaQueue = 10000
+)
+
+type pendingCopy struct {
+	added     time.Time
+	toPrimary bool
+	failed    bool
+}
+
+// replicated writes objects into two object storages, reads from the primary one and fails over
+// to the secondary one. In async mode, objects are copied to the other one in background.
+type replicated struct {
+	DefaultObjectStorage
+	primary   ObjectStorage
+	secondary ObjectStorage
+	async     bool
+
+	sync.Mutex
+	pending map[string]*pendingCopy
+	queue   chan string
+	deleted map[string]bool // tombstones of the objects failed to be deleted from any replica
+}
+
+func (r *replicated) String() string {
+	return fmt.Sprintf("replica(%s,%s)", r.primary, r.secondary)
+}
+
+func (r *replicated) Create() error {
+	if err := r.primary.Create(); err != nil {
+		return err
+	}
+	return r.secondary.Create()
+}
+
+func (r *replicated) Head(key string) (Object, error) {
+	o, err := r.primary.Head(key)
+	if err != nil {
+		if o, e := r.secondary.Head(key); e == nil {
+			return o, nil
+		}
+	}
+	return o, err
+}
+
+func (r *replicated) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	in, err := r.primary.Get(key, off, limit)
+	if err != nil {
+		var e error
+		if in, e = r.secondary.Get(key, off, limit); e == nil {
+			logger.Debugf("Get %s from %s: %s, read it from %s", key, r.primary, err, r.secondary)
+			return in, nil
+		}
+	}
+	return in, err
+}
+
+func (r *replicated) Put(key string, in io.Reader) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	delete(r.deleted, key)
+	r.Unlock()
+	if r.async {
+		if err = r.primary.Put(key, bytes.NewReader(data)); err == nil {
+			r.replicate(key, data, false)
+			return nil
+		}
+		logger.Warnf("Put %s into %s: %s, write it into %s", key, r.primary, err, r.secondary)
+		if err = r.secondary.Put(key, bytes.NewReader(data)); err == nil {
+			r.replicate(key, data, true)
+		}
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var perr, serr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		perr = r.primary.Put(key, bytes.NewReader(data))
+	}()
+	go func() {
+		defer wg.Done()
+		serr = r.secondary.Put(key, bytes.NewReader(data))
+	}()
+	wg.Wait()
+	if perr != nil {
+		return perr
+	}
+	return serr
+}
+
+func (r *replicated) Delete(key string) error {
+	if r.async {
+		r.Lock()
+		delete(r.pending, key)
+		r.Unlock()
+	}
+	err := r.primary.Delete(key)
+	e := r.secondary.Delete(key)
+	if e != nil {
+		logger.Warnf("Delete %s from %s: %s", key, r.secondary, e)
+	}
+	r.Lock()
+	if err != nil || e != nil {
+		// remember it, so Reconcile will delete the leftover rather than copy it back
+		r.deleted[key] = true
+	} else {
+		delete(r.deleted, key)
+	}
+	r.Unlock()
+	return err
+}
+
+func (r *replicated) List(prefix, marker string, limit int64) ([]Object, error) {
+	objs, err := r.primary.List(prefix, marker, limit)
+	if err != nil && err != notSupported {
+		if sobjs, e := r.secondary.List(prefix, marker, limit); e == nil {
+			return sobjs, nil
+		}
+	}
+	return objs, err
+}
+
+// mergeReplicas walks through the sorted objects from both replicas, the callback is called with nil
+// for the replica missing the object. It stops once any of the listings fails, otherwise all the
+// objects after the failure would look missing in that replica.
+func mergeReplicas(pch, sch <-chan Object, cb func(p, s Object)) error {
+	next := func(ch <-chan Object) (Object, bool) {
+		o, ok := <-ch
+		return o, ok && o == nil
+	}
+	p, pfailed := next(pch)
+	s, sfailed := next(sch)
+	for {
+		if pfailed {
+			return errors.New("list primary: interrupted")
+		}
+		if sfailed {
+			return errors.New("list secondary: interrupted")
+		}
+		switch {
+		case p == nil && s == nil:
+			return nil
+		case s == nil || p != nil && p.Key() < s.Key():
+			cb(p, nil)
+			p, pfailed = next(pch)
+		case p == nil || s.Key() < p.Key():
+			cb(nil, s)
+			s, sfailed = next(sch)
+		default:
+			cb(p, s)
+			p, pfailed = next(pch)
+			s, sfailed = next(sch)
+		}
+	}
+}
+
+// ListAll returns the objects in any of the replicas, it lists the available one only if the other one fails.
+func (r *replicated) ListAll(prefix, marker string) (<-chan Object, error) {
+	pch, err := ListAll(r.primary, prefix, marker)
+	if err != nil {
+		logger.Warnf("List %s: %s, list %s only", r.primary, err, r.secondary)
+		return ListAll(r.secondary, prefix, marker)
+	}
+	sch, err := ListAll(r.secondary, prefix, marker)
+	if err != nil {
+		logger.Warnf("List %s: %s, list %s only", r.secondary, err, r.primary)
+		return pch, nil
+	}
+	out := make(chan Object, maxResults)
+	go func() {
+		err := mergeReplicas(pch, sch, func(p, s Object) {
+			if p != nil {
+				out <- p
+			} else {
+				out <- s
+			}
+		})
+		if err != nil {
+			logger.Errorf("List %s: %s", r, err)
+			out <- nil
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
+func (r *replicated) copy(key string, toPrimary bool) error {
+	src, dst := r.primary, r.secondary
+	if toPrimary {
+		src, dst = dst, src
+	}
+	in, err := src.Get(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return err
+	}
+	if err = dst.Put(key, bytes.NewReader(data)); err == nil {
+		replicationCopied.Inc()
+	}
+	return err
+}
+
+// Reconcile copies the objects which exist in only one of the replicas.
+func (r *replicated) Reconcile(prefix string, before time.Time) (int, error) {
+	pch, err := ListAll(r.primary, prefix, "")
+	if err != nil {
+		return 0, fmt.Errorf("list %s: %s", r.primary, err)
+	}
+	sch, err := ListAll(r.secondary, prefix, "")
+	if err != nil {
+		return 0, fmt.Errorf("list %s: %s", r.secondary, err)
+	}
+	var copied int
+	err = mergeReplicas(pch, sch, func(p, s Object) {
+		if p == nil && s == nil {
+			return
+		}
+		o := p
+		if o == nil {
+			o = s
+		}
+		key := o.Key()
+		r.Lock()
+		_, deleted := r.deleted[key]
+		r.Unlock()
+		if deleted {
+			r.purge(key, p != nil, s != nil)
+			return
+		}
+		if p != nil && s != nil || o.IsDir() || o.Mtime().After(before) {
+			return
+		}
+		if err := r.copy(key, p == nil); err != nil {
+			logger.Warnf("Copy %s to the other replica: %s", key, err)
+		} else {
+			copied++
+		}
+	})
+	return copied, err
+}
+
+// purge deletes the leftovers of an object which was failed to be deleted from the replicas.
+func (r *replicated) purge(key string, inPrimary, inSecondary bool) {
+	var err error
+	if inPrimary {
+		err = r.primary.Delete(key)
+	}
+	if err == nil && inSecondary {
+		err = r.secondary.Delete(key)
+	}
+	if err != nil {
+		logger.Warnf("Delete %s: %s", key, err)
+		return
+	}
+	r.Lock()
+	delete(r.deleted, key)
+	r.Unlock()
+}
+
+// replicate copies the object to the other replica in background, or writes it in place when
+// the queue is full, so the writers are not blocked by a slow replica.
+func (r *replicated) replicate(key string, data []byte, toPrimary bool) {
+	p := &pendingCopy{added: time.Now(), toPrimary: toPrimary}
+	r.Lock()
+	r.pending[key] = p
+	r.Unlock()
+	select {
+	case r.queue <- key:
+		return
+	default:
+	}
+	dst := r.secondary
+	if toPrimary {
+		dst = r.primary
+	}
+	err := dst.Put(key, bytes.NewReader(data))
+	if err == nil {
+		replicationCopied.Inc()
+	}
+	r.finish(key, p, err)
+}
+
+// finish removes the copied object from pending ones, or marks it as failed to be retried later.
+func (r *replicated) finish(key string, p *pendingCopy, err error) {
+	r.Lock()
+	if r.pending[key] == p {
+		if err == nil {
+			delete(r.pending, key)
+		} else {
+			p.failed = true
+		}
+	}
+	r.Unlock()
+	if err != nil {
+		logger.Warnf("Copy %s to the other replica: %s", key, err)
+	}
+}
+
+func (r *replicated) worker() {
+	for key := range r.queue {
+		r.Lock()
+		p := r.pending[key]
+		r.Unlock()
+		if p == nil {
+			continue // deleted
+		}
+		r.finish(key, p, r.copy(key, p.toPrimary))
+	}
+}
+
+// retry requeues the failed copies periodically and updates the metrics of lag.
+func (r *replicated) retry() {
+	for range time.Tick(time.Second * 10) {
+		var failed []string
+		var oldest time.Time
+		r.Lock()
+		for key, p := range r.pending {
+			if p.failed {
+				p.failed = false
+				failed = append(failed, key)
+			}
+			if oldest.IsZero() || p.added.Before(oldest) {
+				oldest = p.added
+			}
+		}
+		replicationPending.Set(float64(len(r.pending)))
+		r.Unlock()
+		if oldest.IsZero() {
+			replicationLag.Set(0)
+		} else {
+			replicationLag.Set(time.Since(oldest).Seconds())
+		}
+		for _, key := range failed {
+			r.queue <- key
+		}
+	}
+}
+
+// NewReplicated returns an object storage which keeps objects in both primary and secondary.
+// Objects are written into both of them in sync mode, or copied to the secondary in background
+// in async mode.
+func NewReplicated(primary, secondary ObjectStorage, async bool) ObjectStorage {
+	r := &replicated{primary: primary, secondary: secondary, async: async, deleted: make(map[string]bool)}
+	if async {
+		r.pending = make(map[string]*pendingCopy)
+		r.queue = make(chan string, maxReplicaQueue)
+		for i := 0; i < replicaWorkers; i++ {
+			go r.worker()
+		}
+		go r.retry()
+	}
+	return r
+}
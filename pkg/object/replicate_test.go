@@ -0,0 +1,129 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestReplicated(t *testing.T) {
+	primary, _ := CreateStorage("mem", "primary", "", "", "")
+	secondary, _ := CreateStorage("mem", "secondary", "", "", "")
+	s := NewReplicated(primary, secondary, false)
+	testStorage(t, s)
+
+	if err := s.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if _, err := secondary.Head("a"); err != nil {
+		t.Fatalf("object is not written into secondary: %s", err)
+	}
+	_ = primary.Delete("a")
+	in, err := s.Get("a", 0, -1)
+	if err != nil {
+		t.Fatalf("failover to secondary: %s", err)
+	}
+	if d, _ := ioutil.ReadAll(in); string(d) != "hello" {
+		t.Fatalf("expect hello, got %s", d)
+	}
+	_ = secondary.Put("b", bytes.NewReader([]byte("world")))
+	if n, err := s.(SupportReconcile).Reconcile("", time.Now()); err != nil || n != 2 {
+		t.Fatalf("reconcile: %d %s", n, err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if _, err := primary.Head(k); err != nil {
+			t.Fatalf("%s is not reconciled: %s", k, err)
+		}
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := secondary.Head("a"); err == nil {
+		t.Fatalf("a should be deleted from secondary")
+	}
+
+	as := NewReplicated(primary, secondary, true)
+	if err := as.Put("c", bytes.NewReader([]byte("async"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	for i := 0; ; i++ {
+		if _, err := secondary.Head("c"); err == nil {
+			break
+		} else if i > 100 {
+			t.Fatalf("c is not copied to secondary: %s", err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+type brokenList struct {
+	ObjectStorage
+}
+
+func (b brokenList) ListAll(prefix, marker string) (<-chan Object, error) {
+	out := make(chan Object, 2)
+	out <- &obj{key: "0"}
+	out <- nil
+	close(out)
+	return out, nil
+}
+
+func TestReconcile(t *testing.T) {
+	primary, _ := CreateStorage("mem", "primary", "", "", "")
+	secondary, _ := CreateStorage("mem", "secondary", "", "", "")
+	faulty, _ := NewChaos(secondary, "delete-error=1")
+	s := NewReplicated(primary, faulty, false)
+	_ = s.Put("a", bytes.NewReader([]byte("hello")))
+	_ = s.Delete("a")
+	if _, err := secondary.Head("a"); err != nil {
+		t.Fatalf("a should be left in secondary: %s", err)
+	}
+	_ = ConfigureChaos(faulty, "")
+	if n, err := s.(SupportReconcile).Reconcile("", time.Now()); err != nil || n != 0 {
+		t.Fatalf("reconcile: %d %s", n, err)
+	}
+	for _, store := range []ObjectStorage{primary, secondary} {
+		if _, err := store.Head("a"); err == nil {
+			t.Fatalf("deleted a is copied back into %s", store)
+		}
+	}
+
+	_ = primary.Put("b", bytes.NewReader([]byte("world")))
+	s = NewReplicated(primary, brokenList{secondary}, false)
+	if _, err := s.(SupportReconcile).Reconcile("", time.Now()); err == nil {
+		t.Fatalf("reconcile should fail with broken listing")
+	}
+	if _, err := secondary.Head("b"); err == nil {
+		t.Fatalf("b should not be copied after the listing failed")
+	}
+
+	// the writers fall back to copy in place once the queue is full
+	as := &replicated{primary: primary, secondary: secondary, async: true,
+		pending: make(map[string]*pendingCopy), deleted: make(map[string]bool)}
+	if err := as.Put("c", bytes.NewReader([]byte("sync"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if _, err := secondary.Head("c"); err != nil {
+		t.Fatalf("c is not copied to secondary: %s", err)
+	}
+	if len(as.pending) != 0 {
+		t.Fatalf("pending copies: %d", len(as.pending))
+	}
+}
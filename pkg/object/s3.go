@@ -55,6 +55,8 @@ type s3client struct {
 	bucket string
 	s3     *s3.S3
 	ses    *session.Session
+	sse    *sseConfig
+	sc     string
 }
 
 func (s *s3client) String() string {
@@ -82,6 +84,7 @@ func (s *s3client) Head(key string) (Object, error) {
 		Bucket: &s.bucket,
 		Key:    &key,
 	}
+	param.SSECustomerAlgorithm, param.SSECustomerKey = s.customer()
 	r, err := s.s3.HeadObject(&param)
 	if err != nil {
 		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
@@ -99,6 +102,7 @@ func (s *s3client) Head(key string) (Object, error) {
 
 func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	params := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key}
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.customer()
 	if off > 0 || limit > 0 {
 		var r string
 		if limit > 0 {
@@ -110,6 +114,11 @@ func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	}
 	resp, err := s.s3.GetObject(params)
 	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == s3.ErrCodeInvalidObjectState {
+			err = ErrNotRestored
+		} else if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+			err = os.ErrNotExist
+		}
 		return nil, err
 	}
 	if off == 0 && limit == -1 {
@@ -141,6 +150,11 @@ func (s *s3client) Put(key string, in io.Reader) error {
 		ContentType: &mimeType,
 		Metadata:    map[string]*string{checksumAlgr: &checksum},
 	}
+	if s.sc != "" {
+		params.StorageClass = &s.sc
+	}
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.encryption()
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.customer()
 	_, err := s.s3.PutObject(params)
 	return err
 }
@@ -152,10 +166,21 @@ func (s *s3client) Copy(dst, src string) error {
 		Key:        &dst,
 		CopySource: &src,
 	}
+	if s.sc != "" {
+		params.StorageClass = &s.sc
+	}
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.encryption()
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.customer()
+	params.CopySourceSSECustomerAlgorithm, params.CopySourceSSECustomerKey = s.customer()
 	_, err := s.s3.CopyObject(params)
 	return err
 }
 
+func (s *s3client) SetStorageClass(sc string) error {
+	s.sc = sc
+	return nil
+}
+
 func (s *s3client) Delete(key string) error {
 	param := s3.DeleteObjectInput{
 		Bucket: &s.bucket,
@@ -205,6 +230,11 @@ func (s *s3client) CreateMultipartUpload(key string) (*MultipartUpload, error) {
 		Bucket: &s.bucket,
 		Key:    &key,
 	}
+	if s.sc != "" {
+		params.StorageClass = &s.sc
+	}
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.encryption()
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.customer()
 	resp, err := s.s3.CreateMultipartUpload(params)
 	if err != nil {
 		return nil, err
@@ -221,6 +251,7 @@ func (s *s3client) UploadPart(key string, uploadID string, num int, body []byte)
 		Body:       bytes.NewReader(body),
 		PartNumber: &n,
 	}
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.customer()
 	resp, err := s.s3.UploadPart(params)
 	if err != nil {
 		return nil, err
@@ -448,9 +479,9 @@ func newS3(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		return nil, fmt.Errorf("Fail to create aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &s3client{bucketName, s3.New(ses), ses}, nil
+	return &s3client{bucket: bucketName, s3: s3.New(ses), ses: ses}, nil
 }
 
 func init() {
-	Register("s3", newS3)
+	Register("s3", withSSE(newS3))
 }
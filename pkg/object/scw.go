@@ -74,9 +74,9 @@ func newScw(endpoint, accessKey, secretKey, token string) (ObjectStorage, error)
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &scw{s3client{bucket, s3.New(ses), ses}}, nil
+	return &scw{s3client{bucket: bucket, s3: s3.New(ses), ses: ses}}, nil
 }
 
 func init() {
-	Register("scw", newScw)
+	Register("scw", withSSE(newScw))
 }
@@ -44,6 +44,19 @@ func (s *sharded) Create() error {
 	return nil
 }
 
+func (s *sharded) SetStorageClass(sc string) error {
+	for _, o := range s.stores {
+		c, ok := o.(SupportStorageClass)
+		if !ok {
+			return notSupported
+		}
+		if err := c.SetStorageClass(sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *sharded) pick(key string) ObjectStorage {
 	h := fnv.New32a()
 	_, _ = h.Write([]byte(key))
@@ -63,9 +63,9 @@ func newSpace(endpoint, accessKey, secretKey, token string) (ObjectStorage, erro
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &space{s3client{bucket, s3.New(ses), ses}}, nil
+	return &space{s3client{bucket: bucket, s3: s3.New(ses), ses: ses}}, nil
 }
 
 func init() {
-	Register("space", newSpace)
+	Register("space", withSSE(newSpace))
 }
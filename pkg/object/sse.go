@@ -0,0 +1,217 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// SupportSSE is implemented by object storages encrypting objects on the server side.
+type SupportSSE interface {
+	// CheckSSE returns an error if the object is not encrypted as configured.
+	CheckSSE(key string) error
+}
+
+const (
+	sseS3  = s3.ServerSideEncryptionAes256
+	sseKMS = s3.ServerSideEncryptionAwsKms
+)
+
+// sseConfig is the server-side encryption of objects in S3 compatible storages.
+type sseConfig struct {
+	algorithm   string // AES256 for SSE-S3 or aws:kms for SSE-KMS, empty for SSE-C
+	kmsKeyID    string // key of SSE-KMS, the AWS managed key is used if it's empty
+	customerKey string // 256-bit key of SSE-C
+}
+
+func (c *sseConfig) String() string {
+	switch {
+	case c.customerKey != "":
+		return "SSE-C"
+	case c.algorithm == sseKMS:
+		return "SSE-KMS"
+	}
+	return "SSE-S3"
+}
+
+// parseSSE removes the options of server-side encryption from the query of endpoint:
+//
+//	sse=SSE-S3|SSE-KMS|SSE-C
+//	sse-kms-key-id=ID     the key of SSE-KMS (default: the AWS managed key)
+//	sse-c-key=PATH        the file of 256-bit key for SSE-C, in 32 raw bytes, 64 hex characters or base64
+//
+// The key of SSE-C is read from a file, so it's never stored in the metadata engine.
+func parseSSE(endpoint string) (string, *sseConfig, error) {
+	p := strings.IndexByte(endpoint, '?')
+	if p < 0 {
+		return endpoint, nil, nil
+	}
+	values, err := url.ParseQuery(endpoint[p+1:])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid query of %s: %s", endpoint, err)
+	}
+	mode, keyID, keyPath := values.Get("sse"), values.Get("sse-kms-key-id"), values.Get("sse-c-key")
+	if mode == "" && keyID == "" && keyPath == "" {
+		return endpoint, nil, nil
+	}
+	values.Del("sse")
+	values.Del("sse-kms-key-id")
+	values.Del("sse-c-key")
+	endpoint = endpoint[:p]
+	if len(values) > 0 {
+		endpoint += "?" + values.Encode()
+	}
+
+	if mode == "" && keyID != "" {
+		mode = "SSE-KMS"
+	} else if mode == "" && keyPath != "" {
+		mode = "SSE-C"
+	}
+	c := &sseConfig{}
+	switch strings.ToUpper(mode) {
+	case "SSE-S3", "AES256":
+		c.algorithm = sseS3
+	case "SSE-KMS", "AWS:KMS":
+		c.algorithm = sseKMS
+		c.kmsKeyID = keyID
+	case "SSE-C":
+		if keyPath == "" {
+			return "", nil, fmt.Errorf("sse-c-key is required for SSE-C")
+		}
+		if c.customerKey, err = readCustomerKey(keyPath); err != nil {
+			return "", nil, err
+		}
+	default:
+		return "", nil, fmt.Errorf("invalid server-side encryption %s, expect SSE-S3, SSE-KMS or SSE-C", mode)
+	}
+	if keyID != "" && c.algorithm != sseKMS || keyPath != "" && c.customerKey == "" {
+		return "", nil, fmt.Errorf("the keys of server-side encryption don't match %s", mode)
+	}
+	return endpoint, c, nil
+}
+
+func readCustomerKey(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read SSE-C key: %s", err)
+	}
+	if len(data) == 32 {
+		return string(data), nil
+	}
+	s := string(bytes.TrimSpace(data))
+	var key []byte
+	if len(s) == 64 {
+		key, err = hex.DecodeString(s)
+	} else {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(key) != 32 {
+		return "", fmt.Errorf("invalid SSE-C key in %s: expect 256 bits in raw bytes, hex or base64", path)
+	}
+	return string(key), nil
+}
+
+// withSSE creates the S3 compatible storage with server-side encryption set in the query of endpoint.
+func withSSE(create Creator) Creator {
+	return func(endpoint, accessKey, secretKey, token string) (ObjectStorage, error) {
+		endpoint, c, err := parseSSE(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		s, err := create(endpoint, accessKey, secretKey, token)
+		if err != nil || c == nil {
+			return s, err
+		}
+		ss, ok := s.(interface{ setSSE(*sseConfig) error })
+		if !ok {
+			return nil, fmt.Errorf("server-side encryption is not supported by %s", s)
+		}
+		if err = ss.setSSE(c); err != nil {
+			return nil, err
+		}
+		logger.Infof("Objects in %s are encrypted with %s", s, c)
+		return s, nil
+	}
+}
+
+func (s *s3client) setSSE(c *sseConfig) error {
+	if c.customerKey != "" && aws.BoolValue(s.ses.Config.DisableSSL) {
+		return fmt.Errorf("SSE-C requires HTTPS")
+	}
+	s.sse = c
+	return nil
+}
+
+// customer returns the algorithm and key of SSE-C, which are required by all requests to read or
+// write an object.
+func (s *s3client) customer() (alg, key *string) {
+	if s.sse == nil || s.sse.customerKey == "" {
+		return nil, nil
+	}
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(s.sse.customerKey)
+}
+
+// encryption returns the algorithm and key id of SSE-S3 or SSE-KMS, which are required to create an object.
+func (s *s3client) encryption() (alg, keyID *string) {
+	if s.sse == nil || s.sse.algorithm == "" {
+		return nil, nil
+	}
+	if s.sse.kmsKeyID != "" {
+		keyID = aws.String(s.sse.kmsKeyID)
+	}
+	return aws.String(s.sse.algorithm), keyID
+}
+
+func (s *s3client) CheckSSE(key string) error {
+	if s.sse == nil {
+		return notSupported
+	}
+	param := &s3.HeadObjectInput{Bucket: &s.bucket, Key: &key}
+	param.SSECustomerAlgorithm, param.SSECustomerKey = s.customer()
+	r, err := s.s3.HeadObject(param)
+	if err != nil {
+		return err
+	}
+	if s.sse.customerKey != "" {
+		sum := md5.Sum([]byte(s.sse.customerKey))
+		if aws.StringValue(r.SSECustomerAlgorithm) != s3.ServerSideEncryptionAes256 ||
+			aws.StringValue(r.SSECustomerKeyMD5) != base64.StdEncoding.EncodeToString(sum[:]) {
+			return fmt.Errorf("%s is not encrypted with the customer key", key)
+		}
+		if _, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key}); err == nil {
+			return fmt.Errorf("%s can be read without the customer key", key)
+		}
+		return nil
+	}
+	if alg := aws.StringValue(r.ServerSideEncryption); alg != s.sse.algorithm {
+		return fmt.Errorf("%s is encrypted with %q, expect %q", key, alg, s.sse.algorithm)
+	}
+	if id := aws.StringValue(r.SSEKMSKeyId); s.sse.kmsKeyID != "" && !strings.HasSuffix(id, s.sse.kmsKeyID) {
+		return fmt.Errorf("%s is encrypted with KMS key %q, expect %q", key, id, s.sse.kmsKeyID)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var sseHeaders = []string{
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Server-Side-Encryption-Customer-Algorithm",
+	"X-Amz-Server-Side-Encryption-Customer-Key-Md5",
+	"X-Amz-Storage-Class",
+}
+
+type fakeObject struct {
+	data   []byte
+	header http.Header
+}
+
+// fakeS3 is a minimal S3 compatible server keeping the headers of server-side encryption and
+// storage class like MinIO, it rejects the requests to objects encrypted with SSE-C without the
+// same key, and the reads of archived objects.
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]*fakeObject
+	parts   map[string]map[int][]byte
+}
+
+func sseOf(r *http.Request) (http.Header, error) {
+	h := make(http.Header)
+	for _, k := range sseHeaders {
+		if v := r.Header.Get(k); v != "" {
+			h.Set(k, v)
+		}
+	}
+	if key := r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key"); key != "" {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("invalid customer key")
+		}
+		sum := md5.Sum(raw)
+		if h.Get(sseHeaders[3]) != base64.StdEncoding.EncodeToString(sum[:]) {
+			return nil, fmt.Errorf("mismatched customer key")
+		}
+	}
+	return h, nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	key := r.URL.Path
+	q := r.URL.Query()
+	h, err := sseOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = &fakeObject{header: h}
+		f.parts[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, id)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		u, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		if h.Get(sseHeaders[3]) != u.header.Get(sseHeaders[3]) {
+			http.Error(w, "mismatched customer key", http.StatusBadRequest)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.parts[q.Get("uploadId")][n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		id := q.Get("uploadId")
+		u, ok := f.uploads[id]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		var nums []int
+		for n := range f.parts[id] {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		for _, n := range nums {
+			u.data = append(u.data, f.parts[id][n]...)
+		}
+		f.objects[key] = u
+		delete(f.uploads, id)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+	case r.Method == http.MethodPut:
+		f.objects[key] = &fakeObject{data: body, header: h}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		o, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if md5 := o.header.Get(sseHeaders[3]); md5 != h.Get(sseHeaders[3]) {
+			http.Error(w, "the customer key is required", http.StatusBadRequest)
+			return
+		}
+		if sc := o.header.Get("X-Amz-Storage-Class"); r.Method == http.MethodGet && (sc == "GLACIER" || sc == "DEEP_ARCHIVE") {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>")
+			return
+		}
+		for k := range o.header {
+			w.Header().Set(k, o.header.Get(k))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(o.data)
+		}
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	srv := httptest.NewTLSServer(&fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]*fakeObject),
+		parts:   make(map[string]map[int][]byte),
+	})
+	defer srv.Close()
+	tr := httpClient.Transport.(*http.Transport)
+	tlsConfig := tr.TLSClientConfig
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	defer func() { tr.TLSClientConfig = tlsConfig }()
+
+	keyPath := filepath.Join(t.TempDir(), "sse-c.key")
+	key := bytes.Repeat([]byte{7}, 32)
+	if err := ioutil.WriteFile(keyPath, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		t.Fatalf("write key: %s", err)
+	}
+	for _, opt := range []string{"sse=SSE-S3", "sse=SSE-KMS&sse-kms-key-id=test-key", "sse=SSE-C&sse-c-key=" + keyPath} {
+		s, err := CreateStorage("s3", fmt.Sprintf("%s/bucket?%s", srv.URL, opt), "ak", "sk", "")
+		if err != nil {
+			t.Fatalf("create with %s: %s", opt, err)
+		}
+		if err = s.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+			t.Fatalf("put with %s: %s", opt, err)
+		}
+		up, err := s.CreateMultipartUpload("b")
+		if err != nil {
+			t.Fatalf("create upload with %s: %s", opt, err)
+		}
+		part, err := s.UploadPart("b", up.UploadID, 1, []byte("world"))
+		if err != nil {
+			t.Fatalf("upload part with %s: %s", opt, err)
+		}
+		if err = s.CompleteUpload("b", up.UploadID, []*Part{part}); err != nil {
+			t.Fatalf("complete upload with %s: %s", opt, err)
+		}
+		for k, v := range map[string]string{"a": "hello", "b": "world"} {
+			if err = s.(SupportSSE).CheckSSE(k); err != nil {
+				t.Fatalf("check %s with %s: %s", k, opt, err)
+			}
+			if o, err := s.Head(k); err != nil || o.Size() != int64(len(v)) {
+				t.Fatalf("head %s with %s: %v %s", k, opt, o, err)
+			}
+			r, err := s.Get(k, 0, -1)
+			if err != nil {
+				t.Fatalf("get %s with %s: %s", k, opt, err)
+			}
+			if d, _ := ioutil.ReadAll(r); string(d) != v {
+				t.Fatalf("get %s with %s: %q", k, opt, d)
+			}
+			_ = r.Close()
+		}
+	}
+
+	plain, _ := CreateStorage("s3", srv.URL+"/bucket", "ak", "sk", "")
+	if err := plain.(SupportSSE).CheckSSE("a"); err != notSupported {
+		t.Fatalf("check without SSE should be not supported: %v", err)
+	}
+	if _, err := plain.Get("a", 0, -1); err == nil {
+		t.Fatalf("object encrypted with SSE-C should not be read without the key")
+	}
+	// written by SSE-C, not SSE-S3
+	s3, _ := CreateStorage("s3", srv.URL+"/bucket?sse=SSE-S3", "ak", "sk", "")
+	_ = s3.Put("c", bytes.NewReader(nil))
+	ssec, _ := CreateStorage("s3", srv.URL+"/bucket?sse-c-key="+keyPath, "ak", "sk", "")
+	if err := ssec.(SupportSSE).CheckSSE("c"); err == nil {
+		t.Fatalf("object encrypted with SSE-S3 should fail the check of SSE-C")
+	}
+}
+
+func TestParseSSE(t *testing.T) {
+	dir := t.TempDir()
+	raw, bad := filepath.Join(dir, "raw"), filepath.Join(dir, "bad")
+	_ = ioutil.WriteFile(raw, bytes.Repeat([]byte{1}, 32), 0600)
+	_ = ioutil.WriteFile(bad, []byte("short"), 0600)
+
+	ep, c, err := parseSSE("https://host/bucket?sse-kms-key-id=k1&other=1")
+	if err != nil || ep != "https://host/bucket?other=1" || c.algorithm != sseKMS || c.kmsKeyID != "k1" {
+		t.Fatalf("parse SSE-KMS: %s %+v %v", ep, c, err)
+	}
+	if ep, c, err = parseSSE("https://host/bucket?sse-c-key=" + raw); err != nil || ep != "https://host/bucket" || c.String() != "SSE-C" {
+		t.Fatalf("parse SSE-C: %s %+v %v", ep, c, err)
+	}
+	if ep, c, err = parseSSE("https://host/bucket"); err != nil || c != nil {
+		t.Fatalf("parse without SSE: %s %+v %v", ep, c, err)
+	}
+	for _, e := range []string{"?sse=SSE-X", "?sse=SSE-C", "?sse=SSE-S3&sse-kms-key-id=k1", "?sse-c-key=" + bad, "?sse-c-key=" + filepath.Join(dir, "none")} {
+		if _, _, err = parseSSE("https://host/bucket" + e); err == nil {
+			t.Fatalf("parse %s should fail", e)
+		}
+	}
+	if _, err = CreateStorage("s3", "http://127.0.0.1:9000/bucket?sse-c-key="+raw, "", "", ""); err == nil || !strings.Contains(err.Error(), "HTTPS") {
+		t.Fatalf("SSE-C should require HTTPS: %v", err)
+	}
+}
+
+func TestS3StorageClass(t *testing.T) {
+	f := &fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]*fakeObject),
+		parts:   make(map[string]map[int][]byte),
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	s, err := CreateStorage("s3", srv.URL+"/bucket", "ak", "sk", "")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err = s.(SupportStorageClass).SetStorageClass("STANDARD_IA"); err != nil {
+		t.Fatalf("set storage class: %s", err)
+	}
+	_ = s.Put("a", bytes.NewReader([]byte("hello")))
+	up, err := s.CreateMultipartUpload("b")
+	if err != nil {
+		t.Fatalf("create upload: %s", err)
+	}
+	part, _ := s.UploadPart("b", up.UploadID, 1, []byte("world"))
+	if err = s.CompleteUpload("b", up.UploadID, []*Part{part}); err != nil {
+		t.Fatalf("complete upload: %s", err)
+	}
+	for _, k := range []string{"/bucket/a", "/bucket/b"} {
+		if sc := f.objects[k].header.Get("X-Amz-Storage-Class"); sc != "STANDARD_IA" {
+			t.Fatalf("storage class of %s: %q", k, sc)
+		}
+	}
+	if r, err := s.Get("a", 0, -1); err != nil {
+		t.Fatalf("get: %s", err)
+	} else {
+		_ = r.Close()
+	}
+
+	_ = s.(SupportStorageClass).SetStorageClass("GLACIER")
+	_ = s.Put("c", bytes.NewReader([]byte("cold")))
+	if _, err = s.Head("c"); err != nil {
+		t.Fatalf("head of archived object: %s", err)
+	}
+	if _, err = s.Get("c", 0, -1); err != ErrNotRestored {
+		t.Fatalf("get of archived object should fail with ErrNotRestored: %v", err)
+	}
+	if _, err = s.Get("d", 0, -1); err == nil || err == ErrNotRestored {
+		t.Fatalf("get of nonexistent object: %v", err)
+	}
+}
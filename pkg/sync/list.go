@@ -0,0 +1,202 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+const (
+	rangesPerThread = 4  // number of ranges to split for every thread
+	probesPerRange  = 4  // max number of requests to find a split point
+	maxSplitDepth   = 64 // max length of prefixes to split the key space
+)
+
+// maxSuffix is larger than any valid UTF-8 sequence, so prefix+maxSuffix is after all the keys
+// starting with prefix, and it's still a valid marker for object storages.
+var maxSuffix = string(utf8.MaxRune)
+
+// listSplits finds the boundaries to split the keys in (start, end] into about n ranges. It
+// skip-scans the keys with one request per distinct prefix, starting with the prefixes of one
+// byte, and uses longer prefixes until enough of them are found. A boundary is the marker
+// after all the keys with a prefix, so a range is (boundary, next boundary].
+func listSplits(store object.ObjectStorage, start, end string, n int) ([]string, error) {
+	seen := make(map[string]bool)
+	var splits []string
+	var probes int
+	for depth := 1; depth <= maxSplitDepth && probes < n*probesPerRange; depth++ {
+		marker := start
+		var found int
+		var longer bool // some keys are longer than depth
+		for probes < n*probesPerRange {
+			objs, err := store.List("", marker, 2)
+			probes++
+			if err != nil {
+				return nil, err
+			}
+			if len(objs) > 0 && objs[0].Key() == marker {
+				objs = objs[1:] // not compatible to S3
+			}
+			if len(objs) == 0 {
+				break
+			}
+			key := objs[0].Key()
+			if key <= marker {
+				return nil, fmt.Errorf("the keys are out of order: marker %q, key %q", marker, key)
+			}
+			if end != "" && key > end {
+				break
+			}
+			if len(key) > depth {
+				longer = true
+				l := depth
+				for l > 0 && !utf8.RuneStart(key[l]) {
+					l--
+				}
+				key = key[:l]
+			}
+			marker = key + maxSuffix
+			found++
+			if !seen[marker] {
+				seen[marker] = true
+				splits = append(splits, marker)
+			}
+		}
+		if found >= n || !longer {
+			break
+		}
+	}
+	sort.Strings(splits)
+	logger.Debugf("Found %d split points of %s with %d requests", len(splits), store, probes)
+	return splits, nil
+}
+
+// listRange lists the keys in (marker, last] ("" means no limit) into out, it returns false if
+// the listing is failed or canceled.
+func listRange(store object.ObjectStorage, marker, last string, out chan<- object.Object, done <-chan struct{}) bool {
+	for {
+		objs, err := store.List("", marker, maxResults)
+		for count := 0; err != nil && count < 3; count++ {
+			logger.Warnf("Fail to list: %s, retry again", err.Error())
+			time.Sleep(time.Millisecond * 100)
+			objs, err = store.List("", marker, maxResults)
+		}
+		if err != nil {
+			logger.Errorf("Fail to list after %s: %s", marker, err.Error())
+			return false
+		}
+		if len(objs) > 0 && objs[0].Key() == marker {
+			// workaround from a object store that is not compatible to S3.
+			objs = objs[1:]
+		}
+		if len(objs) == 0 {
+			return true
+		}
+		for _, obj := range objs {
+			if last != "" && obj.Key() > last {
+				return true
+			}
+			select {
+			case out <- obj:
+			case <-done:
+				return false
+			}
+		}
+		marker = objs[len(objs)-1].Key()
+	}
+}
+
+// parallelList sends the first page of keys and the rest of keys till end into out, the latter
+// are split into ranges and listed concurrently, then merged in order.
+func parallelList(store object.ObjectStorage, first []object.Object, end string, threads int, out chan object.Object) error {
+	lastkey := first[len(first)-1].Key()
+	splits, err := listSplits(store, lastkey, end, threads*rangesPerThread)
+	if err != nil {
+		return err
+	}
+	bounds := append([]string{lastkey}, splits...)
+	ranges := make([]chan object.Object, len(bounds))
+	for i := range ranges {
+		ranges[i] = make(chan object.Object, maxResults)
+	}
+	done := make(chan struct{})
+	go func() {
+		sem := make(chan struct{}, threads)
+		for i := range bounds {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			last := end
+			if i+1 < len(bounds) && (end == "" || bounds[i+1] < end) {
+				last = bounds[i+1]
+			}
+			go func(i int, last string) {
+				defer func() { <-sem }()
+				if !listRange(store, bounds[i], last, ranges[i], done) {
+					select {
+					case ranges[i] <- nil:
+					case <-done:
+					}
+				}
+				close(ranges[i])
+			}(i, last)
+		}
+	}()
+
+	go func() {
+		defer close(out)
+		defer close(done)
+		var prev string
+		for i, obj := range first {
+			key := obj.Key()
+			if i > 0 && key <= prev {
+				logger.Errorf("The keys are out of order: last %q current %q", prev, key)
+				out <- nil
+				return
+			}
+			if end != "" && key > end {
+				return
+			}
+			prev = key
+			out <- obj
+		}
+		for _, r := range ranges {
+			for obj := range r {
+				if obj == nil {
+					out <- nil // failed listing
+					return
+				}
+				if key := obj.Key(); key <= prev {
+					logger.Errorf("The keys are out of order: last %q current %q", prev, key)
+					out <- nil
+					return
+				} else {
+					prev = key
+				}
+				out <- obj
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestParallelListAll(t *testing.T) {
+	store, _ := object.CreateStorage("mem", "", "", "", "")
+	for i := 0; i < 5000; i++ {
+		_ = store.Put(fmt.Sprintf("chunks/%d/%d/%d_0_4096", i/1000, i/100, i), bytes.NewReader(nil))
+	}
+	for i := 0; i < 500; i++ {
+		_ = store.Put(fmt.Sprintf("数据/%03d", i), bytes.NewReader(nil))
+		_ = store.Put(fmt.Sprintf("x%d", i), bytes.NewReader(nil))
+	}
+
+	for _, c := range [][2]string{{"", ""}, {"chunks/1/", ""}, {"", "chunks/3/3"}, {"chunks/0/5/", "x3"}, {"x1", ""}} {
+		ch, err := ListAll(store, c[0], c[1])
+		if err != nil {
+			t.Fatalf("list all: %s", err)
+		}
+		expected := collectAll(ch)
+		for _, threads := range []int{2, 10} {
+			ch, err = ParallelListAll(store, c[0], c[1], threads)
+			if err != nil {
+				t.Fatalf("parallel list all: %s", err)
+			}
+			if keys := collectAll(ch); !reflect.DeepEqual(keys, expected) {
+				t.Fatalf("parallel list %q-%q with %d threads: expect %d keys, got %d", c[0], c[1], threads, len(expected), len(keys))
+			}
+		}
+	}
+
+	splits, err := listSplits(store, "", "", 8)
+	if err != nil {
+		t.Fatalf("split: %s", err)
+	}
+	if len(splits) < 8 {
+		t.Fatalf("expect at least 8 split points, got %v", splits)
+	}
+}
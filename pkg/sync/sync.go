@@ -74,6 +74,12 @@ func formatSize(bytes int64) string {
 
 // ListAll on all the keys that starts at marker from object storage.
 func ListAll(store object.ObjectStorage, start, end string) (<-chan object.Object, error) {
+	return ParallelListAll(store, start, end, 1)
+}
+
+// ParallelListAll is ListAll with the key space split into ranges which are listed by up to
+// `threads` concurrent listers, for the object storages without native ListAll.
+func ParallelListAll(store object.ObjectStorage, start, end string, threads int) (<-chan object.Object, error) {
 	startTime := time.Now()
 	logger.Debugf("Iterating objects from %s start %q", store, start)
 
@@ -121,6 +127,12 @@ func ListAll(store object.ObjectStorage, start, end string) (<-chan object.Objec
 		return nil, err
 	}
 	logger.Debugf("Found %d object from %s in %s", len(objs), store, time.Since(startTime))
+	if threads > 1 && len(objs) == maxResults {
+		if err = parallelList(store, objs, end, threads, out); err == nil {
+			return out, nil
+		}
+		logger.Warnf("Can't list %s in parallel: %s", store, err)
+	}
 	go func() {
 		lastkey := ""
 		first := true
@@ -625,12 +637,12 @@ func startProducer(tasks chan<- object.Object, src, dst object.ObjectStorage, co
 	}
 	logger.Debugf("maxResults: %d, defaultPartSize: %d, maxBlock: %d", maxResults, defaultPartSize, maxBlock)
 
-	srckeys, err := ListAll(src, start, end)
+	srckeys, err := ParallelListAll(src, start, end, config.ListThreads)
 	if err != nil {
 		return fmt.Errorf("list %s: %s", src, err)
 	}
 
-	dstkeys, err := ListAll(dst, start, end)
+	dstkeys, err := ParallelListAll(dst, start, end, config.ListThreads)
 	if err != nil {
 		return fmt.Errorf("list %s: %s", dst, err)
 	}
@@ -492,6 +492,30 @@ func TestLimits(t *testing.T) {
 	}
 }
 
+func TestSyncChaos(t *testing.T) {
+	a, _ := object.CreateStorage("mem", "", "", "", "")
+	mem, _ := object.CreateStorage("mem", "", "", "", "")
+	keys := []string{"a1", "a2", "a3", "a4", "a5", "a6"}
+	for _, key := range keys {
+		_ = a.Put(key, bytes.NewReader([]byte(key)))
+	}
+	// the failed puts should be retried
+	b, err := object.NewChaos(mem, "seed=3&put-error=0.3")
+	if err != nil {
+		t.Fatalf("chaos: %s", err)
+	}
+	if err := Sync(a, b, &Config{Threads: 1, Update: true, Limit: -1, Quiet: true}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if c := copied.Current(); c != int64(len(keys)) {
+		t.Fatalf("should copy %d keys, but got %d", len(keys), c)
+	}
+	objs, _ := mem.List("", "", 10)
+	if len(objs) != len(keys) {
+		t.Fatalf("expected %d keys, got %d", len(keys), len(objs))
+	}
+}
+
 func testKeysEqual(objsCh <-chan object.Object, expectedKeys []string) error {
 	var gottenKeys []string
 	for obj := range objsCh {
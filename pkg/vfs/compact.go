@@ -17,11 +17,16 @@
 package vfs
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io/ioutil"
+	"syscall"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -51,7 +56,8 @@ func readSlice(store chunk.ChunkStore, s *meta.Slice, page *chunk.Page, off int)
 	return nil
 }
 
-func Compact(conf chunk.Config, store chunk.ChunkStore, slices []meta.Slice, chunkid uint64) error {
+// Compact writes the data of slices into a new chunk, and fills the checksums of its blocks into sums.
+func Compact(conf chunk.Config, store chunk.ChunkStore, slices []meta.Slice, chunkid uint64, sums *[]uint32) error {
 	for utils.AllocMemory()-store.UsedMemory() > int64(conf.BufferSize)*3/2 {
 		time.Sleep(time.Millisecond * 100)
 	}
@@ -104,6 +110,48 @@ func Compact(conf chunk.Config, store chunk.ChunkStore, slices []meta.Slice, chu
 	err := writer.Finish(pos)
 	if err != nil {
 		writer.Abort()
+	} else if sums != nil {
+		*sums = writer.Checksums()
 	}
 	return err
 }
+
+// CompactPack copies the live slices of a shared object into a new one, the old one is deleted
+// after all of them are moved.
+func CompactPack(m meta.Meta, blob object.ObjectStorage, hashPrefix bool, id uint64, slices []meta.Slice) error {
+	key := chunk.PackKey(id, hashPrefix)
+	in, err := blob.Get(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return err
+	}
+	var newid uint64
+	if st := m.NewChunk(meta.Background, &newid); st != 0 {
+		return st
+	}
+	var buf []byte
+	packs := make([]meta.Pack, len(slices))
+	for i, s := range slices {
+		p := s.Pack
+		if int(p.Off)+int(p.Len) > len(data) {
+			return fmt.Errorf("slice %d (%d+%d) is out of %s (%d bytes)", s.Chunkid, p.Off, p.Len, key, len(data))
+		}
+		packs[i] = meta.Pack{ID: newid, Off: uint32(len(buf)), Len: p.Len}
+		buf = append(buf, data[p.Off:p.Off+p.Len]...)
+	}
+	logger.Debugf("compact %d slices (%d bytes) of %s into pack %d", len(slices), len(buf), key, newid)
+	if err = blob.Put(chunk.PackKey(newid, hashPrefix), bytes.NewReader(buf)); err != nil {
+		return err
+	}
+	for i, s := range slices {
+		// the slice could be deleted in the meantime
+		if st := m.MovePack(meta.Background, s.Chunkid, id, packs[i]); st != 0 && st != syscall.ENOENT {
+			return fmt.Errorf("move slice %d: %s", s.Chunkid, st)
+		}
+	}
+	return blob.Delete(key)
+}
@@ -61,10 +61,14 @@ func TestCompact(t *testing.T) {
 
 	// compact
 	var cid uint64 = 1000
-	err := Compact(cconf, store, slices, cid)
+	var sums []uint32
+	err := Compact(cconf, store, slices, cid, &sums)
 	if err != nil {
 		t.Fatalf("compact %d slices : %s", len(slices), err)
 	}
+	if n := (total-1)/cconf.BlockSize + 1; len(sums) != n {
+		t.Fatalf("expect %d checksums, got %d", n, len(sums))
+	}
 
 	// verify result
 	r := store.NewReader(cid, total)
@@ -89,7 +93,7 @@ func TestCompact(t *testing.T) {
 
 	// failed
 	_ = store.Remove(1, 200)
-	err = Compact(cconf, store, slices, cid)
+	err = Compact(cconf, store, slices, cid, nil)
 	if err == nil {
 		t.Fatalf("compact should fail with read but got nil")
 	}
@@ -29,13 +29,42 @@ import (
 	"github.com/juicedata/juicefs/pkg/meta"
 )
 
+type CacheAction uint8
+
+const (
+	WarmupCache CacheAction = iota
+	PinCache
+	UnpinCache
+	EvictCache
+	CheckCache
+	UnpinEvictCache
+)
+
+func (act CacheAction) String() string {
+	switch act {
+	case WarmupCache:
+		return "warmup"
+	case PinCache:
+		return "pin"
+	case UnpinCache:
+		return "unpin"
+	case EvictCache:
+		return "evict"
+	case CheckCache:
+		return "check"
+	case UnpinEvictCache:
+		return "unpin and evict"
+	}
+	return "unknown"
+}
+
 type _file struct {
 	ino  Ino
 	size uint64
 }
 
-func (v *VFS) fillCache(ctx meta.Context, paths []string, concurrent int, count, bytes *uint64) {
-	logger.Infof("start to warmup %d paths with %d workers", len(paths), concurrent)
+func (v *VFS) fillCache(ctx meta.Context, action CacheAction, paths []string, concurrent int, count, bytes, cached, failed *uint64) {
+	logger.Infof("start to %s %d paths with %d workers", action, len(paths), concurrent)
 	start := time.Now()
 	todo := make(chan _file, 10240)
 	wg := sync.WaitGroup{}
@@ -47,8 +76,11 @@ func (v *VFS) fillCache(ctx meta.Context, paths []string, concurrent int, count,
 				if f.ino == 0 {
 					break
 				}
-				if err := v.fillInode(ctx, f.ino, f.size, bytes); err != nil {
-					logger.Errorf("Inode %d could be corrupted: %s", f.ino, err)
+				if err := v.fillInode(ctx, action, f.ino, f.size, bytes, cached); err != nil {
+					logger.Errorf("Failed to %s inode %d: %s", action, f.ino, err)
+					if failed != nil {
+						atomic.AddUint64(failed, 1)
+					}
 				}
 				if count != nil {
 					atomic.AddUint64(count, 1)
@@ -81,9 +113,9 @@ func (v *VFS) fillCache(ctx meta.Context, paths []string, concurrent int, count,
 	close(todo)
 	wg.Wait()
 	if ctx.Canceled() {
-		logger.Infof("warmup cancelled")
+		logger.Infof("%s cancelled", action)
 	}
-	logger.Infof("Warmup %d paths in %s", len(paths), time.Since(start))
+	logger.Infof("%s %d paths in %s", action, len(paths), time.Since(start))
 }
 
 func (v *VFS) resolve(ctx meta.Context, p string, inode *Ino, attr *Attr) syscall.Errno {
@@ -178,18 +210,38 @@ func (v *VFS) walkDir(ctx meta.Context, inode Ino, todo chan _file) {
 	}
 }
 
-func (v *VFS) fillInode(ctx meta.Context, inode Ino, size uint64, bytes *uint64) error {
+func (v *VFS) fillInode(ctx meta.Context, action CacheAction, inode Ino, size uint64, bytes, cached *uint64) error {
 	var slices []meta.Slice
 	for indx := uint64(0); indx*meta.ChunkSize < size; indx++ {
 		if st := v.Meta.Read(ctx, inode, uint32(indx), &slices); st != 0 {
-			return fmt.Errorf("Failed to get slices of inode %d index %d: %d", inode, indx, st)
+			return fmt.Errorf("read slices of index %d: %s", indx, st)
 		}
 		for _, s := range slices {
 			if bytes != nil {
 				atomic.AddUint64(bytes, uint64(s.Size))
 			}
-			if err := v.Store.FillCache(s.Chunkid, s.Size); err != nil {
-				return fmt.Errorf("Failed to cache inode %d slice %d: %s", inode, s.Chunkid, err)
+			var err error
+			switch action {
+			case WarmupCache:
+				err = v.Store.FillCache(s.Chunkid, s.Size)
+			case PinCache:
+				err = v.Store.PinCache(s.Chunkid, s.Size)
+			case UnpinCache:
+				err = v.Store.UnpinCache(s.Chunkid, s.Size)
+			case EvictCache:
+				err = v.Store.EvictCache(s.Chunkid, s.Size)
+			case UnpinEvictCache:
+				if err = v.Store.UnpinCache(s.Chunkid, s.Size); err == nil {
+					err = v.Store.EvictCache(s.Chunkid, s.Size)
+				}
+			case CheckCache:
+				var n uint64
+				if n, err = v.Store.CheckCache(s.Chunkid, s.Size); err == nil && cached != nil {
+					atomic.AddUint64(cached, n)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("slice %d: %s", s.Chunkid, err)
 			}
 			if ctx.Canceled() {
 				return syscall.EINTR
@@ -36,7 +36,24 @@ func TestFill(t *testing.T) {
 	_, _ = v.Symlink(ctx, "testfile", 1, "sym3")
 
 	// normal cases
-	v.fillCache(meta.Background, []string{"/test/file", "/test", "/sym", "/"}, 2, nil, nil)
+	v.fillCache(meta.Background, WarmupCache, []string{"/test/file", "/test", "/sym", "/"}, 2, nil, nil, nil, nil)
+	var failed uint64
+	v.fillCache(meta.Background, PinCache, []string{"/test/file"}, 2, nil, nil, nil, &failed)
+	if failed != 1 {
+		t.Fatalf("pin into memory cache should fail: %d", failed)
+	}
+	v.fillCache(meta.Background, UnpinCache, []string{"/test/file"}, 2, nil, nil, nil, nil)
+	var bytes, cached uint64
+	v.fillCache(meta.Background, CheckCache, []string{"/test/file"}, 2, nil, &bytes, &cached, nil)
+	if bytes != 5 || cached != 5 {
+		t.Fatalf("check cache: %d of %d bytes cached, expect 5 of 5", cached, bytes)
+	}
+	v.fillCache(meta.Background, EvictCache, []string{"/test"}, 2, nil, nil, nil, nil)
+	cached = 0
+	v.fillCache(meta.Background, CheckCache, []string{"/test/file"}, 2, nil, nil, &cached, nil)
+	if cached != 0 {
+		t.Fatalf("check cache after evicted: %d bytes cached, expect 0", cached)
+	}
 
 	// remove chunk
 	var slices []meta.Slice
@@ -45,5 +62,5 @@ func TestFill(t *testing.T) {
 		_ = v.Store.Remove(s.Chunkid, int(s.Size))
 	}
 	// bad cases
-	v.fillCache(meta.Background, []string{"/test/file", "/sym2", "/sym3", "/.stats", "/not_exists"}, 2, nil, nil)
+	v.fillCache(meta.Background, WarmupCache, []string{"/test/file", "/sym2", "/sym3", "/.stats", "/not_exists"}, 2, nil, nil, nil, nil)
 }
@@ -27,6 +27,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
@@ -243,6 +244,14 @@ func (v *VFS) caclObjects(id uint64, size, offset, length uint32) []*obj {
 		lo.key = fmt.Sprintf("%s_%d_%d", prefix, last, lo.size)
 	}
 	lo.len = (offset + length) - last*bsize - lo.off
+	if v.Conf.Format.Dedup {
+		hashes, _ := v.Meta.GetHashes(meta.Background, id)
+		for indx := first; indx <= last; indx++ {
+			if int(indx) < len(hashes) && hashes[indx] != "" {
+				objs[indx-first].key = fmt.Sprintf("%s/%s", v.Conf.Format.Name, chunk.DedupKey(hashes[indx]))
+			}
+		}
+	}
 
 	return objs
 }
@@ -290,6 +299,13 @@ func (v *VFS) handleInternalMsg(ctx meta.Context, cmd uint32, r *utils.Buffer, d
 		fmt.Fprintf(w, "   dirs: %d\n", summary.Dirs)
 		fmt.Fprintf(w, " length: %s\n", utils.FormatBytes(summary.Length))
 		fmt.Fprintf(w, "   size: %s\n", utils.FormatBytes(summary.Size))
+		if v.Conf.Format.Dedup {
+			var logical, stored uint64
+			if st := v.Meta.DedupStat(ctx, &logical, &stored); st == 0 && stored > 0 {
+				fmt.Fprintf(w, "  dedup: %.2f (%s referenced, %s stored)\n", float64(logical)/float64(stored),
+					utils.FormatBytes(logical), utils.FormatBytes(stored))
+			}
+		}
 		ps := meta.GetPaths(v.Meta, ctx, inode)
 		switch len(ps) {
 		case 0:
@@ -328,16 +344,32 @@ func (v *VFS) handleInternalMsg(ctx meta.Context, cmd uint32, r *utils.Buffer, d
 		paths := strings.Split(string(r.Get(int(r.Get32()))), "\n")
 		concurrent := r.Get16()
 		background := r.Get8()
+		action := WarmupCache
+		if r.HasMore() {
+			action = CacheAction(r.Get8())
+		}
 		if background == 0 {
-			var count, bytes uint64
+			var count, bytes, cached, failed uint64
 			done := make(chan struct{})
 			go func() {
-				v.fillCache(ctx, paths, int(concurrent), &count, &bytes)
+				v.fillCache(ctx, action, paths, int(concurrent), &count, &bytes, &cached, &failed)
 				close(done)
 			}()
 			writeProgress(&count, &bytes, data, done)
+			if action == CheckCache {
+				wb := utils.NewBuffer(9)
+				wb.Put8(meta.CCACHED)
+				wb.Put64(cached)
+				*data = append(*data, wb.Bytes()...)
+			}
+			if failed > 0 {
+				wb := utils.NewBuffer(9)
+				wb.Put8(meta.CFAILED)
+				wb.Put64(failed)
+				*data = append(*data, wb.Bytes()...)
+			}
 		} else {
-			go v.fillCache(meta.NewContext(ctx.Pid(), ctx.Uid(), ctx.Gids()), paths, int(concurrent), nil, nil)
+			go v.fillCache(meta.NewContext(ctx.Pid(), ctx.Uid(), ctx.Gids()), action, paths, int(concurrent), nil, nil, nil, nil)
 		}
 		*data = append(*data, uint8(0))
 	default:
@@ -0,0 +1,66 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// Reconcile the replicas of data periodically, only one client does it in every interval.
+// Objects written or deleted recently are skipped since they may be in progress.
+func Reconcile(m meta.Meta, blob object.ObjectStorage, interval time.Duration) {
+	r, ok := blob.(object.SupportReconcile)
+	if !ok {
+		return
+	}
+	ctx := meta.Background
+	key := "lastReconcile"
+	for {
+		utils.SleepWithJitter(interval / 10)
+		var value []byte
+		if st := m.GetXattr(ctx, 0, key, &value); st != 0 && st != meta.ENOATTR {
+			logger.Warnf("getxattr inode 1 key %s: %s", key, st)
+			continue
+		}
+		var last time.Time
+		var err error
+		if len(value) > 0 {
+			last, err = time.Parse(time.RFC3339, string(value))
+		}
+		if err != nil {
+			logger.Warnf("parse time value %s: %s", value, err)
+			continue
+		}
+		if now := time.Now(); now.Sub(last) >= interval {
+			if st := m.SetXattr(ctx, 0, key, []byte(now.Format(time.RFC3339)), meta.XattrCreateOrReplace); st != 0 {
+				logger.Warnf("setxattr inode 1 key %s: %s", key, st)
+				continue
+			}
+			logger.Debugf("reconcile replicas started")
+			copied, err := r.Reconcile("chunks/", now.Add(-time.Hour))
+			if err == nil {
+				logger.Infof("reconcile replicas succeed, copied %d objects, used %s", copied, time.Since(now))
+			} else {
+				logger.Warnf("reconcile replicas failed: %s", err)
+			}
+		}
+	}
+}
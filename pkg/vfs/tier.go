@@ -0,0 +1,209 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tierMovedSlices = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tier_moved_slices",
+		Help: "Number of slices moved to tier storage.",
+	})
+	tierMovedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tier_moved_bytes",
+		Help: "Bytes of slices moved to tier storage.",
+	})
+)
+
+// MoveCold moves the blocks of files untouched for the days set by tier policies to tier storage
+// periodically, only one client does it in every interval.
+func MoveCold(m meta.Meta, blob, tier object.ObjectStorage, interval time.Duration) {
+	ctx := meta.Background
+	key := "lastTiering"
+	for {
+		utils.SleepWithJitter(interval / 10)
+		var value []byte
+		if st := m.GetXattr(ctx, 0, key, &value); st != 0 && st != meta.ENOATTR {
+			logger.Warnf("getxattr inode 1 key %s: %s", key, st)
+			continue
+		}
+		var last time.Time
+		var err error
+		if len(value) > 0 {
+			last, err = time.Parse(time.RFC3339, string(value))
+		}
+		if err != nil {
+			logger.Warnf("parse time value %s: %s", value, err)
+			continue
+		}
+		if now := time.Now(); now.Sub(last) >= interval {
+			if st := m.SetXattr(ctx, 0, key, []byte(now.Format(time.RFC3339)), meta.XattrCreateOrReplace); st != 0 {
+				logger.Warnf("setxattr inode 1 key %s: %s", key, st)
+				continue
+			}
+			format, err := m.Load(false)
+			if err != nil {
+				logger.Warnf("load format: %s", err)
+				continue
+			}
+			logger.Debugf("move cold data started")
+			t := &tierMover{m: m, blob: blob, tier: tier, format: format, now: now, seen: make(map[uint64]bool)}
+			if st := t.walk(meta.RootInode, "/"); st == 0 {
+				logger.Infof("move cold data succeed, moved %d slices (%d bytes), used %s", t.slices, t.bytes, time.Since(now))
+			} else {
+				logger.Warnf("move cold data failed: %s", st)
+			}
+		}
+	}
+}
+
+type tierMover struct {
+	m      meta.Meta
+	blob   object.ObjectStorage
+	tier   object.ObjectStorage
+	format *meta.Format
+	now    time.Time
+	seen   map[uint64]bool // slices shared by multiple files are checked only once
+	slices int
+	bytes  int64
+}
+
+func (t *tierMover) walk(inode meta.Ino, dir string) syscall.Errno {
+	var entries []*meta.Entry
+	if st := t.m.Readdir(meta.Background, inode, 1, &entries); st != 0 {
+		return st
+	}
+	days := t.format.TierDays(dir)
+	for _, e := range entries {
+		name := string(e.Name)
+		if name == "." || name == ".." {
+			continue
+		}
+		switch e.Attr.Typ {
+		case meta.TypeDirectory:
+			if st := t.walk(e.Inode, path.Join(dir, name)); st != 0 {
+				return st
+			}
+		case meta.TypeFile:
+			edge := t.now.Add(-time.Hour * 24 * time.Duration(days)).Unix()
+			if days > 0 && e.Attr.Atime < edge && e.Attr.Mtime < edge {
+				if st := t.moveFile(e.Inode, e.Attr.Length); st != 0 {
+					logger.Warnf("move file %s: %s", path.Join(dir, name), st)
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func (t *tierMover) moveFile(inode meta.Ino, length uint64) syscall.Errno {
+	for indx := uint32(0); uint64(indx)*meta.ChunkSize < length; indx++ {
+		var slices []meta.Slice
+		if st := t.m.Read(meta.Background, inode, indx, &slices); st != 0 {
+			return st
+		}
+		for _, s := range slices {
+			if s.Chunkid == 0 || t.seen[s.Chunkid] {
+				continue
+			}
+			t.seen[s.Chunkid] = true
+			if st := t.moveSlice(inode, indx, s); st != 0 {
+				return st
+			}
+		}
+	}
+	return 0
+}
+
+// moveSlice copies the blocks of a slice to tier storage, then records the new tier and deletes
+// them from the primary storage; slices in shared objects, metadata engine or deduplicated
+// objects are left as they are.
+func (t *tierMover) moveSlice(inode meta.Ino, indx uint32, s meta.Slice) syscall.Errno {
+	ctx := meta.Background
+	if tier, st := t.m.GetTier(ctx, s.Chunkid); st != 0 || tier != meta.TierPrimary {
+		return st
+	}
+	if t.format.PackSize > 0 {
+		if p, st := t.m.GetPack(ctx, s.Chunkid); st != 0 || p != nil {
+			return st
+		}
+	}
+	if t.format.InlineSize > 0 {
+		if data, st := t.m.GetInline(ctx, s.Chunkid); st != 0 || data != nil {
+			return st
+		}
+	}
+	if t.format.Dedup {
+		if hashes, st := t.m.GetHashes(ctx, s.Chunkid); st != 0 || len(hashes) > 0 {
+			return st
+		}
+	}
+	bsize := t.format.BlockSize << 10
+	var keys []string
+	for off := 0; off < int(s.Size); off += bsize {
+		keys = append(keys, chunk.BlockKey(s.Chunkid, off/bsize, utils.Min(bsize, int(s.Size)-off), t.format.HashPrefix))
+	}
+	for _, key := range keys {
+		in, err := t.blob.Get(key, 0, -1)
+		if err != nil {
+			logger.Warnf("Get %s: %s", key, err)
+			return 0 // try it next time
+		}
+		data, err := ioutil.ReadAll(in)
+		_ = in.Close()
+		if err == nil {
+			err = t.tier.Put(key, bytes.NewReader(data))
+		}
+		if err != nil {
+			logger.Warnf("Copy %s to tier storage: %s", key, err)
+			return 0
+		}
+	}
+	st := t.m.SetTier(ctx, inode, indx, s.Chunkid, meta.TierArchive)
+	if st == syscall.ENOENT {
+		// the slice is overwritten or deleted in the meantime
+		for _, key := range keys {
+			_ = t.tier.Delete(key)
+		}
+		return 0
+	} else if st != 0 {
+		return st
+	}
+	for _, key := range keys {
+		if err := t.blob.Delete(key); err != nil {
+			logger.Warnf("Delete %s moved to tier storage: %s", key, err)
+		}
+	}
+	logger.Debugf("moved slice %d (%d bytes) of inode %d to tier storage", s.Chunkid, s.Size, inode)
+	t.slices++
+	t.bytes += int64(s.Size)
+	tierMovedSlices.Inc()
+	tierMovedBytes.Add(float64(s.Size))
+	return 0
+}
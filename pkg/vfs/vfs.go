@@ -1028,4 +1028,6 @@ func InitMetrics(registerer prometheus.Registerer) {
 	registerer.MustRegister(writtenSizeHistogram)
 	registerer.MustRegister(opsDurationsHistogram)
 	registerer.MustRegister(compactSizeHistogram)
+	registerer.MustRegister(tierMovedSlices)
+	registerer.MustRegister(tierMovedBytes)
 }
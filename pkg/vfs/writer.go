@@ -55,6 +55,9 @@ type sliceWriter struct {
 	soff    uint32
 	slen    uint32
 	writer  chunk.Writer
+	sums    []uint32 // checksums of blocks, available after flushed
+	pack    *chunk.Pack
+	inline  []byte // data stored in metadata engine
 	freezed bool
 	done    bool
 	err     syscall.Errno
@@ -117,6 +120,10 @@ func (s *sliceWriter) flushData() {
 		logger.Errorf("upload chunk %v (length: %v) fail: %s", s.id, s.length, err)
 		s.writer.Abort()
 		s.err = syscall.EIO
+	} else {
+		s.sums = s.writer.Checksums()
+		s.pack = s.writer.Packed()
+		s.inline = s.writer.Inlined()
 	}
 	s.writer = nil
 }
@@ -197,8 +204,12 @@ func (c *chunkWriter) commitThread() {
 		f.Unlock()
 
 		if err == 0 {
-			var ss = meta.Slice{Chunkid: s.id, Size: s.length, Off: s.soff, Len: s.slen}
+			var ss = meta.Slice{Chunkid: s.id, Size: s.length, Off: s.soff, Len: s.slen, Checksums: s.sums, Pack: (*meta.Pack)(s.pack), Inline: s.inline}
 			err = f.w.m.Write(meta.Background, f.inode, c.indx, s.off, ss)
+			if err == syscall.ENOENT || err == syscall.ENOSPC || err == syscall.EROFS {
+				// the slice is rejected and never committed
+				_ = f.w.m.ReleaseBlocks(meta.Background, s.id)
+			}
 			f.w.reader.Invalidate(f.inode, uint64(c.indx)*meta.ChunkSize+uint64(s.off), uint64(ss.Len))
 		}
 
@@ -262,6 +273,11 @@ func (f *fileWriter) writeChunk(ctx meta.Context, indx uint32, off uint32, data
 			notify:  utils.NewCond(&f.Mutex),
 			started: time.Now(),
 		}
+		s.writer.SetInode(uint64(f.inode), indx)
+		s.writer.AllowPacking()
+		if indx == 0 && f.length <= uint64(f.w.inlineSize) && int(off)+len(data) <= f.w.inlineSize {
+			s.writer.AllowInline() // the whole file is small
+		}
 		c.slices = append(c.slices, s)
 		if len(c.slices) == 1 {
 			f.w.Lock()
@@ -414,6 +430,7 @@ type dataWriter struct {
 	store      chunk.ChunkStore
 	reader     DataReader
 	blockSize  int
+	inlineSize int
 	bufferSize int64
 	files      map[Ino]*fileWriter
 	maxRetries uint32
@@ -425,6 +442,7 @@ func NewDataWriter(conf *Config, m meta.Meta, store chunk.ChunkStore, reader Dat
 		store:      store,
 		reader:     reader,
 		blockSize:  conf.Chunk.BlockSize,
+		inlineSize: conf.Chunk.InlineSize,
 		bufferSize: int64(conf.Chunk.BufferSize),
 		files:      make(map[Ino]*fileWriter),
 		maxRetries: uint32(conf.Meta.Retries),
@@ -231,6 +231,7 @@ type javaConf struct {
 	Bucket          string  `json:"bucket"`
 	ReadOnly        bool    `json:"readOnly"`
 	NoBGJob         bool    `json:"noBGJob"`
+	NoVerify        bool    `json:"noVerify"`
 	OpenCache       float64 `json:"openCache"`
 	BackupMeta      int64   `json:"backupMeta"`
 	Heartbeat       int     `json:"heartbeat"`
@@ -443,26 +444,96 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			freeSpaceRatio, _ = strconv.ParseFloat(jConf.FreeSpace, 64)
 		}
 		chunkConf := chunk.Config{
-			BlockSize:      format.BlockSize * 1024,
-			Compress:       format.Compression,
-			CacheDir:       jConf.CacheDir,
-			CacheMode:      0644, // all user can read cache
-			CacheSize:      jConf.CacheSize,
-			FreeSpace:      float32(freeSpaceRatio),
-			AutoCreate:     jConf.AutoCreate,
-			CacheFullBlock: jConf.CacheFullBlock,
-			MaxUpload:      jConf.MaxUploads,
-			MaxDeletes:     jConf.MaxDeletes,
-			MaxRetries:     jConf.IORetries,
-			UploadLimit:    int64(jConf.UploadLimit) * 1e6 / 8,
-			DownloadLimit:  int64(jConf.DownloadLimit) * 1e6 / 8,
-			Prefetch:       jConf.Prefetch,
-			Writeback:      jConf.Writeback,
-			HashPrefix:     format.HashPrefix,
-			GetTimeout:     time.Second * time.Duration(jConf.GetTimeout),
-			PutTimeout:     time.Second * time.Duration(jConf.PutTimeout),
-			BufferSize:     jConf.MemorySize << 20,
-			Readahead:      jConf.Readahead << 20,
+			BlockSize:         format.BlockSize * 1024,
+			Compress:          format.Compression,
+			CompressThreshold: format.CompressThreshold,
+			BlockHeader:       format.BlockHeader,
+			CacheDir:          jConf.CacheDir,
+			CacheMode:         0644, // all user can read cache
+			CacheSize:         jConf.CacheSize,
+			FreeSpace:         float32(freeSpaceRatio),
+			AutoCreate:        jConf.AutoCreate,
+			CacheFullBlock:    jConf.CacheFullBlock,
+			MaxUpload:         jConf.MaxUploads,
+			MaxDeletes:        jConf.MaxDeletes,
+			MaxRetries:        jConf.IORetries,
+			UploadLimit:       int64(jConf.UploadLimit) * 1e6 / 8,
+			DownloadLimit:     int64(jConf.DownloadLimit) * 1e6 / 8,
+			Prefetch:          jConf.Prefetch,
+			Writeback:         jConf.Writeback,
+			HashPrefix:        format.HashPrefix,
+			GetTimeout:        time.Second * time.Duration(jConf.GetTimeout),
+			PutTimeout:        time.Second * time.Duration(jConf.PutTimeout),
+			BufferSize:        jConf.MemorySize << 20,
+			Readahead:         jConf.Readahead << 20,
+			PackSize:          format.PackSize * 1024,
+			InlineSize:        format.InlineSize * 1024,
+		}
+		if !jConf.NoVerify {
+			chunkConf.Checksums = func(chunkid uint64) ([]uint32, error) {
+				sums, st := m.GetChecksums(meta.Background, chunkid)
+				if st != 0 {
+					return nil, st
+				}
+				return sums, nil
+			}
+		}
+		if format.HasPacks() {
+			chunkConf.Packs = func(chunkid uint64) (*chunk.Pack, error) {
+				p, st := m.GetPack(meta.Background, chunkid)
+				if st != 0 {
+					return nil, st
+				}
+				return (*chunk.Pack)(p), nil
+			}
+		}
+		if format.HasInlines() {
+			chunkConf.Inlines = func(chunkid uint64) ([]byte, error) {
+				data, st := m.GetInline(meta.Background, chunkid)
+				if st != 0 {
+					return nil, st
+				}
+				return data, nil
+			}
+		}
+		if format.Dedup {
+			chunkConf.Dedup = func(chunkid uint64, indx int, hash string, size int) (int64, error) {
+				refs, st := m.AcquireBlock(meta.Background, chunkid, uint32(indx), hash, uint32(size))
+				if st != 0 {
+					return 0, st
+				}
+				return refs, nil
+			}
+			chunkConf.Hashes = func(chunkid uint64) ([]string, error) {
+				hashes, st := m.GetHashes(meta.Background, chunkid)
+				if st != 0 {
+					return nil, st
+				}
+				return hashes, nil
+			}
+			chunkConf.Release = func(chunkid uint64) error {
+				if st := m.ReleaseBlocks(meta.Background, chunkid); st != 0 {
+					return st
+				}
+				return nil
+			}
+			if chunkConf.HashKey, err = cmd.DedupHashKey(format); err != nil {
+				logger.Errorf("key to hash blocks: %s", err)
+				return nil
+			}
+		}
+		if chunkConf.TierStorage, err = cmd.NewTierStorage(*format); err != nil {
+			logger.Errorf("tier storage: %s", err)
+			return nil
+		} else if chunkConf.TierStorage != nil {
+			logger.Infof("Cold data use %s", chunkConf.TierStorage)
+			chunkConf.Tiers = func(chunkid uint64) (uint8, error) {
+				tier, st := m.GetTier(meta.Background, chunkid)
+				if st != 0 {
+					return 0, st
+				}
+				return tier, nil
+			}
 		}
 		if chunkConf.CacheDir != "memory" {
 			ds := utils.SplitDir(chunkConf.CacheDir)
@@ -477,10 +548,13 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			length := args[1].(uint32)
 			return store.Remove(chunkid, int(length))
 		})
+		m.OnMsg(meta.DeleteBlock, func(args ...interface{}) error {
+			return store.RemoveBlock(args[0].(string))
+		})
 		m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
 			slices := args[0].([]meta.Slice)
 			chunkid := args[1].(uint64)
-			return vfs.Compact(chunkConf, store, slices, chunkid)
+			return vfs.Compact(chunkConf, store, slices, chunkid, args[2].(*[]uint32))
 		})
 		err = m.NewSession()
 		if err != nil {